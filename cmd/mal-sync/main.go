@@ -1,14 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/antnsn/mal-sync/internal/alertmanager"
+	"github.com/antnsn/mal-sync/internal/analyze"
+	"github.com/antnsn/mal-sync/internal/apply"
+	"github.com/antnsn/mal-sync/internal/catalog"
+	"github.com/antnsn/mal-sync/internal/common"
+	"github.com/antnsn/mal-sync/internal/controller"
+	"github.com/antnsn/mal-sync/internal/convert"
+	"github.com/antnsn/mal-sync/internal/format"
+	"github.com/antnsn/mal-sync/internal/kube"
+	"github.com/antnsn/mal-sync/internal/limits"
 	"github.com/antnsn/mal-sync/internal/lokirules"
 	"github.com/antnsn/mal-sync/internal/mimirrules"
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/ruletest"
+	"github.com/antnsn/mal-sync/internal/silences"
+	"github.com/antnsn/mal-sync/internal/source"
+	"github.com/antnsn/mal-sync/internal/state"
 )
 
 func main() {
@@ -17,45 +38,219 @@ func main() {
 	alertmanagerCmd := flag.NewFlagSet("alertmanager", flag.ExitOnError)
 	// Note: flag.String returns a pointer. We'll dereference after parsing.
 	_ = alertmanagerCmd.String("config.file", "", "Path to the Alertmanager configuration file (e.g., /config/alertmanager.yaml). Env: MALSYNC_ALERTMANAGER_CONFIG_FILE")
-	_ = alertmanagerCmd.String("templates.dir", "", "Path to the directory containing Alertmanager template files (e.g., /etc/alertmanager/templates). Env: MALSYNC_ALERTMANAGER_TEMPLATES_DIR")
+	_ = alertmanagerCmd.String("config.fragments", "", "Comma-separated list of Alertmanager config fragment files or directories merged into the base config (receivers, routes, inhibit_rules, time_intervals). Env: MALSYNC_ALERTMANAGER_CONFIG_FRAGMENTS")
+	_ = alertmanagerCmd.String("config.merged-output", "", "Optional path to write the merged Alertmanager config to for inspection. Env: MALSYNC_ALERTMANAGER_CONFIG_MERGED_OUTPUT")
+	_ = alertmanagerCmd.String("templates.dir", "", "Comma-separated list of directories containing Alertmanager template files, walked recursively (e.g., /etc/alertmanager/templates). Env: MALSYNC_ALERTMANAGER_TEMPLATES_DIR")
+	_ = alertmanagerCmd.String("templates.pattern", "*.tmpl", "Comma-separated list of file name globs selecting template files. Env: MALSYNC_ALERTMANAGER_TEMPLATES_PATTERN")
+	_ = alertmanagerCmd.String("tenants.dir", "", "Optional directory of per-tenant overlay files (or values files when config.file is a .tmpl template); each <tenant>.yaml generates and loads that tenant's config, overriding mimir.id. Env: MALSYNC_ALERTMANAGER_TENANTS_DIR")
 	_ = alertmanagerCmd.String("mimir.address", "", "Address of the Mimir instance (e.g., http://mimir-nginx.mimir.svc.cluster.local:80). Env: MALSYNC_ALERTMANAGER_MIMIR_ADDRESS")
 	_ = alertmanagerCmd.String("mimir.id", "anonymous", "Mimir tenant ID. Env: MALSYNC_ALERTMANAGER_MIMIR_ID")
 	_ = alertmanagerCmd.String("temp.dir", "/tmp", "Temporary directory for staging files. Env: MALSYNC_ALERTMANAGER_TEMP_DIR")
+	_ = alertmanagerCmd.Int("limits.max-config-size", 0, "Maximum Alertmanager config size in bytes (alertmanager_max_config_size_bytes); 0 is unlimited. Env: MALSYNC_ALERTMANAGER_LIMITS_MAX_CONFIG_SIZE")
+	_ = alertmanagerCmd.Int("limits.max-templates", 0, "Maximum number of templates (alertmanager_max_templates_count); 0 is unlimited. Env: MALSYNC_ALERTMANAGER_LIMITS_MAX_TEMPLATES")
+	_ = alertmanagerCmd.Int("limits.max-template-size", 0, "Maximum size of a template in bytes (alertmanager_max_template_size_bytes); 0 is unlimited. Env: MALSYNC_ALERTMANAGER_LIMITS_MAX_TEMPLATE_SIZE")
+	_ = alertmanagerCmd.String("limits.runtime-config", "", "Optional Mimir runtime config file whose per-tenant overrides replace the limits above. Env: MALSYNC_ALERTMANAGER_LIMITS_RUNTIME_CONFIG")
+	_ = alertmanagerCmd.String("source.git.url", "", "Optional git repository (https, ssh, file:// or a local path) to sync from; paths are then relative to the checkout. Env: MALSYNC_ALERTMANAGER_SOURCE_GIT_URL")
+	_ = alertmanagerCmd.String("source.git.ref", "", "Branch, tag or commit of source.git.url to sync; the remote's default branch when empty. Env: MALSYNC_ALERTMANAGER_SOURCE_GIT_REF")
+	_ = alertmanagerCmd.String("source.git.subpath", "", "Directory of the repository that paths are relative to. Env: MALSYNC_ALERTMANAGER_SOURCE_GIT_SUBPATH")
+	_ = alertmanagerCmd.String("source.git.dir", "", "Directory the repository is checked out into and kept between syncs; defaults to a directory in temp.dir. Env: MALSYNC_ALERTMANAGER_SOURCE_GIT_DIR")
+	_ = alertmanagerCmd.String("daemon.interval", "0", "Keep running and sync every interval (e.g., 1m), syncing only new commits of source.git.url; 0 syncs once. Env: MALSYNC_ALERTMANAGER_DAEMON_INTERVAL")
+	_ = alertmanagerCmd.String("state.file", "", "Optional state file, a local path or s3:// URL, recording the content hash of each tenant config loaded; tenants unchanged since the last successful sync are not loaded again. Env: MALSYNC_ALERTMANAGER_STATE_FILE")
+	_ = alertmanagerCmd.String("state.verify-interval", "1h", "Load every tenant config again after this long, changed or not, to undo edits made outside mal-sync; 0 never does. Env: MALSYNC_ALERTMANAGER_STATE_VERIFY_INTERVAL")
+	_ = alertmanagerCmd.String("source.cache-dir", "", "Directory downloads of https:// and s3:// config.file and templates.dir are cached in between syncs; defaults to a directory in temp.dir. Env: MALSYNC_ALERTMANAGER_SOURCE_CACHE_DIR")
+	_ = alertmanagerCmd.String("source.max-size", "100MiB", "Maximum size of a download and of an extracted .tar.gz or .zip bundle. Env: MALSYNC_ALERTMANAGER_SOURCE_MAX_SIZE")
+	_ = alertmanagerCmd.String("source.s3.endpoint", "", "Endpoint of an S3-compatible store (e.g., http://minio:9000) for s3:// paths, addressed path-style; AWS when empty. Env: MALSYNC_ALERTMANAGER_SOURCE_S3_ENDPOINT")
+	_ = alertmanagerCmd.String("source.s3.region", "", "Region of s3:// paths; AWS_REGION, AWS_DEFAULT_REGION or us-east-1 when empty. Env: MALSYNC_ALERTMANAGER_SOURCE_S3_REGION")
+	_ = alertmanagerCmd.String("source.s3.credentials-file", "", "Shared credentials file for s3:// paths when AWS_ACCESS_KEY_ID is not set; AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials when empty. Env: MALSYNC_ALERTMANAGER_SOURCE_S3_CREDENTIALS_FILE")
+
+	// For Alertmanager test notifications
+	amTestReceiverCmd := flag.NewFlagSet("alertmanager test-receiver", flag.ExitOnError)
+	_ = amTestReceiverCmd.String("config.file", "", "Path to the Alertmanager configuration file. Env: MALSYNC_ALERTMANAGER_CONFIG_FILE")
+	_ = amTestReceiverCmd.String("config.fragments", "", "Comma-separated list of Alertmanager config fragment files or directories merged into the base config. Env: MALSYNC_ALERTMANAGER_CONFIG_FRAGMENTS")
+	_ = amTestReceiverCmd.String("templates.dir", "", "Comma-separated list of directories containing Alertmanager template files, walked recursively. Env: MALSYNC_ALERTMANAGER_TEMPLATES_DIR")
+	_ = amTestReceiverCmd.String("templates.pattern", "*.tmpl", "Comma-separated list of file name globs selecting template files. Env: MALSYNC_ALERTMANAGER_TEMPLATES_PATTERN")
+	_ = amTestReceiverCmd.String("tenants.dir", "", "Optional directory of per-tenant overlay or values files. Env: MALSYNC_ALERTMANAGER_TENANTS_DIR")
+	_ = amTestReceiverCmd.String("tenant", "", "Tenant whose generated config is tested; required with tenants.dir. Env: MALSYNC_ALERTMANAGER_TENANT")
+	_ = amTestReceiverCmd.String("temp.dir", "/tmp", "Temporary directory for staging files. Env: MALSYNC_ALERTMANAGER_TEMP_DIR")
 
 	// For Mimir Rules
 	mimirRulesCmd := flag.NewFlagSet("mimir-rules", flag.ExitOnError)
-	_ = mimirRulesCmd.String("rules.path", "", "Path to a directory containing Mimir rule files (*.yaml, *.yml) or a single rule file. Env: MALSYNC_MIMIRRULES_RULES_PATH")
+	_ = mimirRulesCmd.String("rules.path", "", "Path to a directory containing Mimir rule files (*.yaml, *.yml, *.json) or a single rule file. Env: MALSYNC_MIMIRRULES_RULES_PATH")
 	_ = mimirRulesCmd.String("mimir.address", "", "Address of the Mimir instance. Env: MALSYNC_MIMIRRULES_MIMIR_ADDRESS")
 	_ = mimirRulesCmd.String("mimir.id", "anonymous", "Mimir tenant ID. Env: MALSYNC_MIMIRRULES_MIMIR_ID")
 	_ = mimirRulesCmd.String("temp.dir", "/tmp", "Temporary directory for staging files. Env: MALSYNC_MIMIRRULES_TEMP_DIR")
 	_ = mimirRulesCmd.String("rules.namespace", "", "Mimir namespace to load the rules into. Env: MALSYNC_MIMIRRULES_RULES_NAMESPACE")
+	_ = mimirRulesCmd.String("rules.policy", "", "Optional rule policy file with organisation conventions; policy errors block the sync. Env: MALSYNC_MIMIRRULES_RULES_POLICY")
+	_ = mimirRulesCmd.Int("limits.max-rule-groups", 0, "Maximum rule groups per tenant (ruler_max_rule_groups_per_tenant); 0 is unlimited. Env: MALSYNC_MIMIRRULES_LIMITS_MAX_RULE_GROUPS")
+	_ = mimirRulesCmd.Int("limits.max-rules-per-group", 0, "Maximum rules per rule group (ruler_max_rules_per_rule_group); 0 is unlimited. Env: MALSYNC_MIMIRRULES_LIMITS_MAX_RULES_PER_GROUP")
+	_ = mimirRulesCmd.String("limits.runtime-config", "", "Optional Mimir runtime config file whose per-tenant overrides replace the limits above. Env: MALSYNC_MIMIRRULES_LIMITS_RUNTIME_CONFIG")
+	_ = mimirRulesCmd.Bool("rules.split-groups", false, "Split groups with more rules than the rules-per-group limit into name-1, name-2, ... before syncing. Env: MALSYNC_MIMIRRULES_RULES_SPLIT_GROUPS")
+	_ = mimirRulesCmd.String("rules.tests", "", "Optional rule unit test file or directory (promtool format); failing tests block the sync. Env: MALSYNC_MIMIRRULES_RULES_TESTS")
+	_ = mimirRulesCmd.String("rules.crd-namespace-format", "", "Namespace the groups of PrometheusRule manifests are loaded into, built from {namespace} and {name} of the object (default {namespace}-{name}). Env: MALSYNC_MIMIRRULES_RULES_CRD_NAMESPACE_FORMAT")
+	_ = mimirRulesCmd.String("rules.include", "", "Comma-separated list of gitignore-style patterns; only files of rules.path matching one are read (e.g., *.rules.yaml). Env: MALSYNC_MIMIRRULES_RULES_INCLUDE")
+	_ = mimirRulesCmd.String("rules.exclude", "", "Comma-separated list of gitignore-style patterns of files in rules.path that are not rule files (e.g., values*.yaml,kustomization.yaml). Env: MALSYNC_MIMIRRULES_RULES_EXCLUDE")
+	_ = mimirRulesCmd.String("rules.mixins", "", "Comma-separated list of Jsonnet entrypoints of monitoring mixins (e.g., vendor/kubernetes-mixin/mixin.libsonnet) whose prometheusAlerts and prometheusRules are synced with rules.path, each in the namespace named after its directory. Requires jsonnet. Env: MALSYNC_MIMIRRULES_RULES_MIXINS")
+	_ = mimirRulesCmd.String("rules.jsonnet-path", "", "Comma-separated list of Jsonnet library directories for rules.mixins; the jsonnet-bundler vendor directory above each mixin when empty. Env: MALSYNC_MIMIRRULES_RULES_JSONNET_PATH")
+	_ = mimirRulesCmd.String("source.git.url", "", "Optional git repository (https, ssh, file:// or a local path) to sync from; paths are then relative to the checkout. Env: MALSYNC_MIMIRRULES_SOURCE_GIT_URL")
+	_ = mimirRulesCmd.String("source.git.ref", "", "Branch, tag or commit of source.git.url to sync; the remote's default branch when empty. Env: MALSYNC_MIMIRRULES_SOURCE_GIT_REF")
+	_ = mimirRulesCmd.String("source.git.subpath", "", "Directory of the repository that paths are relative to. Env: MALSYNC_MIMIRRULES_SOURCE_GIT_SUBPATH")
+	_ = mimirRulesCmd.String("source.git.dir", "", "Directory the repository is checked out into and kept between syncs; defaults to a directory in temp.dir. Env: MALSYNC_MIMIRRULES_SOURCE_GIT_DIR")
+	_ = mimirRulesCmd.String("daemon.interval", "0", "Keep running and sync every interval (e.g., 1m), syncing only new commits of source.git.url; 0 syncs once. Env: MALSYNC_MIMIRRULES_DAEMON_INTERVAL")
+	_ = mimirRulesCmd.String("since", "", "Git commit, branch or tag to compare rules.path with; only namespaces whose rule files changed or were deleted since are linted and synced. auto uses the commit last applied from source.git.url. Env: MALSYNC_MIMIRRULES_SINCE")
+	_ = mimirRulesCmd.String("state.file", "", "Optional state file, a local path or s3:// URL, recording the content hash of each rule namespace synced; namespaces unchanged since the last successful sync are skipped. Env: MALSYNC_MIMIRRULES_STATE_FILE")
+	_ = mimirRulesCmd.String("state.verify-interval", "1h", "Sync every namespace again after this long, changed or not, to undo edits made outside mal-sync; 0 never does. Env: MALSYNC_MIMIRRULES_STATE_VERIFY_INTERVAL")
+	_ = mimirRulesCmd.String("source.cache-dir", "", "Directory downloads of https:// and s3:// rules.path are cached in between syncs; defaults to a directory in temp.dir. Env: MALSYNC_MIMIRRULES_SOURCE_CACHE_DIR")
+	_ = mimirRulesCmd.String("source.max-size", "100MiB", "Maximum size of a download and of an extracted .tar.gz or .zip bundle. Env: MALSYNC_MIMIRRULES_SOURCE_MAX_SIZE")
+	_ = mimirRulesCmd.String("source.s3.endpoint", "", "Endpoint of an S3-compatible store (e.g., http://minio:9000) for s3:// paths, addressed path-style; AWS when empty. Env: MALSYNC_MIMIRRULES_SOURCE_S3_ENDPOINT")
+	_ = mimirRulesCmd.String("source.s3.region", "", "Region of s3:// paths; AWS_REGION, AWS_DEFAULT_REGION or us-east-1 when empty. Env: MALSYNC_MIMIRRULES_SOURCE_S3_REGION")
+	_ = mimirRulesCmd.String("source.s3.credentials-file", "", "Shared credentials file for s3:// paths when AWS_ACCESS_KEY_ID is not set; AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials when empty. Env: MALSYNC_MIMIRRULES_SOURCE_S3_CREDENTIALS_FILE")
+
+	// For Mimir rule unit tests
+	mimirRulesTestCmd := flag.NewFlagSet("mimir-rules test", flag.ExitOnError)
+	_ = mimirRulesTestCmd.String("rules.path", "", "Path to the Mimir rule files tested by test files that list no rule_files. Env: MALSYNC_MIMIRRULES_RULES_PATH")
+	_ = mimirRulesTestCmd.String("rules.tests", "", "Rule unit test file or directory (promtool format); more may be given as arguments. Env: MALSYNC_MIMIRRULES_RULES_TESTS")
 
 	// For Loki Rules
 	lokiRulesCmd := flag.NewFlagSet("loki-rules", flag.ExitOnError)
-	_ = lokiRulesCmd.String("rules.path", "", "Path to a directory containing Loki rule files (*.yaml, *.yml) or a single rule file. Env: MALSYNC_LOKIRULES_RULES_PATH")
+	_ = lokiRulesCmd.String("rules.path", "", "Path to a directory containing Loki rule files (*.yaml, *.yml, *.json) or a single rule file. Env: MALSYNC_LOKIRULES_RULES_PATH")
 	_ = lokiRulesCmd.String("loki.address", "", "Address of the Loki instance (e.g., http://loki.loki.svc.cluster.local:3100). Env: MALSYNC_LOKIRULES_LOKI_ADDRESS")
 	_ = lokiRulesCmd.String("loki.org-id", "fake", "Loki Organization ID. Env: MALSYNC_LOKIRULES_LOKI_ORG_ID") // Loki often uses 'fake' as a default/common org-id for single-tenant setups
 	_ = lokiRulesCmd.String("temp.dir", "/tmp", "Temporary directory for staging files. Env: MALSYNC_LOKIRULES_TEMP_DIR")
+	_ = lokiRulesCmd.String("rules.policy", "", "Optional rule policy file with organisation conventions; policy errors block the sync. Env: MALSYNC_LOKIRULES_RULES_POLICY")
+	_ = lokiRulesCmd.Int("limits.max-rule-groups", 0, "Maximum rule groups per tenant (ruler_max_rule_groups_per_tenant); 0 is unlimited. Env: MALSYNC_LOKIRULES_LIMITS_MAX_RULE_GROUPS")
+	_ = lokiRulesCmd.Int("limits.max-rules-per-group", 0, "Maximum rules per rule group (ruler_max_rules_per_rule_group); 0 is unlimited. Env: MALSYNC_LOKIRULES_LIMITS_MAX_RULES_PER_GROUP")
+	_ = lokiRulesCmd.String("limits.runtime-config", "", "Optional Loki runtime config file whose per-tenant overrides replace the limits above. Env: MALSYNC_LOKIRULES_LIMITS_RUNTIME_CONFIG")
+	_ = lokiRulesCmd.Bool("rules.split-groups", false, "Split groups with more rules than the rules-per-group limit into name-1, name-2, ... before syncing. Env: MALSYNC_LOKIRULES_RULES_SPLIT_GROUPS")
+	_ = lokiRulesCmd.String("rules.crd-namespace-format", "", "Namespace the groups of PrometheusRule manifests are loaded into, built from {namespace} and {name} of the object (default {namespace}-{name}). Env: MALSYNC_LOKIRULES_RULES_CRD_NAMESPACE_FORMAT")
+	_ = lokiRulesCmd.String("rules.include", "", "Comma-separated list of gitignore-style patterns; only files of rules.path matching one are read (e.g., *.rules.yaml). Env: MALSYNC_LOKIRULES_RULES_INCLUDE")
+	_ = lokiRulesCmd.String("rules.exclude", "", "Comma-separated list of gitignore-style patterns of files in rules.path that are not rule files (e.g., values*.yaml,kustomization.yaml). Env: MALSYNC_LOKIRULES_RULES_EXCLUDE")
+	_ = lokiRulesCmd.String("source.git.url", "", "Optional git repository (https, ssh, file:// or a local path) to sync from; paths are then relative to the checkout. Env: MALSYNC_LOKIRULES_SOURCE_GIT_URL")
+	_ = lokiRulesCmd.String("source.git.ref", "", "Branch, tag or commit of source.git.url to sync; the remote's default branch when empty. Env: MALSYNC_LOKIRULES_SOURCE_GIT_REF")
+	_ = lokiRulesCmd.String("source.git.subpath", "", "Directory of the repository that paths are relative to. Env: MALSYNC_LOKIRULES_SOURCE_GIT_SUBPATH")
+	_ = lokiRulesCmd.String("source.git.dir", "", "Directory the repository is checked out into and kept between syncs; defaults to a directory in temp.dir. Env: MALSYNC_LOKIRULES_SOURCE_GIT_DIR")
+	_ = lokiRulesCmd.String("daemon.interval", "0", "Keep running and sync every interval (e.g., 1m), syncing only new commits of source.git.url; 0 syncs once. Env: MALSYNC_LOKIRULES_DAEMON_INTERVAL")
+	_ = lokiRulesCmd.String("since", "", "Git commit, branch or tag to compare rules.path with; only namespaces whose rule files changed or were deleted since are linted and synced. auto uses the commit last applied from source.git.url. Env: MALSYNC_LOKIRULES_SINCE")
+	_ = lokiRulesCmd.String("state.file", "", "Optional state file, a local path or s3:// URL, recording the content hash of each rule namespace synced; namespaces unchanged since the last successful sync are skipped. Env: MALSYNC_LOKIRULES_STATE_FILE")
+	_ = lokiRulesCmd.String("state.verify-interval", "1h", "Sync every namespace again after this long, changed or not, to undo edits made outside mal-sync; 0 never does. Env: MALSYNC_LOKIRULES_STATE_VERIFY_INTERVAL")
+	_ = lokiRulesCmd.String("source.cache-dir", "", "Directory downloads of https:// and s3:// rules.path are cached in between syncs; defaults to a directory in temp.dir. Env: MALSYNC_LOKIRULES_SOURCE_CACHE_DIR")
+	_ = lokiRulesCmd.String("source.max-size", "100MiB", "Maximum size of a download and of an extracted .tar.gz or .zip bundle. Env: MALSYNC_LOKIRULES_SOURCE_MAX_SIZE")
+	_ = lokiRulesCmd.String("source.s3.endpoint", "", "Endpoint of an S3-compatible store (e.g., http://minio:9000) for s3:// paths, addressed path-style; AWS when empty. Env: MALSYNC_LOKIRULES_SOURCE_S3_ENDPOINT")
+	_ = lokiRulesCmd.String("source.s3.region", "", "Region of s3:// paths; AWS_REGION, AWS_DEFAULT_REGION or us-east-1 when empty. Env: MALSYNC_LOKIRULES_SOURCE_S3_REGION")
+	_ = lokiRulesCmd.String("source.s3.credentials-file", "", "Shared credentials file for s3:// paths when AWS_ACCESS_KEY_ID is not set; AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials when empty. Env: MALSYNC_LOKIRULES_SOURCE_S3_CREDENTIALS_FILE")
 	// Add Loki specific flags here ...
 
+	// For Silences
+	silencesSyncCmd := flag.NewFlagSet("silences sync", flag.ExitOnError)
+	_ = silencesSyncCmd.String("path", "", "Path to a directory containing silence files (*.yaml, *.yml) or a single silence file. Env: MALSYNC_SILENCES_PATH")
+	_ = silencesSyncCmd.String("mimir.address", "", "Address of the Mimir instance. Env: MALSYNC_SILENCES_MIMIR_ADDRESS")
+	_ = silencesSyncCmd.String("mimir.id", "anonymous", "Mimir tenant ID. Env: MALSYNC_SILENCES_MIMIR_ID")
+	_ = silencesSyncCmd.String("state.file", "", "Optional state file, a local path or s3:// URL, recording when silences declared with only a duration first started, so they are not created again after Alertmanager forgets them. Env: MALSYNC_SILENCES_STATE_FILE")
+	_ = silencesSyncCmd.String("source.s3.endpoint", "", "Endpoint of an S3-compatible store (e.g., http://minio:9000) for an s3:// state.file, addressed path-style; AWS when empty. Env: MALSYNC_SILENCES_SOURCE_S3_ENDPOINT")
+	_ = silencesSyncCmd.String("source.s3.region", "", "Region of an s3:// state.file; AWS_REGION, AWS_DEFAULT_REGION or us-east-1 when empty. Env: MALSYNC_SILENCES_SOURCE_S3_REGION")
+	_ = silencesSyncCmd.String("source.s3.credentials-file", "", "Shared credentials file for an s3:// state.file when AWS_ACCESS_KEY_ID is not set; AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials when empty. Env: MALSYNC_SILENCES_SOURCE_S3_CREDENTIALS_FILE")
+
+	// For rule analysis
+	analyzeDepsCmd := flag.NewFlagSet("analyze deps", flag.ExitOnError)
+	_ = analyzeDepsCmd.String("rules.path", "", "Path to a directory containing Mimir rule files (*.yaml, *.yml, *.json) or a single rule file. Env: MALSYNC_ANALYZE_RULES_PATH")
+	_ = analyzeDepsCmd.String("output.format", "text", "Output format: text, dot or json. Env: MALSYNC_ANALYZE_OUTPUT_FORMAT")
+	_ = analyzeDepsCmd.String("output.file", "", "File to write the graph to; stdout when empty. Env: MALSYNC_ANALYZE_OUTPUT_FILE")
+	_ = analyzeDepsCmd.Bool("strict", false, "Exit non-zero when dependency issues are found. Env: MALSYNC_ANALYZE_STRICT")
+
+	// For the alert catalog
+	catalogCmd := flag.NewFlagSet("catalog", flag.ExitOnError)
+	_ = catalogCmd.String("mimir.rules-path", "", "Comma-separated list of Mimir rule directories or files. Env: MALSYNC_CATALOG_MIMIR_RULES_PATH")
+	_ = catalogCmd.String("loki.rules-path", "", "Comma-separated list of Loki rule directories or files. Env: MALSYNC_CATALOG_LOKI_RULES_PATH")
+	_ = catalogCmd.String("output.format", "markdown", "Output format: markdown, csv or json. Env: MALSYNC_CATALOG_OUTPUT_FORMAT")
+	_ = catalogCmd.String("output.file", "", "File to write the catalog to; stdout when empty. Env: MALSYNC_CATALOG_OUTPUT_FILE")
+
+	// For formatting
+	fmtCmd := flag.NewFlagSet("fmt", flag.ExitOnError)
+	_ = fmtCmd.Bool("w", false, "Write the formatted files back instead of printing them")
+	_ = fmtCmd.Bool("check", false, "Only list files that are not formatted and exit non-zero if there are any")
+
+	// For the Kubernetes controller
+	controllerCmd := flag.NewFlagSet("controller", flag.ExitOnError)
+	_ = controllerCmd.String("mimir.address", "", "Address of the Mimir instance rules and Alertmanager configs are synced to. Env: MALSYNC_CONTROLLER_MIMIR_ADDRESS")
+	_ = controllerCmd.String("loki.address", "", "Optional address of the Loki instance loki-rules objects are synced to. Env: MALSYNC_CONTROLLER_LOKI_ADDRESS")
+	_ = controllerCmd.String("tenant.label", "mal-sync/tenant", "Namespace label holding the tenant of the objects in the namespace. Env: MALSYNC_CONTROLLER_TENANT_LABEL")
+	_ = controllerCmd.String("rules.crd-namespace-format", "", "Rule namespace of PrometheusRules and of ConfigMap rule files without one, built from {namespace} and {name} of the object (default {namespace}-{name}). Env: MALSYNC_CONTROLLER_RULES_CRD_NAMESPACE_FORMAT")
+	_ = controllerCmd.String("resync.interval", "5m", "Sync unchanged tenants again after this long to undo changes made outside the cluster; 0 only syncs changes. Env: MALSYNC_CONTROLLER_RESYNC_INTERVAL")
+	_ = controllerCmd.String("temp.dir", "/tmp", "Temporary directory for staging files. Env: MALSYNC_CONTROLLER_TEMP_DIR")
+	_ = controllerCmd.String("kube.api-server", "", "Kubernetes API server URL; the in-cluster API server when empty. Env: MALSYNC_CONTROLLER_KUBE_API_SERVER")
+	_ = controllerCmd.String("kube.token-file", "", "File holding the bearer token for the API server; the service account token in-cluster. Env: MALSYNC_CONTROLLER_KUBE_TOKEN_FILE")
+	_ = controllerCmd.String("kube.ca-file", "", "CA bundle of the API server; the service account CA in-cluster. Env: MALSYNC_CONTROLLER_KUBE_CA_FILE")
+	_ = controllerCmd.Bool("kube.insecure-skip-tls-verify", false, "Do not verify the API server certificate. Env: MALSYNC_CONTROLLER_KUBE_INSECURE_SKIP_TLS_VERIFY")
+
+	// For syncing every subtree of a monorepo
+	applyCmd := flag.NewFlagSet("apply", flag.ExitOnError)
+	_ = applyCmd.String("root", ".", "Directory searched for .mal-sync.yaml files, each declaring how its subtree is synced. Env: MALSYNC_APPLY_ROOT")
+	_ = applyCmd.String("mimir.address", "", "Address of the Mimir instance mimir-rules and alertmanager subtrees are synced to. Env: MALSYNC_APPLY_MIMIR_ADDRESS")
+	_ = applyCmd.String("loki.address", "", "Address of the Loki instance loki-rules subtrees are synced to. Env: MALSYNC_APPLY_LOKI_ADDRESS")
+	_ = applyCmd.String("rules.policy", "", "Optional rule policy file of subtrees that do not set their own. Env: MALSYNC_APPLY_RULES_POLICY")
+	_ = applyCmd.String("temp.dir", "/tmp", "Temporary directory for staging files. Env: MALSYNC_APPLY_TEMP_DIR")
+	_ = applyCmd.String("state.file", "", "Optional state file, a local path or s3:// URL, recording the content hash of each namespace and tenant config synced; unchanged ones are skipped. Env: MALSYNC_APPLY_STATE_FILE")
+	_ = applyCmd.String("state.verify-interval", "1h", "Sync everything again after this long, changed or not, to undo edits made outside mal-sync; 0 never does. Env: MALSYNC_APPLY_STATE_VERIFY_INTERVAL")
+	_ = applyCmd.String("source.s3.endpoint", "", "Endpoint of an S3-compatible store (e.g., http://minio:9000) for an s3:// state.file, addressed path-style; AWS when empty. Env: MALSYNC_APPLY_SOURCE_S3_ENDPOINT")
+	_ = applyCmd.String("source.s3.region", "", "Region of an s3:// state.file; AWS_REGION, AWS_DEFAULT_REGION or us-east-1 when empty. Env: MALSYNC_APPLY_SOURCE_S3_REGION")
+	_ = applyCmd.String("source.s3.credentials-file", "", "Shared credentials file for an s3:// state.file when AWS_ACCESS_KEY_ID is not set; AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials when empty. Env: MALSYNC_APPLY_SOURCE_S3_CREDENTIALS_FILE")
+
+	// For conversion between rule files and PrometheusRule manifests
+	convertCmd := flag.NewFlagSet("convert", flag.ExitOnError)
+	_ = convertCmd.String("to", "", "Target format: crd (PrometheusRule manifests) or rules (plain rule files)")
+	_ = convertCmd.String("o", "", "Output file, or directory for one rule file per PrometheusRule; stdout when empty")
+	_ = convertCmd.String("name", "", "metadata.name of the PrometheusRule when converting a single rule file; derived from the file name by default")
+	_ = convertCmd.String("namespace", "", "metadata.namespace of generated PrometheusRules")
+	_ = convertCmd.String("namespace-format", "", "Rule namespace of converted PrometheusRules, built from {namespace} and {name} of the object (default {namespace}-{name})")
+
 	if len(os.Args) < 2 {
 		log.Println("Expected 'alertmanager' or 'loki' subcommands")
 		fmt.Println("Usage: mal-sync <subcommand> [options]")
 		fmt.Println("\nSubcommands:")
 		fmt.Println("  alertmanager  Sync Alertmanager configurations")
+		fmt.Println("  alertmanager test-receiver <name>  Send a test notification through a receiver")
 		fmt.Println("  mimir-rules   Sync Mimir rule files")
+		fmt.Println("  mimir-rules test [test files]  Run promtool-style rule unit tests")
 		fmt.Println("  loki-rules    Sync Loki rule files") // For future
+		fmt.Println("  silences sync Reconcile declared silences with Mimir's Alertmanager")
+		fmt.Println("  analyze deps  Report recording rule dependencies and undefined or unused series")
+		fmt.Println("  catalog       Export a catalog of every alert as Markdown, CSV or JSON")
+		fmt.Println("  fmt [-w] [-check] <paths>  Format rule files and Alertmanager configs canonically")
+		fmt.Println("  convert -to crd|rules <paths>  Convert between rule files and PrometheusRule manifests")
+		fmt.Println("  controller    Reconcile labelled ConfigMaps and PrometheusRules of a Kubernetes cluster")
+		fmt.Println("  apply         Sync every subtree declared by a .mal-sync.yaml file")
 		fmt.Println("\nAlertmanager options:")
 		alertmanagerCmd.PrintDefaults()
+		fmt.Println("\nAlertmanager test-receiver options:")
+		amTestReceiverCmd.PrintDefaults()
 		fmt.Println("\nMimir Rules options:")
 		mimirRulesCmd.PrintDefaults()
+		fmt.Println("\nMimir Rules test options:")
+		mimirRulesTestCmd.PrintDefaults()
 		fmt.Println("\nLoki Rules options:")
 		lokiRulesCmd.PrintDefaults()
+		fmt.Println("\nSilences sync options:")
+		silencesSyncCmd.PrintDefaults()
+		fmt.Println("\nAnalyze deps options:")
+		analyzeDepsCmd.PrintDefaults()
+		fmt.Println("\nCatalog options:")
+		catalogCmd.PrintDefaults()
+		fmt.Println("\nFmt options:")
+		fmtCmd.PrintDefaults()
+		fmt.Println("\nConvert options:")
+		convertCmd.PrintDefaults()
+		fmt.Println("\nController options:")
+		controllerCmd.PrintDefaults()
+		fmt.Println("\nApply options:")
+		applyCmd.PrintDefaults()
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "alertmanager":
+		if len(os.Args) > 2 && os.Args[2] == "test-receiver" {
+			runTestReceiver(amTestReceiverCmd, os.Args[3:])
+			return
+		}
 		alertmanagerCmd.Parse(os.Args[2:])
 		// Helper to determine if a flag was set on the command line
 		alertmanagerFlagsSet := make(map[string]bool)
@@ -76,10 +271,47 @@ func main() {
 		}
 
 		configFileVal := getAMValue("config.file", "MALSYNC_ALERTMANAGER_CONFIG_FILE")
+		fragmentsValAM := getAMValue("config.fragments", "MALSYNC_ALERTMANAGER_CONFIG_FRAGMENTS")
+		mergedOutputValAM := getAMValue("config.merged-output", "MALSYNC_ALERTMANAGER_CONFIG_MERGED_OUTPUT")
 		templatesDirVal := getAMValue("templates.dir", "MALSYNC_ALERTMANAGER_TEMPLATES_DIR")
+		templatesPatternVal := getAMValue("templates.pattern", "MALSYNC_ALERTMANAGER_TEMPLATES_PATTERN")
+		tenantsDirValAM := getAMValue("tenants.dir", "MALSYNC_ALERTMANAGER_TENANTS_DIR")
 		mimirAddressValAM := getAMValue("mimir.address", "MALSYNC_ALERTMANAGER_MIMIR_ADDRESS")
 		mimirIDValAM := getAMValue("mimir.id", "MALSYNC_ALERTMANAGER_MIMIR_ID")
 		tempDirValAM := getAMValue("temp.dir", "MALSYNC_ALERTMANAGER_TEMP_DIR")
+		limitsValAM := limits.Limits{
+			AlertmanagerConfigSize:   parseLimit("limits.max-config-size", getAMValue("limits.max-config-size", "MALSYNC_ALERTMANAGER_LIMITS_MAX_CONFIG_SIZE")),
+			AlertmanagerTemplates:    parseLimit("limits.max-templates", getAMValue("limits.max-templates", "MALSYNC_ALERTMANAGER_LIMITS_MAX_TEMPLATES")),
+			AlertmanagerTemplateSize: parseLimit("limits.max-template-size", getAMValue("limits.max-template-size", "MALSYNC_ALERTMANAGER_LIMITS_MAX_TEMPLATE_SIZE")),
+		}
+		runtimeConfigValAM := getAMValue("limits.runtime-config", "MALSYNC_ALERTMANAGER_LIMITS_RUNTIME_CONFIG")
+		gitSourceAM := source.Git{
+			URL:     getAMValue("source.git.url", "MALSYNC_ALERTMANAGER_SOURCE_GIT_URL"),
+			Ref:     getAMValue("source.git.ref", "MALSYNC_ALERTMANAGER_SOURCE_GIT_REF"),
+			Subpath: getAMValue("source.git.subpath", "MALSYNC_ALERTMANAGER_SOURCE_GIT_SUBPATH"),
+			Dir:     getAMValue("source.git.dir", "MALSYNC_ALERTMANAGER_SOURCE_GIT_DIR"),
+		}
+		if gitSourceAM.Dir == "" {
+			gitSourceAM.Dir = filepath.Join(tempDirValAM, "mal-sync-git-alertmanager")
+		}
+		intervalValAM := parseInterval("daemon.interval", getAMValue("daemon.interval", "MALSYNC_ALERTMANAGER_DAEMON_INTERVAL"))
+		artifactsAM := source.Artifacts{
+			CacheDir: getAMValue("source.cache-dir", "MALSYNC_ALERTMANAGER_SOURCE_CACHE_DIR"),
+			MaxSize:  parseSize("source.max-size", getAMValue("source.max-size", "MALSYNC_ALERTMANAGER_SOURCE_MAX_SIZE")),
+			S3: source.S3{
+				Endpoint:        getAMValue("source.s3.endpoint", "MALSYNC_ALERTMANAGER_SOURCE_S3_ENDPOINT"),
+				Region:          getAMValue("source.s3.region", "MALSYNC_ALERTMANAGER_SOURCE_S3_REGION"),
+				CredentialsFile: getAMValue("source.s3.credentials-file", "MALSYNC_ALERTMANAGER_SOURCE_S3_CREDENTIALS_FILE"),
+			},
+		}
+		if artifactsAM.CacheDir == "" {
+			artifactsAM.CacheDir = filepath.Join(tempDirValAM, "mal-sync-cache")
+		}
+		stateAM := state.Store{
+			Path:           getAMValue("state.file", "MALSYNC_ALERTMANAGER_STATE_FILE"),
+			S3:             artifactsAM.S3,
+			VerifyInterval: parseInterval("state.verify-interval", getAMValue("state.verify-interval", "MALSYNC_ALERTMANAGER_STATE_VERIFY_INTERVAL")),
+		}
 
 		if configFileVal == "" {
 			log.Fatal("Error: -config.file flag or MALSYNC_ALERTMANAGER_CONFIG_FILE env var is required for alertmanager sync")
@@ -88,12 +320,35 @@ func main() {
 			log.Fatal("Error: -mimir.address flag or MALSYNC_ALERTMANAGER_MIMIR_ADDRESS env var is required for alertmanager sync")
 		}
 
-		err := alertmanager.Sync(configFileVal, templatesDirVal, mimirAddressValAM, mimirIDValAM, tempDirValAM)
+		versionAM := func() (string, error) {
+			return artifactsAM.Version(append([]string{configFileVal}, common.SplitList(templatesDirVal)...)...)
+		}
+		err := source.Run(gitSourceAM, versionAM, intervalValAM, func(dir string) error {
+			return alertmanager.Sync(alertmanager.Options{
+				ConfigFile:       inSource(dir, configFileVal),
+				Fragments:        inSourceList(dir, fragmentsValAM),
+				MergedOutput:     mergedOutputValAM,
+				TemplateDirs:     inSourceList(dir, templatesDirVal),
+				TemplatePatterns: common.SplitList(templatesPatternVal),
+				TenantsDir:       inSource(dir, tenantsDirValAM),
+				MimirAddress:     mimirAddressValAM,
+				MimirID:          mimirIDValAM,
+				Limits:           limitsValAM,
+				RuntimeConfig:    runtimeConfigValAM,
+				Artifacts:        artifactsAM,
+				State:            stateAM,
+				TempBaseDir:      tempDirValAM,
+			})
+		})
 		if err != nil {
 			log.Fatalf("Alertmanager sync failed: %v", err)
 		}
 		log.Println("Alertmanager sync completed successfully.")
 	case "mimir-rules":
+		if len(os.Args) > 2 && os.Args[2] == "test" {
+			runRulesTest(mimirRulesTestCmd, os.Args[3:])
+			return
+		}
 		mimirRulesCmd.Parse(os.Args[2:])
 		// Helper to determine if a flag was set on the command line
 		mimirRulesFlagsSet := make(map[string]bool)
@@ -118,10 +373,59 @@ func main() {
 		mimirIDValMR := getMRValue("mimir.id", "MALSYNC_MIMIRRULES_MIMIR_ID")
 		tempDirValMR := getMRValue("temp.dir", "MALSYNC_MIMIRRULES_TEMP_DIR")
 		namespaceValMR := getMRValue("rules.namespace", "MALSYNC_MIMIRRULES_RULES_NAMESPACE")
+		policyValMR := getMRValue("rules.policy", "MALSYNC_MIMIRRULES_RULES_POLICY")
+		testsValMR := getMRValue("rules.tests", "MALSYNC_MIMIRRULES_RULES_TESTS")
+		limitsValMR := limits.Limits{
+			RuleGroupsPerTenant: parseLimit("limits.max-rule-groups", getMRValue("limits.max-rule-groups", "MALSYNC_MIMIRRULES_LIMITS_MAX_RULE_GROUPS")),
+			RulesPerRuleGroup:   parseLimit("limits.max-rules-per-group", getMRValue("limits.max-rules-per-group", "MALSYNC_MIMIRRULES_LIMITS_MAX_RULES_PER_GROUP")),
+		}
+		runtimeConfigValMR := getMRValue("limits.runtime-config", "MALSYNC_MIMIRRULES_LIMITS_RUNTIME_CONFIG")
+		splitGroupsValMR := parseBool("rules.split-groups", getMRValue("rules.split-groups", "MALSYNC_MIMIRRULES_RULES_SPLIT_GROUPS"))
+		crdNamespaceFormatValMR := getMRValue("rules.crd-namespace-format", "MALSYNC_MIMIRRULES_RULES_CRD_NAMESPACE_FORMAT")
+		mixinsValMR := getMRValue("rules.mixins", "MALSYNC_MIMIRRULES_RULES_MIXINS")
+		jsonnetPathValMR := getMRValue("rules.jsonnet-path", "MALSYNC_MIMIRRULES_RULES_JSONNET_PATH")
+		filterValMR := rules.Filter{
+			Include: common.SplitList(getMRValue("rules.include", "MALSYNC_MIMIRRULES_RULES_INCLUDE")),
+			Exclude: common.SplitList(getMRValue("rules.exclude", "MALSYNC_MIMIRRULES_RULES_EXCLUDE")),
+		}
+		gitSourceMR := source.Git{
+			URL:     getMRValue("source.git.url", "MALSYNC_MIMIRRULES_SOURCE_GIT_URL"),
+			Ref:     getMRValue("source.git.ref", "MALSYNC_MIMIRRULES_SOURCE_GIT_REF"),
+			Subpath: getMRValue("source.git.subpath", "MALSYNC_MIMIRRULES_SOURCE_GIT_SUBPATH"),
+			Dir:     getMRValue("source.git.dir", "MALSYNC_MIMIRRULES_SOURCE_GIT_DIR"),
+		}
+		if gitSourceMR.Dir == "" {
+			gitSourceMR.Dir = filepath.Join(tempDirValMR, "mal-sync-git-mimir-rules")
+		}
+		intervalValMR := parseInterval("daemon.interval", getMRValue("daemon.interval", "MALSYNC_MIMIRRULES_DAEMON_INTERVAL"))
+		artifactsMR := source.Artifacts{
+			CacheDir: getMRValue("source.cache-dir", "MALSYNC_MIMIRRULES_SOURCE_CACHE_DIR"),
+			MaxSize:  parseSize("source.max-size", getMRValue("source.max-size", "MALSYNC_MIMIRRULES_SOURCE_MAX_SIZE")),
+			S3: source.S3{
+				Endpoint:        getMRValue("source.s3.endpoint", "MALSYNC_MIMIRRULES_SOURCE_S3_ENDPOINT"),
+				Region:          getMRValue("source.s3.region", "MALSYNC_MIMIRRULES_SOURCE_S3_REGION"),
+				CredentialsFile: getMRValue("source.s3.credentials-file", "MALSYNC_MIMIRRULES_SOURCE_S3_CREDENTIALS_FILE"),
+			},
+		}
+		if artifactsMR.CacheDir == "" {
+			artifactsMR.CacheDir = filepath.Join(tempDirValMR, "mal-sync-cache")
+		}
+		stateMR := state.Store{
+			Path:           getMRValue("state.file", "MALSYNC_MIMIRRULES_STATE_FILE"),
+			S3:             artifactsMR.S3,
+			VerifyInterval: parseInterval("state.verify-interval", getMRValue("state.verify-interval", "MALSYNC_MIMIRRULES_STATE_VERIFY_INTERVAL")),
+		}
 
+		if rulesPathValMR == "" && gitSourceMR.URL != "" {
+			rulesPathValMR = "." // the rules are the checkout itself
+		}
 		if rulesPathValMR == "" {
 			log.Fatal("Error: -rules.path flag or MALSYNC_MIMIRRULES_RULES_PATH env var is required for mimir-rules sync")
 		}
+		sinceValMR := getMRValue("since", "MALSYNC_MIMIRRULES_SINCE")
+		if sinceValMR == "auto" && gitSourceMR.URL == "" {
+			log.Fatal("Error: -since auto requires -source.git.url, whose last applied commit it compares with")
+		}
 		if mimirAddressValMR == "" {
 			log.Fatal("Error: -mimir.address flag or MALSYNC_MIMIRRULES_MIMIR_ADDRESS env var is required for mimir-rules sync")
 		}
@@ -129,7 +433,28 @@ func main() {
 			log.Fatal("Error: -rules.namespace flag or MALSYNC_MIMIRRULES_RULES_NAMESPACE env var is required for mimir-rules sync")
 		}
 
-		err := mimirrules.Sync(rulesPathValMR, mimirAddressValMR, mimirIDValMR, namespaceValMR, tempDirValMR)
+		versionMR := func() (string, error) { return artifactsMR.Version(rulesPathValMR) }
+		err := source.Run(gitSourceMR, versionMR, intervalValMR, func(dir string) error {
+			return mimirrules.Sync(mimirrules.Options{
+				RulesPath:       inSource(dir, rulesPathValMR),
+				Filter:          filterValMR,
+				Mixins:          inSourceList(dir, mixinsValMR),
+				JsonnetPaths:    inSourceList(dir, jsonnetPathValMR),
+				Since:           resolveSince(sinceValMR, gitSourceMR),
+				MimirAddress:    mimirAddressValMR,
+				MimirID:         mimirIDValMR,
+				Namespace:       namespaceValMR,
+				PolicyFile:      inSource(dir, policyValMR),
+				TestsPath:       inSource(dir, testsValMR),
+				Limits:          limitsValMR,
+				RuntimeConfig:   runtimeConfigValMR,
+				SplitGroups:     splitGroupsValMR,
+				NamespaceFormat: crdNamespaceFormatValMR,
+				Artifacts:       artifactsMR,
+				State:           stateMR,
+				TempBaseDir:     tempDirValMR,
+			})
+		})
 		if err != nil {
 			log.Fatalf("Mimir rules sync failed: %v", err)
 		}
@@ -158,10 +483,56 @@ func main() {
 		lokiAddressValLR := getLRValue("loki.address", "MALSYNC_LOKIRULES_LOKI_ADDRESS")
 		lokiOrgIDValLR := getLRValue("loki.org-id", "MALSYNC_LOKIRULES_LOKI_ORG_ID")
 		tempDirValLR := getLRValue("temp.dir", "MALSYNC_LOKIRULES_TEMP_DIR")
+		policyValLR := getLRValue("rules.policy", "MALSYNC_LOKIRULES_RULES_POLICY")
+		limitsValLR := limits.Limits{
+			RuleGroupsPerTenant: parseLimit("limits.max-rule-groups", getLRValue("limits.max-rule-groups", "MALSYNC_LOKIRULES_LIMITS_MAX_RULE_GROUPS")),
+			RulesPerRuleGroup:   parseLimit("limits.max-rules-per-group", getLRValue("limits.max-rules-per-group", "MALSYNC_LOKIRULES_LIMITS_MAX_RULES_PER_GROUP")),
+		}
+		runtimeConfigValLR := getLRValue("limits.runtime-config", "MALSYNC_LOKIRULES_LIMITS_RUNTIME_CONFIG")
+		splitGroupsValLR := parseBool("rules.split-groups", getLRValue("rules.split-groups", "MALSYNC_LOKIRULES_RULES_SPLIT_GROUPS"))
+		crdNamespaceFormatValLR := getLRValue("rules.crd-namespace-format", "MALSYNC_LOKIRULES_RULES_CRD_NAMESPACE_FORMAT")
+		filterValLR := rules.Filter{
+			Include: common.SplitList(getLRValue("rules.include", "MALSYNC_LOKIRULES_RULES_INCLUDE")),
+			Exclude: common.SplitList(getLRValue("rules.exclude", "MALSYNC_LOKIRULES_RULES_EXCLUDE")),
+		}
+		gitSourceLR := source.Git{
+			URL:     getLRValue("source.git.url", "MALSYNC_LOKIRULES_SOURCE_GIT_URL"),
+			Ref:     getLRValue("source.git.ref", "MALSYNC_LOKIRULES_SOURCE_GIT_REF"),
+			Subpath: getLRValue("source.git.subpath", "MALSYNC_LOKIRULES_SOURCE_GIT_SUBPATH"),
+			Dir:     getLRValue("source.git.dir", "MALSYNC_LOKIRULES_SOURCE_GIT_DIR"),
+		}
+		if gitSourceLR.Dir == "" {
+			gitSourceLR.Dir = filepath.Join(tempDirValLR, "mal-sync-git-loki-rules")
+		}
+		intervalValLR := parseInterval("daemon.interval", getLRValue("daemon.interval", "MALSYNC_LOKIRULES_DAEMON_INTERVAL"))
+		artifactsLR := source.Artifacts{
+			CacheDir: getLRValue("source.cache-dir", "MALSYNC_LOKIRULES_SOURCE_CACHE_DIR"),
+			MaxSize:  parseSize("source.max-size", getLRValue("source.max-size", "MALSYNC_LOKIRULES_SOURCE_MAX_SIZE")),
+			S3: source.S3{
+				Endpoint:        getLRValue("source.s3.endpoint", "MALSYNC_LOKIRULES_SOURCE_S3_ENDPOINT"),
+				Region:          getLRValue("source.s3.region", "MALSYNC_LOKIRULES_SOURCE_S3_REGION"),
+				CredentialsFile: getLRValue("source.s3.credentials-file", "MALSYNC_LOKIRULES_SOURCE_S3_CREDENTIALS_FILE"),
+			},
+		}
+		if artifactsLR.CacheDir == "" {
+			artifactsLR.CacheDir = filepath.Join(tempDirValLR, "mal-sync-cache")
+		}
+		stateLR := state.Store{
+			Path:           getLRValue("state.file", "MALSYNC_LOKIRULES_STATE_FILE"),
+			S3:             artifactsLR.S3,
+			VerifyInterval: parseInterval("state.verify-interval", getLRValue("state.verify-interval", "MALSYNC_LOKIRULES_STATE_VERIFY_INTERVAL")),
+		}
 
+		if rulesPathValLR == "" && gitSourceLR.URL != "" {
+			rulesPathValLR = "." // the rules are the checkout itself
+		}
 		if rulesPathValLR == "" {
 			log.Fatal("Error: -rules.path flag or MALSYNC_LOKIRULES_RULES_PATH env var is required for loki-rules sync")
 		}
+		sinceValLR := getLRValue("since", "MALSYNC_LOKIRULES_SINCE")
+		if sinceValLR == "auto" && gitSourceLR.URL == "" {
+			log.Fatal("Error: -since auto requires -source.git.url, whose last applied commit it compares with")
+		}
 		if lokiAddressValLR == "" {
 			log.Fatal("Error: -loki.address flag or MALSYNC_LOKIRULES_LOKI_ADDRESS env var is required for loki-rules sync")
 		}
@@ -169,12 +540,491 @@ func main() {
 			log.Fatal("Error: -loki.org-id flag or MALSYNC_LOKIRULES_LOKI_ORG_ID env var is required for loki-rules sync")
 		}
 
-		err := lokirules.Sync(rulesPathValLR, lokiAddressValLR, lokiOrgIDValLR, tempDirValLR)
+		versionLR := func() (string, error) { return artifactsLR.Version(rulesPathValLR) }
+		err := source.Run(gitSourceLR, versionLR, intervalValLR, func(dir string) error {
+			return lokirules.Sync(lokirules.Options{
+				RulesPath:       inSource(dir, rulesPathValLR),
+				Filter:          filterValLR,
+				Since:           resolveSince(sinceValLR, gitSourceLR),
+				LokiAddress:     lokiAddressValLR,
+				OrgID:           lokiOrgIDValLR,
+				PolicyFile:      inSource(dir, policyValLR),
+				Limits:          limitsValLR,
+				RuntimeConfig:   runtimeConfigValLR,
+				SplitGroups:     splitGroupsValLR,
+				NamespaceFormat: crdNamespaceFormatValLR,
+				Artifacts:       artifactsLR,
+				State:           stateLR,
+				TempBaseDir:     tempDirValLR,
+			})
+		})
 		if err != nil {
 			log.Fatalf("Loki rules sync failed: %v", err)
 		}
 		log.Println("Loki rules sync completed successfully.")
+	case "silences":
+		if len(os.Args) < 3 || os.Args[2] != "sync" {
+			log.Fatal("Expected 'silences sync'")
+		}
+		silencesSyncCmd.Parse(os.Args[3:])
+		// Helper to determine if a flag was set on the command line
+		silencesFlagsSet := make(map[string]bool)
+		silencesSyncCmd.Visit(func(f *flag.Flag) { silencesFlagsSet[f.Name] = true })
+
+		getSLValue := func(flagName, envVarName string) string {
+			val := silencesSyncCmd.Lookup(flagName).Value.String()
+			defVal := silencesSyncCmd.Lookup(flagName).DefValue
+			if silencesFlagsSet[flagName] { // Flag was explicitly set
+				return val
+			}
+			env := os.Getenv(envVarName)
+			if env != "" {
+				log.Printf("Using %s from environment variable %s: %s", flagName, envVarName, env)
+				return env
+			}
+			return defVal
+		}
+
+		pathValSL := getSLValue("path", "MALSYNC_SILENCES_PATH")
+		mimirAddressValSL := getSLValue("mimir.address", "MALSYNC_SILENCES_MIMIR_ADDRESS")
+		mimirIDValSL := getSLValue("mimir.id", "MALSYNC_SILENCES_MIMIR_ID")
+		stateSL := state.Store{
+			Path: getSLValue("state.file", "MALSYNC_SILENCES_STATE_FILE"),
+			S3: source.S3{
+				Endpoint:        getSLValue("source.s3.endpoint", "MALSYNC_SILENCES_SOURCE_S3_ENDPOINT"),
+				Region:          getSLValue("source.s3.region", "MALSYNC_SILENCES_SOURCE_S3_REGION"),
+				CredentialsFile: getSLValue("source.s3.credentials-file", "MALSYNC_SILENCES_SOURCE_S3_CREDENTIALS_FILE"),
+			},
+		}
+
+		if pathValSL == "" {
+			log.Fatal("Error: -path flag or MALSYNC_SILENCES_PATH env var is required for silences sync")
+		}
+		if mimirAddressValSL == "" {
+			log.Fatal("Error: -mimir.address flag or MALSYNC_SILENCES_MIMIR_ADDRESS env var is required for silences sync")
+		}
+
+		err := silences.Sync(silences.Options{
+			Path:         pathValSL,
+			MimirAddress: mimirAddressValSL,
+			MimirID:      mimirIDValSL,
+			State:        stateSL,
+		})
+		if err != nil {
+			log.Fatalf("Silences sync failed: %v", err)
+		}
+		log.Println("Silences sync completed successfully.")
+	case "analyze":
+		if len(os.Args) < 3 || os.Args[2] != "deps" {
+			log.Fatal("Expected 'analyze deps'")
+		}
+		analyzeDepsCmd.Parse(os.Args[3:])
+		// Helper to determine if a flag was set on the command line
+		analyzeFlagsSet := make(map[string]bool)
+		analyzeDepsCmd.Visit(func(f *flag.Flag) { analyzeFlagsSet[f.Name] = true })
+
+		getANValue := func(flagName, envVarName string) string {
+			val := analyzeDepsCmd.Lookup(flagName).Value.String()
+			defVal := analyzeDepsCmd.Lookup(flagName).DefValue
+			if analyzeFlagsSet[flagName] { // Flag was explicitly set
+				return val
+			}
+			env := os.Getenv(envVarName)
+			if env != "" {
+				log.Printf("Using %s from environment variable %s: %s", flagName, envVarName, env)
+				return env
+			}
+			return defVal
+		}
+
+		rulesPathValAN := getANValue("rules.path", "MALSYNC_ANALYZE_RULES_PATH")
+		formatValAN := getANValue("output.format", "MALSYNC_ANALYZE_OUTPUT_FORMAT")
+		outputValAN := getANValue("output.file", "MALSYNC_ANALYZE_OUTPUT_FILE")
+		strictValAN := parseBool("strict", getANValue("strict", "MALSYNC_ANALYZE_STRICT"))
+
+		if rulesPathValAN == "" {
+			log.Fatal("Error: -rules.path flag or MALSYNC_ANALYZE_RULES_PATH env var is required for analyze deps")
+		}
+
+		err := analyze.Deps(analyze.DepsOptions{
+			RulesPath: rulesPathValAN,
+			Format:    formatValAN,
+			Output:    outputValAN,
+			Strict:    strictValAN,
+		})
+		if err != nil {
+			log.Fatalf("Dependency analysis failed: %v", err)
+		}
+	case "catalog":
+		catalogCmd.Parse(os.Args[2:])
+		// Helper to determine if a flag was set on the command line
+		catalogFlagsSet := make(map[string]bool)
+		catalogCmd.Visit(func(f *flag.Flag) { catalogFlagsSet[f.Name] = true })
+
+		getCTValue := func(flagName, envVarName string) string {
+			val := catalogCmd.Lookup(flagName).Value.String()
+			defVal := catalogCmd.Lookup(flagName).DefValue
+			if catalogFlagsSet[flagName] { // Flag was explicitly set
+				return val
+			}
+			env := os.Getenv(envVarName)
+			if env != "" {
+				log.Printf("Using %s from environment variable %s: %s", flagName, envVarName, env)
+				return env
+			}
+			return defVal
+		}
+
+		mimirPathsValCT := getCTValue("mimir.rules-path", "MALSYNC_CATALOG_MIMIR_RULES_PATH")
+		lokiPathsValCT := getCTValue("loki.rules-path", "MALSYNC_CATALOG_LOKI_RULES_PATH")
+		formatValCT := getCTValue("output.format", "MALSYNC_CATALOG_OUTPUT_FORMAT")
+		outputValCT := getCTValue("output.file", "MALSYNC_CATALOG_OUTPUT_FILE")
+
+		if mimirPathsValCT == "" && lokiPathsValCT == "" {
+			log.Fatal("Error: -mimir.rules-path or -loki.rules-path flag (or MALSYNC_CATALOG_MIMIR_RULES_PATH / MALSYNC_CATALOG_LOKI_RULES_PATH env var) is required for catalog")
+		}
+
+		err := catalog.Run(catalog.Options{
+			MimirPaths: common.SplitList(mimirPathsValCT),
+			LokiPaths:  common.SplitList(lokiPathsValCT),
+			Format:     formatValCT,
+			Output:     outputValCT,
+		})
+		if err != nil {
+			log.Fatalf("Catalog export failed: %v", err)
+		}
+	case "fmt":
+		fmtCmd.Parse(os.Args[2:])
+		if fmtCmd.NArg() == 0 {
+			log.Fatal("Usage: mal-sync fmt [-w] [-check] <paths>")
+		}
+		err := format.Run(format.Options{
+			Paths: fmtCmd.Args(),
+			Write: parseBool("w", fmtCmd.Lookup("w").Value.String()),
+			Check: parseBool("check", fmtCmd.Lookup("check").Value.String()),
+		})
+		if err != nil {
+			log.Fatalf("Formatting failed: %v", err)
+		}
+	case "convert":
+		convertCmd.Parse(os.Args[2:])
+		if convertCmd.NArg() == 0 {
+			log.Fatal("Usage: mal-sync convert -to crd|rules [options] <paths>")
+		}
+		err := convert.Run(convert.Options{
+			Paths:           convertCmd.Args(),
+			To:              convertCmd.Lookup("to").Value.String(),
+			Output:          convertCmd.Lookup("o").Value.String(),
+			Name:            convertCmd.Lookup("name").Value.String(),
+			Namespace:       convertCmd.Lookup("namespace").Value.String(),
+			NamespaceFormat: convertCmd.Lookup("namespace-format").Value.String(),
+		})
+		if err != nil {
+			log.Fatalf("Conversion failed: %v", err)
+		}
+	case "controller":
+		controllerCmd.Parse(os.Args[2:])
+		// Helper to determine if a flag was set on the command line
+		controllerFlagsSet := make(map[string]bool)
+		controllerCmd.Visit(func(f *flag.Flag) { controllerFlagsSet[f.Name] = true })
+
+		getCOValue := func(flagName, envVarName string) string {
+			val := controllerCmd.Lookup(flagName).Value.String()
+			defVal := controllerCmd.Lookup(flagName).DefValue
+			if controllerFlagsSet[flagName] { // Flag was explicitly set
+				return val
+			}
+			env := os.Getenv(envVarName)
+			if env != "" {
+				log.Printf("Using %s from environment variable %s: %s", flagName, envVarName, env)
+				return env
+			}
+			return defVal
+		}
+
+		mimirAddressValCO := getCOValue("mimir.address", "MALSYNC_CONTROLLER_MIMIR_ADDRESS")
+		lokiAddressValCO := getCOValue("loki.address", "MALSYNC_CONTROLLER_LOKI_ADDRESS")
+		tenantLabelValCO := getCOValue("tenant.label", "MALSYNC_CONTROLLER_TENANT_LABEL")
+		namespaceFormatValCO := getCOValue("rules.crd-namespace-format", "MALSYNC_CONTROLLER_RULES_CRD_NAMESPACE_FORMAT")
+		resyncValCO := parseInterval("resync.interval", getCOValue("resync.interval", "MALSYNC_CONTROLLER_RESYNC_INTERVAL"))
+		tempDirValCO := getCOValue("temp.dir", "MALSYNC_CONTROLLER_TEMP_DIR")
+		kubeConfigCO := kube.Config{
+			Server:             getCOValue("kube.api-server", "MALSYNC_CONTROLLER_KUBE_API_SERVER"),
+			TokenFile:          getCOValue("kube.token-file", "MALSYNC_CONTROLLER_KUBE_TOKEN_FILE"),
+			CAFile:             getCOValue("kube.ca-file", "MALSYNC_CONTROLLER_KUBE_CA_FILE"),
+			InsecureSkipVerify: parseBool("kube.insecure-skip-tls-verify", getCOValue("kube.insecure-skip-tls-verify", "MALSYNC_CONTROLLER_KUBE_INSECURE_SKIP_TLS_VERIFY")),
+		}
+
+		if mimirAddressValCO == "" {
+			log.Fatal("Error: -mimir.address flag or MALSYNC_CONTROLLER_MIMIR_ADDRESS env var is required for controller")
+		}
+
+		client, err := kube.NewClient(kubeConfigCO)
+		if err != nil {
+			log.Fatalf("Controller failed: %v", err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		log.Printf("Starting controller for Kubernetes API server %s", client.Server)
+		err = controller.New(client, controller.Options{
+			MimirAddress:    mimirAddressValCO,
+			LokiAddress:     lokiAddressValCO,
+			TenantLabel:     tenantLabelValCO,
+			NamespaceFormat: namespaceFormatValCO,
+			ResyncInterval:  resyncValCO,
+			TempBaseDir:     tempDirValCO,
+		}).Run(ctx)
+		if err != nil {
+			log.Fatalf("Controller failed: %v", err)
+		}
+		log.Println("Controller stopped.")
+	case "apply":
+		applyCmd.Parse(os.Args[2:])
+		// Helper to determine if a flag was set on the command line
+		applyFlagsSet := make(map[string]bool)
+		applyCmd.Visit(func(f *flag.Flag) { applyFlagsSet[f.Name] = true })
+
+		getAPValue := func(flagName, envVarName string) string {
+			val := applyCmd.Lookup(flagName).Value.String()
+			defVal := applyCmd.Lookup(flagName).DefValue
+			if applyFlagsSet[flagName] { // Flag was explicitly set
+				return val
+			}
+			env := os.Getenv(envVarName)
+			if env != "" {
+				log.Printf("Using %s from environment variable %s: %s", flagName, envVarName, env)
+				return env
+			}
+			return defVal
+		}
+
+		stateAP := state.Store{
+			Path: getAPValue("state.file", "MALSYNC_APPLY_STATE_FILE"),
+			S3: source.S3{
+				Endpoint:        getAPValue("source.s3.endpoint", "MALSYNC_APPLY_SOURCE_S3_ENDPOINT"),
+				Region:          getAPValue("source.s3.region", "MALSYNC_APPLY_SOURCE_S3_REGION"),
+				CredentialsFile: getAPValue("source.s3.credentials-file", "MALSYNC_APPLY_SOURCE_S3_CREDENTIALS_FILE"),
+			},
+			VerifyInterval: parseInterval("state.verify-interval", getAPValue("state.verify-interval", "MALSYNC_APPLY_STATE_VERIFY_INTERVAL")),
+		}
+		err := apply.Run(apply.Options{
+			Root:         getAPValue("root", "MALSYNC_APPLY_ROOT"),
+			MimirAddress: getAPValue("mimir.address", "MALSYNC_APPLY_MIMIR_ADDRESS"),
+			LokiAddress:  getAPValue("loki.address", "MALSYNC_APPLY_LOKI_ADDRESS"),
+			PolicyFile:   getAPValue("rules.policy", "MALSYNC_APPLY_RULES_POLICY"),
+			State:        stateAP,
+			TempBaseDir:  getAPValue("temp.dir", "MALSYNC_APPLY_TEMP_DIR"),
+		})
+		if err != nil {
+			log.Fatalf("Apply failed: %v", err)
+		}
+		log.Println("Apply completed successfully.")
 	default:
-		log.Fatalf("Unknown subcommand: %s. Expected 'alertmanager', 'mimir-rules', or 'loki-rules'.", os.Args[1])
+		log.Fatalf("Unknown subcommand: %s. Expected 'alertmanager', 'mimir-rules', 'loki-rules', 'silences', 'analyze', 'catalog', 'fmt', 'convert', 'controller' or 'apply'.", os.Args[1])
+	}
+}
+
+// parseLimit parses the value of a limit flag or its environment variable.
+func parseLimit(flagName, val string) int {
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		log.Fatalf("Error: -%s must be a non-negative integer, got %q", flagName, val)
+	}
+	return n
+}
+
+// resolveSince returns the commit an incremental sync compares with: since
+// itself, or for "auto" the commit last applied from src. Without an
+// applied commit everything is synced.
+func resolveSince(since string, src source.Git) string {
+	if since != "auto" {
+		return since
+	}
+	applied := src.Applied()
+	if applied == "" {
+		log.Printf("No applied commit recorded in %s, syncing every namespace", src.Dir)
+	}
+	return applied
+}
+
+// parseSize parses a size flag such as 100MiB, exiting on invalid values.
+func parseSize(flagName, val string) int64 {
+	n, err := source.ParseSize(val)
+	if err != nil {
+		log.Fatalf("Error: -%s: %v", flagName, err)
+	}
+	return n
+}
+
+// parseBool parses the value of a boolean flag or its environment
+// variable, accepting what strconv.ParseBool does (1, t, TRUE, false, ...).
+func parseBool(flagName, val string) bool {
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Fatalf("Error: -%s must be true or false, got %q", flagName, val)
+	}
+	return b
+}
+
+// parseInterval parses the value of a duration flag or its environment
+// variable.
+func parseInterval(flagName, val string) time.Duration {
+	if val == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		log.Fatalf("Error: -%s must be a non-negative duration such as 30s or 5m, got %q", flagName, val)
+	}
+	return d
+}
+
+// inSource resolves a relative path against the checkout directory of a
+// source; absolute paths, URLs, and all paths when dir is "", are kept as
+// is.
+func inSource(dir, path string) string {
+	if dir == "" || path == "" || filepath.IsAbs(path) || strings.Contains(path, "://") {
+		return path
+	}
+	if source.IsArtifact(path) {
+		// Joining would clean away the "//" before a path inside a bundle
+		return filepath.Join(dir) + string(filepath.Separator) + path
+	}
+	return filepath.Join(dir, path)
+}
+
+// inSourceList splits a comma-separated list of paths and resolves each
+// one with inSource.
+func inSourceList(dir, list string) []string {
+	paths := common.SplitList(list)
+	for i, p := range paths {
+		paths[i] = inSource(dir, p)
+	}
+	return paths
+}
+
+// runRulesTest implements "mimir-rules test [test files]". Test files that
+// list no rule_files are run against the rules in rules.path.
+func runRulesTest(cmd *flag.FlagSet, args []string) {
+	cmd.Parse(args)
+	// Helper to determine if a flag was set on the command line
+	flagsSet := make(map[string]bool)
+	cmd.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+
+	getRTValue := func(flagName, envVarName string) string {
+		val := cmd.Lookup(flagName).Value.String()
+		defVal := cmd.Lookup(flagName).DefValue
+		if flagsSet[flagName] { // Flag was explicitly set
+			return val
+		}
+		env := os.Getenv(envVarName)
+		if env != "" {
+			log.Printf("Using %s from environment variable %s: %s", flagName, envVarName, env)
+			return env
+		}
+		return defVal
+	}
+
+	rulesPathVal := getRTValue("rules.path", "MALSYNC_MIMIRRULES_RULES_PATH")
+	testsVal := getRTValue("rules.tests", "MALSYNC_MIMIRRULES_RULES_TESTS")
+
+	testPaths := cmd.Args()
+	if testsVal != "" {
+		testPaths = append([]string{testsVal}, testPaths...)
+	}
+	if len(testPaths) == 0 {
+		log.Fatal("Error: -rules.tests flag, MALSYNC_MIMIRRULES_RULES_TESTS env var or test file arguments are required for mimir-rules test")
+	}
+	var ruleFiles []string
+	if rulesPathVal != "" {
+		var err error
+		if ruleFiles, err = rules.ResolveFiles(rulesPathVal); err != nil {
+			log.Fatalf("Mimir rules test failed: %v", err)
+		}
+	}
+
+	if err := ruletest.Run(ruletest.Options{TestPaths: testPaths, RuleFiles: ruleFiles}); err != nil {
+		log.Fatalf("Mimir rules test failed: %v", err)
+	}
+}
+
+// runTestReceiver implements "alertmanager test-receiver <name>". The receiver
+// name may be given before or after the flags.
+func runTestReceiver(cmd *flag.FlagSet, args []string) {
+	var receiver string
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		receiver, args = args[0], args[1:]
+	}
+	cmd.Parse(args)
+	if receiver == "" && cmd.NArg() > 0 {
+		receiver = cmd.Arg(0)
+	}
+	if receiver == "" {
+		log.Fatal("Usage: mal-sync alertmanager test-receiver <name> [options]")
+	}
+	// Helper to determine if a flag was set on the command line
+	flagsSet := make(map[string]bool)
+	cmd.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+
+	getTRValue := func(flagName, envVarName string) string {
+		val := cmd.Lookup(flagName).Value.String()
+		defVal := cmd.Lookup(flagName).DefValue
+		if flagsSet[flagName] { // Flag was explicitly set
+			return val
+		}
+		env := os.Getenv(envVarName)
+		if env != "" {
+			log.Printf("Using %s from environment variable %s: %s", flagName, envVarName, env)
+			return env
+		}
+		return defVal
+	}
+
+	configFileVal := getTRValue("config.file", "MALSYNC_ALERTMANAGER_CONFIG_FILE")
+	fragmentsVal := getTRValue("config.fragments", "MALSYNC_ALERTMANAGER_CONFIG_FRAGMENTS")
+	templatesDirVal := getTRValue("templates.dir", "MALSYNC_ALERTMANAGER_TEMPLATES_DIR")
+	templatesPatternVal := getTRValue("templates.pattern", "MALSYNC_ALERTMANAGER_TEMPLATES_PATTERN")
+	tenantsDirVal := getTRValue("tenants.dir", "MALSYNC_ALERTMANAGER_TENANTS_DIR")
+	tenantVal := getTRValue("tenant", "MALSYNC_ALERTMANAGER_TENANT")
+	tempDirVal := getTRValue("temp.dir", "MALSYNC_ALERTMANAGER_TEMP_DIR")
+
+	if configFileVal == "" {
+		log.Fatal("Error: -config.file flag or MALSYNC_ALERTMANAGER_CONFIG_FILE env var is required for alertmanager test-receiver")
+	}
+	if tenantsDirVal != "" && tenantVal == "" {
+		log.Fatal("Error: -tenant flag or MALSYNC_ALERTMANAGER_TENANT env var is required with -tenants.dir")
+	}
+
+	results, err := alertmanager.TestReceiver(alertmanager.TestReceiverOptions{
+		ConfigFile:       configFileVal,
+		Fragments:        common.SplitList(fragmentsVal),
+		TemplateDirs:     common.SplitList(templatesDirVal),
+		TemplatePatterns: common.SplitList(templatesPatternVal),
+		TenantsDir:       tenantsDirVal,
+		Tenant:           tenantVal,
+		TempBaseDir:      tempDirVal,
+		Receiver:         receiver,
+	})
+	if err != nil {
+		log.Fatalf("Alertmanager test-receiver failed: %v", err)
+	}
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			log.Printf("%s: skipped (%s)", r.Integration, r.Status)
+		case r.Err != nil:
+			failed++
+			log.Printf("%s: FAILED sending to %s: %v", r.Integration, r.Target, r.Err)
+		default:
+			log.Printf("%s: OK sent to %s (%s)", r.Integration, r.Target, r.Status)
+		}
+		if r.Response != "" {
+			log.Printf("%s: response: %s", r.Integration, r.Response)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d integration(s) of receiver %q failed", failed, len(results), receiver)
 	}
+	log.Printf("Test notification sent through receiver %q.", receiver)
 }
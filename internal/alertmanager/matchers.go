@@ -0,0 +1,82 @@
+package alertmanager
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Matcher is a single Alertmanager label matcher such as severity="critical".
+type Matcher struct {
+	Name  string
+	Op    string // one of =, !=, =~, !~
+	Value string
+}
+
+// String formats the matcher in its normalized `name op "value"` form.
+func (m Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Op, m.Value)
+}
+
+// IsRegex reports whether the matcher compares against a regular expression.
+func (m Matcher) IsRegex() bool { return m.Op == "=~" || m.Op == "!~" }
+
+// IsEqual reports whether the matcher is positive (= or =~).
+func (m Matcher) IsEqual() bool { return m.Op == "=" || m.Op == "=~" }
+
+// ParseMatchers parses an Alertmanager matcher string such as
+// `severity="critical"` or `{team=~"a|b", env!="dev"}`. Values may be
+// quoted or bare.
+func ParseMatchers(s string) ([]Matcher, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	var parts []string
+	var cur strings.Builder
+	inQuote, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuote = !inQuote
+		case r == ',' && !inQuote:
+			parts = append(parts, cur.String())
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	parts = append(parts, cur.String())
+
+	var out []Matcher
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idx := strings.IndexAny(part, "=!")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid matcher %q", part)
+		}
+		m := Matcher{Name: strings.TrimSpace(part[:idx])}
+		rest := part[idx:]
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, op) {
+				m.Op = op
+				break
+			}
+		}
+		if m.Op == "" {
+			return nil, fmt.Errorf("invalid matcher %q", part)
+		}
+		value := strings.TrimSpace(rest[len(m.Op):])
+		if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) && len(value) >= 2 {
+			value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+			value = strings.ReplaceAll(value, `\\`, `\`)
+		}
+		m.Value = value
+		out = append(out, m)
+	}
+	return out, nil
+}
@@ -0,0 +1,272 @@
+package alertmanager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// fragmentKeys are the top-level keys a config fragment may contribute.
+// "routes" holds child routes that are appended to the base route.
+var fragmentKeys = map[string]bool{
+	"receivers":           true,
+	"routes":              true,
+	"inhibit_rules":       true,
+	"time_intervals":      true,
+	"mute_time_intervals": true,
+}
+
+// ResolveFragments expands a list of fragment files and directories into the
+// ordered list of fragment files to merge. Directories contribute their
+// *.yaml and *.yml files; the result is sorted by path so merges are
+// deterministic regardless of the order paths were given in.
+func ResolveFragments(paths []string) ([]string, error) {
+	var files []string
+	seen := map[string]bool{}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat config fragment path %s: %w", p, err)
+		}
+		if !info.IsDir() {
+			if !seen[p] {
+				files = append(files, p)
+				seen[p] = true
+			}
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config fragment directory %s: %w", p, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".yaml") || strings.HasSuffix(entry.Name(), ".yml")) {
+				f := filepath.Join(p, entry.Name())
+				if !seen[f] {
+					files = append(files, f)
+					seen[f] = true
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// origin records where a merged element was defined, for conflict messages.
+type origin struct {
+	file string
+	line int
+}
+
+func (o origin) String() string { return fmt.Sprintf("%s:%d", o.file, o.line) }
+
+// MergeConfigs merges the receivers, child routes, inhibit rules and time
+// intervals of each fragment into the base Alertmanager config and returns
+// the merged document. Fragments are applied in the order given. Duplicate
+// receiver or time interval names and child routes that can never match
+// because an earlier route shadows them are reported as errors.
+func MergeConfigs(baseFile string, fragmentFiles []string) ([]byte, error) {
+	base, err := loadMapping(baseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	receivers := map[string]origin{}
+	intervals := map[string]origin{}
+	if err := collectNames(base, "receivers", baseFile, receivers, "receiver"); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"time_intervals", "mute_time_intervals"} {
+		if err := collectNames(base, key, baseFile, intervals, "time interval"); err != nil {
+			return nil, err
+		}
+	}
+
+	route := base.Get("route")
+	var routeOrigins []origin
+	if route != nil {
+		for _, r := range route.Get("routes").Items() {
+			routeOrigins = append(routeOrigins, origin{baseFile, r.Line})
+		}
+	}
+
+	for _, file := range fragmentFiles {
+		log.Printf("Merging Alertmanager config fragment: %s", file)
+		frag, err := loadMapping(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range frag.Keys() {
+			if !fragmentKeys[key] {
+				return nil, fmt.Errorf("config fragment %s: key %q is not allowed in a fragment (allowed: receivers, routes, inhibit_rules, time_intervals, mute_time_intervals)", file, key)
+			}
+		}
+		frag = frag.Expand()
+
+		if err := collectNames(frag, "receivers", file, receivers, "receiver"); err != nil {
+			return nil, err
+		}
+		for _, key := range []string{"time_intervals", "mute_time_intervals"} {
+			if err := collectNames(frag, key, file, intervals, "time interval"); err != nil {
+				return nil, err
+			}
+		}
+		for _, key := range []string{"receivers", "inhibit_rules", "time_intervals", "mute_time_intervals"} {
+			if err := appendItems(base, frag, key, file); err != nil {
+				return nil, err
+			}
+		}
+
+		routes := frag.Get("routes")
+		if routes.IsNull() {
+			continue
+		}
+		if routes.Kind != yamlnode.SequenceNode {
+			return nil, fmt.Errorf("config fragment %s: routes must be a list (line %d)", file, routes.Line)
+		}
+		if route == nil {
+			return nil, fmt.Errorf("config fragment %s contributes routes but base config %s has no route", file, baseFile)
+		}
+		children := route.Get("routes")
+		if children.IsNull() {
+			children = yamlnode.NewSequence()
+			route.Set("routes", children)
+		}
+		for _, r := range routes.Items() {
+			children.Content = append(children.Content, r)
+			routeOrigins = append(routeOrigins, origin{file, r.Line})
+		}
+	}
+
+	if route != nil {
+		if err := checkRouteOrder(route.Get("routes").Items(), routeOrigins); err != nil {
+			return nil, err
+		}
+	}
+	return yamlnode.Encode(base), nil
+}
+
+func loadMapping(file string) (*yamlnode.Node, error) {
+	docs, err := yamlnode.ParseFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) != 1 {
+		return nil, fmt.Errorf("%s must contain exactly one YAML document, found %d", file, len(docs))
+	}
+	if docs[0].Kind != yamlnode.MappingNode {
+		return nil, fmt.Errorf("%s: top level must be a mapping", file)
+	}
+	return docs[0], nil
+}
+
+// collectNames records the "name" of every item under key, failing when a
+// name was already defined by the base config or an earlier fragment.
+func collectNames(doc *yamlnode.Node, key, file string, seen map[string]origin, what string) error {
+	for _, item := range doc.Get(key).Items() {
+		name := item.Get("name").Text()
+		if name == "" {
+			return fmt.Errorf("%s:%d: %s without a name", file, item.Line, what)
+		}
+		if prev, dup := seen[name]; dup {
+			return fmt.Errorf("duplicate %s name %q: defined at %s and %s:%d", what, name, prev, file, item.Line)
+		}
+		seen[name] = origin{file, item.Line}
+	}
+	return nil
+}
+
+func appendItems(base, frag *yamlnode.Node, key, file string) error {
+	items := frag.Get(key)
+	if items.IsNull() {
+		return nil
+	}
+	if items.Kind != yamlnode.SequenceNode {
+		return fmt.Errorf("config fragment %s: %s must be a list (line %d)", file, key, items.Line)
+	}
+	target := base.Get(key)
+	if target.IsNull() {
+		target = yamlnode.NewSequence()
+		base.Set(key, target)
+	}
+	if target.Kind != yamlnode.SequenceNode {
+		return fmt.Errorf("base config: %s must be a list (line %d)", key, target.Line)
+	}
+	if key == "inhibit_rules" {
+		for _, rule := range items.Items() {
+			for _, existing := range target.Items() {
+				if string(yamlnode.Encode(existing)) == string(yamlnode.Encode(rule)) {
+					log.Printf("Warning: inhibit rule at %s:%d duplicates an existing inhibit rule (line %d)", file, rule.Line, existing.Line)
+				}
+			}
+		}
+	}
+	target.Content = append(target.Content, items.Items()...)
+	return nil
+}
+
+// checkRouteOrder fails when a child route can never be reached because an
+// earlier sibling without "continue: true" matches everything it matches.
+// Alertmanager evaluates sibling routes in order, so merging fragments must
+// not silently change which route an alert ends up in.
+func checkRouteOrder(routes []*yamlnode.Node, origins []origin) error {
+	sets := make([]map[string]bool, len(routes))
+	for i, r := range routes {
+		set, err := routeMatchers(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", origins[i], err)
+		}
+		sets[i] = set
+	}
+	for i, earlier := range routes {
+		if earlier.Get("continue").Text() == "true" {
+			continue
+		}
+		for j := i + 1; j < len(routes); j++ {
+			if isSubset(sets[i], sets[j]) {
+				return fmt.Errorf("route at %s (receiver %q) is shadowed by route at %s (receiver %q): the earlier route matches every alert the later one does and has no \"continue: true\"",
+					origins[j], routes[j].Get("receiver").Text(), origins[i], earlier.Get("receiver").Text())
+			}
+		}
+	}
+	return nil
+}
+
+func isSubset(a, b map[string]bool) bool {
+	for m := range a {
+		if !b[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// routeMatchers returns the normalized matchers of a route from its
+// "matchers", "match" and "match_re" fields.
+func routeMatchers(route *yamlnode.Node) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, m := range route.Get("matchers").Items() {
+		parsed, err := ParseMatchers(m.Text())
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parsed {
+			set[p.String()] = true
+		}
+	}
+	match := route.Get("match")
+	for _, k := range match.Keys() {
+		set[Matcher{Name: k, Op: "=", Value: match.Get(k).Text()}.String()] = true
+	}
+	matchRE := route.Get("match_re")
+	for _, k := range matchRE.Keys() {
+		set[Matcher{Name: k, Op: "=~", Value: matchRE.Get(k).Text()}.String()] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,169 @@
+package alertmanager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, keyed by path relative to dir, and returns dir.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const baseConfig = `route:
+  receiver: default
+  routes:
+    - receiver: platform
+      matchers: ['team="platform"']
+receivers:
+  - name: default
+  - name: platform
+`
+
+func TestMergeConfigs(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": baseConfig,
+		"teams/payments.yaml": `receivers:
+  - name: payments
+    webhook_configs:
+      - url: http://payments
+routes:
+  - receiver: payments
+    matchers: ['team="payments"']
+inhibit_rules:
+  - source_matchers: [severity="critical"]
+    target_matchers: [severity="warning"]
+`,
+		"teams/search.yml": `receivers:
+  - name: search
+routes:
+  - receiver: search
+    match:
+      team: search
+time_intervals:
+  - name: weekends
+    time_intervals:
+      - weekdays: [saturday, sunday]
+`,
+		"teams/README.md": "not a fragment",
+	})
+	fragments, err := ResolveFragments([]string{filepath.Join(dir, "teams/search.yml"), filepath.Join(dir, "teams")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "teams/payments.yaml"), filepath.Join(dir, "teams/search.yml")}
+	if strings.Join(fragments, ",") != strings.Join(want, ",") {
+		t.Fatalf("ResolveFragments = %v, want %v", fragments, want)
+	}
+
+	merged, err := MergeConfigs(filepath.Join(dir, "base.yaml"), fragments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMerged := `route:
+  receiver: default
+  routes:
+    - receiver: platform
+      matchers:
+        - team="platform"
+    - receiver: payments
+      matchers:
+        - team="payments"
+    - receiver: search
+      match:
+        team: search
+receivers:
+  - name: default
+  - name: platform
+  - name: payments
+    webhook_configs:
+      - url: http://payments
+  - name: search
+inhibit_rules:
+  - source_matchers:
+      - severity="critical"
+    target_matchers:
+      - severity="warning"
+time_intervals:
+  - name: weekends
+    time_intervals:
+      - weekdays:
+          - saturday
+          - sunday
+`
+	if string(merged) != wantMerged {
+		t.Errorf("MergeConfigs =\n%s\nwant\n%s", merged, wantMerged)
+	}
+}
+
+func TestMergeConfigsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment string
+		err      string
+	}{
+		{
+			name:     "duplicate receiver",
+			fragment: "receivers:\n  - name: platform\n",
+			err:      `duplicate receiver name "platform": defined at `,
+		},
+		{
+			name:     "receiver without name",
+			fragment: "receivers:\n  - webhook_configs: []\n",
+			err:      "receiver without a name",
+		},
+		{
+			name:     "key not allowed",
+			fragment: "route:\n  receiver: x\n",
+			err:      `key "route" is not allowed in a fragment`,
+		},
+		{
+			name:     "shadowed route",
+			fragment: "receivers:\n  - name: platform-critical\nroutes:\n  - receiver: platform-critical\n    matchers: ['team=\"platform\"', 'severity=\"critical\"']\n",
+			err:      `(receiver "platform-critical") is shadowed by route at`,
+		},
+		{
+			name:     "routes not a list",
+			fragment: "routes:\n  receiver: x\n",
+			err:      "routes must be a list",
+		},
+		{
+			name:     "unquoted template",
+			fragment: "receivers:\n  - name: t\n    slack_configs:\n      - title: {{ .CommonLabels.alertname }}\n",
+			err:      "flow collections cannot be mapping keys",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"base.yaml": baseConfig, "fragment.yaml": tt.fragment})
+			_, err := MergeConfigs(filepath.Join(dir, "base.yaml"), []string{filepath.Join(dir, "fragment.yaml")})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("MergeConfigs error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMergeConfigsContinueAllowsOverlap(t *testing.T) {
+	base := strings.Replace(baseConfig, "matchers: ['team=\"platform\"']", "matchers: ['team=\"platform\"']\n      continue: true", 1)
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":     base,
+		"fragment.yaml": "receivers:\n  - name: pager\nroutes:\n  - receiver: pager\n    matchers: ['team=\"platform\"', 'severity=\"critical\"']\n",
+	})
+	if _, err := MergeConfigs(filepath.Join(dir, "base.yaml"), []string{filepath.Join(dir, "fragment.yaml")}); err != nil {
+		t.Errorf("MergeConfigs: %v", err)
+	}
+}
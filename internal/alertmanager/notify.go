@@ -0,0 +1,234 @@
+package alertmanager
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The types in this file mirror the data Alertmanager passes to notification
+// templates, so templates that render in Alertmanager render the same way
+// when mal-sync sends test notifications.
+
+// KV is a set of labels or annotations.
+type KV map[string]string
+
+// Pair is a single label or annotation.
+type Pair struct {
+	Name, Value string
+}
+
+// Pairs is a list of labels or annotations, sorted by name.
+type Pairs []Pair
+
+// Names returns the names of the pairs.
+func (ps Pairs) Names() []string {
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = p.Name
+	}
+	return out
+}
+
+// Values returns the values of the pairs.
+func (ps Pairs) Values() []string {
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = p.Value
+	}
+	return out
+}
+
+// SortedPairs returns the pairs sorted by name, with alertname first.
+func (kv KV) SortedPairs() Pairs {
+	var pairs Pairs
+	for k, v := range kv {
+		pairs = append(pairs, Pair{k, v})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Name == "alertname" {
+			return pairs[j].Name != "alertname"
+		}
+		if pairs[j].Name == "alertname" {
+			return false
+		}
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// Remove returns a copy of kv without the given keys.
+func (kv KV) Remove(keys []string) KV {
+	out := KV{}
+	for k, v := range kv {
+		out[k] = v
+	}
+	for _, k := range keys {
+		delete(out, k)
+	}
+	return out
+}
+
+// Names returns the sorted names of kv.
+func (kv KV) Names() []string { return kv.SortedPairs().Names() }
+
+// Values returns the values of kv sorted by name.
+func (kv KV) Values() []string { return kv.SortedPairs().Values() }
+
+// Alert is a single alert as seen by notification templates.
+type Alert struct {
+	Status       string    `json:"status"`
+	Labels       KV        `json:"labels"`
+	Annotations  KV        `json:"annotations"`
+	StartsAt     time.Time `json:"startsAt"`
+	EndsAt       time.Time `json:"endsAt"`
+	GeneratorURL string    `json:"generatorURL"`
+	Fingerprint  string    `json:"fingerprint"`
+}
+
+// Alerts is a list of alerts.
+type Alerts []Alert
+
+// Firing returns the firing alerts.
+func (as Alerts) Firing() []Alert {
+	var out []Alert
+	for _, a := range as {
+		if a.Status == "firing" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// Resolved returns the resolved alerts.
+func (as Alerts) Resolved() []Alert {
+	var out []Alert
+	for _, a := range as {
+		if a.Status == "resolved" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// Data is the top-level value notification templates are executed with.
+type Data struct {
+	Receiver          string `json:"receiver"`
+	Status            string `json:"status"`
+	Alerts            Alerts `json:"alerts"`
+	GroupLabels       KV     `json:"groupLabels"`
+	CommonLabels      KV     `json:"commonLabels"`
+	CommonAnnotations KV     `json:"commonAnnotations"`
+	ExternalURL       string `json:"externalURL"`
+}
+
+// templateFuncs is the function set Alertmanager provides to templates.
+var templateFuncs = template.FuncMap{
+	"toUpper":   strings.ToUpper,
+	"toLower":   strings.ToLower,
+	"title":     strings.Title, //nolint:staticcheck // matches Alertmanager
+	"trimSpace": strings.TrimSpace,
+	"join": func(sep string, s []string) string {
+		return strings.Join(s, sep)
+	},
+	"match": regexp.MatchString,
+	"safeHtml": func(text string) htmltemplate.HTML {
+		return htmltemplate.HTML(text)
+	},
+	"safeUrl": func(text string) htmltemplate.URL {
+		return htmltemplate.URL(text)
+	},
+	"urlUnescape": url.QueryUnescape,
+	"reReplaceAll": func(pattern, repl, text string) string {
+		return regexp.MustCompile(pattern).ReplaceAllString(text, repl)
+	},
+	"stringSlice": func(s ...string) []string { return s },
+	"date": func(fmt string, t time.Time) string {
+		return t.Format(fmt)
+	},
+	"tz": func(name string, t time.Time) (time.Time, error) {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return t.In(loc), nil
+	},
+	"since": time.Since,
+	"humanizeDuration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+}
+
+// defaultTemplates provides the template names Alertmanager's integrations
+// use by default, so receivers that rely on them can be tested without the
+// templates shipped inside Alertmanager.
+const defaultTemplates = `
+{{ define "__alertmanager" }}Alertmanager{{ end }}
+{{ define "__alertmanagerURL" }}{{ .ExternalURL }}/#/alerts?receiver={{ .Receiver | urlquery }}{{ end }}
+{{ define "__subject" }}[{{ .Status | toUpper }}{{ if eq .Status "firing" }}:{{ .Alerts.Firing | len }}{{ end }}] {{ .GroupLabels.SortedPairs.Values | join " " }} {{ if gt (len .CommonLabels) (len .GroupLabels) }}({{ with .CommonLabels.Remove .GroupLabels.Names }}{{ .Values | join " " }}{{ end }}){{ end }}{{ end }}
+{{ define "__description" }}{{ end }}
+{{ define "__text_alert_list" }}{{ range . }}Labels:
+{{ range .Labels.SortedPairs }} - {{ .Name }} = {{ .Value }}
+{{ end }}Annotations:
+{{ range .Annotations.SortedPairs }} - {{ .Name }} = {{ .Value }}
+{{ end }}Source: {{ .GeneratorURL }}
+{{ end }}{{ end }}
+{{ define "slack.default.title" }}{{ template "__subject" . }}{{ end }}
+{{ define "slack.default.username" }}{{ template "__alertmanager" . }}{{ end }}
+{{ define "slack.default.fallback" }}{{ template "slack.default.title" . }} | {{ template "slack.default.titlelink" . }}{{ end }}
+{{ define "slack.default.callbackid" }}{{ end }}
+{{ define "slack.default.pretext" }}{{ end }}
+{{ define "slack.default.titlelink" }}{{ template "__alertmanagerURL" . }}{{ end }}
+{{ define "slack.default.iconemoji" }}{{ end }}
+{{ define "slack.default.iconurl" }}{{ end }}
+{{ define "slack.default.text" }}{{ end }}
+{{ define "slack.default.footer" }}{{ end }}
+{{ define "email.default.subject" }}{{ template "__subject" . }}{{ end }}
+{{ define "email.default.html" }}<html><body><h2>{{ template "__subject" . }}</h2><pre>{{ template "__text_alert_list" .Alerts }}</pre><p><a href="{{ template "__alertmanagerURL" . }}">View in {{ template "__alertmanager" . }}</a></p></body></html>{{ end }}
+`
+
+// newTemplate returns a template holding the default templates plus the
+// given template file contents.
+func newTemplate(files map[string]string) (*template.Template, error) {
+	tmpl, err := template.New("").Option("missingkey=zero").Funcs(templateFuncs).Parse(defaultTemplates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse default templates: %w", err)
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := tmpl.New(name).Parse(files[name]); err != nil {
+			return nil, fmt.Errorf("failed to parse template file %s: %w", name, err)
+		}
+	}
+	return tmpl, nil
+}
+
+// render executes text as a template against data, with access to every
+// template defined in tmpl.
+func render(tmpl *template.Template, text string, data *Data) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	t, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	t, err = t.New("").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %q: %w", text, err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to execute template %q: %w", text, err)
+	}
+	return b.String(), nil
+}
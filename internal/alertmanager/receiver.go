@@ -0,0 +1,574 @@
+package alertmanager
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/common"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// TestReceiverOptions configures a test notification.
+type TestReceiverOptions struct {
+	ConfigFile       string
+	Fragments        []string
+	TemplateDirs     []string
+	TemplatePatterns []string
+	TenantsDir       string // Optional directory of per-tenant overlay or values files
+	Tenant           string // Tenant whose generated config is used; required with TenantsDir
+	TempBaseDir      string
+	Receiver         string       // Name of the receiver to test
+	HTTPClient       *http.Client // Optional; defaults to a client with a 30s timeout
+}
+
+// IntegrationResult is the outcome of sending a test notification through
+// one integration of a receiver.
+type IntegrationResult struct {
+	Integration string // e.g. "webhook[0]"
+	Target      string // URL or address the notification was sent to
+	Status      string // HTTP status or SMTP outcome
+	Response    string // Response body, if any
+	Err         error
+	Skipped     bool // Integration type is not supported by test-receiver
+}
+
+// TestReceiver builds a synthetic alert and sends it through every
+// integration of the named receiver, using the same config, fragments and
+// templates the Alertmanager sync loads. It returns one result per
+// integration; an error is returned only when the receiver could not be
+// prepared.
+func TestReceiver(opts TestReceiverOptions) ([]IntegrationResult, error) {
+	log.Printf("Testing Alertmanager receiver %q from config %s", opts.Receiver, opts.ConfigFile)
+
+	syncTempDir := filepath.Join(opts.TempBaseDir, fmt.Sprintf("mal-sync-alertmanager-test-%d", os.Getpid()))
+	if err := common.EnsureDir(syncTempDir); err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory %s: %w", syncTempDir, err)
+	}
+	defer func() {
+		log.Printf("Cleaning up temporary directory: %s", syncTempDir)
+		if err := os.RemoveAll(syncTempDir); err != nil {
+			log.Printf("Warning: failed to clean up temporary directory %s: %v", syncTempDir, err)
+		}
+	}()
+
+	// 1. Build the effective config
+	config, err := effectiveConfig(opts, syncTempDir)
+	if err != nil {
+		return nil, err
+	}
+	var receiver *yamlnode.Node
+	for _, r := range config.Get("receivers").Items() {
+		if r.Get("name").Text() == opts.Receiver {
+			receiver = r
+			break
+		}
+	}
+	if receiver == nil {
+		return nil, fmt.Errorf("receiver %q not found in config %s", opts.Receiver, opts.ConfigFile)
+	}
+
+	// 2. Load templates
+	files := map[string]string{}
+	if len(opts.TemplateDirs) > 0 {
+		paths, err := collectTemplates(opts.TemplateDirs, opts.TemplatePatterns, syncTempDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read template file %s: %w", p, err)
+			}
+			files[filepath.Base(p)] = string(data)
+		}
+	}
+	tmpl, err := newTemplate(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Send the synthetic alert through each integration
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	n := &notifier{
+		global: config.Get("global"),
+		tmpl:   tmpl,
+		data:   testData(opts.Receiver),
+		client: httpClient,
+	}
+	var results []IntegrationResult
+	for _, key := range receiver.Keys() {
+		if !strings.HasSuffix(key, "_configs") {
+			continue
+		}
+		kind := strings.TrimSuffix(key, "_configs")
+		for i, cfg := range receiver.Get(key).Items() {
+			res := IntegrationResult{Integration: fmt.Sprintf("%s[%d]", kind, i)}
+			switch kind {
+			case "webhook":
+				n.webhook(cfg, &res)
+			case "slack":
+				n.slack(cfg, &res)
+			case "email":
+				n.email(cfg, &res)
+			default:
+				res.Skipped = true
+				res.Status = "integration type not supported by test-receiver"
+			}
+			results = append(results, res)
+		}
+	}
+	if len(results) == 0 {
+		log.Printf("Receiver %q has no integrations configured", opts.Receiver)
+	}
+	return results, nil
+}
+
+// effectiveConfig builds the config of the tenant being tested the same way
+// Sync does.
+func effectiveConfig(opts TestReceiverOptions, workDir string) (*yamlnode.Node, error) {
+	var fragmentFiles []string
+	if len(opts.Fragments) > 0 {
+		var err error
+		if fragmentFiles, err = ResolveFragments(opts.Fragments); err != nil {
+			return nil, err
+		}
+	}
+	tenant := Tenant{ID: opts.Tenant}
+	if opts.TenantsDir != "" {
+		tenants, err := ResolveTenants(opts.TenantsDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tenants {
+			if t.ID == opts.Tenant {
+				tenant = t
+			}
+		}
+		if tenant.File == "" {
+			return nil, fmt.Errorf("tenant %q has no file in %s", opts.Tenant, opts.TenantsDir)
+		}
+	}
+	config, err := BuildConfig(opts.ConfigFile, fragmentFiles, tenant, workDir)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := yamlnode.Parse(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse effective config: %w", err)
+	}
+	if len(docs) != 1 || docs[0].Kind != yamlnode.MappingNode {
+		return nil, fmt.Errorf("effective config of %s is not a single YAML mapping", opts.ConfigFile)
+	}
+	return docs[0], nil
+}
+
+// testData returns the template data of a single synthetic firing alert.
+func testData(receiver string) *Data {
+	now := time.Now().UTC()
+	labels := KV{"alertname": "MalSyncTestAlert", "severity": "info", "receiver": receiver}
+	annotations := KV{
+		"summary":     "Test notification from mal-sync",
+		"description": fmt.Sprintf("This is a test notification sent by mal-sync to receiver %q. It can be ignored.", receiver),
+	}
+	return &Data{
+		Receiver: receiver,
+		Status:   "firing",
+		Alerts: Alerts{{
+			Status:       "firing",
+			Labels:       labels,
+			Annotations:  annotations,
+			StartsAt:     now,
+			GeneratorURL: "http://mal-sync/test-receiver",
+			Fingerprint:  "0000000000000000",
+		}},
+		GroupLabels:       KV{"alertname": "MalSyncTestAlert"},
+		CommonLabels:      labels,
+		CommonAnnotations: annotations,
+		ExternalURL:       "http://mal-sync",
+	}
+}
+
+type notifier struct {
+	global *yamlnode.Node
+	tmpl   *template.Template
+	data   *Data
+	client *http.Client
+}
+
+// setting returns a config value, falling back to a global setting.
+func (n *notifier) setting(cfg *yamlnode.Node, key, globalKey string) string {
+	if v := cfg.Get(key).Text(); v != "" {
+		return v
+	}
+	if globalKey != "" {
+		return n.global.Get(globalKey).Text()
+	}
+	return ""
+}
+
+// secret returns a value given inline or through its *_file variant.
+func secret(cfg *yamlnode.Node, key string) (string, error) {
+	if v := cfg.Get(key).Text(); v != "" {
+		return v, nil
+	}
+	if file := cfg.Get(key + "_file").Text(); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_file %s: %w", key, file, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+func (n *notifier) post(res *IntegrationResult, cfg *yamlnode.Node, url string, payload any) {
+	res.Target = url
+	body, err := json.Marshal(payload)
+	if err != nil {
+		res.Err = fmt.Errorf("failed to encode payload: %w", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		res.Err = fmt.Errorf("failed to build request: %w", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mal-sync")
+	if httpConfig := cfg.Get("http_config"); httpConfig != nil {
+		if basic := httpConfig.Get("basic_auth"); basic != nil {
+			password, err := secret(basic, "password")
+			if err != nil {
+				res.Err = err
+				return
+			}
+			req.SetBasicAuth(basic.Get("username").Text(), password)
+		}
+		if auth := httpConfig.Get("authorization"); auth != nil {
+			credentials, err := secret(auth, "credentials")
+			if err != nil {
+				res.Err = err
+				return
+			}
+			scheme := auth.Get("type").Text()
+			if scheme == "" {
+				scheme = "Bearer"
+			}
+			req.Header.Set("Authorization", scheme+" "+credentials)
+		}
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		res.Err = fmt.Errorf("request failed: %w", err)
+		return
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	res.Status = resp.Status
+	res.Response = strings.TrimSpace(string(data))
+	if resp.StatusCode/100 != 2 {
+		res.Err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+func (n *notifier) webhook(cfg *yamlnode.Node, res *IntegrationResult) {
+	url, err := secret(cfg, "url")
+	if err != nil {
+		res.Err = err
+		return
+	}
+	if url == "" {
+		res.Err = fmt.Errorf("webhook config has no url")
+		return
+	}
+	payload := struct {
+		*Data
+		Version         string `json:"version"`
+		GroupKey        string `json:"groupKey"`
+		TruncatedAlerts int    `json:"truncatedAlerts"`
+	}{Data: n.data, Version: "4", GroupKey: `{}:{alertname="MalSyncTestAlert"}`}
+	n.post(res, cfg, url, payload)
+}
+
+func (n *notifier) slack(cfg *yamlnode.Node, res *IntegrationResult) {
+	url, err := secret(cfg, "api_url")
+	if err != nil {
+		res.Err = err
+		return
+	}
+	if url == "" {
+		if url, err = secret(n.global, "slack_api_url"); err != nil {
+			res.Err = err
+			return
+		}
+	}
+	if url == "" {
+		res.Err = fmt.Errorf("slack config has no api_url and no global slack_api_url is set")
+		return
+	}
+	field := func(key, def string) string {
+		text := cfg.Get(key).Text()
+		if cfg.Get(key) == nil {
+			text = def
+		}
+		if res.Err != nil {
+			return ""
+		}
+		out, err := render(n.tmpl, text, n.data)
+		if err != nil {
+			res.Err = fmt.Errorf("slack %s: %w", key, err)
+		}
+		return out
+	}
+	attachment := map[string]any{
+		"title":      field("title", `{{ template "slack.default.title" . }}`),
+		"title_link": field("title_link", `{{ template "slack.default.titlelink" . }}`),
+		"pretext":    field("pretext", `{{ template "slack.default.pretext" . }}`),
+		"text":       field("text", `{{ template "slack.default.text" . }}`),
+		"fallback":   field("fallback", `{{ template "slack.default.fallback" . }}`),
+		"footer":     field("footer", `{{ template "slack.default.footer" . }}`),
+		"color":      field("color", `{{ if eq .Status "firing" }}danger{{ else }}good{{ end }}`),
+		"mrkdwn_in":  []string{"fallback", "pretext", "text"},
+	}
+	payload := map[string]any{
+		"channel":     field("channel", ""),
+		"username":    field("username", `{{ template "slack.default.username" . }}`),
+		"icon_emoji":  field("icon_emoji", `{{ template "slack.default.iconemoji" . }}`),
+		"icon_url":    field("icon_url", `{{ template "slack.default.iconurl" . }}`),
+		"attachments": []any{attachment},
+	}
+	if res.Err != nil {
+		return
+	}
+	n.post(res, cfg, url, payload)
+}
+
+func (n *notifier) email(cfg *yamlnode.Node, res *IntegrationResult) {
+	smarthost := n.setting(cfg, "smarthost", "smtp_smarthost")
+	from := n.setting(cfg, "from", "smtp_from")
+	res.Target = smarthost
+	if smarthost == "" || from == "" {
+		res.Err = fmt.Errorf("email config needs smarthost and from (directly or via global smtp_smarthost/smtp_from)")
+		return
+	}
+	renderField := func(text string) string {
+		if res.Err != nil {
+			return ""
+		}
+		out, err := render(n.tmpl, text, n.data)
+		if err != nil {
+			res.Err = err
+		}
+		return out
+	}
+	to := renderField(cfg.Get("to").Text())
+	subject := `{{ template "email.default.subject" . }}`
+	if s := cfg.Get("headers").Get("Subject"); s != nil {
+		subject = s.Text()
+	}
+	subject = renderField(subject)
+	html := `{{ template "email.default.html" . }}`
+	if h := cfg.Get("html"); h != nil {
+		html = h.Text()
+	}
+	body := renderField(html)
+	contentType := "text/html"
+	if body == "" {
+		body = renderField(cfg.Get("text").Text())
+		contentType = "text/plain"
+	}
+	if res.Err != nil {
+		return
+	}
+	if to == "" {
+		res.Err = fmt.Errorf("email config has no recipient (to)")
+		return
+	}
+
+	username := n.setting(cfg, "auth_username", "smtp_auth_username")
+	password, err := secret(cfg, "auth_password")
+	if err == nil && password == "" {
+		password, err = secret(n.global, "smtp_auth_password")
+	}
+	if err != nil {
+		res.Err = err
+		return
+	}
+	_, port, err := net.SplitHostPort(smarthost)
+	if err != nil {
+		res.Err = fmt.Errorf("invalid smarthost %s: %w", smarthost, err)
+		return
+	}
+	tlsConf, err := tlsConfig(cfg.Get("tls_config"))
+	if err != nil {
+		res.Err = err
+		return
+	}
+	conf := smtpConfig{
+		smarthost:   smarthost,
+		username:    username,
+		password:    password,
+		implicitTLS: port == "465",
+		requireTLS:  n.setting(cfg, "require_tls", "smtp_require_tls") != "false",
+		tls:         tlsConf,
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: %s; charset=UTF-8\r\n\r\n%s\r\n",
+		from, to, subject, contentType, body)
+	if err := sendMail(conf, from, strings.Split(to, ","), []byte(msg)); err != nil {
+		res.Err = err
+		return
+	}
+	res.Status = "accepted by smarthost"
+}
+
+// tlsVersions are the values of min_version in a tls_config.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS settings of a tls_config block: ca, cert and
+// key, each inline or as a *_file, server_name, insecure_skip_verify and
+// min_version.
+func tlsConfig(cfg *yamlnode.Node) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: cfg.Get("server_name").Text()}
+	if v := cfg.Get("insecure_skip_verify").Text(); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("tls_config insecure_skip_verify must be true or false, got %q", v)
+		}
+		conf.InsecureSkipVerify = skip
+	}
+	if v := cfg.Get("min_version").Text(); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("tls_config min_version %q is not one of TLS10, TLS11, TLS12 or TLS13", v)
+		}
+		conf.MinVersion = version
+	}
+	ca, err := secret(cfg, "ca")
+	if err != nil {
+		return nil, err
+	}
+	if ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, fmt.Errorf("no certificates found in tls_config ca")
+		}
+		conf.RootCAs = pool
+	}
+	cert, err := secret(cfg, "cert")
+	if err != nil {
+		return nil, err
+	}
+	key, err := secret(cfg, "key")
+	if err != nil {
+		return nil, err
+	}
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("tls_config needs both a client cert and its key")
+	}
+	if cert != "" {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls_config client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
+
+// smtpConfig is how mail is sent through a smarthost.
+type smtpConfig struct {
+	smarthost   string
+	username    string
+	password    string
+	implicitTLS bool // TLS from the start, as Alertmanager uses on port 465
+	requireTLS  bool // STARTTLS, unless implicitTLS
+	tls         *tls.Config
+}
+
+// sendMail sends msg through a smarthost the way Alertmanager does: over
+// implicit TLS with implicitTLS, and otherwise upgraded with STARTTLS when
+// requireTLS is set.
+func sendMail(conf smtpConfig, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(conf.smarthost)
+	if err != nil {
+		return fmt.Errorf("invalid smarthost %s: %w", conf.smarthost, err)
+	}
+	tlsConf := conf.tls.Clone()
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = host
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	if conf.implicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", conf.smarthost, tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", conf.smarthost)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", conf.smarthost, err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to %s: %w", conf.smarthost, err)
+	}
+	defer c.Close()
+	if !conf.implicitTLS && conf.requireTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smarthost %s does not support STARTTLS and require_tls is set", conf.smarthost)
+		}
+		if err := c.StartTLS(tlsConf); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if conf.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", conf.username, conf.password, host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(strings.TrimSpace(rcpt)); err != nil {
+			return fmt.Errorf("RCPT TO %s failed: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message rejected: %w", err)
+	}
+	return c.Quit()
+}
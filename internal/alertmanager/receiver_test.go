@@ -0,0 +1,365 @@
+package alertmanager
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// testCert returns the certificate of httptest, valid for 127.0.0.1, and
+// its PEM encoding to trust it with.
+func testCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	return srv.TLS.Certificates[0], string(ca)
+}
+
+// fakeSMTP is a smarthost accepting every message.
+type fakeSMTP struct {
+	addr     string
+	tls      *tls.Config
+	startTLS bool // Offer STARTTLS
+
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	tls  bool // Received over TLS
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// startSMTP starts a smarthost, speaking TLS from the start with
+// implicitTLS.
+func startSMTP(t *testing.T, cert tls.Certificate, implicitTLS, startTLS bool) *fakeSMTP {
+	t.Helper()
+	s := &fakeSMTP{tls: &tls.Config{Certificates: []tls.Certificate{cert}}, startTLS: startTLS}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if implicitTLS {
+		l = tls.NewListener(l, s.tls)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.addr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, implicitTLS)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn, overTLS bool) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			tp.PrintfLine("250-fake")
+			if s.startTLS && !overTLS {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, overTLS = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			msg.auth = arg
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			msg.from = arg
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, arg)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			msg.data, msg.tls = string(data), overTLS
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func TestSendMail(t *testing.T) {
+	cert, ca := testCert(t)
+	tests := []struct {
+		name        string
+		implicitTLS bool // Of the smarthost and the config
+		startTLS    bool
+		requireTLS  bool
+		tlsConfig   string
+		wantTLS     bool
+		err         string
+	}{
+		{name: "STARTTLS", startTLS: true, requireTLS: true, tlsConfig: "ca: |\n" + indent(ca), wantTLS: true},
+		{name: "implicit TLS", implicitTLS: true, requireTLS: true, tlsConfig: "ca: |\n" + indent(ca), wantTLS: true},
+		{name: "implicit TLS without require_tls", implicitTLS: true, tlsConfig: "ca: |\n" + indent(ca), wantTLS: true},
+		{name: "insecure_skip_verify", startTLS: true, requireTLS: true, tlsConfig: "insecure_skip_verify: true\n", wantTLS: true},
+		{name: "plain without require_tls", startTLS: true},
+		{name: "untrusted certificate", startTLS: true, requireTLS: true, err: "STARTTLS failed"},
+		{name: "untrusted certificate, implicit TLS", implicitTLS: true, err: "failed to connect"},
+		{name: "wrong server_name", startTLS: true, requireTLS: true, tlsConfig: "server_name: mail.example.org\nca: |\n" + indent(ca), err: "mail.example.org"},
+		{name: "STARTTLS not offered", requireTLS: true, err: "does not support STARTTLS and require_tls is set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			smtpServer := startSMTP(t, cert, tt.implicitTLS, tt.startTLS)
+			tlsConf := &tls.Config{}
+			if tt.tlsConfig != "" {
+				var err error
+				if tlsConf, err = tlsConfig(parseNode(t, tt.tlsConfig)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conf := smtpConfig{
+				smarthost:   smtpServer.addr,
+				username:    "user",
+				password:    "secret",
+				implicitTLS: tt.implicitTLS,
+				requireTLS:  tt.requireTLS,
+				tls:         tlsConf,
+			}
+			err := sendMail(conf, "am@example.com", []string{"a@example.com", " b@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("sendMail error = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := smtpServer.received()
+			if len(msgs) != 1 {
+				t.Fatalf("smarthost received %d messages, want 1", len(msgs))
+			}
+			m := msgs[0]
+			if m.tls != tt.wantTLS {
+				t.Errorf("message sent over TLS = %v, want %v", m.tls, tt.wantTLS)
+			}
+			if m.from != "FROM:<am@example.com>" || strings.Join(m.to, ",") != "TO:<a@example.com>,TO:<b@example.com>" {
+				t.Errorf("envelope from %q to %q", m.from, m.to)
+			}
+			if !strings.HasPrefix(m.auth, "PLAIN ") {
+				t.Errorf("AUTH %q, want PLAIN", m.auth)
+			}
+			if m.data != "Subject: test\n\nbody\n" {
+				t.Errorf("message data %q", m.data)
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	_, ca := testCert(t)
+	dir := writeFiles(t, map[string]string{"ca.pem": ca, "cert.pem": "not a certificate", "key.pem": "not a key"})
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{name: "empty", config: "{}"},
+		{name: "ca_file", config: "ca_file: " + filepath.Join(dir, "ca.pem")},
+		{name: "min_version", config: "min_version: TLS12"},
+		{name: "missing ca_file", config: "ca_file: " + filepath.Join(dir, "missing.pem"), err: "failed to read ca_file"},
+		{name: "no certificate in ca", config: "ca: nothing", err: "no certificates found in tls_config ca"},
+		{name: "cert without key", config: "cert_file: " + filepath.Join(dir, "cert.pem"), err: "needs both a client cert and its key"},
+		{name: "invalid client certificate", config: "cert_file: " + filepath.Join(dir, "cert.pem") + "\nkey_file: " + filepath.Join(dir, "key.pem"), err: "invalid tls_config client certificate"},
+		{name: "invalid min_version", config: "min_version: TLS9", err: `min_version "TLS9" is not one of`},
+		{name: "invalid insecure_skip_verify", config: "insecure_skip_verify: maybe", err: "insecure_skip_verify must be true or false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := tlsConfig(parseNode(t, tt.config))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("tlsConfig: %v", err)
+				}
+				if strings.HasPrefix(tt.config, "ca_file") && conf.RootCAs == nil {
+					t.Error("ca_file did not set the root CAs")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("tlsConfig error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTestReceiver(t *testing.T) {
+	cert, ca := testCert(t)
+	smtpServer := startSMTP(t, cert, false, true)
+	var mu sync.Mutex
+	requests := map[string]map[string]any{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests[r.URL.Path] = body
+		mu.Unlock()
+		if r.URL.Path == "/webhook" {
+			if user, pass, _ := r.BasicAuth(); user != "am" || pass != "secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.URL.Path == "/failing" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer hook.Close()
+
+	dir := writeFiles(t, map[string]string{
+		"ca.pem":               ca,
+		"templates/title.tmpl": `{{ define "custom.title" }}[{{ .Status | toUpper }}] {{ .CommonLabels.alertname }}{{ end }}`,
+	})
+	config := `global:
+  smtp_from: alertmanager@example.com
+route:
+  receiver: team
+receivers:
+  - name: team
+    webhook_configs:
+      - url: ` + hook.URL + `/webhook
+        http_config:
+          basic_auth:
+            username: am
+            password: secret
+      - url: ` + hook.URL + `/failing
+    slack_configs:
+      - api_url: ` + hook.URL + `/slack
+        channel: '#alerts'
+        title: '{{ template "custom.title" . }}'
+    email_configs:
+      - to: team@example.com
+        smarthost: ` + smtpServer.addr + `
+        tls_config:
+          ca_file: ` + filepath.Join(dir, "ca.pem") + `
+    pagerduty_configs:
+      - routing_key: x
+templates: ['*.tmpl']
+`
+	if err := os.WriteFile(filepath.Join(dir, "alertmanager.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	results, err := TestReceiver(TestReceiverOptions{
+		ConfigFile:   filepath.Join(dir, "alertmanager.yaml"),
+		TemplateDirs: []string{filepath.Join(dir, "templates")},
+		TempBaseDir:  t.TempDir(),
+		Receiver:     "team",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		outcome := "ok"
+		switch {
+		case r.Skipped:
+			outcome = "skipped"
+		case r.Err != nil:
+			outcome = "error: " + r.Err.Error()
+		}
+		got = append(got, r.Integration+" "+outcome)
+	}
+	want := []string{
+		"webhook[0] ok",
+		"webhook[1] error: unexpected status 500 Internal Server Error",
+		"slack[0] ok",
+		"email[0] ok",
+		"pagerduty[0] skipped",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("results:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if payload := requests["/webhook"]; payload["version"] != "4" || payload["receiver"] != "team" {
+		t.Errorf("webhook payload %v", payload)
+	}
+	slack := requests["/slack"]
+	if slack["channel"] != "#alerts" {
+		t.Errorf("slack channel %v", slack["channel"])
+	}
+	if title := slack["attachments"].([]any)[0].(map[string]any)["title"]; title != "[FIRING] MalSyncTestAlert" {
+		t.Errorf("slack title %q", title)
+	}
+	msgs := smtpServer.received()
+	if len(msgs) != 1 || !msgs[0].tls || !strings.Contains(msgs[0].data, "To: team@example.com") {
+		t.Errorf("smarthost received %+v", msgs)
+	}
+}
+
+// parseNode parses a YAML mapping.
+func parseNode(t *testing.T, text string) *yamlnode.Node {
+	t.Helper()
+	docs, err := yamlnode.Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return docs[0]
+}
+
+// indent indents every line of text by two spaces, to nest it in a YAML
+// literal block.
+func indent(text string) string {
+	return "  " + strings.ReplaceAll(strings.TrimSpace(text), "\n", "\n  ") + "\n"
+}
@@ -5,21 +5,56 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/antnsn/mal-sync/internal/common" // Adjusted import path
+	"github.com/antnsn/mal-sync/internal/limits"
+	"github.com/antnsn/mal-sync/internal/source"
+	"github.com/antnsn/mal-sync/internal/state"
 )
 
 const (
 	mimirtoolCmd = "mimirtool" // Assuming mimirtool is in PATH
 )
 
-// Sync performs the Alertmanager synchronization.
-func Sync(configFile, templatesDir, mimirAddress, mimirID, tempBaseDir string) error {
-	log.Printf("Starting Alertmanager sync for Mimir instance: %s (ID: %s)", mimirAddress, mimirID)
+// Options configures an Alertmanager sync.
+type Options struct {
+	ConfigFile       string   // Base Alertmanager configuration file, or a template base when it ends in .tmpl
+	Fragments        []string // Fragment files or directories merged into ConfigFile
+	MergedOutput     string   // Optional path the merged configuration is written to; a directory when TenantsDir is set
+	TemplateDirs     []string // Directories walked recursively for template files
+	TemplatePatterns []string // File name globs selecting templates; DefaultTemplatePatterns when empty
+	TenantsDir       string   // Optional directory of per-tenant overlay or values files; overrides MimirID
+	MimirAddress     string
+	MimirID          string
+	Limits           limits.Limits    // Alertmanager limits of every tenant; zero values are unlimited
+	RuntimeConfig    string           // Optional runtime config file with per-tenant limit overrides
+	Artifacts        source.Artifacts // Fetches ConfigFile and TemplateDirs that are URLs or bundles
+	State            state.Store      // Content hashes of the last successful sync; unchanged tenant configs are not loaded when set
+	TempBaseDir      string
+}
+
+// tenantConfig is the effective config generated for one tenant.
+type tenantConfig struct {
+	id   string
+	file string // staged config file
+}
+
+// Sync performs the Alertmanager synchronization. With TenantsDir set, one
+// config is generated per tenant file and every config is verified before
+// any of them is loaded.
+func Sync(opts Options) error {
+	configFile, templateDirs := opts.ConfigFile, opts.TemplateDirs
+	mimirAddress, mimirID, tempBaseDir := opts.MimirAddress, opts.MimirID, opts.TempBaseDir
+
+	if opts.TenantsDir != "" {
+		log.Printf("Starting Alertmanager sync for Mimir instance: %s (tenants from %s)", mimirAddress, opts.TenantsDir)
+	} else {
+		log.Printf("Starting Alertmanager sync for Mimir instance: %s (ID: %s)", mimirAddress, mimirID)
+	}
 	log.Printf("Config file: %s", configFile)
-	if templatesDir != "" {
-		log.Printf("Templates directory: %s", templatesDir)
+	if len(templateDirs) > 0 {
+		log.Printf("Templates directories: %v", templateDirs)
 	}
 
 	// 1. Prepare temporary directory for this sync operation
@@ -35,69 +70,198 @@ func Sync(configFile, templatesDir, mimirAddress, mimirID, tempBaseDir string) e
 	}()
 	log.Printf("Using temporary directory: %s", syncTempDir)
 
-	// 2. Copy main config file to temporary location (snapshot)
-	tempConfigFile := filepath.Join(syncTempDir, "alertmanager-config.yml")
-	log.Printf("Copying main config file %s to %s", configFile, tempConfigFile)
-	if err := common.CopyFile(configFile, tempConfigFile); err != nil {
-		return fmt.Errorf("failed to copy config file %s to %s: %w", configFile, tempConfigFile, err)
+	// 2. Build the config of each tenant in the temporary location
+	// (snapshot), fetching URLs and extracting bundles of the config and
+	// templates and merging in any fragments and tenant overlays first
+	artifactsDir := filepath.Join(syncTempDir, "artifacts")
+	configFile, err := opts.Artifacts.Resolve(configFile, artifactsDir)
+	if err != nil {
+		return err
+	}
+	templateDirs = append([]string(nil), templateDirs...)
+	for i, dir := range templateDirs {
+		if templateDirs[i], err = opts.Artifacts.Resolve(dir, artifactsDir); err != nil {
+			return err
+		}
+	}
+	var fragmentFiles []string
+	if len(opts.Fragments) > 0 {
+		var err error
+		if fragmentFiles, err = ResolveFragments(opts.Fragments); err != nil {
+			return err
+		}
+		log.Printf("Merging %d config fragment(s) into %s", len(fragmentFiles), configFile)
+	}
+	tenants := []Tenant{{ID: mimirID}}
+	if opts.TenantsDir != "" {
+		var err error
+		if tenants, err = ResolveTenants(opts.TenantsDir); err != nil {
+			return err
+		}
+		if len(tenants) == 0 {
+			return fmt.Errorf("no tenant files (*.yaml, *.yml) found in %s", opts.TenantsDir)
+		}
+		if opts.MergedOutput != "" {
+			if err := common.EnsureDir(opts.MergedOutput); err != nil {
+				return err
+			}
+		}
+	}
+
+	var configs []tenantConfig
+	for _, tenant := range tenants {
+		tenantDir := filepath.Join(syncTempDir, "tenants", tenant.ID)
+		if err := common.EnsureDir(tenantDir); err != nil {
+			return fmt.Errorf("failed to create temporary directory %s: %w", tenantDir, err)
+		}
+		tempConfigFile := filepath.Join(tenantDir, "alertmanager-config.yml")
+		if tenant.File == "" && len(fragmentFiles) == 0 && !IsTemplateConfig(configFile) {
+			log.Printf("Copying main config file %s to %s", configFile, tempConfigFile)
+			if err := common.CopyFile(configFile, tempConfigFile); err != nil {
+				return fmt.Errorf("failed to copy config file %s to %s: %w", configFile, tempConfigFile, err)
+			}
+			configs = append(configs, tenantConfig{id: tenant.ID, file: tempConfigFile})
+			continue
+		}
+		if tenant.File != "" {
+			log.Printf("Generating Alertmanager config for tenant %s from %s", tenant.ID, tenant.File)
+		}
+		config, err := BuildConfig(configFile, fragmentFiles, tenant, tenantDir)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(tempConfigFile, config, 0640); err != nil {
+			return fmt.Errorf("failed to write merged config to %s: %w", tempConfigFile, err)
+		}
+		if opts.MergedOutput != "" {
+			output := opts.MergedOutput
+			if opts.TenantsDir != "" {
+				output = filepath.Join(opts.MergedOutput, tenant.ID+".yaml")
+			}
+			log.Printf("Writing merged Alertmanager config to %s", output)
+			if err := os.WriteFile(output, config, 0640); err != nil {
+				return fmt.Errorf("failed to write merged config to %s: %w", output, err)
+			}
+		}
+		configs = append(configs, tenantConfig{id: tenant.ID, file: tempConfigFile})
 	}
 
-	// 3. Verify the temporary config file
-	log.Printf("Verifying Alertmanager config: %s", tempConfigFile)
-	verifyArgs := []string{"alertmanager", "verify", tempConfigFile}
-	if output, err := common.ExecuteCommand(mimirtoolCmd, verifyArgs...); err != nil {
-		return fmt.Errorf("Alertmanager config verification failed for %s: %w\nOutput:\n%s", tempConfigFile, err, output)
+	// 3. Verify the temporary config files
+	for _, c := range configs {
+		log.Printf("Verifying Alertmanager config for tenant %s: %s", c.id, c.file)
+		verifyArgs := []string{"alertmanager", "verify", c.file}
+		if output, err := common.ExecuteCommand(mimirtoolCmd, verifyArgs...); err != nil {
+			return fmt.Errorf("Alertmanager config verification failed for tenant %s (%s): %w\nOutput:\n%s", c.id, c.file, err, output)
+		}
 	}
-	log.Println("Alertmanager config verified successfully.")
+	log.Printf("Alertmanager config verified successfully for %d tenant(s).", len(configs))
 
 	// 4. Handle templates
 	var templateFileArgs []string
-	if templatesDir != "" {
+	if len(templateDirs) > 0 {
 		tempTemplatesDir := filepath.Join(syncTempDir, "templates")
 		if err := common.EnsureDir(tempTemplatesDir); err != nil {
 			return fmt.Errorf("failed to create temporary templates directory %s: %w", tempTemplatesDir, err)
 		}
-		log.Printf("Processing templates from %s, copying to %s", templatesDir, tempTemplatesDir)
-
-		entries, err := os.ReadDir(templatesDir)
+		files, err := collectTemplates(templateDirs, opts.TemplatePatterns, tempTemplatesDir)
 		if err != nil {
-			log.Printf("Warning: could not read templates directory %s: %v. Proceeding without templates.", templatesDir, err)
+			return err
+		}
+		templateFileArgs = files
+		if len(templateFileArgs) == 0 {
+			log.Printf("No template files found in %v", templateDirs)
 		} else {
-			foundTemplates := false
-			for _, entry := range entries {
-				if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".tmpl") {
-					srcPath := filepath.Join(templatesDir, entry.Name())
-					dstPath := filepath.Join(tempTemplatesDir, entry.Name())
-					log.Printf("Copying template %s to %s", srcPath, dstPath)
-					if err := common.CopyFile(srcPath, dstPath); err != nil {
-						return fmt.Errorf("failed to copy template file %s to %s: %w", srcPath, dstPath, err)
-					}
-					templateFileArgs = append(templateFileArgs, dstPath)
-					foundTemplates = true
-				}
+			log.Printf("Copied %d template(s) to %s", len(templateFileArgs), tempTemplatesDir)
+		}
+	}
+	log.Println("Checking Alertmanager templates...")
+	for _, c := range configs {
+		if err := checkTemplates(c.file, templateFileArgs); err != nil {
+			return fmt.Errorf("Alertmanager template check failed for tenant %s: %w", c.id, err)
+		}
+	}
+
+	// 5. Check the configs and templates against each tenant's limits
+	for _, c := range configs {
+		if err := limits.EnforceAlertmanager(opts.Limits, opts.RuntimeConfig, c.id, c.file, templateFileArgs); err != nil {
+			return err
+		}
+	}
+
+	// 6. Load the Alertmanager configuration and templates into Mimir,
+	// skipping tenants whose config and templates are unchanged since their
+	// last successful sync unless it is time to verify them
+	loaded := 0
+	for _, c := range configs {
+		var last *state.Target
+		var hash string
+		target := "alertmanager " + mimirAddress + " " + c.id
+		verify := true
+		if opts.State.Enabled() {
+			files := append([]string{c.file}, templateFileArgs...)
+			names := make([]string, len(files))
+			for i, f := range files {
+				names[i] = filepath.Base(f)
+			}
+			if hash, err = state.HashFiles(names, files); err != nil {
+				return err
+			}
+			if last, err = opts.State.Load(target); err != nil {
+				return err
+			}
+			if verify = opts.State.Due(last); !verify && last.Hashes[c.id] == hash {
+				log.Printf("Alertmanager config of tenant %s is unchanged since the last sync, skipping", c.id)
+				continue
 			}
-			if !foundTemplates {
-				log.Printf("No .tmpl files found in %s", templatesDir)
-			} else {
-				log.Printf("Copied %d template(s) to %s", len(templateFileArgs), tempTemplatesDir)
+			if verify {
+				log.Printf("Loading the Alertmanager config of tenant %s to verify it in Mimir", c.id)
+			}
+		}
+		loaded++
+		log.Printf("Loading Alertmanager config and templates into Mimir for tenant %s...", c.id)
+		loadArgs := []string{
+			"alertmanager",
+			"load",
+			c.file, // The staged config file of the tenant
+		}
+		loadArgs = append(loadArgs, templateFileArgs...) // Add copied template files
+		loadArgs = append(loadArgs, "--address="+mimirAddress, "--id="+c.id)
+
+		if output, err := common.ExecuteCommand(mimirtoolCmd, loadArgs...); err != nil {
+			return fmt.Errorf("failed to load Alertmanager config to Mimir for tenant %s: %w\nOutput:\n%s", c.id, err, output)
+		}
+
+		if opts.State.Enabled() {
+			next := &state.Target{Verified: last.Verified, Hashes: map[string]string{}}
+			for id, h := range last.Hashes {
+				next.Hashes[id] = h
+			}
+			next.Hashes[c.id] = hash
+			if verify {
+				next.Verified = time.Now().UTC()
+			}
+			if err := opts.State.Save(target, next); err != nil {
+				return err
 			}
 		}
 	}
 
-	// 5. Load the Alertmanager configuration and templates into Mimir
-	log.Println("Loading Alertmanager config and templates into Mimir...")
-	loadArgs := []string{
+	log.Printf("Alertmanager configuration and templates loaded successfully for %d of %d tenant(s).", loaded, len(configs))
+	return nil
+}
+
+// Delete removes the Alertmanager config and templates of tenant MimirID
+// from Mimir, such as once nothing declares a config for it anymore.
+func Delete(opts Options) error {
+	log.Printf("Deleting Alertmanager config of tenant %s from Mimir instance: %s", opts.MimirID, opts.MimirAddress)
+	deleteArgs := []string{
 		"alertmanager",
-		"load",
-		tempConfigFile, // The copied main config file
+		"delete",
+		"--address=" + opts.MimirAddress,
+		"--id=" + opts.MimirID,
 	}
-	loadArgs = append(loadArgs, templateFileArgs...) // Add copied template files
-	loadArgs = append(loadArgs, "--address="+mimirAddress, "--id="+mimirID)
-
-	if output, err := common.ExecuteCommand(mimirtoolCmd, loadArgs...); err != nil {
-		return fmt.Errorf("failed to load Alertmanager config to Mimir: %w\nOutput:\n%s", err, output)
+	if output, err := common.ExecuteCommand(mimirtoolCmd, deleteArgs...); err != nil {
+		return fmt.Errorf("failed to delete Alertmanager config of tenant %s from Mimir: %w\nOutput:\n%s", opts.MimirID, err, output)
 	}
-
-	log.Println("Alertmanager configuration and templates loaded successfully.")
 	return nil
 }
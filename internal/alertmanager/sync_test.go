@@ -0,0 +1,112 @@
+package alertmanager
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/state"
+)
+
+// fakeMimirtool puts a mimirtool on PATH that succeeds and appends its
+// arguments to a log, and returns a function reading and clearing the log.
+func fakeMimirtool(t *testing.T) func() []string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mimirtool is a shell script")
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "mimirtool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() []string {
+		t.Helper()
+		data, err := os.ReadFile(calls)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(calls)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// loadedTenants returns the tenants of the "alertmanager load" calls.
+func loadedTenants(calls []string) []string {
+	var tenants []string
+	for _, c := range calls {
+		if strings.HasPrefix(c, "alertmanager load ") {
+			tenants = append(tenants, c[strings.LastIndex(c, "--id=")+len("--id="):])
+		}
+	}
+	return tenants
+}
+
+func TestSyncState(t *testing.T) {
+	calls := fakeMimirtool(t)
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":      baseConfig,
+		"tenants/a.yaml": "{}",
+		"tenants/b.yaml": "{}",
+	})
+	store := state.Store{Path: filepath.Join(dir, "state.json"), VerifyInterval: time.Hour}
+	opts := Options{
+		ConfigFile:   filepath.Join(dir, "base.yaml"),
+		TenantsDir:   filepath.Join(dir, "tenants"),
+		MimirAddress: "http://mimir",
+		State:        store,
+		TempBaseDir:  t.TempDir(),
+	}
+	sync := func(want string) {
+		t.Helper()
+		if err := Sync(opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(loadedTenants(calls()), ","); got != want {
+			t.Errorf("loaded tenants %q, want %q", got, want)
+		}
+	}
+
+	sync("a,b")
+	sync("")
+
+	// Only the changed tenant is loaded, and the other keeps its state
+	if err := os.WriteFile(filepath.Join(dir, "tenants", "b.yaml"), []byte("global:\n  resolve_timeout: 1m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := store.Load("alertmanager http://mimir a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync("b")
+	after, err := store.Load("alertmanager http://mimir a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Verified.Equal(before.Verified) || after.Hashes["a"] == "" || after.Hashes["a"] != before.Hashes["a"] {
+		t.Errorf("state of tenant a changed from %+v to %+v", before, after)
+	}
+
+	// Each tenant is verified on its own schedule
+	after.Verified = time.Now().Add(-2 * time.Hour)
+	if err := store.Save("alertmanager http://mimir a", after); err != nil {
+		t.Fatal(err)
+	}
+	sync("a")
+	a, err := store.Load("alertmanager http://mimir a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(a.Verified) > time.Minute || a.Hashes["a"] != after.Hashes["a"] {
+		t.Errorf("state of tenant a after verification = %+v", a)
+	}
+	sync("")
+}
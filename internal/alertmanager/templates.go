@@ -0,0 +1,155 @@
+package alertmanager
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template/parse"
+
+	"github.com/antnsn/mal-sync/internal/common"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// DefaultTemplatePatterns are the file name globs used to pick template files
+// when none are configured.
+var DefaultTemplatePatterns = []string{"*.tmpl"}
+
+// collectTemplates walks every template directory recursively, skipping
+// hidden directories, and copies the files whose base name matches one of
+// patterns into dstDir. Mimir stores
+// templates by file name, so two files with the same base name are an error
+// even when they live in different directories.
+func collectTemplates(dirs, patterns []string, dstDir string) ([]string, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultTemplatePatterns
+	}
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid template pattern %q: %w", pattern, err)
+		}
+	}
+
+	sources := map[string]string{} // base name -> source path
+	var names []string
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat templates directory %s: %w", dir, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("templates directory %s is not a directory", dir)
+		}
+		log.Printf("Processing templates from %s (patterns: %v)", dir, patterns)
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed to walk templates directory %s: %w", dir, err)
+			}
+			if d.IsDir() {
+				// Hidden directories are skipped, such as the ..data and
+				// ..<timestamp> directories of a mounted ConfigMap, whose
+				// files are also linked from the directory itself
+				if path != dir && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !matchesAny(d.Name(), patterns) {
+				return nil
+			}
+			if prev, dup := sources[d.Name()]; dup {
+				return fmt.Errorf("template file name %s is used by both %s and %s; template names must be unique", d.Name(), prev, path)
+			}
+			sources[d.Name()] = path
+			names = append(names, d.Name())
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(names)
+	var files []string
+	for _, name := range names {
+		srcPath := sources[name]
+		dstPath := filepath.Join(dstDir, name)
+		log.Printf("Copying template %s to %s", srcPath, dstPath)
+		if err := common.CopyFile(srcPath, dstPath); err != nil {
+			return nil, fmt.Errorf("failed to copy template file %s to %s: %w", srcPath, dstPath, err)
+		}
+		files = append(files, dstPath)
+	}
+	return files, nil
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTemplates verifies that every glob in the config's "templates" list
+// matches at least one template file, and that no two template files define
+// the same named template.
+func checkTemplates(configFile string, templateFiles []string) error {
+	docs, err := yamlnode.ParseFile(configFile)
+	if err != nil {
+		return err
+	}
+	var globs []*yamlnode.Node
+	if len(docs) > 0 {
+		globs = docs[0].Get("templates").Items()
+	}
+	for _, g := range globs {
+		// Mimir places all templates of a tenant in one directory, so only
+		// the base name of each configured glob is significant.
+		pattern := filepath.Base(g.Text())
+		matched := false
+		for _, f := range templateFiles {
+			if ok, err := filepath.Match(pattern, filepath.Base(f)); err != nil {
+				return fmt.Errorf("invalid templates glob %q in config (line %d): %w", g.Text(), g.Line, err)
+			} else if ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("templates glob %q in config (line %d) does not match any uploaded template file", g.Text(), g.Line)
+		}
+	}
+
+	defined := map[string]string{} // template name -> file
+	for _, f := range templateFiles {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("failed to read template file %s: %w", f, err)
+		}
+		t := parse.New(filepath.Base(f))
+		t.Mode = parse.SkipFuncCheck
+		trees := map[string]*parse.Tree{}
+		if _, err := t.Parse(string(data), "{{", "}}", trees); err != nil {
+			return fmt.Errorf("failed to parse template file %s: %w", filepath.Base(f), err)
+		}
+		var names []string
+		for name := range trees {
+			if name != filepath.Base(f) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prev, dup := defined[name]; dup {
+				return fmt.Errorf("template %q is defined in both %s and %s", name, prev, filepath.Base(f))
+			}
+			defined[name] = filepath.Base(f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package alertmanager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mountConfigMap lays out files the way the kubelet mounts a ConfigMap:
+// the files live in a timestamped directory, ..data links to it, and each
+// file is linked from the mount directory through ..data.
+func mountConfigMap(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	data := filepath.Join(dir, "..2026_10_18_20_00_00.123456789")
+	if err := os.MkdirAll(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(data, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Base(data), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectTemplatesConfigMapMount(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tpl")
+	mountConfigMap(t, dir, map[string]string{
+		"foo.tmpl": `{{ define "foo" }}foo{{ end }}`,
+		"bar.tmpl": `{{ define "bar" }}bar{{ end }}`,
+	})
+	dst := t.TempDir()
+	files, err := collectTemplates([]string{dir}, nil, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dst, "bar.tmpl"), filepath.Join(dst, "foo.tmpl")}
+	if strings.Join(files, ",") != strings.Join(want, ",") {
+		t.Fatalf("collectTemplates = %v, want %v", files, want)
+	}
+	data, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{{ define "foo" }}foo{{ end }}` {
+		t.Errorf("copied foo.tmpl = %q", data)
+	}
+}
+
+func TestCollectTemplates(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a/slack.tmpl":       `{{ define "slack.title" }}x{{ end }}`,
+		"a/nested/mail.html": `{{ define "mail.body" }}x{{ end }}`,
+		"b/pager.tmpl":       `{{ define "pager" }}x{{ end }}`,
+		"b/notes.txt":        "not a template",
+		"b/.git/x.tmpl":      "hidden",
+	})
+	dst := t.TempDir()
+	files, err := collectTemplates([]string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}, []string{"*.tmpl", "*.html"}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	if got := strings.Join(names, ","); got != "mail.html,pager.tmpl,slack.tmpl" {
+		t.Errorf("collectTemplates copied %s, want mail.html,pager.tmpl,slack.tmpl", got)
+	}
+}
+
+func TestCollectTemplatesErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a/x.tmpl":     "a",
+		"a/sub/x.tmpl": "b",
+	})
+	tests := []struct {
+		name     string
+		dirs     []string
+		patterns []string
+		err      string
+	}{
+		{"duplicate name", []string{filepath.Join(dir, "a")}, nil, "template file name x.tmpl is used by both"},
+		{"missing directory", []string{filepath.Join(dir, "missing")}, nil, "failed to stat templates directory"},
+		{"file instead of directory", []string{filepath.Join(dir, "a/x.tmpl")}, nil, "is not a directory"},
+		{"invalid pattern", []string{filepath.Join(dir, "a")}, []string{"[x"}, `invalid template pattern "[x"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := collectTemplates(tt.dirs, tt.patterns, t.TempDir())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("collectTemplates error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckTemplates(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		files  map[string]string
+		err    string
+	}{
+		{
+			name:   "globs match",
+			config: "templates: ['/etc/alertmanager/templates/*.tmpl']\n",
+			files:  map[string]string{"a.tmpl": `{{ define "a" }}{{ end }}`, "b.tmpl": `{{ define "b" }}{{ end }}`},
+		},
+		{
+			name:   "glob without match",
+			config: "templates: ['*.tmpl', '*.html']\n",
+			files:  map[string]string{"a.tmpl": `{{ define "a" }}{{ end }}`},
+			err:    `templates glob "*.html" in config (line 1) does not match any uploaded template file`,
+		},
+		{
+			name:   "duplicate define",
+			config: "templates: ['*.tmpl']\n",
+			files:  map[string]string{"a.tmpl": `{{ define "title" }}a{{ end }}`, "b.tmpl": `{{ define "title" }}b{{ end }}`},
+			err:    `template "title" is defined in both a.tmpl and b.tmpl`,
+		},
+		{
+			name:   "syntax error",
+			config: "templates: ['*.tmpl']\n",
+			files:  map[string]string{"a.tmpl": `{{ define "a" }}{{ end`},
+			err:    "failed to parse template file a.tmpl",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.files["alertmanager.yaml"] = tt.config
+			dir := writeFiles(t, tt.files)
+			var templates []string
+			for name := range tt.files {
+				if name != "alertmanager.yaml" {
+					templates = append(templates, filepath.Join(dir, name))
+				}
+			}
+			// Sorted, as collectTemplates returns them
+			if len(templates) == 2 && templates[0] > templates[1] {
+				templates[0], templates[1] = templates[1], templates[0]
+			}
+			err := checkTemplates(filepath.Join(dir, "alertmanager.yaml"), templates)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("checkTemplates: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("checkTemplates error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package alertmanager
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// Tenant is a tenant whose Alertmanager config is generated from the shared
+// base config and the tenant's own overlay or values file.
+type Tenant struct {
+	ID   string // Mimir tenant ID, taken from the file name
+	File string // Overlay or values file
+}
+
+// ResolveTenants lists the tenants of a tenants directory: every *.yaml or
+// *.yml file is one tenant, named after the file without its extension.
+func ResolveTenants(dir string) ([]Tenant, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants directory %s: %w", dir, err)
+	}
+	var tenants []Tenant
+	seen := map[string]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		t := Tenant{ID: strings.TrimSuffix(name, ext), File: filepath.Join(dir, name)}
+		if prev, dup := seen[t.ID]; dup {
+			return nil, fmt.Errorf("tenant %q is defined by both %s and %s", t.ID, prev, t.File)
+		}
+		seen[t.ID] = t.File
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, nil
+}
+
+// IsTemplateConfig reports whether a base config is a Go template rendered
+// with per-tenant values rather than a plain config that overlays apply to.
+func IsTemplateConfig(configFile string) bool {
+	return strings.HasSuffix(configFile, ".tmpl")
+}
+
+// BuildConfig returns the effective config of a tenant. A template base is
+// rendered with the tenant's values file first; config fragments are then
+// merged in, and for a plain base the tenant's overlay is applied last. An
+// empty tenant file builds the base config with its fragments only. workDir
+// receives intermediate files.
+func BuildConfig(configFile string, fragmentFiles []string, tenant Tenant, workDir string) ([]byte, error) {
+	baseFile := configFile
+	if IsTemplateConfig(configFile) {
+		rendered, err := renderConfigTemplate(configFile, tenant)
+		if err != nil {
+			return nil, err
+		}
+		baseFile = filepath.Join(workDir, "base.yml")
+		if err := os.WriteFile(baseFile, rendered, 0640); err != nil {
+			return nil, fmt.Errorf("failed to write rendered config to %s: %w", baseFile, err)
+		}
+		if len(fragmentFiles) == 0 {
+			if _, err := loadMapping(baseFile); err != nil {
+				return nil, fmt.Errorf("rendered config of tenant %s is not valid YAML: %w", tenant.ID, err)
+			}
+			return rendered, nil
+		}
+	}
+
+	var config *yamlnode.Node
+	if len(fragmentFiles) > 0 {
+		merged, err := MergeConfigs(baseFile, fragmentFiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge Alertmanager config fragments: %w", err)
+		}
+		docs, err := yamlnode.Parse(merged)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse merged config: %w", err)
+		}
+		config = docs[0]
+	} else {
+		var err error
+		if config, err = loadMapping(baseFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if tenant.File != "" && !IsTemplateConfig(configFile) {
+		docs, err := yamlnode.ParseFile(tenant.File)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) > 1 {
+			return nil, fmt.Errorf("%s must contain at most one YAML document, found %d", tenant.File, len(docs))
+		}
+		if len(docs) == 1 && !docs[0].IsNull() {
+			overlay := docs[0].Expand()
+			if overlay.Kind != yamlnode.MappingNode {
+				return nil, fmt.Errorf("%s: top level of an overlay must be a mapping", tenant.File)
+			}
+			config = config.Expand()
+			applyOverlay(config, overlay)
+		}
+	}
+	return yamlnode.Encode(config), nil
+}
+
+// renderConfigTemplate executes a template base config for a tenant. The
+// template uses [[ ]] delimiters so the {{ }} of Alertmanager notification
+// templates pass through untouched. It is executed with .Tenant (the tenant
+// ID) and .Values (the contents of the tenant's values file). Missing values
+// are empty in conditions and "default", but printing one is an error.
+func renderConfigTemplate(configFile string, tenant Tenant) ([]byte, error) {
+	text, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config template %s: %w", configFile, err)
+	}
+	values := map[string]any{}
+	if tenant.File != "" {
+		docs, err := yamlnode.ParseFile(tenant.File)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) > 1 {
+			return nil, fmt.Errorf("%s must contain at most one YAML document, found %d", tenant.File, len(docs))
+		}
+		if len(docs) == 1 && !docs[0].IsNull() {
+			v, ok := docs[0].Interface().(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: top level of a values file must be a mapping", tenant.File)
+			}
+			values = v
+		}
+	}
+	tmpl, err := template.New(filepath.Base(configFile)).
+		Delims("[[", "]]").
+		Option("missingkey=zero").
+		Funcs(configTemplateFuncs).
+		Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config template %s: %w", configFile, err)
+	}
+	var out bytes.Buffer
+	data := map[string]any{"Tenant": tenant.ID, "Values": values}
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("failed to render config template %s for tenant %s (values %s): %w", configFile, tenant.ID, tenant.File, err)
+	}
+	if i := bytes.Index(out.Bytes(), []byte("<no value>")); i >= 0 {
+		line := bytes.Count(out.Bytes()[:i], []byte("\n")) + 1
+		return nil, fmt.Errorf("config template %s for tenant %s prints a value missing from %s (rendered line %d)", configFile, tenant.ID, tenant.File, line)
+	}
+	return out.Bytes(), nil
+}
+
+// configTemplateFuncs are the helpers available to template base configs.
+var configTemplateFuncs = template.FuncMap{
+	"default": func(def, v any) any {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	"quote": func(v any) string {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	},
+	"toYaml": func(v any) string {
+		return strings.TrimSuffix(string(yamlnode.Encode(yamlnode.FromInterface(v))), "\n")
+	},
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	"hasKey": func(m map[string]any, key string) bool {
+		_, ok := m[key]
+		return ok
+	},
+}
+
+// applyOverlay deep-merges overlay into config:
+//   - mappings are merged key by key,
+//   - a null value removes the key,
+//   - lists whose items all have a "name" (receivers, time intervals) are
+//     merged by name, with new names appended,
+//   - any other value replaces the base value.
+func applyOverlay(config, overlay *yamlnode.Node) {
+	for _, key := range overlay.Keys() {
+		value := overlay.Get(key)
+		base := config.Get(key)
+		switch {
+		case value.IsNull():
+			config.Delete(key)
+		case base != nil && base.Kind == yamlnode.MappingNode && value.Kind == yamlnode.MappingNode:
+			applyOverlay(base, value)
+		case base != nil && isNamedList(base) && isNamedList(value):
+			for _, item := range value.Items() {
+				name := item.Get("name").Text()
+				replaced := false
+				for _, existing := range base.Content {
+					if existing.Get("name").Text() == name {
+						applyOverlay(existing, item)
+						replaced = true
+						break
+					}
+				}
+				if !replaced {
+					base.Content = append(base.Content, item)
+				}
+			}
+		default:
+			config.Set(key, value)
+		}
+	}
+}
+
+func isNamedList(n *yamlnode.Node) bool {
+	if n.Kind != yamlnode.SequenceNode || len(n.Content) == 0 {
+		return false
+	}
+	for _, item := range n.Content {
+		if item.Kind != yamlnode.MappingNode || item.Get("name").Text() == "" {
+			return false
+		}
+	}
+	return true
+}
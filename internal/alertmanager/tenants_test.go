@@ -0,0 +1,183 @@
+package alertmanager
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveTenants(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"payments.yaml":  "{}",
+		"search.yml":     "{}",
+		"README.md":      "not a tenant",
+		"nested/x.yaml":  "{}",
+		"platform.yaml":  "{}",
+		"platform2.json": "{}",
+	})
+	tenants, err := ResolveTenants(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tenant := range tenants {
+		got = append(got, tenant.ID+"="+filepath.Base(tenant.File))
+	}
+	want := "payments=payments.yaml platform=platform.yaml search=search.yml"
+	if strings.Join(got, " ") != want {
+		t.Errorf("ResolveTenants = %s, want %s", strings.Join(got, " "), want)
+	}
+
+	dir = writeFiles(t, map[string]string{"a.yaml": "{}", "a.yml": "{}"})
+	if _, err := ResolveTenants(dir); err == nil || !strings.Contains(err.Error(), `tenant "a" is defined by both`) {
+		t.Errorf("ResolveTenants with a tenant defined twice error = %v", err)
+	}
+}
+
+func TestBuildConfigOverlay(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": `global:
+  resolve_timeout: 5m
+  smtp_from: alerts@example.com
+route:
+  receiver: default
+  group_by: [alertname]
+receivers:
+  - name: default
+    email_configs:
+      - to: ops@example.com
+  - name: platform
+inhibit_rules:
+  - source_matchers: [severity="critical"]
+    target_matchers: [severity="warning"]
+`,
+		"fragment.yaml": "receivers:\n  - name: pager\n",
+		"tenants/payments.yaml": `global:
+  resolve_timeout: 1m
+route:
+  group_by: [alertname, team]
+receivers:
+  - name: default
+    email_configs:
+      - to: payments@example.com
+  - name: payments
+inhibit_rules: null
+`,
+	})
+	tenant := Tenant{ID: "payments", File: filepath.Join(dir, "tenants/payments.yaml")}
+	config, err := BuildConfig(filepath.Join(dir, "base.yaml"), []string{filepath.Join(dir, "fragment.yaml")}, tenant, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `global:
+  resolve_timeout: 1m
+  smtp_from: alerts@example.com
+route:
+  receiver: default
+  group_by:
+    - alertname
+    - team
+receivers:
+  - name: default
+    email_configs:
+      - to: payments@example.com
+  - name: platform
+  - name: pager
+  - name: payments
+`
+	if string(config) != want {
+		t.Errorf("BuildConfig =\n%s\nwant\n%s", config, want)
+	}
+
+	// Without a tenant file the base is built with its fragments only
+	config, err = BuildConfig(filepath.Join(dir, "base.yaml"), nil, Tenant{ID: "other"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), "to: ops@example.com") || !strings.Contains(string(config), "inhibit_rules:") {
+		t.Errorf("BuildConfig without a tenant file =\n%s", config)
+	}
+}
+
+func TestBuildConfigTemplate(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml.tmpl": `route:
+  receiver: [[ .Tenant ]]
+  group_wait: [[ default "30s" .Values.group_wait ]]
+receivers:
+  - name: [[ .Tenant ]]
+    slack_configs:
+      - channel: [[ quote .Values.channel ]]
+        title: '{{ .CommonLabels.alertname }}'
+[[- if hasKey .Values "webhooks" ]]
+  - name: webhooks
+    webhook_configs:
+[[ toYaml .Values.webhooks | indent 6 ]]
+[[- end ]]
+`,
+		"payments.yaml": "channel: '#payments'\ngroup_wait: 10s\nwebhooks:\n  - url: http://payments\n",
+		"search.yaml":   "channel: '#search'\n",
+	})
+	tests := []struct {
+		tenant string
+		want   string
+	}{
+		{"payments", `route:
+  receiver: payments
+  group_wait: 10s
+receivers:
+  - name: payments
+    slack_configs:
+      - channel: "#payments"
+        title: '{{ .CommonLabels.alertname }}'
+  - name: webhooks
+    webhook_configs:
+      - url: http://payments
+`},
+		{"search", `route:
+  receiver: search
+  group_wait: 30s
+receivers:
+  - name: search
+    slack_configs:
+      - channel: "#search"
+        title: '{{ .CommonLabels.alertname }}'
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			tenant := Tenant{ID: tt.tenant, File: filepath.Join(dir, tt.tenant+".yaml")}
+			config, err := BuildConfig(filepath.Join(dir, "base.yaml.tmpl"), nil, tenant, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(config) != tt.want {
+				t.Errorf("BuildConfig =\n%s\nwant\n%s", config, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildConfigTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		values   string
+		err      string
+	}{
+		{"missing value printed", "route:\n  receiver: [[ .Values.receiver ]]\n", "other: x\n", "prints a value missing from"},
+		{"values not a mapping", "route: {}\n", "- a\n", "top level of a values file must be a mapping"},
+		{"invalid YAML rendered", "route: [[ .Values.route ]]\n  x: y\n", "route: '[a'\n", "is not valid YAML"},
+		{"template syntax", "route: [[ .Values.route\n", "{}\n", "failed to parse config template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"base.tmpl": tt.template, "tenant.yaml": tt.values})
+			tenant := Tenant{ID: "tenant", File: filepath.Join(dir, "tenant.yaml")}
+			_, err := BuildConfig(filepath.Join(dir, "base.tmpl"), nil, tenant, t.TempDir())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("BuildConfig error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
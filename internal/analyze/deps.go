@@ -0,0 +1,350 @@
+// Package analyze inspects rule files without syncing them.
+package analyze
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/rules"
+)
+
+// DepsOptions configures "analyze deps".
+type DepsOptions struct {
+	RulesPath string // Directory of rule files (*.yaml, *.yml, *.json) or a single rule file
+	Format    string // "text", "dot" or "json"
+	Output    string // File to write to; stdout when empty
+	Strict    bool   // Fail when issues are found
+}
+
+// Node is an alerting or recording rule, or an undefined series that rules
+// reference.
+type Node struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"` // "alert", "record" or "undefined"
+	Group string `json:"group,omitempty"`
+	File  string `json:"file,omitempty"`
+	Line  int    `json:"line,omitempty"`
+}
+
+// Edge means the rule From consumes the series produced by To.
+type Edge struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	CrossGroup bool   `json:"cross_group,omitempty"`
+}
+
+// Issue kinds.
+const (
+	IssueUndefined  = "undefined"
+	IssueUnused     = "unused"
+	IssueCrossGroup = "cross_group"
+	IssueOrder      = "order"
+	IssueCycle      = "cycle"
+)
+
+// Issue is a problem found in the dependency graph.
+type Issue struct {
+	Kind    string `json:"kind"`
+	Pos     string `json:"pos"`
+	Group   string `json:"group"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: [%s] %s/%s: %s", i.Pos, i.Kind, i.Group, i.Rule, i.Message)
+}
+
+// Graph is the dependency graph of a set of rule files.
+type Graph struct {
+	Nodes  []*Node `json:"nodes"`
+	Edges  []Edge  `json:"edges"`
+	Issues []Issue `json:"issues"`
+}
+
+// recordingNameRe matches the level:metric:operations naming convention of
+// recording rules; only such names are expected to be defined by a rule.
+var recordingNameRe = regexp.MustCompile(`^[^:]+:[^:]+:[^:]+`)
+
+// Deps builds the dependency graph of the rule files under opts.RulesPath
+// and writes it in the requested format.
+func Deps(opts DepsOptions) error {
+	paths, err := rules.ResolveFiles(opts.RulesPath)
+	if err != nil {
+		return err
+	}
+	files, err := rules.LoadFiles(paths)
+	if err != nil {
+		return err
+	}
+	log.Printf("Analyzing dependencies of %d rule file(s) in %s", len(files), opts.RulesPath)
+	g := BuildGraph(files)
+
+	var w io.Writer = os.Stdout
+	if opts.Output != "" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", opts.Output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch opts.Format {
+	case "", "text":
+		err = g.WriteText(w)
+	case "dot":
+		err = g.WriteDOT(w)
+	case "json":
+		err = g.WriteJSON(w)
+	default:
+		return fmt.Errorf("unknown output format %q, expected text, dot or json", opts.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write dependency graph: %w", err)
+	}
+	if opts.Output != "" {
+		log.Printf("Wrote dependency graph to %s", opts.Output)
+	}
+	if opts.Format != "" && opts.Format != "text" {
+		for _, i := range g.Issues {
+			log.Print(i)
+		}
+	}
+	if opts.Strict && len(g.Issues) > 0 {
+		return fmt.Errorf("found %d dependency issue(s)", len(g.Issues))
+	}
+	return nil
+}
+
+// BuildGraph links every rule to the recording rules whose series its
+// expression selects. Rules whose expression does not parse are skipped.
+func BuildGraph(files []*rules.File) *Graph {
+	g := &Graph{Nodes: []*Node{}, Edges: []Edge{}, Issues: []Issue{}}
+	type ruleInfo struct {
+		rule  *rules.Rule
+		node  *Node
+		index int // position within its group
+		refs  []string
+		deps  []*ruleInfo // recording rules it consumes
+	}
+	var all []*ruleInfo
+	defs := map[string][]*ruleInfo{}
+
+	// 1. One node per rule; remember which rules define each series
+	for _, f := range files {
+		for _, grp := range f.Groups {
+			for i, r := range grp.Rules {
+				info := &ruleInfo{rule: r, index: i}
+				kind := "alert"
+				if !r.IsAlert() {
+					kind = "record"
+				}
+				info.node = &Node{ID: r.Pos(), Name: r.Name(), Kind: kind, Group: grp.Name, File: f.Path, Line: r.Node.Line}
+				g.Nodes = append(g.Nodes, info.node)
+				if expr, err := promql.Parse(r.Expr); err != nil {
+					log.Printf("%s: skipping %s/%s, its expression does not parse: %v", r.Pos(), grp.Name, r.Name(), err)
+				} else {
+					info.refs = promql.MetricNames(expr)
+				}
+				if kind == "record" {
+					defs[r.Record] = append(defs[r.Record], info)
+				}
+				all = append(all, info)
+			}
+		}
+	}
+
+	// 2. Edges from consumers to the recording rules they use
+	used := map[*ruleInfo]bool{}
+	undefined := map[string]*Node{}
+	for _, c := range all {
+		r := c.rule
+		for _, name := range c.refs {
+			producers := defs[name]
+			if len(producers) == 0 {
+				if !recordingNameRe.MatchString(name) {
+					continue // a raw metric, not expected to be recorded
+				}
+				n := undefined[name]
+				if n == nil {
+					n = &Node{ID: "undefined:" + name, Name: name, Kind: "undefined"}
+					undefined[name] = n
+				}
+				g.Edges = append(g.Edges, Edge{From: c.node.ID, To: n.ID})
+				g.Issues = append(g.Issues, Issue{Kind: IssueUndefined, Pos: r.Pos(), Group: r.Group.Name, Rule: r.Name(),
+					Message: fmt.Sprintf("references %s, which no recording rule defines", name)})
+				continue
+			}
+			for _, p := range producers {
+				used[p] = true
+				c.deps = append(c.deps, p)
+				cross := p.rule.Group != r.Group
+				g.Edges = append(g.Edges, Edge{From: c.node.ID, To: p.node.ID, CrossGroup: cross})
+				switch {
+				case p == c:
+					// reported as a cycle
+				case cross:
+					g.Issues = append(g.Issues, Issue{Kind: IssueCrossGroup, Pos: r.Pos(), Group: r.Group.Name, Rule: r.Name(),
+						Message: fmt.Sprintf("uses %s from group %s (%s); groups are evaluated independently, so it may see stale or missing data", name, p.rule.Group.Name, p.rule.Pos())})
+				case p.index >= c.index:
+					g.Issues = append(g.Issues, Issue{Kind: IssueOrder, Pos: r.Pos(), Group: r.Group.Name, Rule: r.Name(),
+						Message: fmt.Sprintf("uses %s, which is recorded later in the same group (%s) and lags one evaluation", name, p.rule.Pos())})
+				}
+			}
+		}
+	}
+	for _, name := range sortedKeys(undefined) {
+		g.Nodes = append(g.Nodes, undefined[name])
+	}
+
+	// 3. Recording rules that depend on their own output, directly or
+	// through others, never see complete data
+	state := map[*ruleInfo]int{} // 0 unvisited, 1 on the path, 2 done
+	var path []*ruleInfo
+	var visit func(info *ruleInfo)
+	visit = func(info *ruleInfo) {
+		state[info] = 1
+		path = append(path, info)
+		for _, dep := range info.deps {
+			switch state[dep] {
+			case 0:
+				visit(dep)
+			case 1:
+				start := len(path) - 1
+				for path[start] != dep {
+					start--
+				}
+				names := []string{}
+				for _, p := range path[start:] {
+					names = append(names, p.rule.Name())
+				}
+				r := dep.rule
+				g.Issues = append(g.Issues, Issue{Kind: IssueCycle, Pos: r.Pos(), Group: r.Group.Name, Rule: r.Name(),
+					Message: fmt.Sprintf("is part of a dependency cycle: %s -> %s", strings.Join(names, " -> "), r.Name())})
+			}
+		}
+		path = path[:len(path)-1]
+		state[info] = 2
+	}
+	for _, info := range all {
+		if state[info] == 0 {
+			visit(info)
+		}
+	}
+
+	// 4. Recording rules nothing consumes
+	for _, info := range all {
+		if !info.rule.IsAlert() && !used[info] {
+			r := info.rule
+			g.Issues = append(g.Issues, Issue{Kind: IssueUnused, Pos: r.Pos(), Group: r.Group.Name, Rule: r.Name(),
+				Message: "no rule consumes this recording rule"})
+		}
+	}
+	return g
+}
+
+// WriteText writes a summary of the graph and its issues.
+func (g *Graph) WriteText(w io.Writer) error {
+	counts := map[string]int{}
+	for _, n := range g.Nodes {
+		counts[n.Kind]++
+	}
+	cross := 0
+	for _, e := range g.Edges {
+		if e.CrossGroup {
+			cross++
+		}
+	}
+	fmt.Fprintf(w, "%d alerting rule(s), %d recording rule(s), %d dependency edge(s) (%d cross-group)\n",
+		counts["alert"], counts["record"], len(g.Edges), cross)
+	if len(g.Issues) == 0 {
+		_, err := fmt.Fprintln(w, "No issues found.")
+		return err
+	}
+	fmt.Fprintf(w, "%d issue(s):\n", len(g.Issues))
+	for _, i := range g.Issues {
+		if _, err := fmt.Fprintln(w, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the graph as indented JSON.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// WriteDOT writes the graph in Graphviz DOT format, clustering rules by
+// group. Alerts are boxes, recording rules ellipses and undefined series
+// dashed red; cross-group edges are red.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph rules {\n  rankdir=LR;\n  node [fontname=\"Helvetica\"];\n")
+	var clusters []string
+	byCluster := map[string][]*Node{}
+	for _, n := range g.Nodes {
+		key := ""
+		if n.Kind != "undefined" {
+			key = n.File + "\x00" + n.Group
+		}
+		if _, ok := byCluster[key]; !ok {
+			clusters = append(clusters, key)
+		}
+		byCluster[key] = append(byCluster[key], n)
+	}
+	for i, key := range clusters {
+		indent := "  "
+		if key != "" {
+			group := key[strings.IndexByte(key, 0)+1:]
+			fmt.Fprintf(&b, "  subgraph cluster_%d {\n    label=%s;\n", i, dotQuote(group))
+			indent = "    "
+		}
+		for _, n := range byCluster[key] {
+			attrs := "shape=ellipse"
+			switch n.Kind {
+			case "alert":
+				attrs = "shape=box"
+			case "undefined":
+				attrs = "shape=ellipse, style=dashed, color=red"
+			}
+			fmt.Fprintf(&b, "%s%s [label=%s, %s];\n", indent, dotQuote(n.ID), dotQuote(n.Name), attrs)
+		}
+		if key != "" {
+			b.WriteString("  }\n")
+		}
+	}
+	for _, e := range g.Edges {
+		attrs := ""
+		if e.CrossGroup {
+			attrs = " [color=red]"
+		}
+		fmt.Fprintf(&b, "  %s -> %s%s;\n", dotQuote(e.From), dotQuote(e.To), attrs)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,247 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+)
+
+func parseRules(t *testing.T, files map[string]string) []*rules.File {
+	t.Helper()
+	var parsed []*rules.File
+	for _, name := range sortedKeys(files) {
+		f, err := rules.Parse(name, []byte(files[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, f...)
+	}
+	return parsed
+}
+
+// issues returns "kind rule" for each issue of g, in order.
+func issues(g *Graph) []string {
+	var out []string
+	for _, i := range g.Issues {
+		out = append(out, i.Kind+" "+i.Rule)
+	}
+	return out
+}
+
+func TestBuildGraph(t *testing.T) {
+	g := BuildGraph(parseRules(t, map[string]string{
+		"a.yaml": `groups:
+  - name: api
+    rules:
+      - record: job:requests:rate5m
+        expr: sum by (job) (rate(requests_total[5m]))
+      - record: job:errors:ratio5m
+        expr: job:errors:rate5m / job:requests:rate5m
+      - record: job:errors:rate5m
+        expr: sum by (job) (rate(errors_total[5m]))
+      - alert: HighErrorRate
+        expr: job:errors:ratio5m > 0.1 and job:latency:p99 > 1
+`,
+		"b.yaml": `groups:
+  - name: slo
+    rules:
+      - record: job:requests:rate1h
+        expr: avg_over_time(job:requests:rate5m[1h])
+      - alert: NoTraffic
+        expr: job:requests:rate1h == 0
+`,
+	}))
+
+	var nodes []string
+	for _, n := range g.Nodes {
+		nodes = append(nodes, n.Kind+" "+n.Name)
+	}
+	wantNodes := []string{
+		"record job:requests:rate5m", "record job:errors:ratio5m", "record job:errors:rate5m", "alert HighErrorRate",
+		"record job:requests:rate1h", "alert NoTraffic",
+		"undefined job:latency:p99",
+	}
+	if strings.Join(nodes, ", ") != strings.Join(wantNodes, ", ") {
+		t.Errorf("nodes = %v, want %v", nodes, wantNodes)
+	}
+
+	var edges []string
+	for _, e := range g.Edges {
+		edge := e.From + " -> " + e.To
+		if e.CrossGroup {
+			edge += " (cross-group)"
+		}
+		edges = append(edges, edge)
+	}
+	wantEdges := []string{
+		"a.yaml:6 -> a.yaml:8",
+		"a.yaml:6 -> a.yaml:4",
+		"a.yaml:10 -> a.yaml:6",
+		"a.yaml:10 -> undefined:job:latency:p99",
+		"b.yaml:4 -> a.yaml:4 (cross-group)",
+		"b.yaml:6 -> b.yaml:4",
+	}
+	if strings.Join(edges, "\n") != strings.Join(wantEdges, "\n") {
+		t.Errorf("edges:\n%s\nwant:\n%s", strings.Join(edges, "\n"), strings.Join(wantEdges, "\n"))
+	}
+
+	wantIssues := []string{
+		"order job:errors:ratio5m",
+		"undefined HighErrorRate",
+		"cross_group job:requests:rate1h",
+	}
+	if got := issues(g); strings.Join(got, ", ") != strings.Join(wantIssues, ", ") {
+		t.Errorf("issues = %v, want %v", got, wantIssues)
+	}
+	if msg := g.Issues[1].Message; msg != "references job:latency:p99, which no recording rule defines" {
+		t.Errorf("undefined message = %q", msg)
+	}
+}
+
+func TestBuildGraphIssues(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  []string
+	}{
+		{
+			name: "raw metrics are not undefined",
+			rules: `      - alert: Down
+        expr: up == 0 or absent(node_exporter_build_info)
+`,
+		},
+		{
+			name: "unused recording rule",
+			rules: `      - record: job:up:sum
+        expr: sum by (job) (up)
+`,
+			want: []string{"unused job:up:sum"},
+		},
+		{
+			name: "self reference",
+			rules: `      - record: job:up:sum
+        expr: job:up:sum or sum by (job) (up)
+`,
+			want: []string{"cycle job:up:sum"},
+		},
+		{
+			name: "cycle through another rule",
+			rules: `      - record: job:a:sum
+        expr: job:b:sum
+      - record: job:b:sum
+        expr: job:a:sum
+`,
+			want: []string{"order job:a:sum", "cycle job:a:sum"},
+		},
+		{
+			name: "unparsable expression",
+			rules: `      - record: job:a:sum
+        expr: sum(
+`,
+			want: []string{"unused job:a:sum"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := BuildGraph(parseRules(t, map[string]string{"rules.yaml": "groups:\n  - name: g\n    rules:\n" + tt.rules}))
+			if got := issues(g); strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("issues = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	g := BuildGraph(parseRules(t, map[string]string{"rules.yaml": `groups:
+  - name: g
+    rules:
+      - record: job:a:sum
+        expr: job:c:sum
+      - record: job:b:sum
+        expr: job:a:sum
+      - record: job:c:sum
+        expr: job:b:sum
+`}))
+	for _, i := range g.Issues {
+		if i.Kind == IssueCycle {
+			if want := "is part of a dependency cycle: job:a:sum -> job:c:sum -> job:b:sum -> job:a:sum"; i.Message != want {
+				t.Errorf("cycle message = %q, want %q", i.Message, want)
+			}
+			return
+		}
+	}
+	t.Errorf("issues = %v, want a cycle", issues(g))
+}
+
+func TestDeps(t *testing.T) {
+	dir := t.TempDir()
+	rulesFile := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(rulesFile, []byte("groups:\n  - name: g\n    rules:\n      - alert: A\n        expr: job:x:sum > 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "graph.json")
+	if err := Deps(DepsOptions{RulesPath: rulesFile, Format: "json", Output: out}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g Graph
+	if err := json.Unmarshal(data, &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Nodes) != 2 || len(g.Edges) != 1 || len(g.Issues) != 1 || g.Issues[0].Kind != IssueUndefined {
+		t.Errorf("JSON graph = %s", data)
+	}
+
+	if err := Deps(DepsOptions{RulesPath: rulesFile, Strict: true, Output: out}); err == nil || err.Error() != "found 1 dependency issue(s)" {
+		t.Errorf("Deps with strict error = %v", err)
+	}
+	if err := Deps(DepsOptions{RulesPath: rulesFile, Format: "svg", Output: out}); err == nil || !strings.Contains(err.Error(), `unknown output format "svg"`) {
+		t.Errorf("Deps with unknown format error = %v", err)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	g := BuildGraph(parseRules(t, map[string]string{"rules.yaml": `groups:
+  - name: 'the "g" group'
+    rules:
+      - record: job:a:sum
+        expr: sum(up)
+      - alert: A
+        expr: job:a:sum > 0 or job:b:sum > 0
+`}))
+	var b bytes.Buffer
+	if err := g.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph rules {
+  rankdir=LR;
+  node [fontname="Helvetica"];
+  subgraph cluster_0 {
+    label="the \"g\" group";
+    "rules.yaml:4" [label="job:a:sum", shape=ellipse];
+    "rules.yaml:6" [label="A", shape=box];
+  }
+  "undefined:job:b:sum" [label="job:b:sum", shape=ellipse, style=dashed, color=red];
+  "rules.yaml:6" -> "rules.yaml:4";
+  "rules.yaml:6" -> "undefined:job:b:sum";
+}
+`
+	if b.String() != want {
+		t.Errorf("WriteDOT =\n%s\nwant\n%s", b.String(), want)
+	}
+
+	b.Reset()
+	if err := g.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "1 alerting rule(s), 1 recording rule(s), 2 dependency edge(s) (0 cross-group)\n1 issue(s):\n"; !strings.HasPrefix(b.String(), want) {
+		t.Errorf("WriteText =\n%s\nwant prefix\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,331 @@
+// Package apply syncs every subtree of a repository that a .mal-sync.yaml
+// marker file declares, so a monorepo of many teams is synced with one
+// command.
+package apply
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/alertmanager"
+	"github.com/antnsn/mal-sync/internal/lokirules"
+	"github.com/antnsn/mal-sync/internal/mimirrules"
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/state"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// MarkerFile is the name of the file declaring how its directory is synced.
+const MarkerFile = rules.MarkerFile
+
+// Kinds of targets a subtree is synced to.
+const (
+	KindMimirRules   = "mimir-rules"
+	KindLokiRules    = "loki-rules"
+	KindAlertmanager = "alertmanager"
+)
+
+// Marker is a parsed marker file. Paths are resolved against its
+// directory.
+type Marker struct {
+	File               string // Path of the marker file
+	Kind               string
+	Tenant             string
+	RulesPath          string                  // Rule files of mimir-rules and loki-rules; the marker's directory by default
+	Filter             rules.Filter            // Include and exclude patterns of RulesPath
+	Namespaces         rules.NamespaceStrategy // How rule files get their namespace
+	CRDNamespaceFormat string                  // Namespace of PrometheusRule objects
+	PolicyFile         string                  // Rule policy replacing Options.PolicyFile; none when "none"
+	TestsPath          string                  // Rule unit tests of mimir-rules
+	Mixins             []string                // Jsonnet entrypoints of monitoring mixins of mimir-rules
+	JsonnetPaths       []string                // Jsonnet library paths of Mixins
+	ConfigFile         string                  // Alertmanager config; alertmanager.yaml by default
+	Fragments          []string                // Alertmanager config fragments
+	TemplateDirs       []string                // Alertmanager template directories
+}
+
+// Dir returns the directory of the subtree m declares.
+func (m *Marker) Dir() string {
+	return filepath.Dir(m.File)
+}
+
+// Options configures an apply.
+type Options struct {
+	Root         string // Directory searched for marker files
+	MimirAddress string // Required when a subtree syncs mimir-rules or alertmanager
+	LokiAddress  string // Required when a subtree syncs loki-rules
+	PolicyFile   string // Default rule policy of subtrees without one of their own
+	State        state.Store
+	TempBaseDir  string
+}
+
+// Find returns the marker files below root, sorted by path. Directories
+// named .git are skipped.
+func Find(root string) ([]*Marker, error) {
+	var markers []*Marker
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || d.Name() != MarkerFile {
+			return nil
+		}
+		m, err := LoadMarker(path)
+		if err != nil {
+			return err
+		}
+		markers = append(markers, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(markers, func(i, j int) bool { return markers[i].File < markers[j].File })
+	return markers, nil
+}
+
+// LoadMarker reads a marker file:
+//
+//	kind: mimir-rules          # mimir-rules, loki-rules or alertmanager
+//	tenant: payments
+//	rules_path: rules          # default: the marker's directory
+//	include: ['*.rules.yaml']
+//	exclude: [values.yaml]
+//	namespace:
+//	  strategy: directory      # file (default), filename, directory or fixed
+//	  name: payments           # with fixed
+//	  prefix: team-
+//	crd_namespace_format: '{namespace}-{name}'
+//	policy: policy.yaml        # or none
+//	tests: tests
+//	mixins: [vendor/kubernetes-mixin/mixin.libsonnet]
+//	jsonnet_path: [vendor]     # default: the vendor directory above each mixin
+//
+// Alertmanager subtrees set config (default alertmanager.yaml), fragments
+// and templates instead of the rule keys.
+func LoadMarker(path string) (*Marker, error) {
+	docs, err := yamlnode.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) != 1 || docs[0].Kind != yamlnode.MappingNode {
+		return nil, fmt.Errorf("%s: marker must be a single YAML mapping", path)
+	}
+	doc := docs[0]
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || p == "none" || filepath.IsAbs(p) || strings.Contains(p, "://") {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	m := &Marker{File: path}
+	var ruleKeys, amKeys []string
+	for _, key := range doc.Keys() {
+		n := doc.Get(key)
+		switch key {
+		case "kind":
+			m.Kind = n.Text()
+		case "tenant":
+			m.Tenant = n.Text()
+		case "rules_path":
+			m.RulesPath = resolve(n.Text())
+			ruleKeys = append(ruleKeys, key)
+		case "include":
+			for _, item := range n.Items() {
+				m.Filter.Include = append(m.Filter.Include, item.Text())
+			}
+			ruleKeys = append(ruleKeys, key)
+		case "exclude":
+			for _, item := range n.Items() {
+				m.Filter.Exclude = append(m.Filter.Exclude, item.Text())
+			}
+			ruleKeys = append(ruleKeys, key)
+		case "namespace":
+			for _, k := range n.Keys() {
+				switch k {
+				case "strategy":
+					m.Namespaces.Strategy = n.Get(k).Text()
+				case "name":
+					m.Namespaces.Name = n.Get(k).Text()
+				case "prefix":
+					m.Namespaces.Prefix = n.Get(k).Text()
+				default:
+					return nil, fmt.Errorf("%s:%d: unknown namespace key %q", path, n.Get(k).Line, k)
+				}
+			}
+			if err := m.Namespaces.Validate(); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n.Line, err)
+			}
+			ruleKeys = append(ruleKeys, key)
+		case "crd_namespace_format":
+			m.CRDNamespaceFormat = n.Text()
+			ruleKeys = append(ruleKeys, key)
+		case "policy":
+			m.PolicyFile = resolve(n.Text())
+			ruleKeys = append(ruleKeys, key)
+		case "tests":
+			m.TestsPath = resolve(n.Text())
+			ruleKeys = append(ruleKeys, key)
+		case "mixins":
+			for _, item := range n.Items() {
+				m.Mixins = append(m.Mixins, resolve(item.Text()))
+			}
+			ruleKeys = append(ruleKeys, key)
+		case "jsonnet_path":
+			for _, item := range n.Items() {
+				m.JsonnetPaths = append(m.JsonnetPaths, resolve(item.Text()))
+			}
+			ruleKeys = append(ruleKeys, key)
+		case "config":
+			m.ConfigFile = resolve(n.Text())
+			amKeys = append(amKeys, key)
+		case "fragments":
+			for _, item := range n.Items() {
+				m.Fragments = append(m.Fragments, resolve(item.Text()))
+			}
+			amKeys = append(amKeys, key)
+		case "templates":
+			for _, item := range n.Items() {
+				m.TemplateDirs = append(m.TemplateDirs, resolve(item.Text()))
+			}
+			amKeys = append(amKeys, key)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown marker key %q", path, n.Line, key)
+		}
+	}
+
+	switch m.Kind {
+	case KindMimirRules, KindLokiRules:
+		if len(amKeys) > 0 {
+			return nil, fmt.Errorf("%s: %s only applies to alertmanager subtrees", path, amKeys[0])
+		}
+		if m.Kind == KindLokiRules && m.TestsPath != "" {
+			return nil, fmt.Errorf("%s: tests only apply to mimir-rules subtrees", path)
+		}
+		if m.Kind == KindLokiRules && (len(m.Mixins) > 0 || len(m.JsonnetPaths) > 0) {
+			return nil, fmt.Errorf("%s: mixins only apply to mimir-rules subtrees", path)
+		}
+		if m.RulesPath == "" {
+			m.RulesPath = dir
+		}
+	case KindAlertmanager:
+		if len(ruleKeys) > 0 {
+			return nil, fmt.Errorf("%s: %s only applies to mimir-rules and loki-rules subtrees", path, ruleKeys[0])
+		}
+		if m.ConfigFile == "" {
+			m.ConfigFile = filepath.Join(dir, "alertmanager.yaml")
+		}
+	case "":
+		return nil, fmt.Errorf("%s: kind is required", path)
+	default:
+		return nil, fmt.Errorf("%s: unknown kind %q, expected %s, %s or %s", path, m.Kind, KindMimirRules, KindLokiRules, KindAlertmanager)
+	}
+	if m.Tenant == "" {
+		return nil, fmt.Errorf("%s: tenant is required", path)
+	}
+	return m, nil
+}
+
+// Run syncs every subtree under Root. All markers are checked before the
+// first sync; a failed subtree is logged and the others are still synced.
+func Run(opts Options) error {
+	markers, err := Find(opts.Root)
+	if err != nil {
+		return err
+	}
+	if len(markers) == 0 {
+		return fmt.Errorf("no %s files found in %s", MarkerFile, opts.Root)
+	}
+	log.Printf("Found %d subtree(s) in %s", len(markers), opts.Root)
+
+	// Each sync replaces all rules or the config of its tenant, so two
+	// subtrees syncing one tenant would undo each other
+	owners := map[string]*Marker{}
+	for _, m := range markers {
+		key := m.Kind + "/" + m.Tenant
+		if other := owners[key]; other != nil {
+			return fmt.Errorf("%s and %s both sync %s of tenant %s; a tenant can only be synced from one subtree", other.File, m.File, m.Kind, m.Tenant)
+		}
+		owners[key] = m
+		if m.Kind == KindLokiRules && opts.LokiAddress == "" {
+			return fmt.Errorf("%s syncs loki-rules, which requires a Loki address", m.File)
+		}
+		if m.Kind != KindLokiRules && opts.MimirAddress == "" {
+			return fmt.Errorf("%s syncs %s, which requires a Mimir address", m.File, m.Kind)
+		}
+	}
+
+	var failed []string
+	for _, m := range markers {
+		log.Printf("Applying %s: %s for tenant %s", m.Dir(), m.Kind, m.Tenant)
+		if err := sync(m, opts); err != nil {
+			log.Printf("Applying %s failed: %v", m.Dir(), err)
+			failed = append(failed, m.Dir())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("failed to apply " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// sync syncs the subtree of m.
+func sync(m *Marker, opts Options) error {
+	policy := opts.PolicyFile
+	switch m.PolicyFile {
+	case "":
+	case "none":
+		policy = ""
+	default:
+		policy = m.PolicyFile
+	}
+	switch m.Kind {
+	case KindMimirRules:
+		return mimirrules.Sync(mimirrules.Options{
+			RulesPath:       m.RulesPath,
+			Filter:          m.Filter,
+			Mixins:          m.Mixins,
+			JsonnetPaths:    m.JsonnetPaths,
+			MimirAddress:    opts.MimirAddress,
+			MimirID:         m.Tenant,
+			Namespace:       m.Namespaces.Name,
+			PolicyFile:      policy,
+			NamespaceFormat: m.CRDNamespaceFormat,
+			Namespaces:      m.Namespaces,
+			State:           opts.State,
+			TestsPath:       m.TestsPath,
+			TempBaseDir:     opts.TempBaseDir,
+		})
+	case KindLokiRules:
+		return lokirules.Sync(lokirules.Options{
+			RulesPath:       m.RulesPath,
+			Filter:          m.Filter,
+			LokiAddress:     opts.LokiAddress,
+			OrgID:           m.Tenant,
+			PolicyFile:      policy,
+			NamespaceFormat: m.CRDNamespaceFormat,
+			Namespaces:      m.Namespaces,
+			State:           opts.State,
+			TempBaseDir:     opts.TempBaseDir,
+		})
+	default:
+		return alertmanager.Sync(alertmanager.Options{
+			ConfigFile:   m.ConfigFile,
+			Fragments:    m.Fragments,
+			TemplateDirs: m.TemplateDirs,
+			MimirAddress: opts.MimirAddress,
+			MimirID:      m.Tenant,
+			State:        opts.State,
+			TempBaseDir:  opts.TempBaseDir,
+		})
+	}
+}
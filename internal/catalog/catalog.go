@@ -0,0 +1,214 @@
+// Package catalog exports an inventory of every alert defined in Mimir and
+// Loki rule files, for on-call handbooks and service catalogs.
+package catalog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+)
+
+// Options configures "catalog".
+type Options struct {
+	MimirPaths []string // Mimir rule directories or files
+	LokiPaths  []string // Loki rule directories or files
+	Format     string   // "markdown", "csv" or "json"
+	Output     string   // File to write to; stdout when empty
+}
+
+// Entry is one alert of the catalog.
+type Entry struct {
+	Name        string            `json:"name"`
+	Source      string            `json:"source"` // "mimir" or "loki"
+	Namespace   string            `json:"namespace,omitempty"`
+	Group       string            `json:"group"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Severity    string            `json:"severity,omitempty"`
+	Team        string            `json:"team,omitempty"`
+	Summary     string            `json:"summary,omitempty"`
+	Runbook     string            `json:"runbook,omitempty"`
+	File        string            `json:"file"`
+	Line        int               `json:"line"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Run builds the catalog of the rule files under opts and writes it in the
+// requested format.
+func Run(opts Options) error {
+	var entries []Entry
+	for _, src := range []struct {
+		name  string
+		paths []string
+	}{{"mimir", opts.MimirPaths}, {"loki", opts.LokiPaths}} {
+		for _, path := range src.paths {
+			paths, err := rules.ResolveFiles(path)
+			if err != nil {
+				return err
+			}
+			files, err := rules.LoadFiles(paths)
+			if err != nil {
+				return err
+			}
+			log.Printf("Cataloguing alerts of %d %s rule file(s) in %s", len(files), src.name, path)
+			entries = append(entries, Build(src.name, files)...)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Source != b.Source {
+			return a.Source > b.Source // mimir before loki
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		return a.Name < b.Name
+	})
+
+	var w io.Writer = os.Stdout
+	if opts.Output != "" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", opts.Output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	var err error
+	switch opts.Format {
+	case "", "markdown":
+		err = WriteMarkdown(w, entries)
+	case "csv":
+		err = WriteCSV(w, entries)
+	case "json":
+		err = WriteJSON(w, entries)
+	default:
+		return fmt.Errorf("unknown output format %q, expected markdown, csv or json", opts.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	if opts.Output != "" {
+		log.Printf("Wrote catalog of %d alert(s) to %s", len(entries), opts.Output)
+	}
+	return nil
+}
+
+// Build returns a catalog entry for every alerting rule in files.
+func Build(source string, files []*rules.File) []Entry {
+	var entries []Entry
+	for _, f := range files {
+		for _, g := range f.Groups {
+			for _, r := range g.Rules {
+				if !r.IsAlert() {
+					continue
+				}
+				runbook := r.Annotations["runbook_url"]
+				if runbook == "" {
+					runbook = r.Annotations["runbook"]
+				}
+				entries = append(entries, Entry{
+					Name:        r.Alert,
+					Source:      source,
+					Namespace:   f.Namespace,
+					Group:       g.Name,
+					Expr:        strings.TrimSpace(r.Expr),
+					For:         r.For,
+					Severity:    r.Labels["severity"],
+					Team:        r.Labels["team"],
+					Summary:     r.Annotations["summary"],
+					Runbook:     runbook,
+					File:        f.Path,
+					Line:        r.Node.Line,
+					Labels:      r.Labels,
+					Annotations: r.Annotations,
+				})
+			}
+		}
+	}
+	return entries
+}
+
+var columns = []string{"Alert", "Source", "Namespace", "Group", "Severity", "Team", "For", "Summary", "Runbook", "Expression", "File"}
+
+func (e Entry) fields() []string {
+	return []string{e.Name, e.Source, e.Namespace, e.Group, e.Severity, e.Team, e.For, e.Summary, e.Runbook, e.Expr, e.File + ":" + strconv.Itoa(e.Line)}
+}
+
+// WriteMarkdown writes the catalog as a Markdown table.
+func WriteMarkdown(w io.Writer, entries []Entry) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Alert catalog\n\n%d alert(s).\n\n", len(entries))
+	b.WriteString("| " + strings.Join(columns, " | ") + " |\n")
+	b.WriteString("|" + strings.Repeat(" --- |", len(columns)) + "\n")
+	for _, e := range entries {
+		cells := e.fields()
+		for i, c := range cells {
+			switch {
+			case c == "":
+			case columns[i] == "Expression":
+				cells[i] = codeSpan(c)
+			case columns[i] == "Runbook" && (strings.HasPrefix(c, "http://") || strings.HasPrefix(c, "https://")):
+				cells[i] = "[runbook](" + c + ")"
+			default:
+				cells[i] = markdownCell(c)
+			}
+		}
+		b.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownCell makes s safe inside a table cell.
+func markdownCell(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+// codeSpan renders s as inline code on one line.
+func codeSpan(s string) string {
+	s = markdownCell(s)
+	if strings.Contains(s, "`") {
+		return "`` " + s + " ``"
+	}
+	return "`" + s + "`"
+}
+
+// WriteCSV writes the catalog as CSV with a header row.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := cw.Write(e.fields()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes the catalog as a JSON array.
+func WriteJSON(w io.Writer, entries []Entry) error {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(entries)
+}
@@ -0,0 +1,146 @@
+package catalog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+)
+
+const mimirRules = `namespace: api
+groups:
+  - name: api
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+      - alert: ApiDown
+        expr: |
+          up{job="api"}
+            == 0
+        for: 5m
+        labels:
+          severity: critical
+          team: api
+        annotations:
+          summary: The API | gateway is down
+          runbook_url: https://runbooks/api-down
+`
+
+const lokiRules = `groups:
+  - name: logs
+    rules:
+      - alert: PanicLogged
+        expr: sum(count_over_time({app="api"} |= "panic" [5m])) > 0
+        annotations:
+          runbook: see the wiki
+`
+
+func writeRules(t *testing.T) (mimirDir, lokiFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	mimirDir = filepath.Join(dir, "mimir")
+	if err := os.Mkdir(mimirDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mimirDir, "api.yaml"), []byte(mimirRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lokiFile = filepath.Join(dir, "loki.yaml")
+	if err := os.WriteFile(lokiFile, []byte(lokiRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return mimirDir, lokiFile
+}
+
+func TestRunCSV(t *testing.T) {
+	mimirDir, lokiFile := writeRules(t)
+	out := filepath.Join(t.TempDir(), "catalog.csv")
+	if err := Run(Options{LokiPaths: []string{lokiFile}, MimirPaths: []string{mimirDir}, Format: "csv", Output: out}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Alert", "Source", "Namespace", "Group", "Severity", "Team", "For", "Summary", "Runbook", "Expression", "File"},
+		{"ApiDown", "mimir", "api", "api", "critical", "api", "5m", "The API | gateway is down", "https://runbooks/api-down", "up{job=\"api\"}\n  == 0", filepath.Join(mimirDir, "api.yaml") + ":7"},
+		{"PanicLogged", "loki", "", "logs", "", "", "", "", "see the wiki", `sum(count_over_time({app="api"} |= "panic" [5m])) > 0`, lokiFile + ":4"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d rows, want %d: %q", len(records), len(want), records)
+	}
+	for i := range want {
+		if strings.Join(records[i], "\x00") != strings.Join(want[i], "\x00") {
+			t.Errorf("row %d = %q, want %q", i, records[i], want[i])
+		}
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	files, err := rules.Parse("api.yaml", []byte(mimirRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := WriteMarkdown(&b, Build("mimir", files)); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Alert catalog\n\n1 alert(s).\n\n" +
+		"| Alert | Source | Namespace | Group | Severity | Team | For | Summary | Runbook | Expression | File |\n" +
+		"| --- | --- | --- | --- | --- | --- | --- | --- | --- | --- | --- |\n" +
+		"| ApiDown | mimir | api | api | critical | api | 5m | The API \\| gateway is down | [runbook](https://runbooks/api-down) | `up{job=\"api\"} == 0` | api.yaml:7 |\n"
+	if b.String() != want {
+		t.Errorf("WriteMarkdown =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b strings.Builder
+	if err := WriteJSON(&b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "[]\n" {
+		t.Errorf("WriteJSON of no entries = %q", b.String())
+	}
+
+	files, err := rules.Parse("loki.yaml", []byte(lokiRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err := WriteJSON(&b, Build("loki", files)); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range got[0] {
+		keys = append(keys, k)
+	}
+	if len(got) != 1 || len(keys) != 8 || got[0]["runbook"] != "see the wiki" || got[0]["line"] != float64(4) {
+		t.Errorf("WriteJSON = %s", b.String())
+	}
+	if !strings.Contains(b.String(), `[5m])) > 0`) {
+		t.Errorf("WriteJSON escaped HTML in the expression: %s", b.String())
+	}
+}
+
+func TestRunUnknownFormat(t *testing.T) {
+	mimirDir, _ := writeRules(t)
+	err := Run(Options{MimirPaths: []string{mimirDir}, Format: "xml", Output: filepath.Join(t.TempDir(), "out")})
+	if err == nil || err.Error() != `unknown output format "xml", expected markdown, csv or json` {
+		t.Errorf("Run error = %v", err)
+	}
+}
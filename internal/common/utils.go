@@ -64,3 +64,15 @@ func EnsureDir(dirName string) error {
 	}
 	return nil
 }
+
+// SplitList splits a comma-separated flag value into its trimmed, non-empty
+// elements.
+func SplitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,509 @@
+// Package controller reconciles labelled ConfigMaps and PrometheusRule
+// objects of a Kubernetes cluster into Mimir and Loki. Each object's
+// tenant comes from a label on its namespace; the objects of a tenant are
+// staged as files and synced with the same code paths as the mimir-rules,
+// loki-rules and alertmanager subcommands. Results are reported as events
+// on the objects.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/alertmanager"
+	"github.com/antnsn/mal-sync/internal/common"
+	"github.com/antnsn/mal-sync/internal/kube"
+	"github.com/antnsn/mal-sync/internal/lokirules"
+	"github.com/antnsn/mal-sync/internal/mimirrules"
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+const (
+	// TypeLabel selects the objects the controller syncs and says what they
+	// hold: TypeMimirRules, TypeLokiRules or TypeAlertmanager.
+	TypeLabel = "mal-sync/type"
+
+	// DefaultTenantLabel is the namespace label holding the tenant.
+	DefaultTenantLabel = "mal-sync/tenant"
+
+	TypeMimirRules   = "mimir-rules"
+	TypeLokiRules    = "loki-rules"
+	TypeAlertmanager = "alertmanager" // ConfigMaps only
+
+	// alertmanagerConfigKey is the ConfigMap key of the Alertmanager
+	// config; keys ending in .tmpl are its templates.
+	alertmanagerConfigKey = "alertmanager.yaml"
+
+	// maxEventMessage keeps event messages within what the API accepts.
+	maxEventMessage = 1024
+)
+
+// Options configures the controller.
+type Options struct {
+	MimirAddress    string
+	LokiAddress     string        // Optional; loki-rules objects fail to sync without it
+	TenantLabel     string        // Namespace label holding the tenant; DefaultTenantLabel when empty
+	NamespaceFormat string        // Rule namespace of objects without one, from {namespace} and {name}; rules.DefaultNamespaceFormat when empty
+	ResyncInterval  time.Duration // Sync unchanged tenants again after this long to undo drift; 0 only syncs changes
+	TempBaseDir     string
+}
+
+// Controller reconciles objects into Mimir and Loki. The Sync and Delete
+// functions default to the real ones and may be replaced, like API, to
+// test the controller without a cluster, Mimir or Loki.
+type Controller struct {
+	API                kube.API
+	Options            Options
+	SyncMimirRules     func(mimirrules.Options) error
+	SyncLokiRules      func(lokirules.Options) error
+	SyncAlertmanager   func(alertmanager.Options) error
+	DeleteAlertmanager func(alertmanager.Options) error
+
+	synced   map[string]syncState // last sync of each target that may have left something behind
+	reported map[string]string    // last event reported for each object UID
+}
+
+// syncState records the objects a target was last synced with, and the
+// rule namespaces they had, which are deleted once no object defines them.
+type syncState struct {
+	fingerprint string
+	at          time.Time
+	namespaces  []string
+	failed      bool // the sync failed and may have been partly applied
+}
+
+// target is the set of objects of one type synced to one tenant.
+type target struct {
+	typ     string
+	tenant  string
+	objects []kube.Object
+}
+
+func (t *target) key() string { return t.typ + "/" + t.tenant }
+
+// New returns a controller using the real syncs.
+func New(api kube.API, opts Options) *Controller {
+	if opts.TenantLabel == "" {
+		opts.TenantLabel = DefaultTenantLabel
+	}
+	if opts.NamespaceFormat == "" {
+		opts.NamespaceFormat = rules.DefaultNamespaceFormat
+	}
+	return &Controller{
+		API:                api,
+		Options:            opts,
+		SyncMimirRules:     mimirrules.Sync,
+		SyncLokiRules:      lokirules.Sync,
+		SyncAlertmanager:   alertmanager.Sync,
+		DeleteAlertmanager: alertmanager.Delete,
+		synced:             map[string]syncState{},
+		reported:           map[string]string{},
+	}
+}
+
+// Run reconciles until ctx is done: once at start, whenever a watched
+// namespace, ConfigMap or PrometheusRule changes, and every resync
+// interval. Failed targets are retried on the next of these.
+func (c *Controller) Run(ctx context.Context) error {
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	go c.watch(ctx, kube.Namespaces, "", notify)
+	go c.watch(ctx, kube.ConfigMaps, TypeLabel, notify)
+	go c.watch(ctx, kube.PrometheusRules, TypeLabel, notify)
+
+	var tick <-chan time.Time
+	if c.Options.ResyncInterval > 0 {
+		ticker := time.NewTicker(c.Options.ResyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		if err := c.Reconcile(ctx); err != nil {
+			log.Printf("Reconcile failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+		case <-trigger:
+			// Let a burst of changes, such as a helm upgrade, settle
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(2 * time.Second):
+			}
+			select {
+			case <-trigger:
+			default:
+			}
+		}
+	}
+}
+
+// watch watches a resource until ctx is done, re-establishing the watch
+// whenever it ends.
+func (c *Controller) watch(ctx context.Context, res kube.Resource, selector string, changed func()) {
+	for ctx.Err() == nil {
+		err := c.API.Watch(ctx, res, selector, changed)
+		if kube.IsNotFound(err) {
+			log.Printf("Not watching %s: the resource is not installed", res.Plural)
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Watch of %s failed, retrying: %v", res.Plural, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+// Reconcile syncs every tenant whose objects changed since their last
+// successful sync, or whose resync interval has passed. A tenant synced
+// before that has no objects of a type left, because they were deleted,
+// lost their type label or moved to another tenant, gets an empty sync
+// deleting what the controller synced to it.
+func (c *Controller) Reconcile(ctx context.Context) error {
+	// 1. Map namespaces to tenants
+	namespaces, err := c.API.List(ctx, kube.Namespaces, "")
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	tenants := map[string]string{}
+	for _, ns := range namespaces {
+		if tenant := ns.Metadata.Labels[c.Options.TenantLabel]; tenant != "" {
+			tenants[ns.Metadata.Name] = tenant
+		}
+	}
+
+	// 2. Collect the labelled ConfigMaps and PrometheusRules
+	objects, err := c.API.List(ctx, kube.ConfigMaps, TypeLabel)
+	if err != nil {
+		return fmt.Errorf("failed to list ConfigMaps: %w", err)
+	}
+	promRules, err := c.API.List(ctx, kube.PrometheusRules, TypeLabel)
+	if err != nil && !kube.IsNotFound(err) {
+		return fmt.Errorf("failed to list PrometheusRules: %w", err)
+	}
+	objects = append(objects, promRules...)
+
+	// 3. Group them by type and tenant, forgetting objects that are gone
+	seen := map[string]bool{}
+	for _, obj := range objects {
+		seen[objectUID(obj)] = true
+	}
+	for uid := range c.reported {
+		if !seen[uid] {
+			delete(c.reported, uid)
+		}
+	}
+	targets := map[string]*target{}
+	for _, obj := range objects {
+		meta := obj.Metadata
+		typ := meta.Labels[TypeLabel]
+		switch {
+		case typ != TypeMimirRules && typ != TypeLokiRules && typ != TypeAlertmanager:
+			c.report(ctx, obj, "Warning", "InvalidType", fmt.Sprintf("label %s must be %s, %s or %s, got %q", TypeLabel, TypeMimirRules, TypeLokiRules, TypeAlertmanager, typ))
+			continue
+		case typ == TypeAlertmanager && obj.Kind != "ConfigMap":
+			c.report(ctx, obj, "Warning", "InvalidType", fmt.Sprintf("only ConfigMaps can hold an Alertmanager config, not %s", obj.Kind))
+			continue
+		}
+		tenant := tenants[meta.Namespace]
+		if tenant == "" {
+			c.report(ctx, obj, "Warning", "NoTenant", fmt.Sprintf("namespace %s has no %s label", meta.Namespace, c.Options.TenantLabel))
+			continue
+		}
+		t := &target{typ: typ, tenant: tenant}
+		if existing, ok := targets[t.key()]; ok {
+			t = existing
+		} else {
+			targets[t.key()] = t
+		}
+		t.objects = append(t.objects, obj)
+	}
+
+	// 4. Sync each target whose objects changed, including the targets
+	// synced before that have no objects left
+	for k := range c.synced {
+		if targets[k] == nil {
+			typ, tenant, _ := strings.Cut(k, "/")
+			targets[k] = &target{typ: typ, tenant: tenant}
+		}
+	}
+	keys := make([]string, 0, len(targets))
+	for k := range targets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	failed := 0
+	for _, k := range keys {
+		t := targets[k]
+		sort.Slice(t.objects, func(i, j int) bool { return objectName(t.objects[i]) < objectName(t.objects[j]) })
+		fp := fingerprint(t.objects)
+		last, ok := c.synced[k]
+		if ok && !last.failed && last.fingerprint == fp && (c.Options.ResyncInterval <= 0 || time.Since(last.at) < c.Options.ResyncInterval) {
+			continue
+		}
+		if len(t.objects) == 0 {
+			log.Printf("No objects left for %s tenant %s, deleting what was synced to it", t.typ, t.tenant)
+		} else {
+			log.Printf("Syncing %d object(s) to %s tenant %s", len(t.objects), t.typ, t.tenant)
+		}
+		namespaces, err := c.syncTarget(t, last.namespaces)
+		if err != nil {
+			failed++
+			// Remember the target, so what it may have synced is still
+			// deleted if its objects go away before a sync succeeds
+			c.synced[k] = syncState{namespaces: union(last.namespaces, namespaces), failed: true}
+			log.Printf("Sync of %s tenant %s failed: %v", t.typ, t.tenant, err)
+			for _, obj := range t.objects {
+				c.report(ctx, obj, "Warning", "SyncFailed", fmt.Sprintf("sync to %s tenant %s failed: %v", t.typ, t.tenant, err))
+			}
+			continue
+		}
+		if len(t.objects) == 0 {
+			delete(c.synced, k)
+			continue
+		}
+		c.synced[k] = syncState{fingerprint: fp, at: time.Now(), namespaces: namespaces}
+		for _, obj := range t.objects {
+			c.report(ctx, obj, "Normal", "Synced", fmt.Sprintf("synced to %s tenant %s", t.typ, t.tenant))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d target(s) failed to sync", failed, len(targets))
+	}
+	return nil
+}
+
+// syncTarget stages the objects of t as files and syncs them, deleting the
+// rule namespaces of prune that no object defines anymore. A target
+// without objects deletes the tenant's Alertmanager config or the rule
+// namespaces of prune. It returns the rule namespaces staged.
+func (c *Controller) syncTarget(t *target, prune []string) ([]string, error) {
+	dir := filepath.Join(c.Options.TempBaseDir, fmt.Sprintf("mal-sync-controller-%d", os.Getpid()), t.typ, strings.ReplaceAll(t.tenant, "/", "_"))
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clean staging directory %s: %w", dir, err)
+	}
+	if err := common.EnsureDir(dir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	switch t.typ {
+	case TypeMimirRules, TypeLokiRules:
+		if err := stageRules(dir, t.objects, c.Options.NamespaceFormat); err != nil {
+			return nil, err
+		}
+		namespaces, err := stagedNamespaces(dir, c.Options.NamespaceFormat)
+		if err != nil {
+			return nil, err
+		}
+		if t.typ == TypeLokiRules {
+			if c.Options.LokiAddress == "" {
+				return namespaces, fmt.Errorf("no Loki address configured")
+			}
+			return namespaces, c.SyncLokiRules(lokirules.Options{
+				RulesPath:       dir,
+				LokiAddress:     c.Options.LokiAddress,
+				OrgID:           t.tenant,
+				NamespaceFormat: c.Options.NamespaceFormat,
+				Prune:           prune,
+				TempBaseDir:     c.Options.TempBaseDir,
+			})
+		}
+		return namespaces, c.SyncMimirRules(mimirrules.Options{
+			RulesPath:       dir,
+			MimirAddress:    c.Options.MimirAddress,
+			MimirID:         t.tenant,
+			NamespaceFormat: c.Options.NamespaceFormat,
+			Prune:           prune,
+			TempBaseDir:     c.Options.TempBaseDir,
+		})
+	}
+	if len(t.objects) == 0 {
+		return nil, c.DeleteAlertmanager(alertmanager.Options{MimirAddress: c.Options.MimirAddress, MimirID: t.tenant})
+	}
+	opts, err := stageAlertmanager(dir, t.objects)
+	if err != nil {
+		return nil, err
+	}
+	opts.MimirAddress = c.Options.MimirAddress
+	opts.MimirID = t.tenant
+	opts.TempBaseDir = c.Options.TempBaseDir
+	return nil, c.SyncAlertmanager(opts)
+}
+
+// stagedNamespaces returns the rule namespaces of the files stageRules
+// wrote to dir, derived the way the syncs derive them.
+func stagedNamespaces(dir, format string) ([]string, error) {
+	paths, err := rules.ResolveFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := rules.LoadFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	if err := rules.ApplyNamespaceFormat(files, format); err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, f := range files {
+		namespaces = append(namespaces, f.Namespace)
+	}
+	return union(namespaces), nil
+}
+
+// union returns the distinct strings of lists, sorted.
+func union(lists ...[]string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, list := range lists {
+		for _, s := range list {
+			if !seen[s] {
+				seen[s] = true
+				out = append(out, s)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// stageRules writes the rule files of ConfigMaps and the PrometheusRule
+// manifests to dir. Rule files without a namespace get the one format
+// derives from their ConfigMap.
+func stageRules(dir string, objects []kube.Object, format string) error {
+	for _, obj := range objects {
+		meta := obj.Metadata
+		if obj.Kind == "PrometheusRule" {
+			doc := yamlnode.FromInterface(obj.Raw)
+			doc.Get("metadata").Delete("managedFields")
+			doc.Delete("status")
+			path := filepath.Join(dir, meta.Namespace+"_"+meta.Name+".yaml")
+			if err := os.WriteFile(path, yamlnode.Encode(doc), 0640); err != nil {
+				return fmt.Errorf("failed to stage PrometheusRule %s/%s: %w", meta.Namespace, meta.Name, err)
+			}
+			continue
+		}
+		keys := make([]string, 0, len(obj.Data))
+		for k := range obj.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !rules.IsRuleFile(key) {
+				log.Printf("Skipping key %s of ConfigMap %s/%s: not a .yaml, .yml or .json rule file", key, meta.Namespace, meta.Name)
+				continue
+			}
+			data := []byte(obj.Data[key])
+			docs, err := yamlnode.Parse(data)
+			if err != nil {
+				return fmt.Errorf("ConfigMap %s/%s key %s: %w", meta.Namespace, meta.Name, key, err)
+			}
+			if len(docs) == 1 && docs[0].Kind == yamlnode.MappingNode && docs[0].Get("namespace") == nil && !rules.IsManifest(docs[0]) {
+				ns := rules.FormatNamespace(format, meta.Namespace, meta.Name)
+				docs[0].Content = append([]*yamlnode.Node{yamlnode.NewScalar("namespace"), yamlnode.NewString(ns)}, docs[0].Content...)
+				data = yamlnode.Encode(docs[0])
+			}
+			path := filepath.Join(dir, meta.Namespace+"_"+meta.Name+"_"+key)
+			if err := os.WriteFile(path, data, 0640); err != nil {
+				return fmt.Errorf("failed to stage ConfigMap %s/%s key %s: %w", meta.Namespace, meta.Name, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stageAlertmanager writes the Alertmanager config and templates of the
+// tenant's only alertmanager ConfigMap to dir.
+func stageAlertmanager(dir string, objects []kube.Object) (alertmanager.Options, error) {
+	if len(objects) != 1 {
+		names := make([]string, len(objects))
+		for i, obj := range objects {
+			names[i] = objectName(obj)
+		}
+		return alertmanager.Options{}, fmt.Errorf("found %d Alertmanager ConfigMaps (%s), a tenant can only have one", len(objects), strings.Join(names, ", "))
+	}
+	obj := objects[0]
+	config, ok := obj.Data[alertmanagerConfigKey]
+	if !ok {
+		return alertmanager.Options{}, fmt.Errorf("ConfigMap %s has no %s key", objectName(obj), alertmanagerConfigKey)
+	}
+	opts := alertmanager.Options{ConfigFile: filepath.Join(dir, alertmanagerConfigKey)}
+	if err := os.WriteFile(opts.ConfigFile, []byte(config), 0640); err != nil {
+		return opts, fmt.Errorf("failed to stage Alertmanager config: %w", err)
+	}
+	templatesDir := filepath.Join(dir, "templates")
+	for key, text := range obj.Data {
+		if !strings.HasSuffix(key, ".tmpl") {
+			continue
+		}
+		if err := common.EnsureDir(templatesDir); err != nil {
+			return opts, err
+		}
+		if err := os.WriteFile(filepath.Join(templatesDir, key), []byte(text), 0640); err != nil {
+			return opts, fmt.Errorf("failed to stage template %s: %w", key, err)
+		}
+		opts.TemplateDirs = []string{templatesDir}
+	}
+	return opts, nil
+}
+
+// report records an event on obj, unless the same event was the last one
+// reported for it.
+func (c *Controller) report(ctx context.Context, obj kube.Object, typ, reason, message string) {
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+	uid := objectUID(obj)
+	key := reason + "\x00" + message
+	if c.reported[uid] == key {
+		return
+	}
+	if typ == "Warning" {
+		log.Printf("%s %s: %s: %s", obj.Kind, objectName(obj), reason, message)
+	}
+	if err := c.API.RecordEvent(ctx, kube.Event{Object: obj, Type: typ, Reason: reason, Message: message}); err != nil {
+		log.Printf("Failed to record event on %s %s: %v", obj.Kind, objectName(obj), err)
+		return
+	}
+	c.reported[uid] = key
+}
+
+// objectUID identifies obj, falling back to its kind and name for API
+// servers that do not set UIDs.
+func objectUID(obj kube.Object) string {
+	if obj.Metadata.UID != "" {
+		return obj.Metadata.UID
+	}
+	return obj.Kind + "/" + objectName(obj)
+}
+
+func objectName(obj kube.Object) string {
+	return obj.Metadata.Namespace + "/" + obj.Metadata.Name
+}
+
+// fingerprint identifies the versions of a target's objects.
+func fingerprint(objects []kube.Object) string {
+	parts := make([]string, len(objects))
+	for i, obj := range objects {
+		parts[i] = obj.Kind + "/" + objectName(obj) + "@" + obj.Metadata.ResourceVersion
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,339 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/alertmanager"
+	"github.com/antnsn/mal-sync/internal/kube"
+	"github.com/antnsn/mal-sync/internal/lokirules"
+	"github.com/antnsn/mal-sync/internal/mimirrules"
+)
+
+// fakeAPI is an in-memory kube.API. Selectors are label names, as the
+// controller uses them.
+type fakeAPI struct {
+	mu      sync.Mutex
+	objects map[string][]kube.Object // by resource plural
+	version int
+	events  []kube.Event
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{objects: map[string][]kube.Object{}}
+}
+
+func (f *fakeAPI) List(ctx context.Context, res kube.Resource, selector string) ([]kube.Object, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []kube.Object
+	for _, obj := range f.objects[res.Plural] {
+		if _, ok := obj.Metadata.Labels[selector]; selector == "" || ok {
+			out = append(out, obj)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeAPI) Watch(ctx context.Context, res kube.Resource, selector string, changed func()) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeAPI) RecordEvent(ctx context.Context, ev kube.Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, ev)
+	return nil
+}
+
+// put creates or replaces an object, bumping its resource version.
+func (f *fakeAPI) put(res kube.Resource, obj kube.Object) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version++
+	obj.Kind = res.Kind
+	obj.Metadata.UID = res.Kind + "/" + obj.Metadata.Namespace + "/" + obj.Metadata.Name
+	obj.Metadata.ResourceVersion = fmt.Sprint(f.version)
+	list := f.objects[res.Plural]
+	for i, o := range list {
+		if o.Metadata.UID == obj.Metadata.UID {
+			list[i] = obj
+			return
+		}
+	}
+	f.objects[res.Plural] = append(list, obj)
+}
+
+func (f *fakeAPI) remove(res kube.Resource, namespace, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := f.objects[res.Plural]
+	for i, o := range list {
+		if o.Metadata.Namespace == namespace && o.Metadata.Name == name {
+			f.objects[res.Plural] = append(list[:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+func namespace(name, tenant string) kube.Object {
+	obj := kube.Object{Metadata: kube.ObjectMeta{Name: name, Labels: map[string]string{}}}
+	if tenant != "" {
+		obj.Metadata.Labels[DefaultTenantLabel] = tenant
+	}
+	return obj
+}
+
+func configMap(namespace, name, typ string, data map[string]string) kube.Object {
+	return kube.Object{
+		Metadata: kube.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{TypeLabel: typ}},
+		Data:     data,
+	}
+}
+
+// syncs records the syncs the controller runs instead of the real ones.
+type syncs struct {
+	calls []string
+	fail  map[string]bool // tenants whose syncs fail
+}
+
+func (s *syncs) rules(typ, tenant, dir string, prune []string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+	s.calls = append(s.calls, fmt.Sprintf("%s %s files=%v prune=%v", typ, tenant, files, prune))
+	if s.fail[tenant] {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+func (s *syncs) alertmanager(action, tenant string) error {
+	s.calls = append(s.calls, action+" "+tenant)
+	if s.fail[tenant] {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+// take returns the calls made since the last call, sorted.
+func (s *syncs) take() string {
+	calls := s.calls
+	s.calls = nil
+	sort.Strings(calls)
+	return strings.Join(calls, "\n")
+}
+
+func newTestController(t *testing.T, api kube.API) (*Controller, *syncs) {
+	t.Helper()
+	s := &syncs{fail: map[string]bool{}}
+	c := New(api, Options{MimirAddress: "http://mimir", LokiAddress: "http://loki", TempBaseDir: t.TempDir()})
+	c.SyncMimirRules = func(o mimirrules.Options) error { return s.rules("mimir", o.MimirID, o.RulesPath, o.Prune) }
+	c.SyncLokiRules = func(o lokirules.Options) error { return s.rules("loki", o.OrgID, o.RulesPath, o.Prune) }
+	c.SyncAlertmanager = func(o alertmanager.Options) error {
+		if _, err := os.Stat(o.ConfigFile); err != nil {
+			return err
+		}
+		return s.alertmanager("alertmanager load", o.MimirID)
+	}
+	c.DeleteAlertmanager = func(o alertmanager.Options) error { return s.alertmanager("alertmanager delete", o.MimirID) }
+	return c, s
+}
+
+// reconcile runs c.Reconcile and checks the syncs it ran and, when
+// wantErr is not empty, that it failed with wantErr.
+func reconcile(t *testing.T, c *Controller, s *syncs, want string, wantErr ...string) {
+	t.Helper()
+	err := c.Reconcile(context.Background())
+	if len(wantErr) == 0 && err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(wantErr) > 0 && (err == nil || err.Error() != wantErr[0]) {
+		t.Errorf("Reconcile error = %v, want %s", err, wantErr[0])
+	}
+	if got := s.take(); got != want {
+		t.Errorf("Reconcile ran:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+const ruleFile = "groups:\n  - name: g\n    rules:\n      - alert: A\n        expr: vector(1)\n"
+
+func TestReconcile(t *testing.T) {
+	api := newFakeAPI()
+	api.put(kube.Namespaces, namespace("ns-a", "team-a"))
+	api.put(kube.ConfigMaps, configMap("ns-a", "alerts", TypeMimirRules, map[string]string{"a.yaml": ruleFile}))
+	api.put(kube.ConfigMaps, configMap("ns-a", "more", TypeMimirRules, map[string]string{"b.yaml": "namespace: shared\n" + ruleFile}))
+	api.put(kube.ConfigMaps, configMap("ns-a", "am", TypeAlertmanager, map[string]string{"alertmanager.yaml": "route:\n  receiver: x\nreceivers:\n  - name: x\n"}))
+	c, s := newTestController(t, api)
+
+	reconcile(t, c, s, "alertmanager load team-a\nmimir team-a files=[ns-a_alerts_a.yaml ns-a_more_b.yaml] prune=[]")
+	reconcile(t, c, s, "")
+
+	// Deleting one of the objects syncs the rest, which deletes the
+	// namespace it defined
+	api.remove(kube.ConfigMaps, "ns-a", "more")
+	reconcile(t, c, s, "mimir team-a files=[ns-a_alerts_a.yaml] prune=[ns-a-alerts shared]")
+
+	// Deleting the last one syncs the tenant with nothing
+	api.remove(kube.ConfigMaps, "ns-a", "alerts")
+	reconcile(t, c, s, "mimir team-a files=[] prune=[ns-a-alerts]")
+	reconcile(t, c, s, "")
+
+	// So does removing the type label of the Alertmanager config
+	am := api.objects[kube.ConfigMaps.Plural][0]
+	am.Metadata.Labels = map[string]string{}
+	api.put(kube.ConfigMaps, am)
+	reconcile(t, c, s, "alertmanager delete team-a")
+	reconcile(t, c, s, "")
+}
+
+func TestReconcileTenantChange(t *testing.T) {
+	api := newFakeAPI()
+	api.put(kube.Namespaces, namespace("ns-a", "team-a"))
+	api.put(kube.ConfigMaps, configMap("ns-a", "alerts", TypeLokiRules, map[string]string{"a.yaml": ruleFile}))
+	c, s := newTestController(t, api)
+	reconcile(t, c, s, "loki team-a files=[ns-a_alerts_a.yaml] prune=[]")
+
+	api.put(kube.Namespaces, namespace("ns-a", "team-b"))
+	reconcile(t, c, s, "loki team-a files=[] prune=[ns-a-alerts]\nloki team-b files=[ns-a_alerts_a.yaml] prune=[]")
+	reconcile(t, c, s, "")
+
+	// Losing the tenant label leaves no tenant to sync the objects to
+	api.put(kube.Namespaces, namespace("ns-a", ""))
+	reconcile(t, c, s, "loki team-b files=[] prune=[ns-a-alerts]")
+	if last := api.events[len(api.events)-1]; last.Reason != "NoTenant" {
+		t.Errorf("last event %s: %s, want NoTenant", last.Reason, last.Message)
+	}
+}
+
+func TestReconcileRetriesEmptySync(t *testing.T) {
+	api := newFakeAPI()
+	api.put(kube.Namespaces, namespace("ns-a", "team-a"))
+	api.put(kube.ConfigMaps, configMap("ns-a", "alerts", TypeMimirRules, map[string]string{"a.yaml": ruleFile}))
+	c, s := newTestController(t, api)
+	reconcile(t, c, s, "mimir team-a files=[ns-a_alerts_a.yaml] prune=[]")
+
+	api.remove(kube.ConfigMaps, "ns-a", "alerts")
+	s.fail["team-a"] = true
+	reconcile(t, c, s, "mimir team-a files=[] prune=[ns-a-alerts]", "1 of 1 target(s) failed to sync")
+	reconcile(t, c, s, "mimir team-a files=[] prune=[ns-a-alerts]", "1 of 1 target(s) failed to sync")
+	s.fail["team-a"] = false
+	reconcile(t, c, s, "mimir team-a files=[] prune=[ns-a-alerts]")
+	reconcile(t, c, s, "")
+}
+
+func TestReconcileFailedSyncIsCleanedUp(t *testing.T) {
+	api := newFakeAPI()
+	api.put(kube.Namespaces, namespace("ns-a", "team-a"))
+	api.put(kube.ConfigMaps, configMap("ns-a", "alerts", TypeMimirRules, map[string]string{"a.yaml": ruleFile}))
+	c, s := newTestController(t, api)
+	s.fail["team-a"] = true
+	reconcile(t, c, s, "mimir team-a files=[ns-a_alerts_a.yaml] prune=[]", "1 of 1 target(s) failed to sync")
+
+	// The failed sync may have been partly applied, so it is cleaned up
+	s.fail["team-a"] = false
+	api.remove(kube.ConfigMaps, "ns-a", "alerts")
+	reconcile(t, c, s, "mimir team-a files=[] prune=[ns-a-alerts]")
+}
+
+func TestReconcileEvents(t *testing.T) {
+	api := newFakeAPI()
+	api.put(kube.Namespaces, namespace("ns-a", "team-a"))
+	api.put(kube.Namespaces, namespace("ns-b", ""))
+	api.put(kube.ConfigMaps, configMap("ns-a", "ok", TypeMimirRules, map[string]string{"a.yaml": ruleFile}))
+	api.put(kube.ConfigMaps, configMap("ns-a", "bad", "prometheus", nil))
+	api.put(kube.ConfigMaps, configMap("ns-b", "orphan", TypeMimirRules, map[string]string{"a.yaml": ruleFile}))
+	api.put(kube.PrometheusRules, kube.Object{
+		Metadata: kube.ObjectMeta{Namespace: "ns-a", Name: "am", Labels: map[string]string{TypeLabel: TypeAlertmanager}},
+		Raw:      map[string]any{},
+	})
+	c, s := newTestController(t, api)
+	reconcile(t, c, s, "mimir team-a files=[ns-a_ok_a.yaml] prune=[]")
+
+	var got []string
+	for _, ev := range api.events {
+		got = append(got, fmt.Sprintf("%s %s %s", ev.Object.Metadata.Name, ev.Type, ev.Reason))
+	}
+	sort.Strings(got)
+	want := []string{"am Warning InvalidType", "bad Warning InvalidType", "ok Normal Synced", "orphan Warning NoTenant"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	// Unchanged events are not recorded again
+	api.put(kube.ConfigMaps, configMap("ns-a", "ok", TypeMimirRules, map[string]string{"a.yaml": ruleFile}))
+	reconcile(t, c, s, "mimir team-a files=[ns-a_ok_a.yaml] prune=[ns-a-ok]")
+	if len(api.events) != len(want) {
+		t.Errorf("recorded %d events, want %d", len(api.events), len(want))
+	}
+}
+
+func TestStageRules(t *testing.T) {
+	dir := t.TempDir()
+	objects := []kube.Object{
+		configMap("ns-a", "cm", TypeMimirRules, map[string]string{"a.yaml": ruleFile, "README.md": "x", "b.yml": "namespace: own\n" + ruleFile}),
+		{Kind: "PrometheusRule", Metadata: kube.ObjectMeta{Namespace: "ns-a", Name: "pr"}, Raw: map[string]any{
+			"apiVersion": "monitoring.coreos.com/v1",
+			"kind":       "PrometheusRule",
+			"metadata":   map[string]any{"name": "pr", "namespace": "ns-a", "managedFields": []any{map[string]any{"manager": "kubectl"}}},
+			"spec":       map[string]any{"groups": []any{map[string]any{"name": "g", "rules": []any{map[string]any{"record": "r", "expr": "vector(1)"}}}}},
+			"status":     map[string]any{},
+		}},
+	}
+	if err := stageRules(dir, objects, "{namespace}/{name}"); err != nil {
+		t.Fatal(err)
+	}
+	namespaces, err := stagedNamespaces(dir, "{namespace}/{name}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(namespaces, " "); got != "ns-a/cm ns-a/pr own" {
+		t.Errorf("staged namespaces = %s", got)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "ns-a_pr.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "managedFields") || strings.Contains(string(data), "status") {
+		t.Errorf("staged PrometheusRule kept managedFields or status:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ns-a_cm_README.md")); err == nil {
+		t.Error("staged a key that is not a rule file")
+	}
+}
+
+func TestStageAlertmanager(t *testing.T) {
+	dir := t.TempDir()
+	obj := configMap("ns-a", "am", TypeAlertmanager, map[string]string{"alertmanager.yaml": "route: {}\n", "mail.tmpl": "{{ define \"x\" }}{{ end }}"})
+	opts, err := stageAlertmanager(dir, []kube.Object{obj})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ConfigFile != filepath.Join(dir, "alertmanager.yaml") || len(opts.TemplateDirs) != 1 {
+		t.Errorf("staged %+v", opts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "templates", "mail.tmpl")); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := stageAlertmanager(dir, []kube.Object{obj, obj}); err == nil || !strings.Contains(err.Error(), "a tenant can only have one") {
+		t.Errorf("two configs: error = %v", err)
+	}
+	delete(obj.Data, "alertmanager.yaml")
+	if _, err := stageAlertmanager(dir, []kube.Object{obj}); err == nil || !strings.Contains(err.Error(), "has no alertmanager.yaml key") {
+		t.Errorf("missing config: error = %v", err)
+	}
+}
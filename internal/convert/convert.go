@@ -0,0 +1,126 @@
+// Package convert converts between plain rule files and Prometheus
+// Operator PrometheusRule manifests.
+package convert
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// Options configures "convert".
+type Options struct {
+	Paths           []string // Rule files, manifests, or directories of them
+	To              string   // "crd" or "rules"
+	Output          string   // File, or directory when converting to rules; stdout when empty
+	Name            string   // metadata.name of the PrometheusRule; derived from the file name when empty
+	Namespace       string   // metadata.namespace of the PrometheusRule; unset when empty
+	NamespaceFormat string   // Ruler namespace of PrometheusRule objects; rules.DefaultNamespaceFormat when empty
+}
+
+// Run converts the files under opts.Paths. Converting to "crd" turns every
+// rule file into a PrometheusRule, written as one multi-document manifest.
+// Converting to "rules" turns every PrometheusRule into a rule file; with
+// an Output directory each is written to a file of its own, otherwise they
+// are written as one multi-document stream. Files already in the target
+// format are skipped.
+func Run(opts Options) error {
+	var files []*rules.File
+	for _, path := range opts.Paths {
+		paths, err := rules.ResolveFiles(path)
+		if err != nil {
+			return err
+		}
+		loaded, err := rules.LoadFiles(paths)
+		if err != nil {
+			return err
+		}
+		files = append(files, loaded...)
+	}
+	if opts.NamespaceFormat != "" {
+		if err := rules.ApplyNamespaceFormat(files, opts.NamespaceFormat); err != nil {
+			return err
+		}
+	}
+	switch opts.To {
+	case "crd":
+		return toCRD(files, opts)
+	case "rules":
+		return toRules(files, opts)
+	}
+	return fmt.Errorf("unknown conversion target %q, expected crd or rules", opts.To)
+}
+
+func toCRD(files []*rules.File, opts Options) error {
+	var plain []*rules.File
+	for _, f := range files {
+		if f.Manifest != nil {
+			log.Printf("Skipping PrometheusRule %s/%s in %s: already a manifest", f.Manifest.Namespace, f.Manifest.Name, f.Path)
+			continue
+		}
+		plain = append(plain, f)
+	}
+	if len(plain) == 0 {
+		return fmt.Errorf("nothing to convert: no plain rule files found")
+	}
+	if opts.Name != "" && len(plain) > 1 {
+		return fmt.Errorf("-name can only be used when converting a single rule file, got %d", len(plain))
+	}
+	var docs []*yamlnode.Node
+	for _, f := range plain {
+		name := opts.Name
+		if name == "" {
+			base := filepath.Base(f.Path)
+			name = rules.ObjectName(strings.TrimSuffix(base, filepath.Ext(base)))
+		}
+		docs = append(docs, rules.ToPrometheusRule(f, name, opts.Namespace))
+	}
+	return write(opts.Output, docs, "PrometheusRule")
+}
+
+func toRules(files []*rules.File, opts Options) error {
+	var docs []*yamlnode.Node
+	var names []string
+	for _, f := range files {
+		if f.Manifest == nil {
+			log.Printf("Skipping %s: already a rule file", f.Path)
+			continue
+		}
+		docs = append(docs, f.Doc)
+		names = append(names, rules.ObjectName(f.Manifest.Namespace+"-"+f.Manifest.Name)+".yaml")
+	}
+	if len(docs) == 0 {
+		return fmt.Errorf("nothing to convert: no PrometheusRule objects found")
+	}
+	if info, err := os.Stat(opts.Output); err != nil || !info.IsDir() {
+		return write(opts.Output, docs, "rule file")
+	}
+	for i, doc := range docs {
+		path := filepath.Join(opts.Output, names[i])
+		if err := os.WriteFile(path, yamlnode.Encode(doc), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		log.Printf("Wrote %s", path)
+	}
+	return nil
+}
+
+// write writes docs as one multi-document stream to output, or to stdout
+// when output is empty.
+func write(output string, docs []*yamlnode.Node, kind string) error {
+	data := yamlnode.Encode(docs...)
+	if output == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", output, err)
+	}
+	log.Printf("Wrote %d %s(s) to %s", len(docs), kind, output)
+	return nil
+}
@@ -0,0 +1,160 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRunToCRD(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"api.yaml":  "namespace: team-a\ngroups:\n  - name: api\n    rules:\n      - alert: ApiDown\n        expr: up == 0\n",
+		"Nodes.yml": "groups:\n  - name: nodes\n    rules:\n      - record: job:up:sum\n        expr: sum(up)\n",
+	})
+	out := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := Run(Options{Paths: []string{dir}, To: "crd", Output: out, Namespace: "monitoring"}); err != nil {
+		t.Fatal(err)
+	}
+	// Files are converted in path order and names are made valid
+	want := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: nodes
+  namespace: monitoring
+spec:
+  groups:
+    - name: nodes
+      rules:
+        - record: job:up:sum
+          expr: sum(up)
+---
+apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: api
+  namespace: monitoring
+  annotations:
+    mal-sync/namespace: team-a
+spec:
+  groups:
+    - name: api
+      rules:
+        - alert: ApiDown
+          expr: up == 0
+`
+	if got := readFile(t, out); got != want {
+		t.Errorf("manifest =\n%s\nwant\n%s", got, want)
+	}
+
+	// Manifests are skipped when converting to manifests
+	if err := Run(Options{Paths: []string{out}, To: "crd", Output: out}); err == nil || err.Error() != "nothing to convert: no plain rule files found" {
+		t.Errorf("Run on a manifest error = %v", err)
+	}
+	if err := Run(Options{Paths: []string{dir}, To: "crd", Name: "x", Output: out}); err == nil || err.Error() != "-name can only be used when converting a single rule file, got 2" {
+		t.Errorf("Run with -name error = %v", err)
+	}
+	if err := Run(Options{Paths: []string{dir}, To: "helm"}); err == nil || err.Error() != `unknown conversion target "helm", expected crd or rules` {
+		t.Errorf("Run with an unknown target error = %v", err)
+	}
+}
+
+const manifest = `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: api
+  namespace: prod
+spec:
+  groups:
+    - name: api
+      rules:
+        - alert: ApiDown
+          expr: up == 0
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+---
+apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: nodes
+  annotations:
+    mal-sync/namespace: infra
+spec:
+  groups:
+    - name: nodes
+      rules:
+        - record: job:up:sum
+          expr: sum(up)
+`
+
+func TestRunToRules(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"manifest.yaml": manifest})
+
+	out := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := Run(Options{Paths: []string{dir}, To: "rules", Output: out}); err != nil {
+		t.Fatal(err)
+	}
+	want := `namespace: prod-api
+groups:
+  - name: api
+    rules:
+      - alert: ApiDown
+        expr: up == 0
+---
+namespace: infra
+groups:
+  - name: nodes
+    rules:
+      - record: job:up:sum
+        expr: sum(up)
+`
+	if got := readFile(t, out); got != want {
+		t.Errorf("rule files =\n%s\nwant\n%s", got, want)
+	}
+
+	// One file per object in an output directory, with the namespace format
+	outDir := t.TempDir()
+	if err := Run(Options{Paths: []string{dir}, To: "rules", Output: outDir, NamespaceFormat: "{namespace}_{name}"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(outDir, "prod-api.yaml")); !strings.HasPrefix(got, "namespace: prod_api\n") {
+		t.Errorf("prod-api.yaml =\n%s", got)
+	}
+	if got := readFile(t, filepath.Join(outDir, "default-nodes.yaml")); !strings.HasPrefix(got, "namespace: infra\n") {
+		t.Errorf("default-nodes.yaml =\n%s", got)
+	}
+	entries, err := os.ReadDir(outDir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("output directory has %d file(s), want 2", len(entries))
+	}
+
+	if err := Run(Options{Paths: []string{dir}, To: "rules", NamespaceFormat: "static"}); err == nil {
+		t.Error("Run with a namespace format without placeholders succeeded")
+	}
+	if err := Run(Options{Paths: []string{outDir}, To: "rules", Output: out}); err == nil || err.Error() != "nothing to convert: no PrometheusRule objects found" {
+		t.Errorf("Run on rule files error = %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+// Package format rewrites rule files and Alertmanager configs into one
+// canonical layout, so reviews only show changes that matter: two-space
+// block YAML with the plainest quoting, keys in a fixed order and PromQL
+// expressions prettified.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// Options configures a format run.
+type Options struct {
+	Paths []string // Files, or directories walked recursively for *.yaml and *.yml files
+	Write bool     // Rewrite files that are not formatted
+	Check bool     // Only report files that are not formatted
+}
+
+// Run formats every file under opts.Paths. Without Write or Check the
+// formatted files are written to stdout. With Check it returns an error
+// when any file would change.
+func Run(opts Options) error {
+	if opts.Write && opts.Check {
+		return fmt.Errorf("-w and -check cannot be used together")
+	}
+	files, err := resolveFiles(opts.Paths)
+	if err != nil {
+		return err
+	}
+	changed := 0
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		out, err := Format(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		switch {
+		case opts.Check:
+			if !bytes.Equal(data, out) {
+				changed++
+				log.Printf("%s is not formatted", path)
+			}
+		case opts.Write:
+			if bytes.Equal(data, out) {
+				continue
+			}
+			changed++
+			info, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("failed to stat %s: %w", path, err)
+			}
+			if err := os.WriteFile(path, out, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			log.Printf("Formatted %s", path)
+		default:
+			if len(files) > 1 {
+				fmt.Printf("# %s\n", path)
+			}
+			os.Stdout.Write(out)
+		}
+	}
+	if opts.Check && changed > 0 {
+		return fmt.Errorf("%d of %d file(s) are not formatted; run mal-sync fmt -w", changed, len(files))
+	}
+	if opts.Write {
+		log.Printf("Formatted %d of %d file(s)", changed, len(files))
+	}
+	return nil
+}
+
+func resolveFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if p != path && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if rules.IsYAMLFile(d.Name()) {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %s: %w", path, err)
+		}
+	}
+	return files, nil
+}
+
+// Format returns the canonical form of a YAML file. Rule files (with a
+// top-level groups key), PrometheusRule manifests and Alertmanager configs (with route, receivers or
+// fragment keys) also get their keys ordered and, for rule files, their
+// PromQL expressions prettified; other YAML files are only re-indented and
+// re-quoted. Expressions that are not PromQL, such as LogQL, or that
+// contain comments are left as they are.
+func Format(data []byte) ([]byte, error) {
+	docs, err := yamlnode.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return data, nil
+	}
+	for _, doc := range docs {
+		switch {
+		case doc.Get("groups") != nil:
+			orderKeys(doc, ruleFileKeys)
+			formatGroups(doc.Get("groups"))
+		case rules.IsPrometheusRule(doc):
+			orderKeys(doc, manifestKeys)
+			orderKeys(doc.Get("metadata"), metadataKeys)
+			formatGroups(doc.Get("spec").Get("groups"))
+		case doc.Get("route") != nil || doc.Get("receivers") != nil || doc.Get("routes") != nil || doc.Get("inhibit_rules") != nil:
+			formatAlertmanagerConfig(doc)
+		}
+	}
+	return yamlnode.Encode(docs...), nil
+}
+
+var (
+	ruleFileKeys = []string{"namespace", "groups"}
+	manifestKeys = []string{"apiVersion", "kind", "metadata", "spec"}
+	metadataKeys = []string{"name", "namespace", "labels", "annotations"}
+	groupKeys    = []string{"name", "interval", "query_offset", "evaluation_delay", "limit", "source_tenants", "rules"}
+	ruleKeys     = []string{"record", "alert", "expr", "for", "keep_firing_for", "labels", "annotations"}
+
+	alertmanagerKeys = []string{"global", "templates", "route", "routes", "inhibit_rules", "receivers", "time_intervals", "mute_time_intervals"}
+	routeKeys        = []string{"receiver", "group_by", "continue", "matchers", "match", "match_re", "group_wait", "group_interval", "repeat_interval", "mute_time_intervals", "active_time_intervals", "routes"}
+	inhibitKeys      = []string{"source_matchers", "source_match", "source_match_re", "target_matchers", "target_match", "target_match_re", "equal"}
+)
+
+func formatGroups(groups *yamlnode.Node) {
+	for _, g := range groups.Items() {
+		orderKeys(g, groupKeys)
+		for _, r := range g.Get("rules").Items() {
+			orderKeys(r, ruleKeys)
+			sortKeys(r.Get("labels"))
+			sortKeys(r.Get("annotations"))
+			prettifyExpr(r.Get("expr"))
+		}
+	}
+}
+
+func formatAlertmanagerConfig(doc *yamlnode.Node) {
+	orderKeys(doc, alertmanagerKeys)
+	formatRoute(doc.Get("route"))
+	for _, r := range doc.Get("routes").Items() {
+		formatRoute(r)
+	}
+	for _, r := range doc.Get("inhibit_rules").Items() {
+		orderKeys(r, inhibitKeys)
+	}
+	for _, r := range doc.Get("receivers").Items() {
+		orderKeys(r, []string{"name"})
+	}
+	for _, key := range []string{"time_intervals", "mute_time_intervals"} {
+		for _, t := range doc.Get(key).Items() {
+			orderKeys(t, []string{"name", "time_intervals"})
+		}
+	}
+}
+
+func formatRoute(route *yamlnode.Node) {
+	if route == nil {
+		return
+	}
+	orderKeys(route, routeKeys)
+	for _, r := range route.Get("routes").Items() {
+		formatRoute(r)
+	}
+}
+
+// prettifyExpr replaces a PromQL expression with its prettified form.
+func prettifyExpr(n *yamlnode.Node) {
+	if n == nil || n.Kind != yamlnode.ScalarNode || strings.Contains(n.Value, "#") {
+		return
+	}
+	expr, err := promql.Parse(n.Value)
+	if err != nil {
+		return
+	}
+	pretty := promql.Prettify(expr)
+	if pretty == n.Value {
+		return
+	}
+	n.Value = pretty
+	n.Tag = ""
+	// Any quoted style lets the encoder pick the plainest quoting, or a
+	// literal block for multi-line expressions.
+	n.Style = yamlnode.DoubleQuotedStyle
+}
+
+// orderKeys moves the keys in order to the front of a mapping, in that
+// order; other keys follow in their original order.
+func orderKeys(n *yamlnode.Node, order []string) {
+	n = n.Resolve()
+	if n == nil || n.Kind != yamlnode.MappingNode {
+		return
+	}
+	rank := map[string]int{}
+	for i, k := range order {
+		rank[k] = i
+	}
+	sortPairs(n, func(a, b string) bool {
+		ra, oka := rank[a]
+		rb, okb := rank[b]
+		switch {
+		case oka && okb:
+			return ra < rb
+		case oka != okb:
+			return oka
+		}
+		return false
+	})
+}
+
+// sortKeys sorts the keys of a mapping alphabetically.
+func sortKeys(n *yamlnode.Node) {
+	n = n.Resolve()
+	if n == nil || n.Kind != yamlnode.MappingNode {
+		return
+	}
+	sortPairs(n, func(a, b string) bool { return a < b })
+}
+
+func sortPairs(n *yamlnode.Node, less func(a, b string) bool) {
+	type pair struct{ key, value *yamlnode.Node }
+	pairs := make([]pair, 0, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		pairs = append(pairs, pair{n.Content[i], n.Content[i+1]})
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return less(pairs[i].key.Resolve().Value, pairs[j].key.Resolve().Value)
+	})
+	for i, p := range pairs {
+		n.Content[2*i], n.Content[2*i+1] = p.key, p.value
+	}
+}
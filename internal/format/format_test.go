@@ -0,0 +1,136 @@
+package format
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const unformatted = `# API rules
+groups:
+    - rules:
+        # alert when the API is down
+        - annotations: {summary: "API down", description: 'it is down'}
+          labels:
+              team: api
+              severity: critical
+          expr: "sum by (job) (rate(http_requests_total{job=\"api\", code=~\"5..\"}[5m])) / sum by (job) (rate(http_requests_total{job=\"api\"}[5m])) > 0.05"
+          for: 5m
+          alert: ApiErrors # inline comment
+        - expr: |
+            sum(up) # with a comment
+          record: job:up:sum
+      interval: 1m
+      name: api
+namespace: team
+`
+
+const formatted = `namespace: team
+# API rules
+groups:
+  - name: api
+    interval: 1m
+    rules:
+      # alert when the API is down
+      - alert: ApiErrors # inline comment
+        expr: |2-
+              sum by (job) (rate(http_requests_total{job="api", code=~"5.."}[5m]))
+            /
+              sum by (job) (rate(http_requests_total{job="api"}[5m]))
+          >
+            0.05
+        for: 5m
+        labels:
+          severity: critical
+          team: api
+        annotations:
+          description: it is down
+          summary: API down
+      - record: job:up:sum
+        expr: |
+          sum(up) # with a comment
+`
+
+func TestFormat(t *testing.T) {
+	out, err := Format([]byte(unformatted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != formatted {
+		t.Errorf("Format =\n%s\nwant\n%s", out, formatted)
+	}
+	again, err := Format(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("Format is not idempotent:\n%s", again)
+	}
+	for _, comment := range []string{"# API rules", "# alert when the API is down", "# inline comment", "# with a comment"} {
+		if !strings.Contains(string(out), comment) {
+			t.Errorf("Format dropped %q", comment)
+		}
+	}
+}
+
+func TestFormatAlertmanagerConfig(t *testing.T) {
+	out, err := Format([]byte(`receivers:
+  - webhook_configs: [{url: "http://x"}]
+    name: default
+route:
+  # the default route
+  routes:
+    - receiver: pager
+      matchers: ['severity="critical"']
+  receiver: default
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `route:
+  receiver: default
+  # the default route
+  routes:
+    - receiver: pager
+      matchers:
+        - severity="critical"
+receivers:
+  - name: default
+    webhook_configs:
+      - url: http://x
+`
+	if string(out) != want {
+		t.Errorf("Format =\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(path, []byte(unformatted), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(Options{Paths: []string{dir}, Check: true}); err == nil || err.Error() != "1 of 1 file(s) are not formatted; run mal-sync fmt -w" {
+		t.Errorf("Run with check error = %v", err)
+	}
+	if err := Run(Options{Paths: []string{dir}, Write: true}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != formatted {
+		t.Errorf("written file =\n%s", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("written file mode = %v, %v", info.Mode(), err)
+	}
+	if err := Run(Options{Paths: []string{dir}, Check: true}); err != nil {
+		t.Errorf("Run with check after writing: %v", err)
+	}
+	if err := Run(Options{Paths: []string{dir}, Write: true, Check: true}); err == nil {
+		t.Error("Run with write and check succeeded")
+	}
+}
@@ -0,0 +1,219 @@
+// Package incremental works out which rule namespaces changed since a git
+// commit or since the last successful sync, so a sync can lint and push
+// only those namespaces.
+package incremental
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/source"
+	"github.com/antnsn/mal-sync/internal/state"
+)
+
+// Changes are the namespaces that differ between a commit and the rule
+// files about to be synced.
+type Changes struct {
+	Since      string          // Commit compared with, if any
+	Namespaces []string        // Namespaces with added, modified or removed rules, sorted
+	Deleted    []string        // Namespaces of Namespaces that no file defines anymore
+	changed    map[string]bool // Namespaces as a set
+}
+
+// Has reports whether namespace changed.
+func (c *Changes) Has(namespace string) bool {
+	return c.changed[namespace]
+}
+
+// Add marks namespace as changed, such as one whose files are generated
+// and so cannot be compared with a commit.
+func (c *Changes) Add(namespace string) {
+	if c.changed[namespace] {
+		return
+	}
+	c.changed[namespace] = true
+	c.Namespaces = append(c.Namespaces, namespace)
+	sort.Strings(c.Namespaces)
+}
+
+// Compare returns the namespaces of files, loaded from rulesPath, whose
+// rule files were added, modified or deleted since the commit since. A
+// namespace changed when a changed file defines it now or defined it at
+// the commit. Only the files that filter selects are compared. If
+// namespaces is not nil, it assigns namespaces to the old versions of
+// files the same way they were assigned to files.
+//
+// Compare returns nil Changes, meaning everything must be synced, when a
+// changed file has no namespace of its own or its old version cannot be
+// parsed.
+func Compare(files []*rules.File, rulesPath, since string, filter rules.Filter, namespaces func([]*rules.File) error) (*Changes, error) {
+	diff, err := source.Diff(rulesPath, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s with %s: %w", rulesPath, since, err)
+	}
+	selector, err := filter.Selector(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+	current := map[string][]*rules.File{}
+	defined := map[string]bool{}
+	for _, f := range files {
+		abs, err := filepath.Abs(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		// git reports paths with symlinks resolved
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+		current[abs] = append(current[abs], f)
+		defined[f.Namespace] = true
+	}
+
+	c := &Changes{Since: since, changed: map[string]bool{}}
+	for _, change := range diff {
+		if selector.Skip(change.Path, false) != "" {
+			continue
+		}
+		versions := current[change.Path]
+		if change.Old != nil {
+			old, err := rules.Parse(change.Path, change.Old)
+			if err != nil {
+				log.Printf("Cannot tell the namespace %s had at %s, syncing every namespace: %v", change.Path, since, err)
+				return nil, nil
+			}
+			if namespaces != nil {
+				if err := namespaces(old); err != nil {
+					return nil, err
+				}
+			}
+			versions = append(versions, old...)
+		}
+		for _, f := range versions {
+			if f.Namespace == "" {
+				log.Printf("%s changed but has no namespace, syncing every namespace", f.Path)
+				return nil, nil
+			}
+			c.changed[f.Namespace] = true
+		}
+	}
+	for ns := range c.changed {
+		c.Namespaces = append(c.Namespaces, ns)
+		if !defined[ns] {
+			c.Deleted = append(c.Deleted, ns)
+		}
+	}
+	sort.Strings(c.Namespaces)
+	sort.Strings(c.Deleted)
+	return c, nil
+}
+
+// Hashes returns the content hash of the staged rule files of each
+// namespace of files, where staged[i] is the staged copy of files[i].
+func Hashes(files []*rules.File, staged []string) (map[string]string, error) {
+	names, paths := map[string][]string{}, map[string][]string{}
+	for i, f := range files {
+		names[f.Namespace] = append(names[f.Namespace], filepath.Base(staged[i]))
+		paths[f.Namespace] = append(paths[f.Namespace], staged[i])
+	}
+	hashes := map[string]string{}
+	for ns := range paths {
+		hash, err := state.HashFiles(names[ns], paths[ns])
+		if err != nil {
+			return nil, err
+		}
+		hashes[ns] = hash
+	}
+	return hashes, nil
+}
+
+// Unsynced returns the namespaces whose hashes differ from the state of
+// the last successful sync, including namespaces synced then that no file
+// defines anymore.
+func Unsynced(last *state.Target, hashes map[string]string) *Changes {
+	c := &Changes{changed: map[string]bool{}}
+	c.Namespaces, c.Deleted = last.Changed(hashes)
+	for _, ns := range c.Namespaces {
+		c.changed[ns] = true
+	}
+	return c
+}
+
+// Intersect returns the namespaces that both a and b mark as changed, such
+// as those changed since a commit and since the last successful sync. Nil
+// Changes mean every namespace changed.
+func Intersect(a, b *Changes) *Changes {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	c := &Changes{Since: a.Since, changed: map[string]bool{}}
+	if c.Since == "" {
+		c.Since = b.Since
+	}
+	for _, ns := range a.Namespaces {
+		if b.Has(ns) {
+			c.Add(ns)
+		}
+	}
+	for _, ns := range a.Deleted {
+		if c.Has(ns) {
+			c.Deleted = append(c.Deleted, ns)
+		}
+	}
+	return c
+}
+
+// SyncedHashes returns the hashes to record once the namespaces of c are
+// synced: the current hashes of those namespaces and the recorded ones of
+// every other namespace, which was left as it was. Nil c means every
+// namespace was synced.
+func SyncedHashes(last *state.Target, hashes map[string]string, c *Changes) map[string]string {
+	if c == nil {
+		return hashes
+	}
+	next := map[string]string{}
+	for ns, hash := range last.Hashes {
+		if !c.Has(ns) {
+			next[ns] = hash
+		}
+	}
+	for ns, hash := range hashes {
+		if c.Has(ns) {
+			next[ns] = hash
+		}
+	}
+	return next
+}
+
+// Prune adds the namespaces of previous, such as those a caller synced
+// last time, that no file defines anymore to c as deleted ones. Nil c
+// means everything is synced, which already deletes them, unless there
+// are no files at all: Prune then returns Changes listing only those
+// namespaces, so the rest of the tenant is left alone.
+func Prune(c *Changes, files []*rules.File, previous []string) *Changes {
+	if len(previous) == 0 || (c == nil && len(files) > 0) {
+		return c
+	}
+	if c == nil {
+		c = &Changes{changed: map[string]bool{}}
+	}
+	defined := map[string]bool{}
+	for _, f := range files {
+		defined[f.Namespace] = true
+	}
+	for _, ns := range previous {
+		if defined[ns] || c.changed[ns] {
+			continue
+		}
+		c.Add(ns)
+		c.Deleted = append(c.Deleted, ns)
+	}
+	sort.Strings(c.Deleted)
+	return c
+}
@@ -0,0 +1,215 @@
+package incremental
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/state"
+)
+
+func namespaceFiles(namespaces ...string) []*rules.File {
+	var files []*rules.File
+	for _, ns := range namespaces {
+		files = append(files, &rules.File{Namespace: ns})
+	}
+	return files
+}
+
+func changesOf(namespaces ...string) *Changes {
+	c := &Changes{changed: map[string]bool{}}
+	for _, ns := range namespaces {
+		c.Add(ns)
+	}
+	return c
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name     string
+		changes  *Changes
+		files    []*rules.File
+		previous []string
+		want     string // "namespaces / deleted", or "nil"
+	}{
+		{"nothing synced before", changesOf("a"), namespaceFiles("a"), nil, "a / "},
+		{"full sync", nil, namespaceFiles("a"), []string{"a", "b"}, "nil"},
+		{"full sync without files", nil, nil, []string{"a", "b"}, "a,b / a,b"},
+		{"without files or previous namespaces", nil, nil, nil, "nil"},
+		{"changed namespaces", changesOf("a"), namespaceFiles("a", "c"), []string{"b", "c", "d"}, "a,b,d / b,d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Prune(tt.changes, tt.files, tt.previous)
+			got := "nil"
+			if c != nil {
+				got = strings.Join(c.Namespaces, ",") + " / " + strings.Join(c.Deleted, ",")
+				for _, ns := range c.Namespaces {
+					if !c.Has(ns) {
+						t.Errorf("Has(%q) = false", ns)
+					}
+				}
+			}
+			if got != tt.want {
+				t.Errorf("Prune = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func deleted(c *Changes, namespaces ...string) *Changes {
+	c.Deleted = namespaces
+	return c
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *Changes
+		want string // "namespaces / deleted", or "nil"
+	}{
+		{"both everything", nil, nil, "nil"},
+		{"a everything", nil, changesOf("a", "b"), "a,b / "},
+		{"b everything", deleted(changesOf("a", "b"), "b"), nil, "a,b / b"},
+		{"both", deleted(changesOf("a", "b", "c"), "b", "c"), changesOf("b", "c", "d"), "b,c / b,c"},
+		{"disjoint", changesOf("a"), changesOf("b"), " / "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Intersect(tt.a, tt.b)
+			got := "nil"
+			if c != nil {
+				got = strings.Join(c.Namespaces, ",") + " / " + strings.Join(c.Deleted, ",")
+				for _, ns := range c.Namespaces {
+					if !c.Has(ns) {
+						t.Errorf("Has(%q) = false", ns)
+					}
+				}
+			}
+			if got != tt.want {
+				t.Errorf("Intersect = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncedHashes(t *testing.T) {
+	last := &state.Target{Hashes: map[string]string{"a": "a1", "b": "b1", "gone": "g1"}}
+	hashes := map[string]string{"a": "a2", "b": "b2", "new": "n2"}
+	tests := []struct {
+		name    string
+		changes *Changes
+		want    string
+	}{
+		{"everything synced", nil, "a=a2 b=b2 new=n2"},
+		{"some synced", changesOf("a", "new"), "a=a2 b=b1 gone=g1 new=n2"},
+		{"deleted synced", deleted(changesOf("gone"), "gone"), "a=a1 b=b1"},
+		{"nothing synced", changesOf(), "a=a1 b=b1 gone=g1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := SyncedHashes(last, hashes, tt.changes)
+			var got []string
+			for ns, hash := range next {
+				got = append(got, ns+"="+hash)
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("SyncedHashes = %s, want %s", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
+
+// gitRepo initializes a git repository in dir and returns a function
+// running git in it.
+func gitRepo(t *testing.T, dir string) func(args ...string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	git("init", "-q", "-b", "main")
+	return git
+}
+
+func writeRules(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, namespace := range files {
+		path := filepath.Join(dir, name)
+		if namespace == "" {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		content := "groups:\n  - name: g\n    rules:\n      - record: r\n        expr: up\n"
+		if namespace != "-" {
+			content = "namespace: " + namespace + "\n" + content
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string // rule file name to its new namespace; "" deletes it, "-" has none
+		want    string            // "namespaces / deleted", or "nil"
+	}{
+		{"unchanged", nil, " / "},
+		{"modified", map[string]string{"a.yaml": "a", "new.yaml": "a"}, "a / "},
+		{"moved to another namespace", map[string]string{"b.yaml": "b2"}, "b,b2 / b"},
+		{"deleted", map[string]string{"c.yaml": ""}, "c / c"},
+		{"excluded", map[string]string{"skip.yaml": "x"}, " / "},
+		{"without a namespace", map[string]string{"a.yaml": "-"}, "nil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			git := gitRepo(t, dir)
+			writeRules(t, dir, map[string]string{"a.yaml": "a", "b.yaml": "b", "c.yaml": "c"})
+			git("add", "-A")
+			git("commit", "-q", "-m", "rules")
+			writeRules(t, dir, tt.changes)
+
+			filter := rules.Filter{Exclude: []string{"skip.yaml"}}
+			paths, err := filter.ResolveFiles(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := rules.LoadFiles(paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := Compare(files, dir, "HEAD", filter, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := "nil"
+			if c != nil {
+				got = strings.Join(c.Namespaces, ",") + " / " + strings.Join(c.Deleted, ",")
+			}
+			if got != tt.want {
+				t.Errorf("Compare = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Package kube is a small client for the parts of the Kubernetes API the
+// controller uses: listing and watching objects and recording events.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// In-cluster service account files.
+const (
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// Resource is a kind of object the client lists and watches.
+type Resource struct {
+	Prefix     string // API path prefix, e.g. "/api/v1" or "/apis/monitoring.coreos.com/v1"
+	Plural     string // e.g. "configmaps"
+	APIVersion string
+	Kind       string
+}
+
+var (
+	Namespaces      = Resource{"/api/v1", "namespaces", "v1", "Namespace"}
+	ConfigMaps      = Resource{"/api/v1", "configmaps", "v1", "ConfigMap"}
+	PrometheusRules = Resource{"/apis/monitoring.coreos.com/v1", "prometheusrules", "monitoring.coreos.com/v1", "PrometheusRule"}
+)
+
+// ObjectMeta is the metadata of an object.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// Object is an object of any kind. Data is set for ConfigMaps; Raw holds
+// the whole object as returned by the API.
+type Object struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+	Raw        map[string]any    `json:"-"`
+}
+
+// Event is a core/v1 Event about an object.
+type Event struct {
+	Object  Object
+	Type    string // "Normal" or "Warning"
+	Reason  string
+	Message string
+}
+
+// API is the part of the Kubernetes API the controller needs. *Client
+// implements it against a real or fake API server; tests may implement it
+// in memory.
+type API interface {
+	// List returns the objects of res in all namespaces matching the label
+	// selector.
+	List(ctx context.Context, res Resource, selector string) ([]Object, error)
+	// Watch calls changed whenever an object of res matching the selector
+	// changes, until the watch ends or ctx is done.
+	Watch(ctx context.Context, res Resource, selector string, changed func()) error
+	// RecordEvent records an event about an object.
+	RecordEvent(ctx context.Context, ev Event) error
+}
+
+// Client talks to a Kubernetes API server.
+type Client struct {
+	Server    string // e.g. https://kubernetes.default.svc
+	TokenFile string // Bearer token file, read on every request so rotated tokens are picked up; optional
+	http      *http.Client
+}
+
+// Config configures NewClient.
+type Config struct {
+	Server             string // API server URL; the in-cluster server when empty
+	TokenFile          string // Bearer token file; the service account token in-cluster
+	CAFile             string // CA bundle of the API server; the service account CA in-cluster
+	InsecureSkipVerify bool
+}
+
+// NewClient returns a client for cfg. Without a server it uses the
+// in-cluster configuration of the pod's service account.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a cluster: set the API server address")
+		}
+		cfg.Server = "https://" + net.JoinHostPort(host, port)
+		if cfg.TokenFile == "" {
+			cfg.TokenFile = serviceAccountToken
+		}
+		if cfg.CAFile == "" {
+			cfg.CAFile = serviceAccountCA
+		}
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %w", cfg.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &Client{
+		Server:    strings.TrimSuffix(cfg.Server, "/"),
+		TokenFile: cfg.TokenFile,
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// StatusError is a non-2xx response of the API server.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API server returned %d: %s", e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 response, as returned when a
+// resource such as the PrometheusRule CRD is not installed.
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request body for %s %s: %w", method, path, err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	u := c.Server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request %s %s: %w", method, u, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.TokenFile != "" {
+		token, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file %s: %w", c.TokenFile, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request %s %s failed: %w", method, u, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var status struct {
+			Message string `json:"message"`
+		}
+		msg := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &status) == nil && status.Message != "" {
+			msg = status.Message
+		}
+		return nil, fmt.Errorf("%s %s: %w", method, u, &StatusError{Code: resp.StatusCode, Message: msg})
+	}
+	return resp, nil
+}
+
+// List implements API.
+func (c *Client) List(ctx context.Context, res Resource, selector string) ([]Object, error) {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+	resp, err := c.request(ctx, http.MethodGet, res.Prefix+"/"+res.Plural, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode %s list: %w", res.Plural, err)
+	}
+	objects := make([]Object, 0, len(list.Items))
+	for _, item := range list.Items {
+		obj, err := decodeObject(item, res)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// decodeObject decodes an object, filling in the apiVersion and kind that
+// list items lack.
+func decodeObject(data []byte, res Resource) (Object, error) {
+	var obj Object
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return Object{}, fmt.Errorf("failed to decode %s: %w", res.Kind, err)
+	}
+	if err := json.Unmarshal(data, &obj.Raw); err != nil {
+		return Object{}, fmt.Errorf("failed to decode %s: %w", res.Kind, err)
+	}
+	if obj.APIVersion == "" {
+		obj.APIVersion, obj.Raw["apiVersion"] = res.APIVersion, res.APIVersion
+	}
+	if obj.Kind == "" {
+		obj.Kind, obj.Raw["kind"] = res.Kind, res.Kind
+	}
+	return obj, nil
+}
+
+// Watch implements API. The server ends watches after a few minutes; the
+// caller is expected to watch again.
+func (c *Client) Watch(ctx context.Context, res Resource, selector string, changed func()) error {
+	query := url.Values{"watch": {"true"}, "timeoutSeconds": {"300"}}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+	resp, err := c.request(ctx, http.MethodGet, res.Prefix+"/"+res.Plural, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type   string `json:"type"`
+			Object struct {
+				Message string `json:"message"`
+			} `json:"object"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("watch of %s failed: %w", res.Plural, err)
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			changed()
+		case "ERROR":
+			return fmt.Errorf("watch of %s failed: %s", res.Plural, ev.Object.Message)
+		}
+	}
+}
+
+// RecordEvent implements API.
+func (c *Client) RecordEvent(ctx context.Context, ev Event) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	meta := ev.Object.Metadata
+	body := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Event",
+		"metadata": map[string]any{
+			"generateName": meta.Name + ".",
+			"namespace":    meta.Namespace,
+		},
+		"involvedObject": map[string]any{
+			"apiVersion":      ev.Object.APIVersion,
+			"kind":            ev.Object.Kind,
+			"name":            meta.Name,
+			"namespace":       meta.Namespace,
+			"uid":             meta.UID,
+			"resourceVersion": meta.ResourceVersion,
+		},
+		"type":           ev.Type,
+		"reason":         ev.Reason,
+		"message":        ev.Message,
+		"source":         map[string]any{"component": "mal-sync"},
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+	}
+	resp, err := c.request(ctx, http.MethodPost, "/api/v1/namespaces/"+url.PathEscape(meta.Namespace)+"/events", nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
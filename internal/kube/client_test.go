@@ -0,0 +1,165 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeServer serves namespaces and ConfigMaps, a watch of ConfigMaps
+// and event creation, and requires the bearer token "secret".
+func newFakeServer(t *testing.T, events *[]map[string]any) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"kind":"Status","message":"Unauthorized"}`)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/v1/namespaces":
+			fmt.Fprint(w, `{"items":[{"metadata":{"name":"team-a","labels":{"mal-sync/tenant":"a"}}}]}`)
+		case r.URL.Path == "/api/v1/configmaps" && r.URL.Query().Get("watch") == "true":
+			if r.URL.Query().Get("labelSelector") != "mal-sync/type" {
+				http.Error(w, "bad selector", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, `{"type":"ADDED","object":{}}`)
+			fmt.Fprintln(w, `{"type":"BOOKMARK","object":{}}`)
+			fmt.Fprintln(w, `{"type":"MODIFIED","object":{}}`)
+			fmt.Fprintln(w, `{"type":"ERROR","object":{"message":"too old resource version"}}`)
+		case r.URL.Path == "/api/v1/configmaps":
+			if r.URL.Query().Get("labelSelector") != "mal-sync/type" {
+				http.Error(w, "bad selector", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"items":[{"metadata":{"name":"rules","namespace":"team-a","uid":"u1","resourceVersion":"7","labels":{"mal-sync/type":"mimir-rules"}},"data":{"a.yaml":"groups: []"}}]}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/team-a/events":
+			var ev map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*events = append(*events, ev)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind":"Status","message":"the server could not find the requested resource"}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestClient(t *testing.T, server, token string) *Client {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(Config{Server: server + "/", TokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestList(t *testing.T) {
+	var events []map[string]any
+	c := newTestClient(t, newFakeServer(t, &events).URL, "secret")
+	ctx := context.Background()
+
+	namespaces, err := c.List(ctx, Namespaces, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(namespaces) != 1 || namespaces[0].Metadata.Labels["mal-sync/tenant"] != "a" || namespaces[0].Kind != "Namespace" {
+		t.Errorf("namespaces = %+v", namespaces)
+	}
+
+	objects, err := c.List(ctx, ConfigMaps, "mal-sync/type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 {
+		t.Fatalf("listed %d ConfigMaps, want 1", len(objects))
+	}
+	obj := objects[0]
+	if obj.Kind != "ConfigMap" || obj.APIVersion != "v1" || obj.Metadata.UID != "u1" || obj.Metadata.ResourceVersion != "7" || obj.Data["a.yaml"] != "groups: []" {
+		t.Errorf("ConfigMap = %+v", obj)
+	}
+	if obj.Raw["kind"] != "ConfigMap" || obj.Raw["data"] == nil {
+		t.Errorf("raw ConfigMap = %v", obj.Raw)
+	}
+
+	_, err = c.List(ctx, PrometheusRules, "mal-sync/type")
+	if !IsNotFound(err) || !strings.Contains(err.Error(), "the server could not find the requested resource") {
+		t.Errorf("List of a missing resource error = %v, want a not found error", err)
+	}
+}
+
+func TestListUnauthorized(t *testing.T) {
+	var events []map[string]any
+	c := newTestClient(t, newFakeServer(t, &events).URL, "wrong")
+	_, err := c.List(context.Background(), Namespaces, "")
+	if err == nil || IsNotFound(err) || !strings.Contains(err.Error(), "API server returned 401: Unauthorized") {
+		t.Errorf("List with a wrong token error = %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var events []map[string]any
+	c := newTestClient(t, newFakeServer(t, &events).URL, "secret")
+	changes := 0
+	err := c.Watch(context.Background(), ConfigMaps, "mal-sync/type", func() { changes++ })
+	if err == nil || !strings.Contains(err.Error(), "too old resource version") {
+		t.Errorf("Watch error = %v, want the ERROR event", err)
+	}
+	if changes != 2 {
+		t.Errorf("Watch reported %d changes, want 2", changes)
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	var events []map[string]any
+	c := newTestClient(t, newFakeServer(t, &events).URL, "secret")
+	obj := Object{APIVersion: "v1", Kind: "ConfigMap", Metadata: ObjectMeta{Name: "rules", Namespace: "team-a", UID: "u1", ResourceVersion: "7"}}
+	if err := c.RecordEvent(context.Background(), Event{Object: obj, Type: "Warning", Reason: "SyncFailed", Message: "boom"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("recorded %d events, want 1", len(events))
+	}
+	ev := events[0]
+	involved, _ := ev["involvedObject"].(map[string]any)
+	if ev["type"] != "Warning" || ev["reason"] != "SyncFailed" || ev["message"] != "boom" || involved["uid"] != "u1" || involved["kind"] != "ConfigMap" {
+		t.Errorf("event = %v", ev)
+	}
+	if meta, _ := ev["metadata"].(map[string]any); meta["generateName"] != "rules." || meta["namespace"] != "team-a" {
+		t.Errorf("event metadata = %v", ev["metadata"])
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := NewClient(Config{}); err == nil || !strings.Contains(err.Error(), "not running in a cluster") {
+		t.Errorf("NewClient outside a cluster error = %v", err)
+	}
+	if _, err := NewClient(Config{Server: "https://k8s", CAFile: filepath.Join(t.TempDir(), "missing")}); err == nil || !strings.Contains(err.Error(), "failed to read CA file") {
+		t.Errorf("NewClient with a missing CA file error = %v", err)
+	}
+	ca := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(ca, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewClient(Config{Server: "https://k8s", CAFile: ca}); err == nil || !strings.Contains(err.Error(), "no certificates found") {
+		t.Errorf("NewClient with an invalid CA file error = %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+// Package limits checks rules and Alertmanager configs against the tenant
+// limits enforced by the Mimir and Loki rulers and Mimir's Alertmanager, so
+// a sync fails before anything is uploaded instead of being rejected
+// server-side.
+package limits
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// Limits are the limits of one tenant, named after the Mimir and Loki
+// runtime config settings. Zero means unlimited.
+type Limits struct {
+	RuleGroupsPerTenant            int            // ruler_max_rule_groups_per_tenant
+	RulesPerRuleGroup              int            // ruler_max_rules_per_rule_group
+	RuleGroupsPerTenantByNamespace map[string]int // ruler_max_rule_groups_per_tenant_by_namespace
+	RulesPerRuleGroupByNamespace   map[string]int // ruler_max_rules_per_rule_group_by_namespace
+	AlertmanagerConfigSize         int            // alertmanager_max_config_size_bytes
+	AlertmanagerTemplates          int            // alertmanager_max_templates_count
+	AlertmanagerTemplateSize       int            // alertmanager_max_template_size_bytes
+}
+
+// ForTenant returns the limits of tenant: defaults, overridden by the
+// tenant's entry in the runtime config file when one is given. The runtime
+// config uses the Mimir and Loki format:
+//
+//	overrides:
+//	  tenant-a:
+//	    ruler_max_rules_per_rule_group: 20
+//	    ruler_max_rules_per_rule_group_by_namespace:
+//	      big-namespace: 50
+//
+// Settings other than the limits checked here are ignored.
+func ForTenant(defaults Limits, runtimeConfig, tenant string) (Limits, error) {
+	l := defaults
+	if runtimeConfig == "" {
+		return l, nil
+	}
+	docs, err := yamlnode.ParseFile(runtimeConfig)
+	if err != nil {
+		return l, err
+	}
+	if len(docs) == 0 {
+		return l, nil
+	}
+	overrides := docs[0].Get("overrides").Get(tenant)
+	if overrides.IsNull() {
+		return l, nil
+	}
+	intValue := func(key string, dst *int) error {
+		n := overrides.Get(key)
+		if n.IsNull() {
+			return nil
+		}
+		v, err := strconv.Atoi(n.Text())
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s:%d: %s of tenant %s must be a non-negative integer", runtimeConfig, n.Line, key, tenant)
+		}
+		*dst = v
+		return nil
+	}
+	mapValue := func(key string, dst *map[string]int) error {
+		n := overrides.Get(key)
+		if n.IsNull() {
+			return nil
+		}
+		m := map[string]int{}
+		for _, ns := range n.Keys() {
+			v, err := strconv.Atoi(n.Get(ns).Text())
+			if err != nil || v < 0 {
+				return fmt.Errorf("%s:%d: %s of tenant %s must map namespaces to non-negative integers", runtimeConfig, n.Get(ns).Line, key, tenant)
+			}
+			m[ns] = v
+		}
+		*dst = m
+		return nil
+	}
+	for _, err := range []error{
+		intValue("ruler_max_rule_groups_per_tenant", &l.RuleGroupsPerTenant),
+		intValue("ruler_max_rules_per_rule_group", &l.RulesPerRuleGroup),
+		mapValue("ruler_max_rule_groups_per_tenant_by_namespace", &l.RuleGroupsPerTenantByNamespace),
+		mapValue("ruler_max_rules_per_rule_group_by_namespace", &l.RulesPerRuleGroupByNamespace),
+		intValue("alertmanager_max_config_size_bytes", &l.AlertmanagerConfigSize),
+		intValue("alertmanager_max_templates_count", &l.AlertmanagerTemplates),
+		intValue("alertmanager_max_template_size_bytes", &l.AlertmanagerTemplateSize),
+	} {
+		if err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+// RulesPerGroup returns the rules-per-group limit of namespace, 0 meaning
+// unlimited.
+func (l Limits) RulesPerGroup(namespace string) int {
+	if v, ok := l.RulesPerRuleGroupByNamespace[namespace]; ok {
+		return v
+	}
+	return l.RulesPerRuleGroup
+}
+
+// rulerUnlimited reports whether no ruler limit is set.
+func (l Limits) rulerUnlimited() bool {
+	return l.RuleGroupsPerTenant == 0 && l.RulesPerRuleGroup == 0 &&
+		len(l.RuleGroupsPerTenantByNamespace) == 0 && len(l.RulesPerRuleGroupByNamespace) == 0
+}
+
+// CheckRules returns a message for every limit the rule files break: the
+// number of rule groups of the tenant or of a namespace, and the number of
+// rules of each group. A namespace-specific limit replaces the tenant-wide
+// one for that namespace.
+func CheckRules(files []*rules.File, l Limits) []string {
+	var problems []string
+	groupsByNamespace := map[string]int{}
+	total := 0
+	for _, f := range files {
+		for _, g := range f.Groups {
+			total++
+			groupsByNamespace[f.Namespace]++
+			limit, setting := l.RulesPerRuleGroup, "ruler_max_rules_per_rule_group"
+			if v, ok := l.RulesPerRuleGroupByNamespace[f.Namespace]; ok {
+				limit, setting = v, "ruler_max_rules_per_rule_group_by_namespace"
+			}
+			if limit > 0 && len(g.Rules) > limit {
+				problems = append(problems, fmt.Sprintf("%s: group %q in namespace %q has %d rules, %d over %s (%d)",
+					g.Pos(), g.Name, f.Namespace, len(g.Rules), len(g.Rules)-limit, setting, limit))
+			}
+		}
+	}
+	namespaces := make([]string, 0, len(groupsByNamespace))
+	for ns := range groupsByNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		if limit, ok := l.RuleGroupsPerTenantByNamespace[ns]; ok && limit > 0 && groupsByNamespace[ns] > limit {
+			problems = append(problems, fmt.Sprintf("namespace %q has %d rule groups, %d over ruler_max_rule_groups_per_tenant_by_namespace (%d)",
+				ns, groupsByNamespace[ns], groupsByNamespace[ns]-limit, limit))
+		}
+	}
+	if l.RuleGroupsPerTenant > 0 && total > l.RuleGroupsPerTenant {
+		problems = append(problems, fmt.Sprintf("tenant has %d rule groups, %d over ruler_max_rule_groups_per_tenant (%d)",
+			total, total-l.RuleGroupsPerTenant, l.RuleGroupsPerTenant))
+	}
+	return problems
+}
+
+// EnforceRules resolves the limits of tenant, logs every limit the rule
+// files break and fails if there are any.
+func EnforceRules(defaults Limits, runtimeConfig, tenant string, files []*rules.File) error {
+	l, err := ForTenant(defaults, runtimeConfig, tenant)
+	if err != nil {
+		return err
+	}
+	if l.rulerUnlimited() {
+		return nil
+	}
+	log.Printf("Checking rule groups against the ruler limits of tenant %s", tenant)
+	return report(tenant, CheckRules(files, l))
+}
+
+// CheckAlertmanager returns a message for every limit an Alertmanager
+// config file and its template files break.
+func CheckAlertmanager(configFile string, templateFiles []string, l Limits) ([]string, error) {
+	var problems []string
+	if l.AlertmanagerConfigSize > 0 {
+		info, err := os.Stat(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", configFile, err)
+		}
+		if size := int(info.Size()); size > l.AlertmanagerConfigSize {
+			problems = append(problems, fmt.Sprintf("config %s is %d bytes, %d over alertmanager_max_config_size_bytes (%d)",
+				configFile, size, size-l.AlertmanagerConfigSize, l.AlertmanagerConfigSize))
+		}
+	}
+	if l.AlertmanagerTemplates > 0 && len(templateFiles) > l.AlertmanagerTemplates {
+		problems = append(problems, fmt.Sprintf("%d templates, %d over alertmanager_max_templates_count (%d)",
+			len(templateFiles), len(templateFiles)-l.AlertmanagerTemplates, l.AlertmanagerTemplates))
+	}
+	if l.AlertmanagerTemplateSize > 0 {
+		for _, t := range templateFiles {
+			info, err := os.Stat(t)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %s: %w", t, err)
+			}
+			if size := int(info.Size()); size > l.AlertmanagerTemplateSize {
+				problems = append(problems, fmt.Sprintf("template %s is %d bytes, %d over alertmanager_max_template_size_bytes (%d)",
+					t, size, size-l.AlertmanagerTemplateSize, l.AlertmanagerTemplateSize))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// EnforceAlertmanager resolves the limits of tenant, logs every limit its
+// config and templates break and fails if there are any.
+func EnforceAlertmanager(defaults Limits, runtimeConfig, tenant, configFile string, templateFiles []string) error {
+	l, err := ForTenant(defaults, runtimeConfig, tenant)
+	if err != nil {
+		return err
+	}
+	problems, err := CheckAlertmanager(configFile, templateFiles, l)
+	if err != nil {
+		return err
+	}
+	return report(tenant, problems)
+}
+
+func report(tenant string, problems []string) error {
+	for _, p := range problems {
+		log.Printf("Limit exceeded for tenant %s: %s", tenant, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("tenant %s exceeds %d limit(s)", tenant, len(problems))
+	}
+	return nil
+}
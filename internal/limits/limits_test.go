@@ -0,0 +1,224 @@
+package limits
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/rules"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const runtimeConfig = `overrides:
+  tenant-a:
+    ruler_max_rule_groups_per_tenant: 5
+    ruler_max_rules_per_rule_group: 20
+    ruler_max_rules_per_rule_group_by_namespace:
+      big: 50
+    ruler_max_rule_groups_per_tenant_by_namespace:
+      small: 1
+    alertmanager_max_config_size_bytes: 1024
+    alertmanager_max_templates_count: 2
+    alertmanager_max_template_size_bytes: 512
+    ingestion_rate: 10000
+  tenant-b:
+    ruler_max_rules_per_rule_group: 0
+`
+
+func TestForTenant(t *testing.T) {
+	config := writeFile(t, t.TempDir(), "runtime.yaml", runtimeConfig)
+	defaults := Limits{RuleGroupsPerTenant: 70, RulesPerRuleGroup: 10}
+	tests := []struct {
+		name          string
+		runtimeConfig string
+		tenant        string
+		want          Limits
+	}{
+		{"no runtime config", "", "tenant-a", defaults},
+		{"tenant missing from the runtime config", config, "tenant-c", defaults},
+		{"overrides beat the defaults", config, "tenant-a", Limits{
+			RuleGroupsPerTenant:            5,
+			RulesPerRuleGroup:              20,
+			RulesPerRuleGroupByNamespace:   map[string]int{"big": 50},
+			RuleGroupsPerTenantByNamespace: map[string]int{"small": 1},
+			AlertmanagerConfigSize:         1024,
+			AlertmanagerTemplates:          2,
+			AlertmanagerTemplateSize:       512,
+		}},
+		{"zero override lifts a default", config, "tenant-b", Limits{RuleGroupsPerTenant: 70}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ForTenant(defaults, tt.runtimeConfig, tt.tenant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ForTenant = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForTenantErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"overrides:\n  t:\n    ruler_max_rules_per_rule_group: many\n", "bad.yaml:3: ruler_max_rules_per_rule_group of tenant t must be a non-negative integer"},
+		{"overrides:\n  t:\n    alertmanager_max_templates_count: -1\n", "bad.yaml:3: alertmanager_max_templates_count of tenant t must be a non-negative integer"},
+		{"overrides:\n  t:\n    ruler_max_rules_per_rule_group_by_namespace:\n      ns: x\n", "bad.yaml:4: ruler_max_rules_per_rule_group_by_namespace of tenant t must map namespaces to non-negative integers"},
+	}
+	for _, tt := range tests {
+		path := writeFile(t, dir, "bad.yaml", tt.config)
+		_, err := ForTenant(Limits{}, path, "t")
+		if err == nil || err.Error() != filepath.Join(dir, tt.want) {
+			t.Errorf("ForTenant(%q) error = %v, want %s", tt.config, err, tt.want)
+		}
+	}
+}
+
+// ruleFiles returns a file with the given number of rules in each group of
+// namespace ns, and a file of one single-rule group in namespace other.
+func ruleFiles(t *testing.T, ns string, groupSizes ...int) []*rules.File {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("namespace: " + ns + "\ngroups:\n")
+	for i, n := range groupSizes {
+		b.WriteString("  - name: g" + string(rune('a'+i)) + "\n    rules:\n")
+		for j := 0; j < n; j++ {
+			b.WriteString("      - record: job:up" + string(rune('a'+j)) + ":sum\n        expr: sum(up)\n")
+		}
+	}
+	files, err := rules.Parse("rules.yaml", []byte(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rules.Parse("other.yaml", []byte("namespace: other\ngroups:\n  - name: o\n    rules:\n      - record: job:up:sum\n        expr: sum(up)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(files, other...)
+}
+
+func TestCheckRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		ns     string
+		groups []int
+		limits Limits
+		want   []string
+	}{
+		{"unlimited", "ns", []int{30, 30}, Limits{}, nil},
+		{"within limits", "ns", []int{2, 2}, Limits{RuleGroupsPerTenant: 3, RulesPerRuleGroup: 2}, nil},
+		{
+			name: "rules per group", ns: "ns", groups: []int{3, 1}, limits: Limits{RulesPerRuleGroup: 2},
+			want: []string{`rules.yaml:3: group "ga" in namespace "ns" has 3 rules, 1 over ruler_max_rules_per_rule_group (2)`},
+		},
+		{
+			name: "rules per group of the namespace", ns: "big", groups: []int{3}, limits: Limits{RulesPerRuleGroup: 1, RulesPerRuleGroupByNamespace: map[string]int{"big": 2}},
+			want: []string{`rules.yaml:3: group "ga" in namespace "big" has 3 rules, 1 over ruler_max_rules_per_rule_group_by_namespace (2)`},
+		},
+		{"namespace limit beats the tenant limit", "big", []int{3}, Limits{RulesPerRuleGroup: 1, RulesPerRuleGroupByNamespace: map[string]int{"big": 5}}, nil},
+		{
+			name: "groups per tenant", ns: "ns", groups: []int{1, 1}, limits: Limits{RuleGroupsPerTenant: 2},
+			want: []string{"tenant has 3 rule groups, 1 over ruler_max_rule_groups_per_tenant (2)"},
+		},
+		{
+			name: "groups per namespace", ns: "ns", groups: []int{1, 1, 1}, limits: Limits{RuleGroupsPerTenantByNamespace: map[string]int{"ns": 2, "other": 1}},
+			want: []string{`namespace "ns" has 3 rule groups, 1 over ruler_max_rule_groups_per_tenant_by_namespace (2)`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CheckRules(ruleFiles(t, tt.ns, tt.groups...), tt.limits)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("CheckRules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestEnforceRules(t *testing.T) {
+	config := writeFile(t, t.TempDir(), "runtime.yaml", runtimeConfig)
+	files := ruleFiles(t, "ns", 15)
+	defaults := Limits{RulesPerRuleGroup: 10}
+
+	// tenant-a may have 20 rules a group, more than the default of 10
+	if err := EnforceRules(defaults, config, "tenant-a", files); err != nil {
+		t.Errorf("EnforceRules with an override: %v", err)
+	}
+	// tenant-c has no overrides, so the default applies
+	if err := EnforceRules(defaults, config, "tenant-c", files); err == nil || err.Error() != "tenant tenant-c exceeds 1 limit(s)" {
+		t.Errorf("EnforceRules without overrides error = %v", err)
+	}
+	if err := EnforceRules(defaults, "", "tenant-a", files); err == nil {
+		t.Error("EnforceRules without a runtime config succeeded")
+	}
+	if err := EnforceRules(defaults, filepath.Join(t.TempDir(), "missing.yaml"), "tenant-a", files); err == nil {
+		t.Error("EnforceRules with a missing runtime config succeeded")
+	}
+}
+
+func TestEnforceAlertmanager(t *testing.T) {
+	dir := t.TempDir()
+	config := writeFile(t, dir, "runtime.yaml", runtimeConfig)
+	amConfig := writeFile(t, dir, "alertmanager.yaml", "route:\n  receiver: default\nreceivers:\n  - name: default\n")
+	small := writeFile(t, dir, "small.tmpl", `{{ define "x" }}x{{ end }}`)
+	big := writeFile(t, dir, "big.tmpl", strings.Repeat("x", 600))
+
+	tests := []struct {
+		name      string
+		defaults  Limits
+		tenant    string
+		config    string
+		templates []string
+		want      string
+	}{
+		{"unlimited", Limits{}, "tenant-c", amConfig, []string{small, big, big}, ""},
+		{"config size", Limits{AlertmanagerConfigSize: 10}, "tenant-c", amConfig, nil, "tenant tenant-c exceeds 1 limit(s)"},
+		{"override beats the config size default", Limits{AlertmanagerConfigSize: 10}, "tenant-a", amConfig, nil, ""},
+		{"template count", Limits{}, "tenant-a", amConfig, []string{small, small, small}, "tenant tenant-a exceeds 1 limit(s)"},
+		{"template size", Limits{}, "tenant-a", amConfig, []string{small, big}, "tenant tenant-a exceeds 1 limit(s)"},
+		{"every limit", Limits{}, "tenant-a", writeFile(t, dir, "big.yaml", strings.Repeat("#\n", 600)), []string{big, big, big}, "tenant tenant-a exceeds 5 limit(s)"},
+		{"missing template", Limits{}, "tenant-a", amConfig, []string{filepath.Join(dir, "missing.tmpl")}, "failed to stat " + filepath.Join(dir, "missing.tmpl")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := EnforceAlertmanager(tt.defaults, config, tt.tenant, tt.config, tt.templates)
+			if tt.want == "" {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("EnforceAlertmanager error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+
+	problems, err := CheckAlertmanager(amConfig, []string{small, big}, Limits{AlertmanagerConfigSize: 10, AlertmanagerTemplates: 1, AlertmanagerTemplateSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"config " + amConfig + " is 56 bytes, 46 over alertmanager_max_config_size_bytes (10)",
+		"2 templates, 1 over alertmanager_max_templates_count (1)",
+		"template " + big + " is 600 bytes, 500 over alertmanager_max_template_size_bytes (100)",
+	}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("CheckAlertmanager:\n%s\nwant:\n%s", strings.Join(problems, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,56 @@
+package logql
+
+import (
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+)
+
+// OutputLabels returns the labels of the series a metric query evaluates
+// to, in the same terms as promql.OutputLabels.
+func OutputLabels(e Expr) promql.ResultLabels {
+	switch e := e.(type) {
+	case *LogExpr:
+		// Stream labels plus whatever the pipeline extracts.
+		return promql.OpenLabels()
+	case *RangeAggregation:
+		return grouped(promql.OpenLabels(), e.Op, e.Grouping, e.Without, len(e.Grouping) > 0 || e.Without)
+	case *VectorAggregation:
+		if e.Op == "topk" || e.Op == "bottomk" {
+			return OutputLabels(e.Expr)
+		}
+		return grouped(OutputLabels(e.Expr), e.Op, e.Grouping, e.Without, true)
+	case *BinaryExpr:
+		_, lhsLiteral := e.LHS.(*Literal)
+		_, rhsLiteral := e.RHS.(*Literal)
+		switch {
+		case lhsLiteral:
+			return OutputLabels(e.RHS)
+		case rhsLiteral:
+			return OutputLabels(e.LHS)
+		}
+		// Vector matching clauses are not kept, so nothing is known.
+		return promql.OpenLabels()
+	case *Call:
+		if e.Func == "label_replace" {
+			return OutputLabels(e.Args[0]).Add(e.Label)
+		}
+		return promql.ClosedLabels(e.Func + "()")
+	}
+	return promql.ClosedLabels("")
+}
+
+// grouped applies a by or without clause. Vector aggregations without a
+// clause aggregate everything away; range aggregations keep their input
+// labels.
+func grouped(in promql.ResultLabels, op string, grouping []string, without, closes bool) promql.ResultLabels {
+	switch {
+	case without:
+		return in.Drop("without ("+strings.Join(grouping, ", ")+")", grouping...)
+	case len(grouping) > 0:
+		return promql.ClosedLabels("by ("+strings.Join(grouping, ", ")+")", grouping...)
+	case closes:
+		return promql.ClosedLabels(op)
+	}
+	return in
+}
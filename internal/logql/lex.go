@@ -0,0 +1,121 @@
+package logql
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+)
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tIdent
+	tNumber
+	tUnitNumber // number with a unit: a duration such as 5m or a size such as 20MB
+	tString
+	tFlag // --strict, --keep-empty
+	tOp
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tEOF:
+		return "end of input"
+	case tString:
+		return "string " + t.val
+	case tNumber, tUnitNumber:
+		return "number " + t.val
+	}
+	return fmt.Sprintf("%q", t.val)
+}
+
+var operators = []string{
+	"|=", "|~", "|>", "!=", "!~", "!>", "=~", "==", "<=", ">=",
+	"|", "=", "<", ">", "+", "-", "*", "/", "%", "^",
+	"(", ")", "{", "}", "[", "]", ",",
+}
+
+func lex(input string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(input[i:], "--") && i+2 < len(input) && isLetter(input[i+2]):
+			start := i
+			i += 2
+			for i < len(input) && (isWordChar(input[i]) || input[i] == '-') {
+				i++
+			}
+			toks = append(toks, token{tFlag, input[start:i], start})
+		case isDigit(c) || (c == '.' && i+1 < len(input) && isDigit(input[i+1])):
+			start := i
+			for i < len(input) && (isDigit(input[i]) || input[i] == '.') {
+				i++
+			}
+			kind := tNumber
+			if i < len(input) && isLetter(input[i]) {
+				// Units: durations (1h30m) and sizes (20MB, 1.5KiB).
+				for i < len(input) && (isWordChar(input[i]) || input[i] == '.') {
+					i++
+				}
+				kind = tUnitNumber
+			}
+			toks = append(toks, token{kind, input[start:i], start})
+		case c == '"' || c == '`':
+			quote := c
+			j := i + 1
+			for j < len(input) && input[j] != quote {
+				if input[j] == '\\' && quote == '"' {
+					j++
+				}
+				j++
+			}
+			if j >= len(input) {
+				return nil, &promql.Error{Pos: i, Msg: "unterminated quoted string"}
+			}
+			toks = append(toks, token{tString, input[i : j+1], i})
+			i = j + 1
+		case isLetter(c) || c == '_':
+			start := i
+			for i < len(input) && isWordChar(input[i]) {
+				i++
+			}
+			toks = append(toks, token{tIdent, input[start:i], start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(input[i:], op) {
+					toks = append(toks, token{tOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				r, _ := utf8.DecodeRuneInString(input[i:])
+				return nil, &promql.Error{Pos: i, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+		}
+	}
+	return append(toks, token{tEOF, "", len(input)}), nil
+}
+
+func isDigit(c byte) bool    { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool   { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isWordChar(c byte) bool { return isLetter(c) || isDigit(c) || c == '_' }
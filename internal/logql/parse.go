@@ -0,0 +1,1108 @@
+// Package logql parses LogQL expressions and checks them the way Loki does
+// before accepting a rule: syntax, stage arguments, regular expressions,
+// templates, range and vector aggregation rules and operand types.
+package logql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+)
+
+// Error is the error type returned by Parse; Pos is a byte offset.
+type Error = promql.Error
+
+// Expr is a parsed LogQL expression.
+type Expr interface {
+	// IsMetric reports whether the expression returns samples rather than
+	// log lines.
+	IsMetric() bool
+	Position() int
+}
+
+// LogExpr is a stream selector followed by a pipeline.
+type LogExpr struct {
+	Matchers []*promql.LabelMatcher
+	Unwrap   string // label unwrapped by the pipeline, if any
+	Pos      int
+}
+
+// RangeAggregation is a range aggregation such as rate({...}[5m]).
+type RangeAggregation struct {
+	Op       string
+	Param    string
+	Log      *LogExpr
+	Range    string
+	Offset   string
+	Grouping []string
+	Without  bool
+	Pos      int
+}
+
+// VectorAggregation is an aggregation such as sum by (app) (...).
+type VectorAggregation struct {
+	Op       string
+	Param    string
+	Expr     Expr
+	Grouping []string
+	Without  bool
+	Pos      int
+}
+
+// BinaryExpr is a binary operation between metric expressions or numbers.
+type BinaryExpr struct {
+	Op       string
+	LHS, RHS Expr
+	Pos      int
+}
+
+// Literal is a number.
+type Literal struct {
+	Val string
+	Pos int
+}
+
+// Call is a call to label_replace or vector.
+type Call struct {
+	Func  string
+	Args  []Expr
+	Label string // destination label of label_replace
+	Pos   int
+}
+
+func (e *LogExpr) IsMetric() bool           { return false }
+func (e *RangeAggregation) IsMetric() bool  { return true }
+func (e *VectorAggregation) IsMetric() bool { return true }
+func (e *BinaryExpr) IsMetric() bool        { return true }
+func (e *Literal) IsMetric() bool           { return true }
+func (e *Call) IsMetric() bool              { return true }
+
+func (e *LogExpr) Position() int           { return e.Pos }
+func (e *RangeAggregation) Position() int  { return e.Pos }
+func (e *VectorAggregation) Position() int { return e.Pos }
+func (e *BinaryExpr) Position() int        { return e.Pos }
+func (e *Literal) Position() int           { return e.Pos }
+func (e *Call) Position() int              { return e.Pos }
+
+// rangeOps maps range aggregations to whether they take a parameter.
+var rangeOps = map[string]bool{
+	"absent_over_time":   false,
+	"avg_over_time":      false,
+	"bytes_over_time":    false,
+	"bytes_rate":         false,
+	"count_over_time":    false,
+	"first_over_time":    false,
+	"last_over_time":     false,
+	"max_over_time":      false,
+	"min_over_time":      false,
+	"quantile_over_time": true,
+	"rate":               false,
+	"rate_counter":       false,
+	"stddev_over_time":   false,
+	"stdvar_over_time":   false,
+	"sum_over_time":      false,
+}
+
+// Range aggregations that accept an unwrapped label, and the ones that
+// work on log lines without one.
+var (
+	unwrapOps   = set("avg_over_time", "sum_over_time", "max_over_time", "min_over_time", "stddev_over_time", "stdvar_over_time", "quantile_over_time", "rate", "rate_counter", "absent_over_time", "first_over_time", "last_over_time")
+	noUnwrapOps = set("bytes_over_time", "bytes_rate", "count_over_time", "rate", "absent_over_time")
+	groupingOps = set("avg_over_time", "stddev_over_time", "stdvar_over_time", "quantile_over_time", "rate", "rate_counter", "max_over_time", "min_over_time", "first_over_time", "last_over_time")
+)
+
+// vectorOps maps vector aggregations to whether they take a parameter.
+var vectorOps = map[string]bool{
+	"approx_topk": true,
+	"avg":         false,
+	"bottomk":     true,
+	"count":       false,
+	"max":         false,
+	"min":         false,
+	"sort":        false,
+	"sort_desc":   false,
+	"stddev":      false,
+	"stdvar":      false,
+	"sum":         false,
+	"topk":        true,
+}
+
+var precedence = map[string]int{
+	"or": 1, "and": 2, "unless": 2,
+	"==": 3, "!=": 3, "<=": 3, "<": 3, ">=": 3, ">": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+	"^": 6,
+}
+
+func set(names ...string) map[string]bool {
+	m := map[string]bool{}
+	for _, n := range names {
+		m[n] = true
+	}
+	return m
+}
+
+// Parse parses a LogQL expression.
+func Parse(input string) (Expr, error) {
+	toks, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	if p.peek().kind == tEOF {
+		return nil, &Error{Pos: 0, Msg: "no expression found in input"}
+	}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, p.unexpected(t, "")
+	}
+	return expr, nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) peekAt(n int) token {
+	if p.i+n < len(p.toks) {
+		return p.toks[p.i+n]
+	}
+	return p.toks[len(p.toks)-1]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isOp(val string) bool {
+	t := p.peek()
+	return t.kind == tOp && t.val == val
+}
+
+func (p *parser) isIdent(val string) bool {
+	t := p.peek()
+	return t.kind == tIdent && t.val == val
+}
+
+func (p *parser) expectOp(val, context string) (token, error) {
+	t := p.next()
+	if t.kind != tOp || t.val != val {
+		return t, p.unexpected(t, fmt.Sprintf("%s, expected %q", context, val))
+	}
+	return t, nil
+}
+
+func (p *parser) expectString(context string) (string, token, error) {
+	t := p.next()
+	if t.kind != tString {
+		return "", t, p.unexpected(t, context+", expected string")
+	}
+	v, err := promql.Unquote(t.val)
+	if err != nil {
+		return "", t, errorf(t.pos, "%v", err)
+	}
+	return v, t, nil
+}
+
+func (p *parser) unexpected(t token, context string) error {
+	msg := "unexpected " + t.String()
+	if context != "" {
+		msg += " in " + context
+	}
+	return &Error{Pos: t.pos, Msg: msg}
+}
+
+func errorf(pos int, format string, args ...any) error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) binaryOp() (string, bool) {
+	t := p.peek()
+	if t.kind != tOp && t.kind != tIdent {
+		return "", false
+	}
+	if _, ok := precedence[t.val]; !ok {
+		return "", false
+	}
+	if t.kind == tIdent && t.val != "and" && t.val != "or" && t.val != "unless" {
+		return "", false
+	}
+	return t.val, true
+}
+
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.binaryOp()
+		if !ok || precedence[op] <= minPrec {
+			return lhs, nil
+		}
+		opTok := p.next()
+		if p.isIdent("bool") {
+			b := p.next()
+			if precedence[op] != 3 {
+				return nil, errorf(b.pos, "bool modifier can only be used on comparison operators")
+			}
+		}
+		if p.isIdent("on") || p.isIdent("ignoring") {
+			t := p.next()
+			if _, err := p.parseLabelList(t.val); err != nil {
+				return nil, err
+			}
+			if p.isIdent("group_left") || p.isIdent("group_right") {
+				g := p.next()
+				if op == "and" || op == "or" || op == "unless" {
+					return nil, errorf(g.pos, "no grouping allowed for %q operation", op)
+				}
+				if p.isOp("(") {
+					if _, err := p.parseLabelList(g.val); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		nextMin := precedence[op]
+		if op == "^" {
+			nextMin--
+		}
+		rhs, err := p.parseExpr(nextMin)
+		if err != nil {
+			return nil, err
+		}
+		for _, side := range []Expr{lhs, rhs} {
+			if !side.IsMetric() {
+				return nil, errorf(opTok.pos, "binary operation %q requires metric queries on both sides, not log queries", op)
+			}
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs, Pos: lhs.Position()}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.isOp("-") || p.isOp("+") {
+		t := p.next()
+		if n := p.peek(); n.kind == tNumber {
+			p.next()
+			return &Literal{Val: t.val + n.val, Pos: t.pos}, nil
+		}
+		return nil, p.unexpected(p.peek(), "unary expression, expected number")
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tNumber:
+		p.next()
+		if _, err := strconv.ParseFloat(t.val, 64); err != nil {
+			return nil, errorf(t.pos, "invalid number %q", t.val)
+		}
+		return &Literal{Val: t.val, Pos: t.pos}, nil
+	case t.kind == tOp && t.val == "{":
+		return p.parseLogExpr()
+	case t.kind == tOp && t.val == "(":
+		p.next()
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expectOp(")", "parenthesized expression"); err != nil {
+			return nil, err
+		}
+		// A parenthesized log query may be followed by more stages.
+		if log, ok := expr.(*LogExpr); ok {
+			if err := p.parsePipeline(log); err != nil {
+				return nil, err
+			}
+		}
+		return expr, nil
+	case t.kind == tIdent:
+		if _, ok := rangeOps[t.val]; ok && p.peekAt(1).kind == tOp && p.peekAt(1).val == "(" {
+			return p.parseRangeAggregation()
+		}
+		if _, ok := vectorOps[t.val]; ok {
+			return p.parseVectorAggregation()
+		}
+		switch t.val {
+		case "label_replace", "vector":
+			return p.parseCall()
+		}
+		if p.peekAt(1).kind == tOp && p.peekAt(1).val == "(" {
+			return nil, errorf(t.pos, "unknown function or aggregation %q", t.val)
+		}
+	}
+	return nil, p.unexpected(t, "expression")
+}
+
+// parseLogExpr parses a stream selector and its pipeline.
+func (p *parser) parseLogExpr() (*LogExpr, error) {
+	open := p.next() // "{"
+	log := &LogExpr{Pos: open.pos}
+	for !p.isOp("}") {
+		m, err := p.parseMatcher()
+		if err != nil {
+			return nil, err
+		}
+		log.Matchers = append(log.Matchers, m)
+		if p.isOp(",") {
+			// Unlike PromQL, LogQL allows no trailing comma
+			p.next()
+			if p.isOp("}") {
+				return nil, p.unexpected(p.peek(), "stream selector, expected label name")
+			}
+		} else if !p.isOp("}") {
+			return nil, p.unexpected(p.peek(), "stream selector, expected \",\" or \"}\"")
+		}
+	}
+	p.next()
+	if len(log.Matchers) == 0 {
+		return nil, errorf(open.pos, "stream selector must contain at least one label matcher")
+	}
+	nonEmpty := false
+	for _, m := range log.Matchers {
+		if !matchesEmpty(m) {
+			nonEmpty = true
+		}
+	}
+	if !nonEmpty {
+		return nil, errorf(open.pos, "queries require at least one regexp or equality matcher that does not have an empty-compatible value. For instance, app=~\".*\" does not meet this requirement, but app=~\".+\" will")
+	}
+	if err := p.parsePipeline(log); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (p *parser) parseMatcher() (*promql.LabelMatcher, error) {
+	t := p.next()
+	if t.kind != tIdent {
+		return nil, p.unexpected(t, "stream selector, expected label name")
+	}
+	op := p.next()
+	if op.kind != tOp || (op.val != "=" && op.val != "!=" && op.val != "=~" && op.val != "!~") {
+		return nil, p.unexpected(op, "stream selector, expected label matching operator")
+	}
+	value, vt, err := p.expectString("stream selector")
+	if err != nil {
+		return nil, err
+	}
+	m := &promql.LabelMatcher{Name: t.val, Op: op.val, Value: value, Pos: t.pos}
+	if m.Op == "=~" || m.Op == "!~" {
+		if _, err := regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, errorf(vt.pos, "invalid regular expression in label matcher %s%s%s: %v", t.val, op.val, vt.val, err)
+		}
+	}
+	return m, nil
+}
+
+func matchesEmpty(m *promql.LabelMatcher) bool {
+	switch m.Op {
+	case "=":
+		return m.Value == ""
+	case "!=", "!~":
+		return true
+	}
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	return err == nil && re.MatchString("")
+}
+
+var stageKeywords = set("json", "logfmt", "regexp", "pattern", "unpack", "line_format", "label_format", "drop", "keep", "decolorize", "unwrap", "distinct")
+
+// parsePipeline parses line filters and "|" stages following a selector.
+func (p *parser) parsePipeline(log *LogExpr) error {
+	for {
+		t := p.peek()
+		if t.kind != tOp {
+			return nil
+		}
+		switch t.val {
+		case "|=", "!=", "|~", "!~", "|>", "!>":
+			// "!=" after a complete metric expression is a binary operator,
+			// but directly after a log query it is a line filter.
+			if err := p.parseLineFilter(); err != nil {
+				return err
+			}
+		case "|":
+			p.next()
+			if err := p.parseStage(log); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *parser) parseLineFilter() error {
+	op := p.next()
+	for {
+		if p.isIdent("ip") {
+			if err := p.parseIPFilter(); err != nil {
+				return err
+			}
+		} else {
+			value, vt, err := p.expectString("line filter")
+			if err != nil {
+				return err
+			}
+			switch op.val {
+			case "|~", "!~":
+				if _, err := regexp.Compile(value); err != nil {
+					return errorf(vt.pos, "invalid regular expression in line filter %s: %v", vt.val, err)
+				}
+			case "|>", "!>":
+				if err := checkPattern(value, false); err != nil {
+					return errorf(vt.pos, "invalid pattern in line filter %s: %v", vt.val, err)
+				}
+			}
+		}
+		if !p.isIdent("or") {
+			return nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseIPFilter() error {
+	t := p.next() // ip
+	if _, err := p.expectOp("(", "ip filter"); err != nil {
+		return err
+	}
+	value, vt, err := p.expectString("ip filter")
+	if err != nil {
+		return err
+	}
+	if _, err := p.expectOp(")", "ip filter"); err != nil {
+		return err
+	}
+	if !validIPPattern(value) {
+		return errorf(vt.pos, "invalid ip pattern %q in %s()", value, t.val)
+	}
+	return nil
+}
+
+var ipPatternRe = regexp.MustCompile(`^[0-9a-fA-F:.]+(/\d{1,3})?$|^[0-9a-fA-F:.]+-[0-9a-fA-F:.]+$`)
+
+func validIPPattern(s string) bool { return ipPatternRe.MatchString(s) }
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (p *parser) parseStage(log *LogExpr) error {
+	t := p.peek()
+	if t.kind == tIdent && stageKeywords[t.val] && !isComparisonOp(p.peekAt(1)) {
+		p.next()
+		switch t.val {
+		case "json", "logfmt":
+			for p.peek().kind == tFlag {
+				f := p.next()
+				if t.val != "logfmt" || (f.val != "--strict" && f.val != "--keep-empty") {
+					return errorf(f.pos, "unknown flag %s for %s", f.val, t.val)
+				}
+			}
+			return p.parseExtractionParams(t.val)
+		case "regexp":
+			value, vt, err := p.expectString("regexp stage")
+			if err != nil {
+				return err
+			}
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return errorf(vt.pos, "invalid regular expression in regexp stage: %v", err)
+			}
+			named := false
+			for _, name := range re.SubexpNames() {
+				if name != "" {
+					named = true
+					if !labelNameRe.MatchString(name) {
+						return errorf(vt.pos, "invalid extracted label name %q", name)
+					}
+				}
+			}
+			if !named {
+				return errorf(vt.pos, "at least one named capture must be supplied in regexp stage")
+			}
+		case "pattern":
+			value, vt, err := p.expectString("pattern stage")
+			if err != nil {
+				return err
+			}
+			if err := checkPattern(value, true); err != nil {
+				return errorf(vt.pos, "invalid pattern: %v", err)
+			}
+		case "line_format":
+			value, vt, err := p.expectString("line_format stage")
+			if err != nil {
+				return err
+			}
+			if err := checkTemplate(value); err != nil {
+				return errorf(vt.pos, "invalid line_format template: %v", err)
+			}
+		case "label_format":
+			return p.parseLabelFormat()
+		case "drop", "keep":
+			return p.parseDropKeep(t.val)
+		case "unpack", "decolorize":
+		case "distinct":
+			_, err := p.parseNameList("distinct")
+			return err
+		case "unwrap":
+			return p.parseUnwrap(log)
+		}
+		return nil
+	}
+	return p.parseLabelFilterExpr()
+}
+
+func isComparisonOp(t token) bool {
+	if t.kind != tOp {
+		return false
+	}
+	switch t.val {
+	case "=", "!=", "=~", "!~", ">", ">=", "<", "<=", "==":
+		return true
+	}
+	return false
+}
+
+// parseExtractionParams parses the optional label="expression" list of
+// json and logfmt.
+func (p *parser) parseExtractionParams(stage string) error {
+	for p.peek().kind == tIdent {
+		name := p.next()
+		if !labelNameRe.MatchString(name.val) {
+			return errorf(name.pos, "invalid label name %q in %s stage", name.val, stage)
+		}
+		if p.isOp("=") {
+			p.next()
+			if _, _, err := p.expectString(stage + " stage"); err != nil {
+				return err
+			}
+		}
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	return nil
+}
+
+func (p *parser) parseLabelFormat() error {
+	for {
+		name := p.next()
+		if name.kind != tIdent || !labelNameRe.MatchString(name.val) {
+			return p.unexpected(name, "label_format stage, expected label name")
+		}
+		if _, err := p.expectOp("=", "label_format stage"); err != nil {
+			return err
+		}
+		v := p.next()
+		switch v.kind {
+		case tIdent:
+		case tString:
+			value, err := promql.Unquote(v.val)
+			if err != nil {
+				return errorf(v.pos, "%v", err)
+			}
+			if err := checkTemplate(value); err != nil {
+				return errorf(v.pos, "invalid label_format template for %s: %v", name.val, err)
+			}
+		default:
+			return p.unexpected(v, "label_format stage, expected label name or template")
+		}
+		if !p.isOp(",") {
+			return nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseDropKeep(stage string) error {
+	for {
+		name := p.next()
+		if name.kind != tIdent || !labelNameRe.MatchString(name.val) {
+			return p.unexpected(name, stage+" stage, expected label name")
+		}
+		if isComparisonOp(p.peek()) {
+			op := p.next()
+			if op.val != "=" && op.val != "!=" && op.val != "=~" && op.val != "!~" {
+				return p.unexpected(op, stage+" stage")
+			}
+			value, vt, err := p.expectString(stage + " stage")
+			if err != nil {
+				return err
+			}
+			if op.val == "=~" || op.val == "!~" {
+				if _, err := regexp.Compile(value); err != nil {
+					return errorf(vt.pos, "invalid regular expression in %s stage: %v", stage, err)
+				}
+			}
+		}
+		if !p.isOp(",") {
+			return nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseNameList(stage string) ([]string, error) {
+	var names []string
+	for {
+		name := p.next()
+		if name.kind != tIdent || !labelNameRe.MatchString(name.val) {
+			return nil, p.unexpected(name, stage+" stage, expected label name")
+		}
+		names = append(names, name.val)
+		if !p.isOp(",") {
+			return names, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseUnwrap(log *LogExpr) error {
+	if log.Unwrap != "" {
+		return errorf(p.peek().pos, "unwrap may only be used once in a pipeline")
+	}
+	t := p.next()
+	if t.kind != tIdent {
+		return p.unexpected(t, "unwrap stage, expected label name")
+	}
+	switch t.val {
+	case "bytes", "duration", "duration_seconds":
+		if p.isOp("(") {
+			p.next()
+			name := p.next()
+			if name.kind != tIdent {
+				return p.unexpected(name, "unwrap stage, expected label name")
+			}
+			if _, err := p.expectOp(")", "unwrap stage"); err != nil {
+				return err
+			}
+			log.Unwrap = name.val
+			break
+		}
+		log.Unwrap = t.val
+	default:
+		log.Unwrap = t.val
+	}
+	// Post-unwrap label filters such as "| __error__=\"\"" are parsed as
+	// ordinary stages by the caller.
+	return nil
+}
+
+// parseLabelFilterExpr parses label filters joined by and, or, "," or
+// whitespace, with parentheses for grouping.
+func (p *parser) parseLabelFilterExpr() error {
+	if err := p.parseLabelFilterTerm(); err != nil {
+		return err
+	}
+	for {
+		switch {
+		case p.isIdent("and") || p.isIdent("or") || p.isOp(","):
+			p.next()
+		case p.peek().kind == tIdent && isComparisonOp(p.peekAt(1)), p.isOp("("):
+			// implicit "and"
+		default:
+			return nil
+		}
+		if err := p.parseLabelFilterTerm(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) parseLabelFilterTerm() error {
+	if p.isOp("(") {
+		p.next()
+		if err := p.parseLabelFilterExpr(); err != nil {
+			return err
+		}
+		_, err := p.expectOp(")", "label filter")
+		return err
+	}
+	name := p.next()
+	if name.kind != tIdent {
+		return p.unexpected(name, "pipeline, expected stage or label filter")
+	}
+	op := p.next()
+	if !isComparisonOp(op) {
+		return p.unexpected(op, "label filter, expected comparison operator")
+	}
+	v := p.peek()
+	switch {
+	case v.kind == tIdent && v.val == "ip":
+		if op.val != "=" && op.val != "!=" {
+			return errorf(op.pos, "ip() label filter only supports = and !=")
+		}
+		return p.parseIPFilter()
+	case v.kind == tString:
+		value, vt, err := p.expectString("label filter")
+		if err != nil {
+			return err
+		}
+		switch op.val {
+		case "=~", "!~":
+			if _, err := regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return errorf(vt.pos, "invalid regular expression in label filter: %v", err)
+			}
+		case "=", "!=":
+		default:
+			return errorf(op.pos, "operator %s cannot be used with a string value", op.val)
+		}
+	case v.kind == tNumber || v.kind == tUnitNumber || v.kind == tOp && v.val == "-":
+		p.next()
+		neg := ""
+		if v.kind == tOp {
+			neg = "-"
+			v = p.next()
+		}
+		if op.val == "=~" || op.val == "!~" {
+			return errorf(op.pos, "operator %s requires a string value", op.val)
+		}
+		if err := checkFilterNumber(neg + v.val); err != nil {
+			return errorf(v.pos, "%v", err)
+		}
+	default:
+		return p.unexpected(v, "label filter, expected value")
+	}
+	return nil
+}
+
+var byteUnits = set("b", "kb", "mb", "gb", "tb", "pb", "eb", "kib", "mib", "gib", "tib", "pib", "eib", "k", "ki", "m", "mi", "g", "gi", "t", "ti", "p", "pi", "e", "ei")
+
+// checkFilterNumber validates a number, duration or byte size compared in
+// a label filter.
+func checkFilterNumber(s string) error {
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return nil
+	}
+	if _, err := time.ParseDuration(s); err == nil {
+		return nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' })
+	if i > 0 {
+		if _, err := strconv.ParseFloat(s[:i], 64); err == nil && byteUnits[strings.ToLower(s[i:])] {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid number, duration or byte size %q in label filter", s)
+}
+
+var rangeDurationRe = regexp.MustCompile(`^(\d+(ms|s|m|h|d|w|y))+$`)
+
+func (p *parser) parseRange() (string, error) {
+	if _, err := p.expectOp("[", "range aggregation"); err != nil {
+		return "", err
+	}
+	t := p.next()
+	if t.kind != tUnitNumber || !rangeDurationRe.MatchString(t.val) {
+		return "", p.unexpected(t, "range, expected duration")
+	}
+	if _, err := p.expectOp("]", "range"); err != nil {
+		return "", err
+	}
+	return t.val, nil
+}
+
+func (p *parser) parseRangeAggregation() (Expr, error) {
+	opTok := p.next()
+	agg := &RangeAggregation{Op: opTok.val, Pos: opTok.pos}
+	p.next() // "("
+	if rangeOps[agg.Op] {
+		t := p.next()
+		if t.kind != tNumber {
+			return nil, p.unexpected(t, agg.Op+", expected parameter")
+		}
+		agg.Param = t.val
+		if _, err := p.expectOp(",", agg.Op); err != nil {
+			return nil, err
+		}
+	}
+
+	// The range goes either right after the selector, before the pipeline,
+	// or after the whole (possibly parenthesized) log query.
+	var log *LogExpr
+	switch {
+	case p.isOp("{"):
+		var err error
+		if log, err = p.parseSelectorOnly(); err != nil {
+			return nil, err
+		}
+		if p.isOp("[") {
+			if agg.Range, err = p.parseRange(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.parsePipeline(log); err != nil {
+			return nil, err
+		}
+	case p.isOp("("):
+		expr, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		l, ok := expr.(*LogExpr)
+		if !ok {
+			return nil, errorf(expr.Position(), "%s expects a log query", agg.Op)
+		}
+		log = l
+	default:
+		return nil, p.unexpected(p.peek(), agg.Op+", expected log query")
+	}
+	if agg.Range == "" {
+		rng, err := p.parseRange()
+		if err != nil {
+			return nil, err
+		}
+		agg.Range = rng
+	}
+	if p.isIdent("offset") {
+		p.next()
+		t := p.next()
+		if t.kind != tUnitNumber || !rangeDurationRe.MatchString(t.val) {
+			return nil, p.unexpected(t, "offset, expected duration")
+		}
+		agg.Offset = t.val
+	}
+	if _, err := p.expectOp(")", agg.Op); err != nil {
+		return nil, err
+	}
+	agg.Log = log
+	if p.isIdent("by") || p.isIdent("without") {
+		t := p.next()
+		labels, err := p.parseLabelList(t.val)
+		if err != nil {
+			return nil, err
+		}
+		agg.Grouping, agg.Without = labels, t.val == "without"
+		if !groupingOps[agg.Op] {
+			return nil, errorf(t.pos, "grouping not allowed for %s aggregation", agg.Op)
+		}
+	}
+	if log.Unwrap != "" && !unwrapOps[agg.Op] {
+		return nil, errorf(agg.Pos, "invalid aggregation %s with unwrap", agg.Op)
+	}
+	if log.Unwrap == "" && !noUnwrapOps[agg.Op] {
+		return nil, errorf(agg.Pos, "invalid aggregation %s without unwrap", agg.Op)
+	}
+	return agg, nil
+}
+
+// parseSelectorOnly parses a stream selector without its pipeline.
+func (p *parser) parseSelectorOnly() (*LogExpr, error) {
+	// Parse the tokens up to the closing "}" on their own so the pipeline
+	// that may follow the range is left to the caller.
+	toks := p.toks
+	start := p.i
+	end := start
+	for end < len(toks) && !(toks[end].kind == tOp && toks[end].val == "}") {
+		end++
+	}
+	if end >= len(toks) {
+		return nil, p.unexpected(toks[len(toks)-1], "stream selector, expected \"}\"")
+	}
+	sub := &parser{toks: append(append([]token{}, toks[start:end+1]...), token{tEOF, "", toks[end].pos + 1})}
+	log, err := sub.parseLogExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.i = end + 1
+	return log, nil
+}
+
+func (p *parser) parseVectorAggregation() (Expr, error) {
+	opTok := p.next()
+	agg := &VectorAggregation{Op: opTok.val, Pos: opTok.pos}
+	grouping := func() error {
+		t := p.next()
+		labels, err := p.parseLabelList(t.val)
+		if err != nil {
+			return err
+		}
+		agg.Grouping, agg.Without = labels, t.val == "without"
+		return nil
+	}
+	if p.isIdent("by") || p.isIdent("without") {
+		if err := grouping(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expectOp("(", agg.Op); err != nil {
+		return nil, err
+	}
+	if vectorOps[agg.Op] {
+		t := p.next()
+		if t.kind != tNumber {
+			return nil, p.unexpected(t, agg.Op+", expected parameter")
+		}
+		if n, err := strconv.Atoi(t.val); err != nil || n <= 0 {
+			return nil, errorf(t.pos, "invalid parameter %s(%s, ...): must be a positive integer", agg.Op, t.val)
+		}
+		agg.Param = t.val
+		if _, err := p.expectOp(",", agg.Op); err != nil {
+			return nil, err
+		}
+	}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if !expr.IsMetric() {
+		return nil, errorf(expr.Position(), "%s expects a metric query, not a log query", agg.Op)
+	}
+	agg.Expr = expr
+	if _, err := p.expectOp(")", agg.Op); err != nil {
+		return nil, err
+	}
+	if agg.Grouping == nil && (p.isIdent("by") || p.isIdent("without")) {
+		if err := grouping(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *parser) parseCall() (Expr, error) {
+	nameTok := p.next()
+	call := &Call{Func: nameTok.val, Pos: nameTok.pos}
+	if _, err := p.expectOp("(", nameTok.val); err != nil {
+		return nil, err
+	}
+	if call.Func == "vector" {
+		t := p.next()
+		if t.kind != tNumber {
+			return nil, p.unexpected(t, "vector, expected number")
+		}
+		call.Args = []Expr{&Literal{Val: t.val, Pos: t.pos}}
+	} else {
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if !expr.IsMetric() {
+			return nil, errorf(expr.Position(), "label_replace expects a metric query, not a log query")
+		}
+		call.Args = append(call.Args, expr)
+		for i := 0; i < 4; i++ {
+			if _, err := p.expectOp(",", "label_replace"); err != nil {
+				return nil, err
+			}
+			value, vt, err := p.expectString("label_replace")
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				call.Label = value
+			}
+			if i == 3 {
+				if _, err := regexp.Compile(value); err != nil {
+					return nil, errorf(vt.pos, "invalid regular expression in label_replace: %v", err)
+				}
+			}
+		}
+	}
+	if _, err := p.expectOp(")", nameTok.val); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+func (p *parser) parseLabelList(context string) ([]string, error) {
+	if _, err := p.expectOp("(", context+" clause"); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for !p.isOp(")") {
+		t := p.next()
+		if t.kind != tIdent {
+			return nil, p.unexpected(t, context+" clause, expected label")
+		}
+		labels = append(labels, t.val)
+		if p.isOp(",") {
+			p.next()
+		} else if !p.isOp(")") {
+			return nil, p.unexpected(p.peek(), context+" clause, expected \",\" or \")\"")
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+// checkPattern validates a pattern stage or pattern line filter expression.
+// Captures are <name> or <_>; a pattern stage needs at least one named
+// capture and two captures may not follow each other.
+func checkPattern(s string, needNamed bool) error {
+	named := 0
+	seen := map[string]bool{}
+	lastWasCapture := false
+	for i := 0; i < len(s); {
+		if s[i] == '<' {
+			if j := strings.IndexByte(s[i:], '>'); j > 0 {
+				name := s[i+1 : i+j]
+				if name == "_" || labelNameRe.MatchString(name) {
+					if lastWasCapture {
+						return fmt.Errorf("found consecutive capture %q", "<"+name+">")
+					}
+					if name != "_" {
+						if seen[name] {
+							return fmt.Errorf("duplicate capture name %q", name)
+						}
+						seen[name] = true
+						named++
+					}
+					lastWasCapture = true
+					i += j + 1
+					continue
+				}
+			}
+		}
+		lastWasCapture = false
+		i++
+	}
+	if needNamed && named == 0 {
+		return fmt.Errorf("at least one capture is required")
+	}
+	return nil
+}
+
+// checkTemplate parses a line_format or label_format template. Functions
+// are not checked, since Loki provides many beyond text/template's own.
+func checkTemplate(s string) error {
+	t := parse.New("template")
+	t.Mode = parse.SkipFuncCheck
+	_, err := t.Parse(s, "", "", map[string]*parse.Tree{})
+	return err
+}
+
+// ParseRule parses the expression of an alerting or recording rule, which
+// Loki requires to be a metric query.
+func ParseRule(input string) (Expr, error) {
+	expr, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	if !expr.IsMetric() {
+		return nil, errorf(expr.Position(), "rule expressions must be metric queries, not log queries")
+	}
+	return expr, nil
+}
@@ -0,0 +1,118 @@
+package logql
+
+import (
+	"strings"
+	"testing"
+)
+
+// The corpus below follows the test cases of the Loki parser: every valid
+// expression is accepted upstream and every invalid one rejected.
+
+var validExprs = []string{
+	// Stream selectors
+	`{foo="bar"}`, `{ foo = "bar" }`, `{foo="bar", bar!="baz"}`, `{foo=~"ba.*"}`, `{foo="bar", bar!~"ba.*"}`, `{foo="bar", x=""}`,
+	`{foo=~".+"}`, `{app="foo", namespace=~"prod-.*"}`,
+	// Line filters
+	`{foo="bar"} |= "baz"`, `{foo="bar"} != "baz"`, `{foo="bar"} |~ "ba.*"`, `{foo="bar"} !~ "ba.*"`,
+	`{foo="bar"} |= "baz" |~ "blip" != "flip" !~ "flap"`, "{foo=\"bar\"} |= `baz`", `{foo="bar"} |> "<_> error <_>"`,
+	`{foo="bar"} |= ip("192.168.0.1")`, `{foo="bar"} |= "a" or "b"`,
+	// Parsers and formatters
+	`{app="foo"} | json`, `{app="foo"} | logfmt`, `{app="foo"} | json first_server="servers[0]", ua="request.headers[\"User-Agent\"]"`,
+	`{app="foo"} | logfmt --strict`, `{app="foo"} | regexp "(?P<method>\\w+) (?P<path>[\\w|/]+)"`,
+	`{app="foo"} | pattern "<ip> - - <_> \"<method> <uri> <_>\" <status>"`, `{app="foo"} | unpack`,
+	`{app="foo"} | line_format "{{.foo}}"`, `{app="foo"} | label_format foo=bar, baz="{{.qux}}"`,
+	`{app="foo"} | drop level, method="GET"`, `{app="foo"} | keep level`, `{app="foo"} | decolorize`,
+	// Label filters
+	`{app="foo"} | json | status >= 400`, `{app="foo"} | logfmt | duration > 1s`, `{app="foo"} | logfmt | size > 20kB`,
+	`{app="foo"} | json | level="error" or level="warn"`, `{app="foo"} | json | level="error", status=~"5.."`,
+	`{app="foo"} | json | (status >= 500 and level="error") or latency > 1s`, `{app="foo"} | logfmt | addr = ip("10.0.0.0/8")`,
+	// Metric queries
+	`count_over_time({foo="bar"}[5m])`, `rate({foo="bar"} |= "error" [1m])`, `bytes_over_time({foo="bar"}[5m])`,
+	`bytes_rate({foo="bar"}[5m])`, `absent_over_time({foo="bar"}[5m])`, `rate({foo="bar"}[5m] offset 1h)`,
+	`sum_over_time({app="foo"} | logfmt | unwrap latency [5m])`, `avg_over_time({app="foo"} | json | unwrap duration(latency) [5m]) by (host)`,
+	`quantile_over_time(0.99, {app="foo"} | json | unwrap bytes(size) [5m]) by (path)`,
+	`max_over_time({app="foo"} | logfmt | unwrap latency | __error__="" [5m]) without (pod)`,
+	`sum by (app) (rate({foo="bar"}[5m]))`, `sum(rate({foo="bar"}[5m])) by (app)`, `topk(5, sum by (app) (rate({foo="bar"}[5m])))`,
+	`count(count_over_time({foo="bar"}[5m]))`, `sort_desc(sum by (app) (count_over_time({foo="bar"}[5m])))`,
+	`sum(rate({foo="bar"}[5m])) / sum(rate({foo="baz"}[5m]))`, `sum(rate({foo="bar"}[5m])) > 10`, `rate({foo="bar"}[5m]) > bool 1`,
+	`sum(rate({foo="bar"}[5m])) by (app) * on (app) group_left sum(rate({foo="baz"}[5m])) by (app)`,
+	`label_replace(rate({foo="bar"}[5m]), "x", "$1", "app", "(.*)")`, `vector(1)`, `1 + 1`, `-1`,
+	`sum(rate({foo="bar"}[5m])) or vector(0)`, `(sum(rate({foo="bar"}[5m])))`,
+}
+
+var invalidExprs = []struct {
+	expr string
+	err  string
+}{
+	// Stream selectors
+	{`{}`, "stream selector must contain at least one label matcher"},
+	{`x{}`, "unexpected"},
+	{`foo`, "unexpected"},
+	{`{foo="bar",}`, "unexpected \"}\" in stream selector, expected label name"},
+	{`{,foo="bar"}`, "unexpected"},
+	{`{foo="bar" bar="baz"}`, "unexpected"},
+	{`{foo=bar}`, "unexpected"},
+	{`{foo=""}`, "queries require at least one regexp or equality matcher that does not have an empty-compatible value"},
+	{`{foo=~".*"}`, "queries require at least one regexp or equality matcher that does not have an empty-compatible value"},
+	{`{foo!~"ba.*"}`, "queries require at least one regexp or equality matcher that does not have an empty-compatible value"},
+	{`{foo!="bar"}`, "queries require at least one regexp or equality matcher that does not have an empty-compatible value"},
+	{`{foo=~"("}`, "invalid regular expression in label matcher"},
+	{`{foo="bar"`, "unexpected end of input"},
+	// Pipelines
+	{`{foo="bar"} |= `, "unexpected end of input"},
+	{`{foo="bar"} |~ "("`, "invalid regular expression in line filter"},
+	{`{foo="bar"} | regexp "(?P<>.*)"`, ""},
+	{`{foo="bar"} | regexp "(.*)"`, "at least one named capture must be supplied in regexp stage"},
+	{`{foo="bar"} | line_format "{{.foo"`, "invalid line_format template"},
+	{`{foo="bar"} | label_format foo="{{.bar"`, "invalid label_format template"},
+	{`{foo="bar"} | json | status >= "400"`, "operator >= cannot be used with a string value"},
+	{`{foo="bar"} | json | level =~ 5`, "requires a string value"},
+	{`{foo="bar"} | logfmt | addr > ip("10.0.0.1")`, "ip() label filter only supports = and !="},
+	{`{foo="bar"} | unknown_stage`, "unexpected"},
+	// Metric queries
+	{`rate({foo="bar"})`, "unexpected"},
+	{`rate({foo="bar"}[5])`, ""},
+	{`count_over_time({foo="bar"} | logfmt | unwrap latency [5m])`, "invalid aggregation count_over_time with unwrap"},
+	{`sum_over_time({foo="bar"}[5m])`, "invalid aggregation sum_over_time without unwrap"},
+	{`count_over_time({foo="bar"}[5m]) by (app)`, "grouping not allowed for count_over_time aggregation"},
+	{`sum({foo="bar"})`, "sum expects a metric query, not a log query"},
+	{`topk(0, sum(rate({foo="bar"}[5m])))`, "must be a positive integer"},
+	{`topk(sum(rate({foo="bar"}[5m])))`, ""},
+	{`unknown_func({foo="bar"}[5m])`, "unknown function or aggregation \"unknown_func\""},
+	{`{foo="bar"} + 1`, "requires metric queries on both sides, not log queries"},
+	{`sum(rate({foo="bar"}[5m])) + bool 1`, "bool modifier can only be used on comparison operators"},
+	{`sum(rate({foo="bar"}[5m])) and on (app) group_left sum(rate({foo="baz"}[5m]))`, "no grouping allowed for \"and\" operation"},
+	{`label_replace({foo="bar"}, "x", "$1", "app", "(.*)")`, "label_replace expects a metric query, not a log query"},
+	{`label_replace(rate({foo="bar"}[5m]), "x", "$1", "app", "(")`, "invalid regular expression in label_replace"},
+	{`sum(rate({foo="bar"}[5m])`, "unexpected end of input"},
+}
+
+func TestParseValid(t *testing.T) {
+	for _, expr := range validExprs {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("Parse(%q): %v", expr, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, tt := range invalidExprs {
+		_, err := Parse(tt.expr)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", tt.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) error = %q, want it to contain %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	if _, err := ParseRule(`sum(rate({foo="bar"}[5m])) > 1`); err != nil {
+		t.Errorf("ParseRule of a metric query: %v", err)
+	}
+	if _, err := ParseRule(`{foo="bar"} |= "error"`); err == nil || !strings.Contains(err.Error(), "rule expressions must be metric queries") {
+		t.Errorf("ParseRule of a log query error = %v, want it to reject log queries", err)
+	}
+}
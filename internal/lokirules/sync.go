@@ -6,16 +6,45 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/antnsn/mal-sync/internal/common"
+	"github.com/antnsn/mal-sync/internal/incremental"
+	"github.com/antnsn/mal-sync/internal/limits"
+	"github.com/antnsn/mal-sync/internal/logql"
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/source"
+	"github.com/antnsn/mal-sync/internal/state"
 )
 
 const (
 	lokitoolCmd = "lokitool"
 )
 
+// Options configures a Loki rules sync.
+type Options struct {
+	RulesPath       string       // Directory of rule files (*.yaml, *.yml, *.json) or a single rule file
+	Filter          rules.Filter // Include and exclude patterns selecting the rule files of RulesPath
+	LokiAddress     string
+	OrgID           string
+	PolicyFile      string                  // Optional rule policy file; policy errors block the sync
+	Limits          limits.Limits           // Ruler limits of the tenant; zero values are unlimited
+	RuntimeConfig   string                  // Optional runtime config file with per-tenant limit overrides
+	SplitGroups     bool                    // Split groups exceeding the rules-per-group limit into name-1, name-2, ...
+	NamespaceFormat string                  // Namespace of PrometheusRule objects, from {namespace} and {name}; rules.DefaultNamespaceFormat when empty
+	Namespaces      rules.NamespaceStrategy // Overrides the namespaces rule files declare
+	Artifacts       source.Artifacts        // Fetches RulesPath when it is a URL or bundle
+	Since           string                  // Git commit to compare RulesPath with; only changed namespaces are linted and synced when set
+	State           state.Store             // Content hashes of the last successful sync; unchanged namespaces are skipped when set
+	Prune           []string                // Namespaces synced before, such as by the controller; those no rule file defines anymore are deleted
+	TempBaseDir     string
+}
+
 // Sync performs the Loki rules synchronization.
-func Sync(rulesPath, lokiAddress, orgID, tempBaseDir string) error {
+func Sync(opts Options) error {
+	rulesPath, lokiAddress, orgID, tempBaseDir := opts.RulesPath, opts.LokiAddress, opts.OrgID, opts.TempBaseDir
+
 	log.Printf("Starting Loki rules sync for Loki instance: %s (OrgID: %s)", lokiAddress, orgID)
 	log.Printf("Rules path: %s", rulesPath)
 
@@ -32,52 +61,162 @@ func Sync(rulesPath, lokiAddress, orgID, tempBaseDir string) error {
 	}()
 	log.Printf("Using temporary directory: %s", syncTempDir)
 
-	// 2. Collect and copy rule files to temporary location
-	var tempRuleFiles []string
-	fileInfo, err := os.Stat(rulesPath)
+	// 2. Collect and copy rule files to temporary location, fetching URLs
+	// and extracting bundles first and converting PrometheusRule manifests
+	// to plain rule files
+	artifactsDir := filepath.Join(syncTempDir, "artifacts")
+	rulesPath, err := opts.Artifacts.Resolve(rulesPath, artifactsDir)
 	if err != nil {
-		return fmt.Errorf("failed to stat rules path %s: %w", rulesPath, err)
+		return err
 	}
-
-	if fileInfo.IsDir() {
-		log.Printf("Processing rules from directory: %s", rulesPath)
-		entries, err := os.ReadDir(rulesPath)
-		if err != nil {
-			return fmt.Errorf("failed to read rules directory %s: %w", rulesPath, err)
-		}
-		for _, entry := range entries {
-			if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".yaml") || strings.HasSuffix(entry.Name(), ".yml")) {
-				srcPath := filepath.Join(rulesPath, entry.Name())
-				dstPath := filepath.Join(syncTempDir, entry.Name())
-				log.Printf("Copying rule file %s to %s", srcPath, dstPath)
-				if err := common.CopyFile(srcPath, dstPath); err != nil {
-					return fmt.Errorf("failed to copy rule file %s to %s: %w", srcPath, dstPath, err)
-				}
-				tempRuleFiles = append(tempRuleFiles, dstPath)
+	ruleFiles, err := opts.Filter.ResolveFiles(rulesPath)
+	if err != nil {
+		return err
+	}
+	if len(ruleFiles) == 0 && len(opts.Prune) == 0 {
+		log.Printf("No .yaml, .yml or .json files found in directory %s. Nothing to sync.", rulesPath)
+		return nil // Not an error, just nothing to do
+	}
+	parsed, err := rules.LoadFiles(ruleFiles)
+	if err != nil {
+		return err
+	}
+	namespaces := func(files []*rules.File) error {
+		if opts.NamespaceFormat != "" {
+			if err := rules.ApplyNamespaceFormat(files, opts.NamespaceFormat); err != nil {
+				return err
 			}
 		}
-		if len(tempRuleFiles) == 0 {
-			log.Printf("No .yaml or .yml files found in directory %s. Nothing to sync.", rulesPath)
-			return nil // Not an error, just nothing to do
+		if !opts.Namespaces.IsZero() {
+			return rules.ApplyNamespaceStrategy(files, opts.Namespaces)
+		}
+		return nil
+	}
+	if err := namespaces(parsed); err != nil {
+		return err
+	}
+	tempRuleFiles, err := rules.StageFiles(parsed, syncTempDir)
+	if err != nil {
+		return err
+	}
+	var changes *incremental.Changes
+	if opts.Since != "" {
+		if changes, err = incremental.Compare(parsed, rulesPath, opts.Since, opts.Filter, namespaces); err != nil {
+			return err
 		}
-	} else {
-		// Single file case
-		if !(strings.HasSuffix(rulesPath, ".yaml") || strings.HasSuffix(rulesPath, ".yml")) {
-			return fmt.Errorf("rules.path points to a file but it is not a .yaml or .yml file: %s", rulesPath)
+	}
+	// Namespaces synced before that no file defines anymore are deleted;
+	// without any rule files only those are synced
+	changes = incremental.Prune(changes, parsed, opts.Prune)
+	if opts.Since != "" {
+		// A due verification syncs everything, so with a state file the
+		// decision is left to the state
+		if changes != nil && len(changes.Namespaces) == 0 && !opts.State.Enabled() {
+			log.Printf("No rule files changed since %s. Nothing to sync.", opts.Since)
+			return nil
 		}
-		dstPath := filepath.Join(syncTempDir, filepath.Base(rulesPath))
-		log.Printf("Copying single rule file %s to %s", rulesPath, dstPath)
-		if err := common.CopyFile(rulesPath, dstPath); err != nil {
-			return fmt.Errorf("failed to copy rule file %s to %s: %w", rulesPath, dstPath, err)
+		if changes != nil && len(changes.Namespaces) > 0 {
+			log.Printf("Namespaces changed since %s: %s", opts.Since, strings.Join(changes.Namespaces, ", "))
+			if len(changes.Deleted) > 0 {
+				log.Printf("Namespaces to delete: %s", strings.Join(changes.Deleted, ", "))
+			}
 		}
-		tempRuleFiles = append(tempRuleFiles, dstPath)
+	}
+	// Only the staged files may be seen by --rule-dirs
+	if err := os.RemoveAll(artifactsDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", artifactsDir, err)
 	}
 
 	log.Printf("Copied %d rule file(s) to %s", len(tempRuleFiles), syncTempDir)
 
-	// 3. Lint each rule file before attempting to sync
+	// 3. Validate every rule expression and alert template, reporting all
+	// errors at their positions in the original files
+	if err := rules.ValidateExprs("LogQL", parsed, func(expr string) error {
+		_, err := logql.ParseRule(expr)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := rules.ValidateTemplates(parsed, func(expr string) (promql.ResultLabels, bool) {
+		e, err := logql.ParseRule(expr)
+		if err != nil {
+			return promql.ResultLabels{}, false
+		}
+		return logql.OutputLabels(e), true
+	}); err != nil {
+		return err
+	}
+
+	// 4. Split groups exceeding the tenant's rules-per-group limit
+	if opts.SplitGroups {
+		tenantLimits, err := limits.ForTenant(opts.Limits, opts.RuntimeConfig, orgID)
+		if err != nil {
+			return err
+		}
+		// LogQL rules read logs, never series recorded by other rules
+		if err := rules.SplitFiles(parsed, tempRuleFiles, tenantLimits.RulesPerGroup, nil); err != nil {
+			return err
+		}
+	}
+
+	// 5. Detect groups and rules that would be merged or overwritten
+	// once all files are uploaded to the tenant
+	if err := rules.ValidateDuplicates(parsed); err != nil {
+		return err
+	}
+
+	// 6. Check the rules against the policy
+	if opts.PolicyFile != "" {
+		if err := rules.Enforce(opts.PolicyFile, parsed); err != nil {
+			return err
+		}
+	}
+
+	// 7. Check the rule groups against the tenant's ruler limits
+	if err := limits.EnforceRules(opts.Limits, opts.RuntimeConfig, opts.OrgID, parsed); err != nil {
+		return err
+	}
+
+	// 8. Skip namespaces whose staged rule files are unchanged since
+	// the last successful sync, unless it is time to verify them all
+	var hashes map[string]string
+	var last *state.Target
+	target := "loki-rules " + lokiAddress + " " + orgID
+	if opts.State.Enabled() {
+		if hashes, err = incremental.Hashes(parsed, tempRuleFiles); err != nil {
+			return err
+		}
+		if last, err = opts.State.Load(target); err != nil {
+			return err
+		}
+		// With --since only namespaces changed both since the commit and
+		// since the last sync are synced; a due verification syncs every
+		// namespace whatever changed since the commit
+		if opts.State.Due(last) {
+			changes = incremental.Prune(nil, parsed, opts.Prune)
+		} else {
+			changes = incremental.Prune(incremental.Intersect(changes, incremental.Unsynced(last, hashes)), parsed, opts.Prune)
+		}
+		switch {
+		case changes == nil:
+			log.Printf("Syncing every namespace to verify the rules in Loki")
+		case len(changes.Namespaces) == 0:
+			log.Printf("No namespace changed since the last sync. Nothing to sync.")
+			return nil
+		default:
+			log.Printf("Namespaces changed since the last sync: %s", strings.Join(changes.Namespaces, ", "))
+			if len(changes.Deleted) > 0 {
+				log.Printf("Namespaces to delete: %s", strings.Join(changes.Deleted, ", "))
+			}
+		}
+	}
+
+	// 9. Lint each rule file before attempting to sync
 	log.Println("Linting Loki rule files...")
-	for _, ruleFile := range tempRuleFiles {
+	for i, ruleFile := range tempRuleFiles {
+		if changes != nil && !changes.Has(parsed[i].Namespace) {
+			continue
+		}
 		log.Printf("Linting rule file: %s", ruleFile)
 		lintArgs := []string{
 			"rules",
@@ -93,7 +232,7 @@ func Sync(rulesPath, lokiAddress, orgID, tempBaseDir string) error {
 		log.Printf("Linting successful for %s", ruleFile)
 	}
 
-	// 4. Sync the Loki rules with Loki using --rule-dirs
+	// 10. Sync the Loki rules with Loki using --rule-dirs
 	log.Println("Syncing Loki rules with Loki...")
 	syncArgs := []string{
 		"rules",
@@ -102,6 +241,11 @@ func Sync(rulesPath, lokiAddress, orgID, tempBaseDir string) error {
 		"--id=" + orgID, // lokitool rules sync uses --id for tenant ID
 		"--rule-dirs=" + syncTempDir,
 	}
+	if changes != nil {
+		// Namespaces outside the list are left alone; listed namespaces
+		// without rule files are deleted
+		syncArgs = append(syncArgs, "--namespaces="+strings.Join(changes.Namespaces, ","))
+	}
 
 	if len(tempRuleFiles) == 0 {
 		log.Println("No rule files to sync. If --rule-dirs is empty, lokitool might remove all rules for the given org-id. Proceeding with empty rule set.")
@@ -113,6 +257,17 @@ func Sync(rulesPath, lokiAddress, orgID, tempBaseDir string) error {
 		return fmt.Errorf("failed to sync Loki rules with Loki: %w\nOutput:\n%s", err, output)
 	}
 
+	if opts.State.Enabled() {
+		// Namespaces left alone keep the hashes they were synced with
+		next := &state.Target{Verified: last.Verified, Hashes: incremental.SyncedHashes(last, hashes, changes)}
+		if changes == nil {
+			next.Verified = time.Now().UTC()
+		}
+		if err := opts.State.Save(target, next); err != nil {
+			return err
+		}
+	}
+
 	log.Println("Loki rules synced successfully.")
 	return nil
 }
@@ -0,0 +1,161 @@
+package mimirrules
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/state"
+)
+
+// fakeMimirtool puts a mimirtool on PATH that succeeds and appends its
+// arguments to a log, and returns a function reading and clearing the log.
+func fakeMimirtool(t *testing.T) func() []string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mimirtool is a shell script")
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "mimirtool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() []string {
+		t.Helper()
+		data, err := os.ReadFile(calls)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(calls)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// gitRepo initializes a git repository in dir and returns a function
+// running git in it.
+func gitRepo(t *testing.T, dir string) func(args ...string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	git("init", "-q", "-b", "main")
+	return git
+}
+
+// writeRule writes <namespace>.yaml recording the namespace from expr.
+func writeRule(t *testing.T, dir, namespace, expr string) {
+	t.Helper()
+	content := "namespace: " + namespace + "\ngroups:\n  - name: g\n    rules:\n      - record: " + namespace + ":up\n        expr: " + expr + "\n"
+	if err := os.WriteFile(filepath.Join(dir, namespace+".yaml"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// syncedNamespaces returns the --namespaces of the "rules sync" call,
+// "all" when it has none and "" without a sync.
+func syncedNamespaces(calls []string) string {
+	for _, c := range calls {
+		if !strings.HasPrefix(c, "rules sync ") {
+			continue
+		}
+		if i := strings.Index(c, "--namespaces="); i >= 0 {
+			return c[i+len("--namespaces="):]
+		}
+		return "all"
+	}
+	return ""
+}
+
+func TestSyncSinceAndState(t *testing.T) {
+	calls := fakeMimirtool(t)
+	dir := t.TempDir()
+	git := gitRepo(t, dir)
+	writeRule(t, dir, "a", "up")
+	writeRule(t, dir, "b", "up")
+	git("add", "-A")
+	git("commit", "-q", "-m", "rules")
+
+	store := state.Store{Path: filepath.Join(t.TempDir(), "state.json"), VerifyInterval: time.Hour}
+	target := "mimir-rules http://mimir tenant"
+	opts := Options{
+		RulesPath:    dir,
+		MimirAddress: "http://mimir",
+		MimirID:      "tenant",
+		Since:        "HEAD",
+		State:        store,
+		TempBaseDir:  t.TempDir(),
+	}
+	sync := func(want string) {
+		t.Helper()
+		if err := Sync(opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := syncedNamespaces(calls()); got != want {
+			t.Errorf("synced namespaces %q, want %q", got, want)
+		}
+	}
+	expire := func() {
+		t.Helper()
+		last, err := store.Load(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last.Verified = time.Now().Add(-2 * time.Hour)
+		if err := store.Save(target, last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verified := func() {
+		t.Helper()
+		last, err := store.Load(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(last.Verified) > time.Minute {
+			t.Errorf("verified at %v, want now", last.Verified)
+		}
+	}
+
+	// Without a state the first sync verifies everything
+	sync("all")
+	verified()
+	sync("")
+
+	writeRule(t, dir, "a", "up == 1")
+	sync("a")
+	sync("")
+
+	// A due verification syncs every namespace, not only those changed
+	// since the commit, and also when none changed
+	expire()
+	sync("all")
+	verified()
+
+	git("add", "-A")
+	git("commit", "-q", "-m", "change a")
+	expire()
+	sync("all")
+	verified()
+	sync("")
+}
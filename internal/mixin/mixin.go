@@ -0,0 +1,165 @@
+// Package mixin compiles monitoring mixins, Jsonnet libraries exposing
+// prometheusAlerts and prometheusRules such as the kubernetes-mixin, into
+// rule files, so they are synced without a separate build step.
+package mixin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+const (
+	jsonnetCmd = "jsonnet"
+)
+
+// program evaluates a mixin entrypoint to its alerts and recording rules.
+// Mixins often define only one of the two.
+const program = `local mixin = import %s;
+{
+  alerts: if std.objectHasAll(mixin, 'prometheusAlerts') then mixin.prometheusAlerts else {},
+  rules: if std.objectHasAll(mixin, 'prometheusRules') then mixin.prometheusRules else {},
+}`
+
+// Namespace returns the namespace of the rules of the mixin at entrypoint:
+// the name of its directory, e.g. kubernetes-mixin for
+// vendor/kubernetes-mixin/mixin.libsonnet.
+func Namespace(entrypoint string) (string, error) {
+	abs, err := filepath.Abs(entrypoint)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(filepath.Dir(abs)), nil
+}
+
+// Compile evaluates every mixin entrypoint and writes its alerts and
+// recording rules to dir as <namespace>-alerts.yaml and
+// <namespace>-rules.yaml, in the namespace Namespace returns. The Jsonnet
+// library paths of a mixin are jpaths, or when there are none the vendor
+// directory of jsonnet-bundler above its entrypoint. It returns the paths
+// of the files written.
+func Compile(entrypoints, jpaths []string, dir string) ([]string, error) {
+	if len(entrypoints) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for mixin rule files %s: %w", dir, err)
+	}
+	seen := map[string]string{}
+	var files []string
+	for _, entrypoint := range entrypoints {
+		namespace, err := Namespace(entrypoint)
+		if err != nil {
+			return nil, err
+		}
+		// Two mixins in one namespace would overwrite each other's rules
+		if other, ok := seen[namespace]; ok {
+			return nil, fmt.Errorf("mixins %s and %s both get namespace %s; put each mixin in a directory of its own", other, entrypoint, namespace)
+		}
+		seen[namespace] = entrypoint
+
+		paths := jpaths
+		if len(paths) == 0 {
+			if vendor := vendorDir(entrypoint); vendor != "" {
+				paths = []string{vendor}
+			}
+		}
+		log.Printf("Compiling mixin %s into namespace %s", entrypoint, namespace)
+		out, err := evaluate(entrypoint, paths)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := yamlnode.Parse(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the output of mixin %s: %w", entrypoint, err)
+		}
+		if len(docs) != 1 {
+			return nil, fmt.Errorf("mixin %s evaluated to %d documents, expected one", entrypoint, len(docs))
+		}
+		for _, part := range []string{"alerts", "rules"} {
+			doc := docs[0].Get(part)
+			groups := len(doc.Get("groups").Items())
+			if groups == 0 {
+				log.Printf("Mixin %s has no %s", entrypoint, part)
+				continue
+			}
+			// Put the namespace first, as in hand-written rule files
+			doc.Delete("namespace")
+			doc.Content = append([]*yamlnode.Node{yamlnode.NewScalar("namespace"), yamlnode.NewString(namespace)}, doc.Content...)
+			path := filepath.Join(dir, namespace+"-"+part+".yaml")
+			if err := os.WriteFile(path, yamlnode.Encode(doc), 0640); err != nil {
+				return nil, fmt.Errorf("failed to write rule file %s: %w", path, err)
+			}
+			log.Printf("Wrote %d group(s) of %s of mixin %s to %s", groups, part, entrypoint, path)
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// evaluate runs jsonnet on program for entrypoint and returns its JSON
+// output. Standard error is kept apart so std.trace output of the mixin
+// does not end up in the JSON.
+func evaluate(entrypoint string, jpaths []string) ([]byte, error) {
+	abs, err := filepath.Abs(entrypoint)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return nil, fmt.Errorf("failed to read mixin %s: %w", entrypoint, err)
+	}
+	// A JSON string is a valid Jsonnet string literal
+	quoted, err := json.Marshal(abs)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, p := range jpaths {
+		args = append(args, "-J", p)
+	}
+	args = append(args, "-e", fmt.Sprintf(program, quoted))
+
+	cmd := exec.Command(jsonnetCmd, args...)
+	log.Printf("Executing command: %s %s <import of %s>", jsonnetCmd, strings.Join(args[:len(args)-1], " "), abs)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, fmt.Errorf("failed to compile mixin %s: %w", entrypoint, err)
+		}
+		return nil, fmt.Errorf("failed to compile mixin %s: %w\n%s", entrypoint, err, msg)
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		log.Printf("jsonnet output for mixin %s:\n%s", entrypoint, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// vendorDir returns the vendor directory jsonnet-bundler creates next to
+// jsonnetfile.json, searched for from the directory of entrypoint upwards,
+// or "" when there is none.
+func vendorDir(entrypoint string) string {
+	abs, err := filepath.Abs(entrypoint)
+	if err != nil {
+		return ""
+	}
+	for d := filepath.Dir(abs); ; {
+		vendor := filepath.Join(d, "vendor")
+		if info, err := os.Stat(vendor); err == nil && info.IsDir() {
+			return vendor
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return ""
+		}
+		d = parent
+	}
+}
@@ -0,0 +1,130 @@
+package mixin
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// requireJsonnet skips tests evaluating mixins when jsonnet is missing.
+func requireJsonnet(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath(jsonnetCmd); err != nil {
+		t.Skip("jsonnet is not installed")
+	}
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// vendored is a mixin importing its alerts from the jsonnet-bundler vendor
+// directory of the repository.
+var vendored = map[string]string{
+	"vendor/lib/alerts.libsonnet": "{ groups: [{ name: 'lib', rules: [{ alert: 'LibDown', expr: 'up == 0' }] }] }\n",
+	"mixins/app/mixin.libsonnet":  "{ prometheusAlerts: import 'lib/alerts.libsonnet' }\n",
+}
+
+func TestCompile(t *testing.T) {
+	requireJsonnet(t)
+	dir := writeFiles(t, vendored)
+	out := t.TempDir()
+	files, err := Compile([]string{filepath.Join(dir, "mixins", "app", "mixin.libsonnet")}, nil, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mixin has no recording rules, so only its alerts are written
+	if len(files) != 1 || files[0] != filepath.Join(out, "app-alerts.yaml") {
+		t.Fatalf("Compile wrote %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "namespace: app\ngroups:\n  - name: lib\n    rules:\n      - alert: LibDown\n        expr: up == 0\n"
+	if string(data) != want {
+		t.Errorf("app-alerts.yaml =\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestCompileJsonnetPaths(t *testing.T) {
+	requireJsonnet(t)
+	dir := writeFiles(t, vendored)
+	// Library paths replace the vendor directory
+	_, err := Compile([]string{filepath.Join(dir, "mixins", "app", "mixin.libsonnet")}, []string{t.TempDir()}, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "lib/alerts.libsonnet") {
+		t.Errorf("Compile with other library paths error = %v", err)
+	}
+}
+
+func TestCompileFailure(t *testing.T) {
+	requireJsonnet(t)
+	dir := writeFiles(t, map[string]string{
+		"broken/mixin.libsonnet": "{ prometheusAlerts: error 'alerts are broken' }\n",
+	})
+	entrypoint := filepath.Join(dir, "broken", "mixin.libsonnet")
+	_, err := Compile([]string{entrypoint}, nil, t.TempDir())
+	if err == nil {
+		t.Fatal("Compile of a failing mixin succeeded")
+	}
+	// The error has the mixin and jsonnet's message
+	if msg := err.Error(); !strings.HasPrefix(msg, "failed to compile mixin "+entrypoint+": ") || !strings.Contains(msg, "alerts are broken") {
+		t.Errorf("Compile error = %v", err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing", "mixin.libsonnet")
+	if _, err := Compile([]string{missing}, nil, t.TempDir()); err == nil || !strings.HasPrefix(err.Error(), "failed to read mixin "+missing+": ") {
+		t.Errorf("Compile of a missing mixin error = %v", err)
+	}
+
+	requireJsonnet(t)
+	files := map[string]string{"other/app/mixin.libsonnet": vendored["mixins/app/mixin.libsonnet"]}
+	for name, content := range vendored {
+		files[name] = content
+	}
+	dir = writeFiles(t, files)
+	a, b := filepath.Join(dir, "mixins", "app", "mixin.libsonnet"), filepath.Join(dir, "other", "app", "mixin.libsonnet")
+	want := "mixins " + a + " and " + b + " both get namespace app; put each mixin in a directory of its own"
+	if _, err := Compile([]string{a, b}, nil, t.TempDir()); err == nil || err.Error() != want {
+		t.Errorf("Compile of two mixins in one namespace error = %v", err)
+	}
+}
+
+func TestVendorDir(t *testing.T) {
+	dir := writeFiles(t, vendored)
+	tests := []struct {
+		entrypoint string
+		want       string
+	}{
+		{"mixins/app/mixin.libsonnet", "vendor"},
+		{"mixin.libsonnet", "vendor"},
+		{"vendor/lib/alerts.libsonnet", "vendor"},
+	}
+	for _, tt := range tests {
+		want := filepath.Join(dir, tt.want)
+		if got := vendorDir(filepath.Join(dir, filepath.FromSlash(tt.entrypoint))); got != want {
+			t.Errorf("vendorDir(%s) = %q, want %q", tt.entrypoint, got, want)
+		}
+	}
+	// The closest vendor directory wins
+	nested := writeFiles(t, map[string]string{"vendor/x": "", "app/vendor/y": ""})
+	if got := vendorDir(filepath.Join(nested, "app", "mixin.libsonnet")); got != filepath.Join(nested, "app", "vendor") {
+		t.Errorf("vendorDir of a nested vendor directory = %q", got)
+	}
+}
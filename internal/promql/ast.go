@@ -0,0 +1,218 @@
+package promql
+
+import "fmt"
+
+// ValueType is the type an expression evaluates to.
+type ValueType string
+
+const (
+	ValueTypeNone   ValueType = "none"
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "instant vector"
+	ValueTypeMatrix ValueType = "range vector"
+	ValueTypeString ValueType = "string"
+)
+
+// Error is a syntax or type error at a byte offset of the expression.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("%d: %s", e.Pos, e.Msg) }
+
+// Node is a node of a parsed expression.
+type Node interface {
+	// Type returns the type the node evaluates to.
+	Type() ValueType
+	// Position returns the byte offset the node starts at.
+	Position() int
+}
+
+// Expr is an expression node.
+type Expr = Node
+
+// NumberLiteral is a number such as 1, 0.5, 0x1f or Inf.
+type NumberLiteral struct {
+	Val string
+	Pos int
+}
+
+// StringLiteral is a quoted string; Val holds the unquoted value.
+type StringLiteral struct {
+	Val string
+	Raw string
+	Pos int
+}
+
+// LabelMatcher is a label matcher of a vector selector.
+type LabelMatcher struct {
+	Name  string
+	Op    string // =, !=, =~ or !~
+	Value string
+	Pos   int
+}
+
+// VectorSelector selects series by metric name and label matchers.
+type VectorSelector struct {
+	Name     string // metric name, empty when selected by matchers only
+	Matchers []*LabelMatcher
+	Offset   string // e.g. "5m" or "-5m"
+	At       string // timestamp, "start()" or "end()"
+	Pos      int
+}
+
+// MatrixSelector is a vector selector with a range.
+type MatrixSelector struct {
+	VectorSelector *VectorSelector
+	Range          string
+	Pos            int
+}
+
+// SubqueryExpr evaluates an expression over a range.
+type SubqueryExpr struct {
+	Expr   Expr
+	Range  string
+	Step   string
+	Offset string
+	At     string
+	Pos    int
+}
+
+// Call is a function call.
+type Call struct {
+	Func *Function
+	Args []Expr
+	Pos  int
+}
+
+// AggregateExpr is an aggregation such as sum by (job) (x).
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr // parameter of topk, bottomk, quantile, count_values, limitk and limit_ratio
+	Grouping []string
+	Without  bool
+	HasBy    bool // grouping given with by (...), possibly empty
+	Pos      int
+}
+
+// VectorMatching describes how the series of a binary operation are matched.
+type VectorMatching struct {
+	On             bool // on (...) rather than ignoring (...)
+	MatchingLabels []string
+	HasMatching    bool   // on or ignoring was given
+	Card           string // "", "group_left" or "group_right"
+	Include        []string
+}
+
+// BinaryExpr is a binary operation.
+type BinaryExpr struct {
+	Op             string
+	LHS, RHS       Expr
+	ReturnBool     bool
+	VectorMatching *VectorMatching
+	Pos            int
+}
+
+// UnaryExpr is a unary minus or plus.
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+	Pos  int
+}
+
+// ParenExpr is a parenthesized expression.
+type ParenExpr struct {
+	Expr Expr
+	Pos  int
+}
+
+func (n *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (n *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (n *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (n *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (n *SubqueryExpr) Type() ValueType   { return ValueTypeMatrix }
+func (n *Call) Type() ValueType           { return n.Func.ReturnType }
+func (n *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (n *UnaryExpr) Type() ValueType      { return n.Expr.Type() }
+func (n *ParenExpr) Type() ValueType      { return n.Expr.Type() }
+
+func (n *BinaryExpr) Type() ValueType {
+	if n.LHS.Type() == ValueTypeScalar && n.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func (n *NumberLiteral) Position() int  { return n.Pos }
+func (n *StringLiteral) Position() int  { return n.Pos }
+func (n *VectorSelector) Position() int { return n.Pos }
+func (n *MatrixSelector) Position() int { return n.Pos }
+func (n *SubqueryExpr) Position() int   { return n.Pos }
+func (n *Call) Position() int           { return n.Pos }
+func (n *AggregateExpr) Position() int  { return n.Pos }
+func (n *BinaryExpr) Position() int     { return n.Pos }
+func (n *UnaryExpr) Position() int      { return n.Pos }
+func (n *ParenExpr) Position() int      { return n.Pos }
+
+// Children returns the direct child expressions of n.
+func Children(n Node) []Node {
+	switch n := n.(type) {
+	case *MatrixSelector:
+		return []Node{n.VectorSelector}
+	case *SubqueryExpr:
+		return []Node{n.Expr}
+	case *Call:
+		return n.Args
+	case *AggregateExpr:
+		if n.Param != nil {
+			return []Node{n.Param, n.Expr}
+		}
+		return []Node{n.Expr}
+	case *BinaryExpr:
+		return []Node{n.LHS, n.RHS}
+	case *UnaryExpr:
+		return []Node{n.Expr}
+	case *ParenExpr:
+		return []Node{n.Expr}
+	}
+	return nil
+}
+
+// Inspect walks the expression depth-first, calling f for every node. The
+// children of a node are skipped when f returns false.
+func Inspect(n Node, f func(Node) bool) {
+	if n == nil || !f(n) {
+		return
+	}
+	for _, c := range Children(n) {
+		Inspect(c, f)
+	}
+}
+
+// MetricNames returns the metric names selected by the expression, in order
+// of first appearance. Names given as a __name__="..." matcher are included;
+// regular expression matchers are not.
+func MetricNames(n Node) []string {
+	var names []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	Inspect(n, func(n Node) bool {
+		if vs, ok := n.(*VectorSelector); ok {
+			add(vs.Name)
+			for _, m := range vs.Matchers {
+				if m.Name == "__name__" && m.Op == "=" {
+					add(m.Value)
+				}
+			}
+		}
+		return true
+	})
+	return names
+}
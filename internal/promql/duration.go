@@ -0,0 +1,44 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var durationRe = regexp.MustCompile(`^(?:(\d+)y)?(?:(\d+)w)?(?:(\d+)d)?(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s)?(?:(\d+)ms)?$`)
+
+// ParseDuration parses a Prometheus duration such as "5m", "1h30m" or "2d".
+// Unlike time.ParseDuration it accepts the d, w and y units and rejects
+// fractional values.
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	m := durationRe.FindStringSubmatch(s)
+	if s == "" || m == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	units := []time.Duration{
+		365 * 24 * time.Hour,
+		7 * 24 * time.Hour,
+		24 * time.Hour,
+		time.Hour,
+		time.Minute,
+		time.Second,
+		time.Millisecond,
+	}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(m[i+1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
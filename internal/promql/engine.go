@@ -0,0 +1,622 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Engine evaluates instant queries against an in-memory Storage. It covers
+// the float parts of PromQL that rules and rule tests use; native
+// histograms are not supported.
+type Engine struct {
+	Storage       *Storage
+	LookbackDelta time.Duration // how far back a selector looks for a sample; 5m when zero
+	DefaultStep   time.Duration // subquery resolution when none is given; 1m when zero
+}
+
+// Instant evaluates expr at ts, in milliseconds since the epoch.
+func (e *Engine) Instant(expr Expr, ts int64) (Value, error) {
+	ev := &evaluator{engine: e, queryTime: ts}
+	ev.lookback = durationMillis(e.LookbackDelta, 5*time.Minute)
+	ev.step = durationMillis(e.DefaultStep, time.Minute)
+	return ev.eval(expr, ts)
+}
+
+func durationMillis(d, def time.Duration) int64 {
+	if d == 0 {
+		d = def
+	}
+	return d.Milliseconds()
+}
+
+type evaluator struct {
+	engine    *Engine
+	queryTime int64 // evaluation time of the query, for start() and end()
+	lookback  int64
+	step      int64
+}
+
+func mustMillis(s string) int64 {
+	d, _ := ParseDuration(strings.TrimPrefix(s, "-"))
+	if strings.HasPrefix(s, "-") {
+		return -d.Milliseconds()
+	}
+	return d.Milliseconds()
+}
+
+// refTime applies the @ and offset modifiers to ts.
+func (ev *evaluator) refTime(ts int64, offset, at string) (int64, error) {
+	switch at {
+	case "":
+	case "start()", "end()":
+		ts = ev.queryTime
+	default:
+		secs, err := strconv.ParseFloat(at, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid @ timestamp %q", at)
+		}
+		ts = int64(math.Round(secs * 1000))
+	}
+	if offset != "" {
+		ts -= mustMillis(offset)
+	}
+	return ts, nil
+}
+
+func (ev *evaluator) eval(node Node, ts int64) (Value, error) {
+	switch n := node.(type) {
+	case *NumberLiteral:
+		v, err := parseNumber(n.Val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", n.Val)
+		}
+		return Scalar{T: ts, V: v}, nil
+	case *StringLiteral:
+		return String{T: ts, V: n.Val}, nil
+	case *ParenExpr:
+		return ev.eval(n.Expr, ts)
+	case *UnaryExpr:
+		v, err := ev.eval(n.Expr, ts)
+		if err != nil || n.Op == "+" {
+			return v, err
+		}
+		switch v := v.(type) {
+		case Scalar:
+			return Scalar{T: v.T, V: -v.V}, nil
+		case Vector:
+			out := make(Vector, len(v))
+			for i, s := range v {
+				out[i] = Sample{Metric: s.Metric.Without(MetricName), Point: Point{T: s.T, V: -s.V}}
+			}
+			return out, nil
+		}
+		return nil, fmt.Errorf("unary %s not allowed on %s", n.Op, v.Type())
+	case *VectorSelector:
+		return ev.selectVector(n, ts, false)
+	case *MatrixSelector, *SubqueryExpr:
+		m, _, _, err := ev.evalRange(n, ts)
+		return m, err
+	case *Call:
+		return ev.call(n, ts)
+	case *AggregateExpr:
+		return ev.aggregate(n, ts)
+	case *BinaryExpr:
+		return ev.binary(n, ts)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", node)
+}
+
+func (ev *evaluator) evalVector(node Node, ts int64) (Vector, error) {
+	v, err := ev.eval(node, ts)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(Vector)
+	if !ok {
+		return nil, fmt.Errorf("expected instant vector, got %s", v.Type())
+	}
+	return vec, nil
+}
+
+func (ev *evaluator) evalScalar(node Node, ts int64) (float64, error) {
+	v, err := ev.eval(node, ts)
+	if err != nil {
+		return 0, err
+	}
+	s, ok := v.(Scalar)
+	if !ok {
+		return 0, fmt.Errorf("expected scalar, got %s", v.Type())
+	}
+	return s.V, nil
+}
+
+func (ev *evaluator) evalString(node Node, ts int64) (string, error) {
+	v, err := ev.eval(node, ts)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(String)
+	if !ok {
+		return "", fmt.Errorf("expected string, got %s", v.Type())
+	}
+	return s.V, nil
+}
+
+// selectVector returns the latest non-stale sample of each matching series
+// within the lookback window. With keepTime the samples keep their own
+// timestamps, as timestamp() needs.
+func (ev *evaluator) selectVector(vs *VectorSelector, ts int64, keepTime bool) (Vector, error) {
+	ref, err := ev.refTime(ts, vs.Offset, vs.At)
+	if err != nil {
+		return nil, err
+	}
+	series, err := ev.engine.Storage.Select(selectorMatchers(vs))
+	if err != nil {
+		return nil, err
+	}
+	out := Vector{}
+	for _, s := range series {
+		i := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > ref }) - 1
+		if i < 0 || s.Points[i].T <= ref-ev.lookback || IsStaleMarker(s.Points[i].V) {
+			continue
+		}
+		p := Point{T: ts, V: s.Points[i].V}
+		if keepTime {
+			p.T = s.Points[i].T
+		}
+		out = append(out, Sample{Metric: s.Metric, Point: p})
+	}
+	return out, nil
+}
+
+func selectorMatchers(vs *VectorSelector) []*LabelMatcher {
+	matchers := vs.Matchers
+	if vs.Name != "" {
+		matchers = append([]*LabelMatcher{{Name: MetricName, Op: "=", Value: vs.Name}}, matchers...)
+	}
+	return matchers
+}
+
+// evalRange evaluates a matrix selector or subquery and returns the window
+// (start, end] it covers.
+func (ev *evaluator) evalRange(node Node, ts int64) (Matrix, int64, int64, error) {
+	switch n := node.(type) {
+	case *ParenExpr:
+		return ev.evalRange(n.Expr, ts)
+	case *MatrixSelector:
+		vs := n.VectorSelector
+		end, err := ev.refTime(ts, vs.Offset, vs.At)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		start := end - mustMillis(n.Range)
+		series, err := ev.engine.Storage.Select(selectorMatchers(vs))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		out := Matrix{}
+		for _, s := range series {
+			var points []Point
+			for _, p := range s.Points {
+				if p.T > start && p.T <= end && !IsStaleMarker(p.V) {
+					points = append(points, p)
+				}
+			}
+			if len(points) > 0 {
+				out = append(out, Series{Metric: s.Metric, Points: points})
+			}
+		}
+		return out, start, end, nil
+	case *SubqueryExpr:
+		end, err := ev.refTime(ts, n.Offset, n.At)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		start := end - mustMillis(n.Range)
+		step := ev.step
+		if n.Step != "" {
+			step = mustMillis(n.Step)
+		}
+		if step <= 0 {
+			return nil, 0, 0, fmt.Errorf("zero subquery step")
+		}
+		first := start - start%step
+		if first <= start {
+			first += step
+		}
+		var keys []string
+		bySeries := map[string]*Series{}
+		for t := first; t <= end; t += step {
+			vec, err := ev.evalVector(n.Expr, t)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			for _, s := range vec {
+				key := s.Metric.String()
+				ser, ok := bySeries[key]
+				if !ok {
+					ser = &Series{Metric: s.Metric}
+					bySeries[key] = ser
+					keys = append(keys, key)
+				}
+				ser.Points = append(ser.Points, Point{T: t, V: s.V})
+			}
+		}
+		out := Matrix{}
+		for _, k := range keys {
+			out = append(out, *bySeries[k])
+		}
+		return out, start, end, nil
+	}
+	return nil, 0, 0, fmt.Errorf("expected range vector, got %T", node)
+}
+
+// groupKey returns the labels an aggregation or binary operation groups by.
+func groupLabels(metric Labels, labels []string, without bool) Labels {
+	if without {
+		return metric.Without(append([]string{MetricName}, labels...)...)
+	}
+	return metric.Only(labels...)
+}
+
+func (ev *evaluator) aggregate(n *AggregateExpr, ts int64) (Value, error) {
+	vec, err := ev.evalVector(n.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	var param float64
+	var label string
+	if n.Param != nil {
+		if n.Op == "count_values" {
+			if label, err = ev.evalString(n.Param, ts); err != nil {
+				return nil, err
+			}
+			if !labelNameRe.MatchString(label) {
+				return nil, fmt.Errorf("invalid label name %q", label)
+			}
+		} else if param, err = ev.evalScalar(n.Param, ts); err != nil {
+			return nil, err
+		}
+	}
+
+	type group struct {
+		metric  Labels
+		samples Vector
+	}
+	var keys []string
+	groups := map[string]*group{}
+	for _, s := range vec {
+		metric := groupLabels(s.Metric, n.Grouping, n.Without)
+		if n.Op == "count_values" {
+			metric = metric.With(label, strconv.FormatFloat(s.V, 'f', -1, 64))
+		}
+		key := metric.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{metric: metric}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.samples = append(g.samples, s)
+	}
+
+	out := Vector{}
+	for _, key := range keys {
+		g := groups[key]
+		values := make([]float64, len(g.samples))
+		for i, s := range g.samples {
+			values[i] = s.V
+		}
+		emit := func(v float64) {
+			out = append(out, Sample{Metric: g.metric, Point: Point{T: ts, V: v}})
+		}
+		switch n.Op {
+		case "sum":
+			emit(sum(values))
+		case "avg":
+			emit(sum(values) / float64(len(values)))
+		case "count", "count_values":
+			emit(float64(len(values)))
+		case "group":
+			emit(1)
+		case "min":
+			emit(minMax(values, func(a, b float64) bool { return a < b }))
+		case "max":
+			emit(minMax(values, func(a, b float64) bool { return a > b }))
+		case "stddev":
+			emit(math.Sqrt(variance(values)))
+		case "stdvar":
+			emit(variance(values))
+		case "quantile":
+			emit(quantile(param, values))
+		case "topk", "bottomk", "limitk":
+			k := int(param)
+			samples := append(Vector{}, g.samples...)
+			switch n.Op {
+			case "topk":
+				sort.SliceStable(samples, func(i, j int) bool { return greater(samples[i].V, samples[j].V) })
+			case "bottomk":
+				sort.SliceStable(samples, func(i, j int) bool { return greater(samples[j].V, samples[i].V) })
+			}
+			if k < len(samples) {
+				samples = samples[:max(k, 0)]
+			}
+			for _, s := range samples {
+				out = append(out, Sample{Metric: s.Metric, Point: Point{T: ts, V: s.V}})
+			}
+		default:
+			return nil, fmt.Errorf("aggregation %s is not supported by the test engine", n.Op)
+		}
+	}
+	return out, nil
+}
+
+// greater orders NaN below every number, as topk and bottomk do.
+func greater(a, b float64) bool {
+	if math.IsNaN(b) {
+		return !math.IsNaN(a)
+	}
+	return a > b
+}
+
+func sum(values []float64) float64 {
+	var s float64
+	for _, v := range values {
+		s += v
+	}
+	return s
+}
+
+func minMax(values []float64, better func(a, b float64) bool) float64 {
+	res := values[0]
+	for _, v := range values[1:] {
+		if better(v, res) || math.IsNaN(res) {
+			res = v
+		}
+	}
+	return res
+}
+
+func variance(values []float64) float64 {
+	mean := sum(values) / float64(len(values))
+	var v float64
+	for _, x := range values {
+		v += (x - mean) * (x - mean)
+	}
+	return v / float64(len(values))
+}
+
+// quantile calculates the φ-quantile of values by linear interpolation.
+func quantile(q float64, values []float64) float64 {
+	switch {
+	case len(values) == 0 || math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := float64(len(sorted))
+	rank := q * (n - 1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(n-1, lower+1)
+	weight := rank - math.Floor(rank)
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
+
+func (ev *evaluator) binary(n *BinaryExpr, ts int64) (Value, error) {
+	lhs, err := ev.eval(n.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(n.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	ls, lIsScalar := lhs.(Scalar)
+	rs, rIsScalar := rhs.(Scalar)
+	switch {
+	case lIsScalar && rIsScalar:
+		v, keep := binop(n.Op, ls.V, rs.V)
+		if isComparison(n.Op) {
+			v = boolValue(keep)
+		}
+		return Scalar{T: ts, V: v}, nil
+	case lIsScalar || rIsScalar:
+		var vec Vector
+		var scalar float64
+		if lIsScalar {
+			vec, scalar = rhs.(Vector), ls.V
+		} else {
+			vec, scalar = lhs.(Vector), rs.V
+		}
+		out := Vector{}
+		for _, s := range vec {
+			l, r := s.V, scalar
+			if lIsScalar {
+				l, r = scalar, s.V
+			}
+			v, keep := binop(n.Op, l, r)
+			metric := s.Metric
+			if isComparison(n.Op) {
+				if n.ReturnBool {
+					v, keep = boolValue(keep), true
+					metric = metric.Without(MetricName)
+				} else {
+					v = s.V
+				}
+			} else {
+				metric = metric.Without(MetricName)
+			}
+			if keep {
+				out = append(out, Sample{Metric: metric, Point: Point{T: ts, V: v}})
+			}
+		}
+		return out, nil
+	}
+	return ev.vectorBinary(n, lhs.(Vector), rhs.(Vector), ts)
+}
+
+func (ev *evaluator) vectorBinary(n *BinaryExpr, lhs, rhs Vector, ts int64) (Vector, error) {
+	vm := n.VectorMatching
+	if vm == nil {
+		vm = &VectorMatching{}
+	}
+	signature := func(metric Labels) string {
+		if vm.On {
+			return metric.Only(vm.MatchingLabels...).String()
+		}
+		return metric.Without(append([]string{MetricName}, vm.MatchingLabels...)...).String()
+	}
+
+	switch n.Op {
+	case "and", "unless":
+		right := map[string]bool{}
+		for _, s := range rhs {
+			right[signature(s.Metric)] = true
+		}
+		out := Vector{}
+		for _, s := range lhs {
+			if right[signature(s.Metric)] == (n.Op == "and") {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	case "or":
+		left := map[string]bool{}
+		out := Vector{}
+		for _, s := range lhs {
+			left[signature(s.Metric)] = true
+			out = append(out, s)
+		}
+		for _, s := range rhs {
+			if !left[signature(s.Metric)] {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	}
+
+	// The "one" side must have unique signatures; with group_right the
+	// sides swap roles.
+	many, one := lhs, rhs
+	if vm.Card == "group_right" {
+		many, one = rhs, lhs
+	}
+	oneBySig := map[string]Sample{}
+	for _, s := range one {
+		sig := signature(s.Metric)
+		if _, dup := oneBySig[sig]; dup {
+			side := "right"
+			if vm.Card == "group_right" {
+				side = "left"
+			}
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the %s hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", sig, side)
+		}
+		oneBySig[sig] = s
+	}
+	seenMany := map[string]bool{}
+	seenResult := map[string]bool{}
+	out := Vector{}
+	for _, ms := range many {
+		sig := signature(ms.Metric)
+		os, ok := oneBySig[sig]
+		if !ok {
+			continue
+		}
+		if vm.Card == "" {
+			if seenMany[sig] {
+				return nil, fmt.Errorf("found duplicate series for the match group %s on the left hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", sig)
+			}
+			seenMany[sig] = true
+		}
+		l, r := ms, os
+		if vm.Card == "group_right" {
+			l, r = os, ms
+		}
+		v, keep := binop(n.Op, l.V, r.V)
+		if isComparison(n.Op) {
+			if n.ReturnBool {
+				v, keep = boolValue(keep), true
+			} else {
+				v = l.V
+			}
+		}
+		if !keep {
+			continue
+		}
+		metric := resultMetric(ms.Metric, os.Metric, n, vm)
+		key := metric.String()
+		if seenResult[key] {
+			return nil, fmt.Errorf("multiple matches for labels: grouping labels must ensure unique matches")
+		}
+		seenResult[key] = true
+		out = append(out, Sample{Metric: metric, Point: Point{T: ts, V: v}})
+	}
+	return out, nil
+}
+
+// resultMetric returns the labels of a vector-vector binary operation's
+// result, built from the "many" side.
+func resultMetric(many, one Labels, n *BinaryExpr, vm *VectorMatching) Labels {
+	metric := many
+	if !isComparison(n.Op) || n.ReturnBool {
+		metric = metric.Without(MetricName)
+	}
+	if vm.Card == "" {
+		if vm.On {
+			return metric.Only(vm.MatchingLabels...)
+		}
+		return metric.Without(vm.MatchingLabels...)
+	}
+	for _, name := range vm.Include {
+		metric = metric.With(name, one.Get(name))
+	}
+	return metric
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binop applies op; for comparisons keep reports whether it holds.
+func binop(op string, l, r float64) (float64, bool) {
+	switch op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "%":
+		return math.Mod(l, r), true
+	case "^":
+		return math.Pow(l, r), true
+	case "atan2":
+		return math.Atan2(l, r), true
+	case "==":
+		return l, l == r
+	case "!=":
+		return l, l != r
+	case ">":
+		return l, l > r
+	case "<":
+		return l, l < r
+	case ">=":
+		return l, l >= r
+	case "<=":
+		return l, l <= r
+	}
+	return math.NaN(), false
+}
@@ -0,0 +1,109 @@
+package promql
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStorage holds the series of the engine tests, one sample a minute
+// from 0 with "_" for a missing one, like promtool's input_series.
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+	s := NewStorage()
+	for series, values := range map[string]string{
+		`requests_total{job="a"}`: "0 10 20 30 40 50 60 70 80 90 100",
+		`requests_total{job="b"}`: "5 10 2 8 20 26",
+		`late_total`:              "_ _ 10 20 30 40",
+		`gauge`:                   "1 3 2 5 4 4",
+		`sparse_total`:            "0 _ _ 30 _ 50",
+	} {
+		expr, err := Parse(series)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs := expr.(*VectorSelector)
+		labels := Labels{{Name: MetricName, Value: vs.Name}}
+		for _, m := range vs.Matchers {
+			labels = labels.With(m.Name, m.Value)
+		}
+		for i, v := range strings.Fields(values) {
+			if v == "_" {
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Add(labels, int64(i)*time.Minute.Milliseconds(), f)
+		}
+	}
+	return s
+}
+
+// The expected results are those promtool 3.9 reports for the same input
+// series and expressions.
+func TestEngineInstant(t *testing.T) {
+	tests := []struct {
+		expr string
+		at   time.Duration
+		want []string // "labels value", sorted
+	}{
+		// Ranges are left-open, so [5m] at 5m holds the samples of 1m to 5m.
+		// rate and increase extrapolate them to the range boundaries, but
+		// no further than half an interval past the first and last sample
+		{`rate(requests_total[5m])`, 5 * time.Minute, []string{`{job="a"} 0.16666666666666666`, `{job="b"} 0.10833333333333334`}},
+		{`increase(requests_total[5m])`, 5 * time.Minute, []string{`{job="a"} 50`, `{job="b"} 32.5`}},
+		{`increase(requests_total[2m30s])`, 5 * time.Minute, []string{`{job="a"} 25`, `{job="b"} 22.5`}},
+		{`rate(requests_total[5m])`, 3 * time.Minute, []string{`{job="a"} 0.1`, `{job="b"} 0.05055555555555556`}},
+		{`rate(requests_total[1m])`, time.Minute, nil},
+		{`rate(requests_total[30s])`, 5 * time.Minute, nil},
+		// A counter starting inside the range is not extrapolated below zero
+		{`increase(late_total[5m])`, 5 * time.Minute, []string{`{} 35`}},
+		{`increase(late_total[10m])`, 5 * time.Minute, []string{`{} 35`}},
+		{`increase(sparse_total[5m])`, 5 * time.Minute, []string{`{} 30`}},
+		{`increase(requests_total[5m] offset 2m)`, 7 * time.Minute, []string{`{job="a"} 50`, `{job="b"} 32.5`}},
+		{`rate(requests_total[5m:1m])`, 6 * time.Minute, []string{`{job="a"} 0.16666666666666666`, `{job="b"} 0.08666666666666667`}},
+		{`irate(requests_total[5m])`, 5 * time.Minute, []string{`{job="a"} 0.16666666666666666`, `{job="b"} 0.1`}},
+		{`resets(requests_total[5m])`, 5 * time.Minute, []string{`{job="a"} 0`, `{job="b"} 1`}},
+		{`delta(gauge[4m])`, 4 * time.Minute, []string{`{} 1.3333333333333333`}},
+		{`idelta(gauge[4m])`, 4 * time.Minute, []string{`{} -1`}},
+		{`deriv(gauge[5m])`, 5 * time.Minute, []string{`{} 0.006666666666666667`}},
+		{`predict_linear(gauge[5m], 60)`, 5 * time.Minute, []string{`{} 4.800000000000001`}},
+		{`avg_over_time(gauge[5m])`, 5 * time.Minute, []string{`{} 3.6`}},
+		{`changes(gauge[5m])`, 5 * time.Minute, []string{`{} 3`}},
+		{`sum by (job) (rate(requests_total[5m]))`, 10 * time.Minute, []string{`{job="a"} 0.16666666666666666`}},
+		{`quantile(0.5, requests_total)`, 5 * time.Minute, []string{`{} 38`}},
+		{`topk(1, requests_total)`, 5 * time.Minute, []string{`requests_total{job="a"} 50`}},
+		// Instant selectors look back 5m, excluding the sample 5m ago
+		{`gauge`, 9 * time.Minute, []string{`gauge 4`}},
+		{`gauge`, 10 * time.Minute, nil},
+	}
+	engine := &Engine{Storage: testStorage(t)}
+	for _, tt := range tests {
+		t.Run(tt.expr+"@"+tt.at.String(), func(t *testing.T) {
+			expr, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := engine.Instant(expr, tt.at.Milliseconds())
+			if err != nil {
+				t.Fatal(err)
+			}
+			vec, ok := v.(Vector)
+			if !ok {
+				t.Fatalf("result is a %s", v.Type())
+			}
+			var got []string
+			for _, s := range vec {
+				got = append(got, s.Metric.String()+" "+strconv.FormatFloat(s.V, 'g', -1, 64))
+			}
+			sort.Strings(got)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,642 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// simpleFuncs are the functions applied to each sample's value.
+var simpleFuncs = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"acos":  math.Acos,
+	"acosh": math.Acosh,
+	"asin":  math.Asin,
+	"asinh": math.Asinh,
+	"atan":  math.Atan,
+	"atanh": math.Atanh,
+	"ceil":  math.Ceil,
+	"cos":   math.Cos,
+	"cosh":  math.Cosh,
+	"deg":   func(v float64) float64 { return v * 180 / math.Pi },
+	"exp":   math.Exp,
+	"floor": math.Floor,
+	"ln":    math.Log,
+	"log10": math.Log10,
+	"log2":  math.Log2,
+	"rad":   func(v float64) float64 { return v * math.Pi / 180 },
+	"sgn": func(v float64) float64 {
+		switch {
+		case v < 0:
+			return -1
+		case v > 0:
+			return 1
+		}
+		return v
+	},
+	"sin":  math.Sin,
+	"sinh": math.Sinh,
+	"sqrt": math.Sqrt,
+	"tan":  math.Tan,
+	"tanh": math.Tanh,
+}
+
+// dateFuncs extract a calendar field from a Unix timestamp in UTC.
+var dateFuncs = map[string]func(time.Time) float64{
+	"day_of_month": func(t time.Time) float64 { return float64(t.Day()) },
+	"day_of_week":  func(t time.Time) float64 { return float64(t.Weekday()) },
+	"day_of_year":  func(t time.Time) float64 { return float64(t.YearDay()) },
+	"days_in_month": func(t time.Time) float64 {
+		return float64(32 - time.Date(t.Year(), t.Month(), 32, 0, 0, 0, 0, time.UTC).Day())
+	},
+	"hour":   func(t time.Time) float64 { return float64(t.Hour()) },
+	"minute": func(t time.Time) float64 { return float64(t.Minute()) },
+	"month":  func(t time.Time) float64 { return float64(t.Month()) },
+	"year":   func(t time.Time) float64 { return float64(t.Year()) },
+}
+
+// overTimeFuncs aggregate the points of each series of a range vector.
+var overTimeFuncs = map[string]func([]Point) float64{
+	"avg_over_time": func(ps []Point) float64 { return sum(pointValues(ps)) / float64(len(ps)) },
+	"count_over_time": func(ps []Point) float64 {
+		return float64(len(ps))
+	},
+	"last_over_time":    func(ps []Point) float64 { return ps[len(ps)-1].V },
+	"max_over_time":     func(ps []Point) float64 { return minMax(pointValues(ps), func(a, b float64) bool { return a > b }) },
+	"min_over_time":     func(ps []Point) float64 { return minMax(pointValues(ps), func(a, b float64) bool { return a < b }) },
+	"present_over_time": func([]Point) float64 { return 1 },
+	"stddev_over_time":  func(ps []Point) float64 { return math.Sqrt(variance(pointValues(ps))) },
+	"stdvar_over_time":  func(ps []Point) float64 { return variance(pointValues(ps)) },
+	"sum_over_time":     func(ps []Point) float64 { return sum(pointValues(ps)) },
+	"mad_over_time": func(ps []Point) float64 {
+		values := pointValues(ps)
+		median := quantile(0.5, values)
+		for i, v := range values {
+			values[i] = math.Abs(v - median)
+		}
+		return quantile(0.5, values)
+	},
+	"changes": func(ps []Point) float64 {
+		n := 0
+		for i := 1; i < len(ps); i++ {
+			if ps[i].V != ps[i-1].V && !(math.IsNaN(ps[i].V) && math.IsNaN(ps[i-1].V)) {
+				n++
+			}
+		}
+		return float64(n)
+	},
+	"resets": func(ps []Point) float64 {
+		n := 0
+		for i := 1; i < len(ps); i++ {
+			if ps[i].V < ps[i-1].V {
+				n++
+			}
+		}
+		return float64(n)
+	},
+}
+
+func pointValues(ps []Point) []float64 {
+	values := make([]float64, len(ps))
+	for i, p := range ps {
+		values[i] = p.V
+	}
+	return values
+}
+
+func (ev *evaluator) call(n *Call, ts int64) (Value, error) {
+	name := n.Func.Name
+	args := n.Args
+
+	if f, ok := simpleFuncs[name]; ok {
+		vec, err := ev.evalVector(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		return mapVector(vec, f), nil
+	}
+	if f, ok := overTimeFuncs[name]; ok {
+		m, _, _, err := ev.evalRange(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		out := Vector{}
+		for _, s := range m {
+			if len(s.Points) == 0 {
+				continue
+			}
+			metric := s.Metric
+			if name != "last_over_time" {
+				metric = metric.Without(MetricName)
+			}
+			out = append(out, Sample{Metric: metric, Point: Point{T: ts, V: f(s.Points)}})
+		}
+		return out, nil
+	}
+	if f, ok := dateFuncs[name]; ok {
+		var vec Vector
+		if len(args) == 0 {
+			vec = Vector{{Point: Point{T: ts, V: float64(ts) / 1000}}}
+		} else {
+			var err error
+			if vec, err = ev.evalVector(args[0], ts); err != nil {
+				return nil, err
+			}
+		}
+		return mapVector(vec, func(v float64) float64 {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return v
+			}
+			return f(time.Unix(int64(v), 0).UTC())
+		}), nil
+	}
+
+	switch name {
+	case "time":
+		return Scalar{T: ts, V: float64(ts) / 1000}, nil
+	case "pi":
+		return Scalar{T: ts, V: math.Pi}, nil
+	case "vector":
+		v, err := ev.evalScalar(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		return Vector{{Metric: Labels{}, Point: Point{T: ts, V: v}}}, nil
+	case "scalar":
+		vec, err := ev.evalVector(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		if len(vec) != 1 {
+			return Scalar{T: ts, V: math.NaN()}, nil
+		}
+		return Scalar{T: ts, V: vec[0].V}, nil
+	case "timestamp":
+		var vec Vector
+		var err error
+		if vs, ok := unwrapParens(args[0]).(*VectorSelector); ok {
+			vec, err = ev.selectVector(vs, ts, true)
+		} else {
+			vec, err = ev.evalVector(args[0], ts)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out := Vector{}
+		for _, s := range vec {
+			out = append(out, Sample{Metric: s.Metric.Without(MetricName), Point: Point{T: ts, V: float64(s.T) / 1000}})
+		}
+		return out, nil
+	case "rate", "increase", "delta":
+		m, start, end, err := ev.evalRange(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		out := Vector{}
+		for _, s := range m {
+			if v, ok := extrapolatedRate(s.Points, start, end, name != "delta", name == "rate"); ok {
+				out = append(out, Sample{Metric: s.Metric.Without(MetricName), Point: Point{T: ts, V: v}})
+			}
+		}
+		return out, nil
+	case "irate", "idelta":
+		m, _, _, err := ev.evalRange(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		out := Vector{}
+		for _, s := range m {
+			if len(s.Points) < 2 {
+				continue
+			}
+			last, prev := s.Points[len(s.Points)-1], s.Points[len(s.Points)-2]
+			v := last.V - prev.V
+			if name == "irate" {
+				if last.V < prev.V {
+					v = last.V // counter reset
+				}
+				v /= float64(last.T-prev.T) / 1000
+			}
+			out = append(out, Sample{Metric: s.Metric.Without(MetricName), Point: Point{T: ts, V: v}})
+		}
+		return out, nil
+	case "deriv", "predict_linear":
+		m, _, _, err := ev.evalRange(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		var dur float64
+		if name == "predict_linear" {
+			if dur, err = ev.evalScalar(args[1], ts); err != nil {
+				return nil, err
+			}
+		}
+		out := Vector{}
+		for _, s := range m {
+			if len(s.Points) < 2 {
+				continue
+			}
+			var v float64
+			if name == "deriv" {
+				v, _ = linearRegression(s.Points, s.Points[0].T)
+			} else {
+				slope, intercept := linearRegression(s.Points, ts)
+				v = slope*dur + intercept
+			}
+			out = append(out, Sample{Metric: s.Metric.Without(MetricName), Point: Point{T: ts, V: v}})
+		}
+		return out, nil
+	case "quantile_over_time":
+		q, err := ev.evalScalar(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		m, _, _, err := ev.evalRange(args[1], ts)
+		if err != nil {
+			return nil, err
+		}
+		out := Vector{}
+		for _, s := range m {
+			out = append(out, Sample{Metric: s.Metric.Without(MetricName), Point: Point{T: ts, V: quantile(q, pointValues(s.Points))}})
+		}
+		return out, nil
+	case "absent", "absent_over_time":
+		var empty bool
+		if name == "absent" {
+			vec, err := ev.evalVector(args[0], ts)
+			if err != nil {
+				return nil, err
+			}
+			empty = len(vec) == 0
+		} else {
+			m, _, _, err := ev.evalRange(args[0], ts)
+			if err != nil {
+				return nil, err
+			}
+			empty = len(m) == 0
+		}
+		if !empty {
+			return Vector{}, nil
+		}
+		return Vector{{Metric: absentLabels(args[0]), Point: Point{T: ts, V: 1}}}, nil
+	case "round":
+		vec, err := ev.evalVector(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		toNearest := 1.0
+		if len(args) > 1 {
+			if toNearest, err = ev.evalScalar(args[1], ts); err != nil {
+				return nil, err
+			}
+		}
+		inv := 1 / toNearest
+		return mapVector(vec, func(v float64) float64 { return math.Floor(v*inv+0.5) / inv }), nil
+	case "clamp", "clamp_min", "clamp_max":
+		vec, err := ev.evalVector(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		lo, hi := math.Inf(-1), math.Inf(1)
+		switch name {
+		case "clamp":
+			if lo, err = ev.evalScalar(args[1], ts); err != nil {
+				return nil, err
+			}
+			if hi, err = ev.evalScalar(args[2], ts); err != nil {
+				return nil, err
+			}
+			if hi < lo {
+				return Vector{}, nil
+			}
+		case "clamp_min":
+			if lo, err = ev.evalScalar(args[1], ts); err != nil {
+				return nil, err
+			}
+		case "clamp_max":
+			if hi, err = ev.evalScalar(args[1], ts); err != nil {
+				return nil, err
+			}
+		}
+		return mapVector(vec, func(v float64) float64 { return math.Max(lo, math.Min(hi, v)) }), nil
+	case "histogram_quantile":
+		q, err := ev.evalScalar(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		vec, err := ev.evalVector(args[1], ts)
+		if err != nil {
+			return nil, err
+		}
+		return histogramQuantile(q, vec, ts), nil
+	case "label_replace":
+		return ev.labelReplace(args, ts)
+	case "label_join":
+		vec, err := ev.evalVector(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		strs := make([]string, len(args)-1)
+		for i, a := range args[1:] {
+			if strs[i], err = ev.evalString(a, ts); err != nil {
+				return nil, err
+			}
+		}
+		dst, sep, srcs := strs[0], strs[1], strs[2:]
+		if !labelNameRe.MatchString(dst) {
+			return nil, fmt.Errorf("invalid destination label name in label_join(): %s", dst)
+		}
+		out := Vector{}
+		for _, s := range vec {
+			values := make([]string, len(srcs))
+			for i, src := range srcs {
+				values[i] = s.Metric.Get(src)
+			}
+			out = append(out, Sample{Metric: s.Metric.With(dst, strings.Join(values, sep)), Point: s.Point})
+		}
+		return out, nil
+	case "sort", "sort_desc":
+		vec, err := ev.evalVector(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		out := append(Vector{}, vec...)
+		sort.SliceStable(out, func(i, j int) bool {
+			if name == "sort" {
+				return greater(out[j].V, out[i].V)
+			}
+			return greater(out[i].V, out[j].V)
+		})
+		return out, nil
+	case "sort_by_label", "sort_by_label_desc":
+		vec, err := ev.evalVector(args[0], ts)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, a := range args[1:] {
+			s, err := ev.evalString(a, ts)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, s)
+		}
+		out := append(Vector{}, vec...)
+		sort.SliceStable(out, func(i, j int) bool {
+			for _, l := range names {
+				a, b := out[i].Metric.Get(l), out[j].Metric.Get(l)
+				if a != b {
+					return (a < b) == (name == "sort_by_label")
+				}
+			}
+			return false
+		})
+		return out, nil
+	}
+	return nil, fmt.Errorf("function %s is not supported by the test engine", name)
+}
+
+func unwrapParens(n Node) Node {
+	for {
+		p, ok := n.(*ParenExpr)
+		if !ok {
+			return n
+		}
+		n = p.Expr
+	}
+}
+
+func mapVector(vec Vector, f func(float64) float64) Vector {
+	out := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		out = append(out, Sample{Metric: s.Metric.Without(MetricName), Point: Point{T: s.T, V: f(s.V)}})
+	}
+	return out
+}
+
+// absentLabels returns the labels absent() reports: the equality matchers
+// of a selector argument.
+func absentLabels(arg Node) Labels {
+	var vs *VectorSelector
+	switch a := unwrapParens(arg).(type) {
+	case *VectorSelector:
+		vs = a
+	case *MatrixSelector:
+		vs = a.VectorSelector
+	default:
+		return Labels{}
+	}
+	m := map[string]string{}
+	seen := map[string]bool{}
+	for _, lm := range vs.Matchers {
+		if lm.Name == MetricName {
+			continue
+		}
+		if lm.Op == "=" && !seen[lm.Name] {
+			m[lm.Name] = lm.Value
+		} else {
+			delete(m, lm.Name)
+		}
+		seen[lm.Name] = true
+	}
+	return LabelsFromMap(m)
+}
+
+func (ev *evaluator) labelReplace(args []Node, ts int64) (Value, error) {
+	vec, err := ev.evalVector(args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	var strs [4]string
+	for i := range strs {
+		if strs[i], err = ev.evalString(args[i+1], ts); err != nil {
+			return nil, err
+		}
+	}
+	dst, repl, src, pattern := strs[0], strs[1], strs[2], strs[3]
+	re, err := regexp.Compile("^(?s:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression in label_replace(): %s", pattern)
+	}
+	if !labelNameRe.MatchString(dst) {
+		return nil, fmt.Errorf("invalid destination label name in label_replace(): %s", dst)
+	}
+	out := Vector{}
+	for _, s := range vec {
+		metric := s.Metric
+		value := metric.Get(src)
+		if idx := re.FindStringSubmatchIndex(value); idx != nil {
+			res := re.ExpandString(nil, repl, value, idx)
+			metric = metric.With(dst, string(res))
+		}
+		out = append(out, Sample{Metric: metric, Point: s.Point})
+	}
+	return out, nil
+}
+
+// extrapolatedRate implements rate, increase and delta, extrapolating to
+// the edges of the window the way Prometheus does.
+func extrapolatedRate(points []Point, rangeStart, rangeEnd int64, isCounter, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	first, last := points[0], points[len(points)-1]
+	result := last.V - first.V
+	if isCounter {
+		for i := 1; i < len(points); i++ {
+			if points[i].V < points[i-1].V {
+				result += points[i-1].V
+			}
+		}
+	}
+	durationToStart := float64(first.T-rangeStart) / 1000
+	durationToEnd := float64(rangeEnd-last.T) / 1000
+	sampledInterval := float64(last.T-first.T) / 1000
+	averageBetween := sampledInterval / float64(len(points)-1)
+	threshold := averageBetween * 1.1
+
+	if durationToStart >= threshold {
+		durationToStart = averageBetween / 2
+	}
+	if isCounter && result > 0 && first.V >= 0 {
+		if durationToZero := sampledInterval * (first.V / result); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+	if durationToEnd >= threshold {
+		durationToEnd = averageBetween / 2
+	}
+	factor := (sampledInterval + durationToStart + durationToEnd) / sampledInterval
+	if isRate {
+		factor /= float64(rangeEnd-rangeStart) / 1000
+	}
+	return result * factor, true
+}
+
+// linearRegression returns the slope and the value at interceptTime of
+// the least-squares line through points.
+func linearRegression(points []Point, interceptTime int64) (slope, intercept float64) {
+	var n, sumX, sumY, sumXY, sumX2 float64
+	constY := true
+	for i, p := range points {
+		if i > 0 && p.V != points[0].V {
+			constY = false
+		}
+		x := float64(p.T-interceptTime) / 1000
+		n++
+		sumX += x
+		sumY += p.V
+		sumXY += x * p.V
+		sumX2 += x * x
+	}
+	if constY {
+		if math.IsInf(points[0].V, 0) {
+			return math.NaN(), math.NaN()
+		}
+		return 0, points[0].V
+	}
+	covXY := sumXY - sumX*sumY/n
+	varX := sumX2 - sumX*sumX/n
+	slope = covXY / varX
+	intercept = sumY/n - slope*sumX/n
+	return slope, intercept
+}
+
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramQuantile calculates quantiles from classic histogram buckets,
+// grouping the input by all labels except le.
+func histogramQuantile(q float64, vec Vector, ts int64) Vector {
+	type group struct {
+		metric  Labels
+		buckets []bucket
+	}
+	var keys []string
+	groups := map[string]*group{}
+	for _, s := range vec {
+		le := s.Metric.Get("le")
+		ub, err := parseNumber(le)
+		if err != nil {
+			if le == "+Inf" {
+				ub = math.Inf(1)
+			} else {
+				continue
+			}
+		}
+		metric := s.Metric.Without(MetricName, "le")
+		key := metric.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{metric: metric}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.buckets = append(g.buckets, bucket{ub, s.V})
+	}
+	out := Vector{}
+	for _, key := range keys {
+		g := groups[key]
+		out = append(out, Sample{Metric: g.metric, Point: Point{T: ts, V: bucketQuantile(q, g.buckets)}})
+	}
+	return out
+}
+
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+	// Merge buckets with the same bound and force monotonic counts.
+	merged := buckets[:1]
+	for _, b := range buckets[1:] {
+		if b.upperBound == merged[len(merged)-1].upperBound {
+			merged[len(merged)-1].count += b.count
+			continue
+		}
+		merged = append(merged, b)
+	}
+	buckets = merged
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+	if len(buckets) < 2 {
+		return math.NaN()
+	}
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+	var bucketStart float64
+	bucketEnd := buckets[b].upperBound
+	count := buckets[b].count
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
@@ -0,0 +1,135 @@
+package promql
+
+// Function describes a PromQL function signature.
+type Function struct {
+	Name       string
+	ArgTypes   []ValueType
+	Variadic   int // when non-zero the last argument is optional and may be given up to Variadic times; -1 for unlimited
+	ReturnType ValueType
+}
+
+const (
+	sc  = ValueTypeScalar
+	vec = ValueTypeVector
+	mat = ValueTypeMatrix
+	str = ValueTypeString
+)
+
+func fn(name string, ret ValueType, variadic int, args ...ValueType) *Function {
+	return &Function{Name: name, ArgTypes: args, Variadic: variadic, ReturnType: ret}
+}
+
+// Functions lists the functions known to PromQL, including the ones Mimir
+// accepts behind experimental flags.
+var Functions = map[string]*Function{}
+
+func init() {
+	for _, f := range []*Function{
+		fn("abs", vec, 0, vec),
+		fn("absent", vec, 0, vec),
+		fn("absent_over_time", vec, 0, mat),
+		fn("acos", vec, 0, vec),
+		fn("acosh", vec, 0, vec),
+		fn("asin", vec, 0, vec),
+		fn("asinh", vec, 0, vec),
+		fn("atan", vec, 0, vec),
+		fn("atanh", vec, 0, vec),
+		fn("avg_over_time", vec, 0, mat),
+		fn("ceil", vec, 0, vec),
+		fn("changes", vec, 0, mat),
+		fn("clamp", vec, 0, vec, sc, sc),
+		fn("clamp_max", vec, 0, vec, sc),
+		fn("clamp_min", vec, 0, vec, sc),
+		fn("cos", vec, 0, vec),
+		fn("cosh", vec, 0, vec),
+		fn("count_over_time", vec, 0, mat),
+		fn("days_in_month", vec, 1, vec),
+		fn("day_of_month", vec, 1, vec),
+		fn("day_of_week", vec, 1, vec),
+		fn("day_of_year", vec, 1, vec),
+		fn("deg", vec, 0, vec),
+		fn("delta", vec, 0, mat),
+		fn("deriv", vec, 0, mat),
+		fn("double_exponential_smoothing", vec, 0, mat, sc, sc),
+		fn("exp", vec, 0, vec),
+		fn("floor", vec, 0, vec),
+		fn("histogram_avg", vec, 0, vec),
+		fn("histogram_count", vec, 0, vec),
+		fn("histogram_fraction", vec, 0, sc, sc, vec),
+		fn("histogram_quantile", vec, 0, sc, vec),
+		fn("histogram_stddev", vec, 0, vec),
+		fn("histogram_stdvar", vec, 0, vec),
+		fn("histogram_sum", vec, 0, vec),
+		fn("holt_winters", vec, 0, mat, sc, sc),
+		fn("hour", vec, 1, vec),
+		fn("idelta", vec, 0, mat),
+		fn("increase", vec, 0, mat),
+		fn("info", vec, 1, vec, vec),
+		fn("irate", vec, 0, mat),
+		fn("label_join", vec, -1, vec, str, str, str),
+		fn("label_replace", vec, 0, vec, str, str, str, str),
+		fn("last_over_time", vec, 0, mat),
+		fn("ln", vec, 0, vec),
+		fn("log10", vec, 0, vec),
+		fn("log2", vec, 0, vec),
+		fn("mad_over_time", vec, 0, mat),
+		fn("max_over_time", vec, 0, mat),
+		fn("min_over_time", vec, 0, mat),
+		fn("minute", vec, 1, vec),
+		fn("month", vec, 1, vec),
+		fn("pi", sc, 0),
+		fn("predict_linear", vec, 0, mat, sc),
+		fn("present_over_time", vec, 0, mat),
+		fn("quantile_over_time", vec, 0, sc, mat),
+		fn("rad", vec, 0, vec),
+		fn("rate", vec, 0, mat),
+		fn("resets", vec, 0, mat),
+		fn("round", vec, 1, vec, sc),
+		fn("scalar", sc, 0, vec),
+		fn("sgn", vec, 0, vec),
+		fn("sin", vec, 0, vec),
+		fn("sinh", vec, 0, vec),
+		fn("sort", vec, 0, vec),
+		fn("sort_by_label", vec, -1, vec, str),
+		fn("sort_by_label_desc", vec, -1, vec, str),
+		fn("sort_desc", vec, 0, vec),
+		fn("sqrt", vec, 0, vec),
+		fn("stddev_over_time", vec, 0, mat),
+		fn("stdvar_over_time", vec, 0, mat),
+		fn("sum_over_time", vec, 0, mat),
+		fn("tan", vec, 0, vec),
+		fn("tanh", vec, 0, vec),
+		fn("time", sc, 0),
+		fn("timestamp", vec, 0, vec),
+		fn("vector", vec, 0, sc),
+		fn("year", vec, 1, vec),
+	} {
+		Functions[f.Name] = f
+	}
+}
+
+// Aggregators lists the aggregation operators. The value reports the type
+// of the parameter the operator takes before its expression, if any.
+var Aggregators = map[string]ValueType{
+	"avg":          "",
+	"bottomk":      ValueTypeScalar,
+	"count":        "",
+	"count_values": ValueTypeString,
+	"group":        "",
+	"limitk":       ValueTypeScalar,
+	"limit_ratio":  ValueTypeScalar,
+	"max":          "",
+	"min":          "",
+	"quantile":     ValueTypeScalar,
+	"stddev":       "",
+	"stdvar":       "",
+	"sum":          "",
+	"topk":         ValueTypeScalar,
+}
+
+// keywords may not be used as metric names without quoting.
+var keywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true, "offset": true, "bool": true,
+	"and": true, "or": true, "unless": true, "atan2": true,
+}
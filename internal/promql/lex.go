@@ -0,0 +1,293 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tIdent
+	tNumber
+	tDuration
+	tString
+	tOp // punctuation and operators; the token value holds the symbol
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tEOF:
+		return "end of input"
+	case tString:
+		return "string " + t.val
+	case tNumber:
+		return "number " + t.val
+	case tDuration:
+		return "duration " + t.val
+	}
+	return fmt.Sprintf("%q", t.val)
+}
+
+// operators lists the symbols recognised by the lexer, longest first so
+// two-character operators win over their one-character prefixes.
+var operators = []string{
+	"==", "!=", "<=", ">=", "=~", "!~",
+	"+", "-", "*", "/", "%", "^", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ",", ":", "@",
+}
+
+// lex splits input into tokens. Comments ("#" to the end of the line) and
+// whitespace are dropped.
+func lex(input string) ([]token, error) {
+	for i, r := range input {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(input[i:]); size == 1 {
+				return nil, &Error{Pos: i, Msg: "invalid UTF-8 rune"}
+			}
+		}
+	}
+	var toks []token
+	i := 0
+	inBrackets := false // ":" separates range and step inside [...]
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ':' && inBrackets:
+			toks = append(toks, token{tOp, ":", i})
+			i++
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case isDigit(c) || (c == '.' && i+1 < len(input) && isDigit(input[i+1])):
+			tok, n, err := lexNumber(input, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, tok)
+			i += n
+		case c == '"' || c == '\'' || c == '`':
+			n, err := scanString(input, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tString, input[i : i+n], i})
+			i += n
+		case isIdentStart(c):
+			start := i
+			for i < len(input) && isIdentChar(input[i]) {
+				i++
+			}
+			toks = append(toks, token{tIdent, input[start:i], start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(input[i:], op) {
+					switch op {
+					case "[":
+						inBrackets = true
+					case "]":
+						inBrackets = false
+					}
+					toks = append(toks, token{tOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				r, _ := utf8.DecodeRuneInString(input[i:])
+				return nil, &Error{Pos: i, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+		}
+	}
+	return append(toks, token{tEOF, "", len(input)}), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || unicode.IsLetter(rune(c)) && c < utf8.RuneSelf
+}
+func isIdentChar(c byte) bool { return isIdentStart(c) || isDigit(c) }
+func isWordChar(c byte) bool  { return c != ':' && isIdentChar(c) }
+
+// lexNumber scans a number or a duration starting at i.
+func lexNumber(input string, i int) (token, int, error) {
+	start := i
+	if strings.HasPrefix(input[i:], "0x") || strings.HasPrefix(input[i:], "0X") {
+		i += 2
+		for i < len(input) && strings.IndexByte("0123456789abcdefABCDEF", input[i]) >= 0 {
+			i++
+		}
+		return token{tNumber, input[start:i], start}, i - start, nil
+	}
+	// A duration is a sequence of <digits><unit> pairs.
+	if n := scanDuration(input[i:]); n > 0 {
+		return token{tDuration, input[i : i+n], start}, n, nil
+	}
+	for i < len(input) && isDigit(input[i]) {
+		i++
+	}
+	if i < len(input) && input[i] == '.' {
+		i++
+		for i < len(input) && isDigit(input[i]) {
+			i++
+		}
+	}
+	if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+		j := i + 1
+		if j < len(input) && (input[j] == '+' || input[j] == '-') {
+			j++
+		}
+		if j < len(input) && isDigit(input[j]) {
+			for j < len(input) && isDigit(input[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	if i < len(input) && isWordChar(input[i]) {
+		return token{}, 0, &Error{Pos: start, Msg: fmt.Sprintf("bad number or duration syntax: %q", input[start:i+1])}
+	}
+	return token{tNumber, input[start:i], start}, i - start, nil
+}
+
+// scanDuration returns the length of the duration at the start of s, or 0.
+func scanDuration(s string) int {
+	i := 0
+	units := 0
+	for i < len(s) && isDigit(s[i]) {
+		j := i
+		for j < len(s) && isDigit(s[j]) {
+			j++
+		}
+		k := j
+		switch {
+		case strings.HasPrefix(s[j:], "ms"):
+			k += 2
+		case j < len(s) && strings.IndexByte("smhdwy", s[j]) >= 0:
+			k++
+		default:
+			return 0
+		}
+		if k < len(s) && isWordChar(s[k]) && !isDigit(s[k]) {
+			return 0
+		}
+		i = k
+		units++
+	}
+	if units == 0 {
+		return 0
+	}
+	return i
+}
+
+// scanString returns the length of the quoted string starting at i,
+// including its quotes.
+func scanString(input string, i int) (int, error) {
+	quote := input[i]
+	j := i + 1
+	for j < len(input) {
+		c := input[j]
+		switch {
+		case c == quote:
+			return j + 1 - i, nil
+		case c == '\\' && quote != '`':
+			j += 2
+		case c == '\n' && quote != '`':
+			return 0, &Error{Pos: i, Msg: "unterminated quoted string"}
+		default:
+			j++
+		}
+	}
+	return 0, &Error{Pos: i, Msg: "unterminated quoted string"}
+}
+
+// Unquote returns the value of a quoted PromQL string.
+func Unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] {
+		return "", fmt.Errorf("invalid quoted string %s", s)
+	}
+	quote := s[0]
+	body := s[1 : len(s)-1]
+	if quote == '`' {
+		return body, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(body) {
+			return "", fmt.Errorf("invalid escape at end of string %s", s)
+		}
+		switch e := body[i]; e {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(e)
+		case 'x', 'u', 'U':
+			n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+			if i+n >= len(body) {
+				return "", fmt.Errorf("invalid escape sequence in %s", s)
+			}
+			var v rune
+			for _, h := range body[i+1 : i+1+n] {
+				d := strings.IndexRune("0123456789abcdef", unicode.ToLower(h))
+				if d < 0 {
+					return "", fmt.Errorf("invalid escape sequence in %s", s)
+				}
+				v = v*16 + rune(d)
+			}
+			if e == 'x' {
+				b.WriteByte(byte(v))
+			} else {
+				b.WriteRune(v)
+			}
+			i += n
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			if i+2 >= len(body) {
+				return "", fmt.Errorf("invalid escape sequence in %s", s)
+			}
+			var v byte
+			for _, o := range body[i : i+3] {
+				if o < '0' || o > '7' {
+					return "", fmt.Errorf("invalid escape sequence in %s", s)
+				}
+				v = v*8 + byte(o-'0')
+			}
+			b.WriteByte(v)
+			i += 2
+		default:
+			return "", fmt.Errorf("unknown escape sequence \\%c in %s", e, s)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,690 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Parse parses a PromQL expression and checks it the way the Prometheus
+// parser does: syntax, function signatures, operand types, regular
+// expressions and label matchers. The returned error is an *Error.
+func Parse(input string) (Expr, error) {
+	toks, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	if p.peek().kind == tEOF {
+		return nil, &Error{Pos: 0, Msg: "no expression found in input"}
+	}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, p.unexpected(t, "")
+	}
+	if expr.Type() != ValueTypeScalar && expr.Type() != ValueTypeVector && expr.Type() != ValueTypeMatrix && expr.Type() != ValueTypeString {
+		return nil, &Error{Pos: expr.Position(), Msg: "invalid expression type"}
+	}
+	return expr, nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isOp(val string) bool {
+	t := p.peek()
+	return t.kind == tOp && t.val == val
+}
+
+// isIdent reports whether the current token is the keyword val. Keywords
+// are case-insensitive, as in Prometheus.
+func (p *parser) isIdent(val string) bool {
+	t := p.peek()
+	return t.kind == tIdent && strings.EqualFold(t.val, val)
+}
+
+func (p *parser) expectOp(val, context string) (token, error) {
+	t := p.next()
+	if t.kind != tOp || t.val != val {
+		return t, p.unexpected(t, fmt.Sprintf("%s, expected %q", context, val))
+	}
+	return t, nil
+}
+
+func (p *parser) unexpected(t token, context string) error {
+	msg := "unexpected " + t.String()
+	if context != "" {
+		msg += " in " + context
+	}
+	return &Error{Pos: t.pos, Msg: msg}
+}
+
+func errorf(pos int, format string, args ...any) error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Binary operator precedences; higher binds tighter.
+var precedence = map[string]int{
+	"or":     1,
+	"and":    2,
+	"unless": 2,
+	"==":     3, "!=": 3, "<=": 3, "<": 3, ">=": 3, ">": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5, "atan2": 5,
+	"^": 6,
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<=", "<", ">=", ">":
+		return true
+	}
+	return false
+}
+
+func isSetOp(op string) bool { return op == "and" || op == "or" || op == "unless" }
+
+// binaryOp returns the binary operator at the current token, if any.
+func (p *parser) binaryOp() (string, bool) {
+	t := p.peek()
+	if t.kind != tOp && t.kind != tIdent {
+		return "", false
+	}
+	op := t.val
+	if t.kind == tIdent {
+		op = strings.ToLower(op)
+	}
+	if _, ok := precedence[op]; !ok {
+		return "", false
+	}
+	if t.kind == tIdent && !isSetOp(op) && op != "atan2" {
+		return "", false
+	}
+	return op, true
+}
+
+// parseExpr parses a binary expression whose operators bind tighter than
+// minPrec (precedence climbing).
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.binaryOp()
+		if !ok || precedence[op] <= minPrec {
+			return lhs, nil
+		}
+		opTok := p.next()
+		bin := &BinaryExpr{Op: op, LHS: lhs, Pos: lhs.Position()}
+		if err := p.parseBinaryModifiers(bin, opTok); err != nil {
+			return nil, err
+		}
+		// "^" is right-associative.
+		nextMin := precedence[op]
+		if op == "^" {
+			nextMin--
+		}
+		rhs, err := p.parseExpr(nextMin)
+		if err != nil {
+			return nil, err
+		}
+		bin.RHS = rhs
+		if err := checkBinary(bin, opTok); err != nil {
+			return nil, err
+		}
+		lhs = bin
+	}
+}
+
+func (p *parser) parseBinaryModifiers(bin *BinaryExpr, opTok token) error {
+	if p.isIdent("bool") {
+		t := p.next()
+		if !isComparison(bin.Op) {
+			return errorf(t.pos, "bool modifier can only be used on comparison operators")
+		}
+		bin.ReturnBool = true
+	}
+	if p.isIdent("on") || p.isIdent("ignoring") {
+		t := p.next()
+		vm := &VectorMatching{On: strings.EqualFold(t.val, "on"), HasMatching: true}
+		labels, err := p.parseLabelList(t.val)
+		if err != nil {
+			return err
+		}
+		vm.MatchingLabels = labels
+		bin.VectorMatching = vm
+		if p.isIdent("group_left") || p.isIdent("group_right") {
+			g := p.next()
+			if isSetOp(bin.Op) {
+				return errorf(g.pos, "no grouping allowed for %q operation", bin.Op)
+			}
+			vm.Card = strings.ToLower(g.val)
+			if p.isOp("(") {
+				include, err := p.parseLabelList(g.val)
+				if err != nil {
+					return err
+				}
+				vm.Include = include
+			}
+			if vm.On {
+				for _, l := range vm.Include {
+					for _, m := range vm.MatchingLabels {
+						if l == m {
+							return errorf(g.pos, "label %q must not occur in ON and GROUP clause at once", l)
+						}
+					}
+				}
+			}
+		}
+	} else if p.isIdent("group_left") || p.isIdent("group_right") {
+		t := p.peek()
+		return errorf(t.pos, "%s must be preceded by on or ignoring", t.val)
+	}
+	return nil
+}
+
+func checkBinary(bin *BinaryExpr, opTok token) error {
+	lt, rt := bin.LHS.Type(), bin.RHS.Type()
+	for _, typ := range []ValueType{lt, rt} {
+		if typ != ValueTypeScalar && typ != ValueTypeVector {
+			return errorf(opTok.pos, "binary expression must contain only scalar and instant vector types")
+		}
+	}
+	if lt == ValueTypeScalar && rt == ValueTypeScalar {
+		if isComparison(bin.Op) && !bin.ReturnBool {
+			return errorf(opTok.pos, "comparisons between scalars must use BOOL modifier")
+		}
+	}
+	if isSetOp(bin.Op) && (lt == ValueTypeScalar || rt == ValueTypeScalar) {
+		return errorf(opTok.pos, "set operator %q not allowed in binary scalar expression", bin.Op)
+	}
+	if bin.VectorMatching != nil && (lt != ValueTypeVector || rt != ValueTypeVector) {
+		return errorf(opTok.pos, "vector matching only allowed between instant vectors")
+	}
+	return nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.isOp("-") || p.isOp("+") {
+		t := p.next()
+		// Unary operators bind looser than "^" but tighter than "*".
+		expr, err := p.parseExpr(precedence["*"])
+		if err != nil {
+			return nil, err
+		}
+		if typ := expr.Type(); typ != ValueTypeScalar && typ != ValueTypeVector {
+			return nil, errorf(t.pos, "unary expression only allowed on expressions of type scalar or instant vector, got %s", typ)
+		}
+		if n, ok := expr.(*NumberLiteral); ok && t.val == "-" {
+			if strings.HasPrefix(n.Val, "-") {
+				n.Val = n.Val[1:]
+			} else {
+				n.Val = "-" + n.Val
+			}
+			n.Pos = t.pos
+			return n, nil
+		}
+		return &UnaryExpr{Op: t.val, Expr: expr, Pos: t.pos}, nil
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses a primary expression followed by range, subquery,
+// offset and @ modifiers.
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("["):
+			open := p.next()
+			rng, err := p.parseDuration("range")
+			if err != nil {
+				return nil, err
+			}
+			if p.isOp(":") {
+				p.next()
+				step := ""
+				if p.peek().kind == tDuration {
+					if step, err = p.parseDuration("subquery step"); err != nil {
+						return nil, err
+					}
+				}
+				if _, err := p.expectOp("]", "subquery"); err != nil {
+					return nil, err
+				}
+				if typ := expr.Type(); typ != ValueTypeVector {
+					return nil, errorf(open.pos, "subquery is only allowed on instant vector, got %s", typ)
+				}
+				expr = &SubqueryExpr{Expr: expr, Range: rng, Step: step, Pos: expr.Position()}
+				continue
+			}
+			if _, err := p.expectOp("]", "range"); err != nil {
+				return nil, err
+			}
+			vs, ok := expr.(*VectorSelector)
+			if !ok {
+				return nil, errorf(open.pos, "ranges only allowed for vector selectors")
+			}
+			if vs.Offset != "" || vs.At != "" {
+				return nil, errorf(open.pos, "no offset or @ modifiers allowed before range")
+			}
+			expr = &MatrixSelector{VectorSelector: vs, Range: rng, Pos: vs.Pos}
+		case p.isIdent("offset"):
+			t := p.next()
+			neg := ""
+			if p.isOp("-") {
+				p.next()
+				neg = "-"
+			} else if p.isOp("+") {
+				p.next()
+			}
+			d, err := p.parseDuration("offset")
+			if err != nil {
+				return nil, err
+			}
+			if err := setModifier(expr, t, func(offset, _ *string) error {
+				if *offset != "" {
+					return errorf(t.pos, "offset may not be set multiple times")
+				}
+				*offset = neg + d
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		case p.isOp("@"):
+			t := p.next()
+			var at string
+			switch n := p.next(); {
+			case n.kind == tNumber:
+				at = n.val
+			case n.kind == tOp && (n.val == "-" || n.val == "+") && p.peek().kind == tNumber:
+				at = n.val + p.next().val
+			case n.kind == tIdent && (strings.EqualFold(n.val, "start") || strings.EqualFold(n.val, "end")):
+				if _, err := p.expectOp("(", "@ modifier"); err != nil {
+					return nil, err
+				}
+				if _, err := p.expectOp(")", "@ modifier"); err != nil {
+					return nil, err
+				}
+				at = strings.ToLower(n.val) + "()"
+			default:
+				return nil, p.unexpected(n, "@ modifier, expected timestamp, start() or end()")
+			}
+			if err := setModifier(expr, t, func(_, atField *string) error {
+				if *atField != "" {
+					return errorf(t.pos, "@ <timestamp> may not be set multiple times")
+				}
+				*atField = at
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// setModifier applies an offset or @ modifier to the selector or subquery
+// it follows.
+func setModifier(expr Expr, t token, set func(offset, at *string) error) error {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return set(&e.Offset, &e.At)
+	case *MatrixSelector:
+		return set(&e.VectorSelector.Offset, &e.VectorSelector.At)
+	case *SubqueryExpr:
+		return set(&e.Offset, &e.At)
+	}
+	return errorf(t.pos, "%s modifier must be preceded by an instant vector selector or range vector selector or a subquery", t.val)
+}
+
+func (p *parser) parseDuration(context string) (string, error) {
+	t := p.next()
+	if t.kind != tDuration {
+		if t.kind == tNumber {
+			return "", errorf(t.pos, "bad %s duration %q: missing unit character in duration", context, t.val)
+		}
+		return "", p.unexpected(t, context+", expected duration")
+	}
+	// Units must be in descending order and each used once
+	if _, err := ParseDuration(t.val); err != nil {
+		return "", errorf(t.pos, "not a valid duration string: %q", t.val)
+	}
+	return t.val, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tNumber:
+		p.next()
+		if _, err := parseNumber(t.val); err != nil {
+			return nil, errorf(t.pos, "invalid number %q", t.val)
+		}
+		return &NumberLiteral{Val: t.val, Pos: t.pos}, nil
+	case tDuration:
+		return nil, p.unexpected(t, "expression")
+	case tString:
+		p.next()
+		val, err := Unquote(t.val)
+		if err != nil {
+			return nil, errorf(t.pos, "%v", err)
+		}
+		return &StringLiteral{Val: val, Raw: t.val, Pos: t.pos}, nil
+	case tOp:
+		switch t.val {
+		case "(":
+			p.next()
+			expr, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expectOp(")", "parenthesized expression"); err != nil {
+				return nil, err
+			}
+			return &ParenExpr{Expr: expr, Pos: t.pos}, nil
+		case "{":
+			return p.parseSelector("", t.pos)
+		}
+		return nil, p.unexpected(t, "expression")
+	case tIdent:
+		p.next()
+		lower := strings.ToLower(t.val)
+		if lower == "inf" || lower == "nan" {
+			return &NumberLiteral{Val: t.val, Pos: t.pos}, nil
+		}
+		if _, ok := Aggregators[lower]; ok && (p.isOp("(") || p.isIdent("by") || p.isIdent("without")) {
+			return p.parseAggregate(t)
+		}
+		if p.isOp("(") {
+			return p.parseCall(t)
+		}
+		if keywords[lower] {
+			return nil, p.unexpected(t, "expression")
+		}
+		return p.parseSelector(t.val, t.pos)
+	}
+	return nil, p.unexpected(t, "expression")
+}
+
+func parseNumber(s string) (float64, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		v, err := strconv.ParseInt(s[2:], 16, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseSelector parses the optional {...} of a vector selector.
+func (p *parser) parseSelector(name string, pos int) (Expr, error) {
+	vs := &VectorSelector{Name: name, Pos: pos}
+	if p.isOp("{") {
+		p.next()
+		for !p.isOp("}") {
+			m, quotedName, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			if quotedName != "" {
+				if vs.Name != "" {
+					return nil, errorf(m.Pos, "metric name must not be set twice: %q or %q", vs.Name, quotedName)
+				}
+				vs.Name = quotedName
+			} else {
+				vs.Matchers = append(vs.Matchers, m)
+			}
+			if p.isOp(",") {
+				p.next()
+				continue
+			}
+			if !p.isOp("}") {
+				return nil, p.unexpected(p.peek(), "label matching, expected \",\" or \"}\"")
+			}
+		}
+		p.next()
+	}
+	for _, m := range vs.Matchers {
+		if m.Name == "__name__" && m.Op == "=" && vs.Name != "" {
+			return nil, errorf(m.Pos, "metric name must not be set twice: %q or %q", vs.Name, m.Value)
+		}
+	}
+	if vs.Name == "" {
+		nonEmpty := false
+		for _, m := range vs.Matchers {
+			if !matchesEmpty(m) {
+				nonEmpty = true
+			}
+		}
+		if !nonEmpty {
+			return nil, errorf(pos, "vector selector must contain at least one non-empty matcher")
+		}
+	}
+	return vs, nil
+}
+
+// parseMatcher parses a label matcher. A lone quoted string is a metric
+// name, returned as quotedName.
+func (p *parser) parseMatcher() (*LabelMatcher, string, error) {
+	t := p.next()
+	var name string
+	switch t.kind {
+	case tIdent:
+		name = t.val
+		if !labelNameRe.MatchString(name) {
+			return nil, "", errorf(t.pos, "invalid label name %q", name)
+		}
+	case tString:
+		v, err := Unquote(t.val)
+		if err != nil {
+			return nil, "", errorf(t.pos, "%v", err)
+		}
+		if p.isOp(",") || p.isOp("}") {
+			return &LabelMatcher{Pos: t.pos}, v, nil
+		}
+		name = v
+	default:
+		return nil, "", p.unexpected(t, "label matching, expected label name")
+	}
+	op := p.next()
+	if op.kind != tOp || (op.val != "=" && op.val != "!=" && op.val != "=~" && op.val != "!~") {
+		return nil, "", p.unexpected(op, "label matching, expected label matching operator")
+	}
+	vt := p.next()
+	if vt.kind != tString {
+		return nil, "", p.unexpected(vt, "label matching, expected string")
+	}
+	value, err := Unquote(vt.val)
+	if err != nil {
+		return nil, "", errorf(vt.pos, "%v", err)
+	}
+	m := &LabelMatcher{Name: name, Op: op.val, Value: value, Pos: t.pos}
+	if m.Op == "=~" || m.Op == "!~" {
+		if _, err := regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, "", errorf(vt.pos, "invalid regular expression in label matcher %s%s%s: %v", name, op.val, vt.val, err)
+		}
+	}
+	return m, "", nil
+}
+
+func matchesEmpty(m *LabelMatcher) bool {
+	switch m.Op {
+	case "=":
+		return m.Value == ""
+	case "!=":
+		return m.Value != ""
+	}
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString("") == (m.Op == "=~")
+}
+
+func (p *parser) parseLabelList(context string) ([]string, error) {
+	if _, err := p.expectOp("(", context+" clause"); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for !p.isOp(")") {
+		t := p.next()
+		var name string
+		switch t.kind {
+		case tIdent:
+			name = t.val
+			if !labelNameRe.MatchString(name) {
+				return nil, errorf(t.pos, "invalid label name %q in %s clause", name, context)
+			}
+		case tString:
+			v, err := Unquote(t.val)
+			if err != nil {
+				return nil, errorf(t.pos, "%v", err)
+			}
+			name = v
+		default:
+			return nil, p.unexpected(t, context+" clause, expected label")
+		}
+		labels = append(labels, name)
+		if p.isOp(",") {
+			p.next()
+		} else if !p.isOp(")") {
+			return nil, p.unexpected(p.peek(), context+" clause, expected \",\" or \")\"")
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+func (p *parser) parseAggregate(opTok token) (Expr, error) {
+	agg := &AggregateExpr{Op: strings.ToLower(opTok.val), Pos: opTok.pos}
+	parseGrouping := func() error {
+		t := p.next()
+		labels, err := p.parseLabelList(t.val)
+		if err != nil {
+			return err
+		}
+		agg.Grouping = labels
+		agg.Without = strings.EqualFold(t.val, "without")
+		agg.HasBy = strings.EqualFold(t.val, "by")
+		return nil
+	}
+	if p.isIdent("by") || p.isIdent("without") {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+	open, err := p.expectOp("(", "aggregation")
+	if err != nil {
+		return nil, err
+	}
+	var args []Expr
+	for !p.isOp(")") {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.isOp(",") {
+			p.next()
+		} else if !p.isOp(")") {
+			return nil, p.unexpected(p.peek(), "aggregation, expected \",\" or \")\"")
+		}
+	}
+	p.next()
+	if (p.isIdent("by") || p.isIdent("without")) && agg.Grouping == nil && !agg.HasBy && !agg.Without {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	paramType := Aggregators[agg.Op]
+	want := 1
+	if paramType != "" {
+		want = 2
+	}
+	if len(args) != want {
+		return nil, errorf(open.pos, "wrong number of arguments for aggregate expression provided, expected %d, got %d", want, len(args))
+	}
+	if paramType != "" {
+		agg.Param = args[0]
+		if typ := agg.Param.Type(); typ != paramType {
+			return nil, errorf(agg.Param.Position(), "expected type %s in aggregation parameter, got %s", paramType, typ)
+		}
+	}
+	agg.Expr = args[len(args)-1]
+	if typ := agg.Expr.Type(); typ != ValueTypeVector {
+		return nil, errorf(agg.Expr.Position(), "expected type instant vector in aggregation expression, got %s", typ)
+	}
+	return agg, nil
+}
+
+func (p *parser) parseCall(nameTok token) (Expr, error) {
+	f, ok := Functions[nameTok.val]
+	if !ok {
+		return nil, errorf(nameTok.pos, "unknown function with name %q", nameTok.val)
+	}
+	p.next() // "("
+	call := &Call{Func: f, Pos: nameTok.pos}
+	for !p.isOp(")") {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.isOp(",") {
+			p.next()
+		} else if !p.isOp(")") {
+			return nil, p.unexpected(p.peek(), "call to function "+f.Name+", expected \",\" or \")\"")
+		}
+	}
+	p.next()
+
+	n := len(call.Args)
+	minArgs, maxArgs := len(f.ArgTypes), len(f.ArgTypes)
+	if f.Variadic != 0 {
+		minArgs--
+		maxArgs = minArgs + f.Variadic
+		if f.Variadic < 0 {
+			maxArgs = -1
+		}
+	}
+	if n < minArgs || (maxArgs >= 0 && n > maxArgs) {
+		expected := strconv.Itoa(minArgs)
+		switch {
+		case maxArgs < 0:
+			expected = "at least " + expected
+		case maxArgs != minArgs:
+			expected = fmt.Sprintf("%d to %d", minArgs, maxArgs)
+		}
+		return nil, errorf(nameTok.pos, "expected %s argument(s) in call to %q, got %d", expected, f.Name, n)
+	}
+	for i, arg := range call.Args {
+		want := f.ArgTypes[min(i, len(f.ArgTypes)-1)]
+		if typ := arg.Type(); typ != want {
+			return nil, errorf(arg.Position(), "expected type %s in call to function %q, got %s", want, f.Name, typ)
+		}
+	}
+	return call, nil
+}
@@ -0,0 +1,218 @@
+package promql
+
+import (
+	"strings"
+	"testing"
+)
+
+// The corpus below follows the test cases of the Prometheus parser: every
+// valid expression is accepted upstream and every invalid one rejected.
+
+var validExprs = []string{
+	// Literals
+	`1`, `+Inf`, `-Inf`, `.5`, `5.`, `123.4567`, `5e-3`, `5e3`, `0xc`, `0755`, `+5.5e-3`, `-0755`, `NaN`, `nan`,
+	`"double-quoted string \" with escape"`, `'single-quoted string \' with escape'`, "`backtick-quoted string`",
+	// Arithmetic and comparisons between scalars
+	`1 + 1`, `1 - 1`, `1 * 1`, `1 % 1`, `1 / 1`, `1 == bool 1`, `1 != bool 1`, `1 > bool 1`, `1 >= bool 1`, `1 < bool 1`, `1 <= bool 1`,
+	`-1^2`, `-1*2`, `-1+2`, `-1^-2`, `+1 + -2 * 1`, `1 + 2/(3*1)`, `1 < bool 2 - 1 * 2`, `2^3^2`, `1 atan2 2`,
+	// Unary and binary operations on vectors
+	`-some_metric`, `+some_metric`, `- some_metric`,
+	`foo * bar`, `foo * sum`, `foo == 1`, `foo == bool 1`, `2.5 / bar`, `foo and bar`, `foo or bar`, `foo unless bar`,
+	`foo + bar or bla and blub`, `foo and bar unless baz or qux`, `bar + on(foo) bla / on(baz, buz) group_right(test) blub`,
+	`foo * on(test,blub) bar`, `foo AND ON(test) bar`, `foo == BOOL 1`, `foo * IGNORING(a) GROUP_LEFT(b) bar`, `foo * on(test,blub) group_left bar`, `foo and on(test,blub) bar`, `foo and on() bar`,
+	`foo and ignoring(test,blub) bar`, `foo and ignoring() bar`, `foo unless on(bar) baz`,
+	`foo / on(test,blub) group_left(bar) bar`, `foo / ignoring(test,blub) group_left(blub) bar`,
+	`foo - on(test,blub) group_right(bar,foo) bar`, `foo - ignoring(test,blub) group_right(bar,foo) bar`,
+	`foo atan2 bar`, `foo == on() group_left() bar`,
+	// Vector selectors
+	`foo`, `min`, `foo offset 5m`, `foo offset -7m`, `foo OFFSET 1h30m`, `foo OFFSET 1m30ms`, `foo @ 1603774568`,
+	`foo @ -100`, `foo @ .3`, `foo @ 3.`, `foo @ 3.33`, `foo @ 3.3333`, `foo @ 3.33335`, `foo @ 3e2`, `foo @ 3e-1`,
+	`foo @ 0xA`, `foo @ -3.3e1`, `foo @ start()`, `foo @ end()`, `foo @ START()`, `foo @ 10 offset 5m`, `foo offset 5m @ 10`,
+	`foo:bar{a="bc"}`, `foo{NaN='bc'}`, `foo{bar='}'}`, `foo{a="b", foo!="bar", test=~"test", bar!~"baz"}`,
+	`foo{a="b", foo!="bar", test=~"test", bar!~"baz",}`, `{__name__=~"foo.+"}`, `{__name__="foo"}`,
+	`{"foo"}`, `{"foo", a="b"}`, `{"foo.bar"}`, `foo{"a.b"="c"}`, `{x=".+"}`, `{x!=""}`,
+	// The label_matchers rule of the Prometheus grammar allows "{}" after a
+	// metric name; only a selector without a metric name needs a matcher
+	`foo{}`, `foo{}[5m]`, `sum(foo{})`,
+	// Matrix selectors
+	`test[5s]`, `test[5m]`, `test[5m30s]`, `test[5h] OFFSET 5m`, `test[5d] OFFSET 10s`, `test[5w] offset 2w`,
+	`test{a="b"}[5y] OFFSET 3d`, `test{a="b"}[5y] @ 1603774699`, `foo[3ms] @ 2.345`, `foo[4s180ms] @ 2.345`,
+	`foo[1m] @ start()`, `test[1000ms]`, `test[1001ms]`, `test[1m:]`,
+	// Aggregations
+	`sum by (foo)(some_metric)`, `avg by (foo)(some_metric)`, `max by (foo)(some_metric)`, `sum without (foo) (some_metric)`,
+	`sum (some_metric) without (foo)`, `stddev(some_metric)`, `stdvar by (foo)(some_metric)`, `sum by ()(some_metric)`,
+	`sum by (foo,bar,)(some_metric)`, `sum by (foo,)(some_metric)`, `topk(5, some_metric)`, `MIN (some_metric) BY (foo)`,
+	`count_values("value", some_metric)`, `sum without(and, by, avg, count, alert, annotations)(some_metric)`,
+	`sum by ("foo")({"some.metric"})`, `quantile(0.5, foo)`, `bottomk(1, foo) by (job)`, `group(foo)`, `count(foo)`,
+	`min(foo)`, `max by (job) (foo)`, `avg(foo) without (instance)`,
+	// Functions
+	`time()`, `floor(some_metric{foo!="bar"})`, `rate(some_metric[5m])`, `round(some_metric)`, `round(some_metric, 5)`,
+	`label_replace(up, "x", "$1", "job", "(.*)")`, `label_join(up, "x", ",", "a", "b")`, `histogram_quantile(0.9, rate(foo_bucket[5m]))`,
+	`absent(nonexistent{job="myjob"})`, `absent_over_time(nonexistent{job="myjob"}[1h])`, `vector(1)`, `scalar(foo)`,
+	`predict_linear(foo[5m], 3600)`, `clamp(foo, 0, 1)`, `sort_desc(foo)`, `timestamp(foo)`, `day_of_week()`, `sgn(foo)`,
+	`changes(foo[1h])`, `increase(foo[1h])`, `deriv(foo[5m])`, `holt_winters(foo[5m], 0.5, 0.5)`,
+	// Subqueries
+	`foo{bar="baz"}[10m:6s]`, `foo{bar="baz"}[10m5s:1h6ms]`, `foo[10m:]`, `min_over_time(rate(foo{bar="baz"}[2s])[5m:5s])`,
+	`min_over_time(rate(foo{bar="baz"}[2s])[5m:])[4m:3s]`, `min_over_time(rate(foo{bar="baz"}[2s])[5m:] offset 4m)[4m:3s]`,
+	`min_over_time(rate(foo{bar="baz"}[2s])[5m:] @ 1603775091)[4m:3s]`, `sum without(and, by, avg, count, alert, annotations)(some_metric) [30m:10s]`,
+	`some_metric OFFSET 1m [10m:5s]`, `some_metric @ 123 [10m:5s]`, `(foo + bar{nm="val"})[5m:]`, `(foo + bar{nm="val"})[5m:] offset 10m`,
+	`(foo + bar{nm="val"} @ 1234)[5m:] @ 1603775019`, `rate(foo[5m])[1h:1m]`,
+	// Parentheses and comments
+	`(1)`, `((foo))`, `(foo + bar) * baz`, `foo # comment`, "foo\n# comment\n+ bar",
+}
+
+var invalidExprs = []struct {
+	expr string
+	err  string
+}{
+	// Parse errors
+	{``, "no expression found in input"},
+	{`# just a comment`, "no expression found in input"},
+	{`1+`, "unexpected end of input"},
+	{`.`, "unexpected character"},
+	{`2.5.`, ""},
+	{`100..4`, ""},
+	{`0deadbeef`, ""},
+	{`1 /`, "unexpected end of input"},
+	{`*1`, "unexpected"},
+	{`(1))`, "unexpected"},
+	{`((1)`, "unexpected end of input"},
+	{`(`, "unexpected end of input"},
+	{`1 and 1`, "set operator \"and\" not allowed in binary scalar expression"},
+	{`1 == 1`, "comparisons between scalars must use BOOL modifier"},
+	{`1 or 1`, "set operator \"or\" not allowed in binary scalar expression"},
+	{`1 unless 1`, "set operator \"unless\" not allowed in binary scalar expression"},
+	{`1 !~ 1`, ""},
+	{`1 =~ 1`, ""},
+	{`-"string"`, "unary expression only allowed on expressions of type scalar or instant vector"},
+	{`-test[5m]`, "unary expression only allowed on expressions of type scalar or instant vector"},
+	{`*test`, "unexpected"},
+	{`1 offset 1d`, "offset modifier must be preceded by an instant vector selector or range vector selector or a subquery"},
+	{`foo offset 1s offset 2s`, "offset may not be set multiple times"},
+	{`a - on(b) ignoring(c) d`, ""},
+	// Binary operations on vectors
+	{`foo and 1`, "set operator \"and\" not allowed in binary scalar expression"},
+	{`1 and foo`, "set operator \"and\" not allowed in binary scalar expression"},
+	{`foo or 1`, "set operator \"or\" not allowed in binary scalar expression"},
+	{`foo unless 1`, "set operator \"unless\" not allowed in binary scalar expression"},
+	{`1 or on(bar) foo`, ""},
+	{`foo == on(bar) 10`, "vector matching only allowed between instant vectors"},
+	{`foo + bool bar`, "bool modifier can only be used on comparison operators"},
+	{`foo + bool 10`, "bool modifier can only be used on comparison operators"},
+	{`foo and bool 10`, "bool modifier can only be used on comparison operators"},
+	{`foo and on(bar) group_left(baz) bar`, "no grouping allowed for \"and\" operation"},
+	{`foo and on(bar) group_right(baz) bar`, "no grouping allowed for \"and\" operation"},
+	{`foo or on(bar) group_left(baz) bar`, "no grouping allowed for \"or\" operation"},
+	{`foo unless on(bar) group_left(baz) bar`, "no grouping allowed for \"unless\" operation"},
+	{`http_requests{group="production"} + on(instance) group_left(job,instance) cpu_count{type="smp"}`, "label \"instance\" must not occur in ON and GROUP clause at once"},
+	{`foo + "bar"`, "binary expression must contain only scalar and instant vector types"},
+	{`"foo" + 1`, "binary expression must contain only scalar and instant vector types"},
+	{`foo[5m] + 1`, "binary expression must contain only scalar and instant vector types"},
+	// Vector selectors
+	{`{`, "unexpected end of input"},
+	{`}`, "unexpected"},
+	{`some{`, "unexpected end of input"},
+	{`some}`, "unexpected"},
+	{`some_metric{a=b}`, "in label matching, expected string"},
+	{`some_metric{a:b="b"}`, "invalid label name \"a:b\""},
+	{`foo{a*"b"}`, "unexpected"},
+	{`foo{a>="b"}`, "unexpected"},
+	{"some_metric{a=\"\xff\"}", "invalid UTF-8 rune"},
+	{`foo{gibberish}`, "unexpected"},
+	{`foo{1}`, "unexpected"},
+	{`{}`, "vector selector must contain at least one non-empty matcher"},
+	{`{x=""}`, "vector selector must contain at least one non-empty matcher"},
+	{`{x=~".*"}`, "vector selector must contain at least one non-empty matcher"},
+	{`{x!~".+"}`, "vector selector must contain at least one non-empty matcher"},
+	{`{x!="a"}`, "vector selector must contain at least one non-empty matcher"},
+	{`foo{__name__="bar"}`, "metric name must not be set twice: \"foo\" or \"bar\""},
+	{`foo{__name__= =}`, "unexpected"},
+	{`foo{,}`, "unexpected \",\" in label matching"},
+	{`foo{__name__ == "bar"}`, "unexpected"},
+	{`foo{__name__="bar" lol}`, "unexpected"},
+	{`{"foo", "bar"}`, "metric name must not be set twice"},
+	{`foo{a=~"("}`, "invalid regular expression"},
+	// Matrix selectors and durations
+	{`foo[5mm]`, "bad number or duration syntax"},
+	{`foo[5m1]`, "bad number or duration syntax"},
+	{`foo[5m:1m1]`, "bad number or duration syntax"},
+	{`foo[5y1hs]`, "bad number or duration syntax"},
+	{`foo[5m1h]`, "not a valid duration string"},
+	{`foo[5m1m]`, "not a valid duration string"},
+	{`foo[5m:1m1h]`, "not a valid duration string"},
+	{`foo offset 1m1h`, "not a valid duration string"},
+	{`foo["5m"]`, "unexpected"},
+	{`foo[]`, "unexpected"},
+	{`foo[1]`, ""},
+	{`some_metric[5m] OFFSET 1`, "missing unit character in duration"},
+	{`some_metric[5m] OFFSET 1mm`, "bad number or duration syntax"},
+	{`some_metric[5m] OFFSET`, "unexpected end of input"},
+	{`some_metric OFFSET 1m[5m]`, "no offset or @ modifiers allowed before range"},
+	{`some_metric @ 123 [5m]`, "no offset or @ modifiers allowed before range"},
+	{`(foo + bar)[5m]`, "ranges only allowed for vector selectors"},
+	{`foo[5m][5m]`, ""},
+	// Aggregations
+	{`sum without(==)(some_metric)`, "unexpected"},
+	{`sum without(,)(some_metric)`, "unexpected"},
+	{`sum without(foo,,)(some_metric)`, "unexpected"},
+	{`sum some_metric by (test)`, "unexpected \"some_metric\""},
+	{`sum (some_metric) by test`, "expected \"(\""},
+	{`sum () by (test)`, "wrong number of arguments for aggregate expression provided, expected 1, got 0"},
+	{`MIN keep_common (some_metric)`, "unexpected"},
+	{`MIN (some_metric) keep_common`, "unexpected"},
+	{`sum (some_metric) without (test) by (test)`, "unexpected"},
+	{`sum without (test) (some_metric) by (test)`, "unexpected"},
+	{`topk(some_metric)`, "wrong number of arguments for aggregate expression provided, expected 2, got 1"},
+	{`topk(some_metric,)`, "wrong number of arguments for aggregate expression provided, expected 2, got 1"},
+	{`topk(some_metric, other_metric)`, "expected type scalar in aggregation parameter, got instant vector"},
+	{`count_values(5, other_metric)`, "expected type string in aggregation parameter, got scalar"},
+	{`rate(some_metric[5m]) @ 1234`, "@ modifier must be preceded by an instant vector selector or range vector selector or a subquery"},
+	{`sum(foo[5m])`, "expected type instant vector in aggregation expression, got range vector"},
+	// Functions
+	{`floor()`, "expected 1 argument(s) in call to \"floor\", got 0"},
+	{`floor(some_metric, other_metric)`, "expected 1 argument(s) in call to \"floor\", got 2"},
+	{`floor(some_metric, 1)`, "expected 1 argument(s) in call to \"floor\", got 2"},
+	{`floor(1)`, "expected type instant vector in call to function \"floor\", got scalar"},
+	{`hour(some_metric, some_metric, some_metric)`, "expected 0 to 1 argument(s) in call to \"hour\", got 3"},
+	{`time(some_metric)`, "expected 0 argument(s) in call to \"time\", got 1"},
+	{`non_existent_function_far_bar()`, "unknown function with name \"non_existent_function_far_bar\""},
+	{`rate(some_metric)`, "expected type range vector in call to function \"rate\", got instant vector"},
+	{`round(some_metric, foo)`, "expected type scalar in call to function \"round\", got instant vector"},
+	{`rate(foo[5m]`, "unexpected end of input"},
+	// Subqueries
+	{`foo{bar="baz"}[`, "unexpected end of input"},
+	{`foo{bar="baz"}[10m:6s`, "unexpected end of input"},
+	{`foo{bar="baz"}[10m:6s]]`, "unexpected"},
+	{`foo{bar="baz"}[10m::6s]`, "unexpected"},
+	{`min_over_time(rate(foo{bar="baz"}[2s])[5m])`, "ranges only allowed for vector selectors"},
+	{`(foo + bar)[5m:] offset 1m offset 2m`, "offset may not be set multiple times"},
+	{`foo @ start() @ end()`, "@ <timestamp> may not be set multiple times"},
+	{`foo @ +Inf`, ""},
+	{`foo @ NaN`, ""},
+	{`foo @ "x"`, "unexpected"},
+	{`start()`, "unknown function with name \"start\""},
+	// Types
+	{`foo[5m] > 1`, "binary expression must contain only scalar and instant vector types"},
+	{`"a" == "b"`, ""},
+}
+
+func TestParseValid(t *testing.T) {
+	for _, expr := range validExprs {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("Parse(%q): %v", expr, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, tt := range invalidExprs {
+		_, err := Parse(tt.expr)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", tt.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) error = %q, want it to contain %q", tt.expr, err, tt.err)
+		}
+	}
+}
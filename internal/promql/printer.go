@@ -0,0 +1,156 @@
+package promql
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxLineLength is the length above which Prettify breaks an expression
+// over several lines, as Prometheus does.
+const maxLineLength = 100
+
+var identRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Format renders n on one line with canonical spacing and quoting.
+func Format(n Node) string {
+	switch n := n.(type) {
+	case *NumberLiteral:
+		return n.Val
+	case *StringLiteral:
+		return n.Raw
+	case *VectorSelector:
+		return formatSelector(n, "")
+	case *MatrixSelector:
+		return formatSelector(n.VectorSelector, "["+n.Range+"]")
+	case *SubqueryExpr:
+		return Format(n.Expr) + subquerySuffix(n)
+	case *Call:
+		args := make([]string, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = Format(a)
+		}
+		return n.Func.Name + "(" + strings.Join(args, ", ") + ")"
+	case *AggregateExpr:
+		s := aggregatePrefix(n) + "("
+		if n.Param != nil {
+			s += Format(n.Param) + ", "
+		}
+		return s + Format(n.Expr) + ")"
+	case *BinaryExpr:
+		return Format(n.LHS) + " " + binaryOp(n) + " " + Format(n.RHS)
+	case *UnaryExpr:
+		return n.Op + Format(n.Expr)
+	case *ParenExpr:
+		return "(" + Format(n.Expr) + ")"
+	}
+	return ""
+}
+
+// Prettify renders n like Prometheus' formatter: expressions that fit on a
+// line are kept on one line, longer ones are broken at binary operators and
+// around the arguments of aggregations and function calls, indenting each
+// level by two spaces.
+func Prettify(n Node) string {
+	return pretty(n, 0)
+}
+
+func pretty(n Node, level int) string {
+	indent := strings.Repeat("  ", level)
+	if s := Format(n); len(indent)+len(s) <= maxLineLength {
+		return indent + s
+	}
+	switch n := n.(type) {
+	case *SubqueryExpr:
+		return pretty(n.Expr, level) + subquerySuffix(n)
+	case *Call:
+		if len(n.Args) == 0 {
+			break
+		}
+		args := make([]string, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = pretty(a, level+1)
+		}
+		return indent + n.Func.Name + "(\n" + strings.Join(args, ",\n") + "\n" + indent + ")"
+	case *AggregateExpr:
+		s := indent + aggregatePrefix(n) + "(\n"
+		if n.Param != nil {
+			s += pretty(n.Param, level+1) + ",\n"
+		}
+		return s + pretty(n.Expr, level+1) + "\n" + indent + ")"
+	case *BinaryExpr:
+		return pretty(n.LHS, level+1) + "\n" + indent + binaryOp(n) + "\n" + pretty(n.RHS, level+1)
+	case *UnaryExpr:
+		return indent + n.Op + strings.TrimLeft(pretty(n.Expr, level), " ")
+	case *ParenExpr:
+		return indent + "(\n" + pretty(n.Expr, level+1) + "\n" + indent + ")"
+	}
+	return indent + Format(n)
+}
+
+func formatSelector(vs *VectorSelector, rng string) string {
+	var matchers []string
+	name := vs.Name
+	if name != "" && !identRe.MatchString(name) {
+		matchers = append(matchers, strconv.Quote(name))
+		name = ""
+	}
+	for _, m := range vs.Matchers {
+		label := m.Name
+		if !identRe.MatchString(label) || strings.Contains(label, ":") {
+			label = strconv.Quote(label)
+		}
+		matchers = append(matchers, label+m.Op+strconv.Quote(m.Value))
+	}
+	s := name
+	if len(matchers) > 0 || name == "" {
+		s += "{" + strings.Join(matchers, ", ") + "}"
+	}
+	return s + rng + modifiers(vs.At, vs.Offset)
+}
+
+func subquerySuffix(n *SubqueryExpr) string {
+	return "[" + n.Range + ":" + n.Step + "]" + modifiers(n.At, n.Offset)
+}
+
+func modifiers(at, offset string) string {
+	s := ""
+	if at != "" {
+		s += " @ " + at
+	}
+	if offset != "" {
+		s += " offset " + offset
+	}
+	return s
+}
+
+func aggregatePrefix(n *AggregateExpr) string {
+	switch {
+	case n.Without:
+		return n.Op + " without (" + strings.Join(n.Grouping, ", ") + ") "
+	case len(n.Grouping) > 0:
+		return n.Op + " by (" + strings.Join(n.Grouping, ", ") + ") "
+	}
+	return n.Op
+}
+
+func binaryOp(n *BinaryExpr) string {
+	s := n.Op
+	if n.ReturnBool {
+		s += " bool"
+	}
+	if vm := n.VectorMatching; vm != nil && vm.HasMatching {
+		if vm.On {
+			s += " on (" + strings.Join(vm.MatchingLabels, ", ") + ")"
+		} else {
+			s += " ignoring (" + strings.Join(vm.MatchingLabels, ", ") + ")"
+		}
+		if vm.Card != "" {
+			s += " " + vm.Card
+			if len(vm.Include) > 0 {
+				s += " (" + strings.Join(vm.Include, ", ") + ")"
+			}
+		}
+	}
+	return s
+}
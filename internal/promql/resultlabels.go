@@ -0,0 +1,187 @@
+package promql
+
+import "strings"
+
+// ResultLabels describes the labels of the series an expression returns, as
+// far as they are known without data. A closed set lists every label the
+// result can have; an open set may have any label except the dropped ones.
+type ResultLabels struct {
+	Closed  bool
+	Kept    map[string]bool   // every label of a closed set
+	Reason  string            // clause that closed the set, e.g. "by (job)"
+	Dropped map[string]string // labels dropped after the set was built, with the clause dropping them
+}
+
+// OpenLabels returns an open set without dropped labels: the result may
+// have any label.
+func OpenLabels() ResultLabels {
+	return ResultLabels{Dropped: map[string]string{}}
+}
+
+// ClosedLabels returns a closed set of labels.
+func ClosedLabels(reason string, labels ...string) ResultLabels {
+	r := ResultLabels{Closed: true, Kept: map[string]bool{}, Reason: reason, Dropped: map[string]string{}}
+	for _, l := range labels {
+		r.Kept[l] = true
+	}
+	return r
+}
+
+// Has reports whether the result can have label. When it cannot, reason
+// names the clause that drops it.
+func (r ResultLabels) Has(label string) (bool, string) {
+	if reason, dropped := r.Dropped[label]; dropped {
+		return false, reason
+	}
+	if r.Closed {
+		return r.Kept[label], r.Reason
+	}
+	return true, ""
+}
+
+// Add returns r with label added, as label_replace does.
+func (r ResultLabels) Add(label string) ResultLabels {
+	r = r.clone()
+	if r.Closed {
+		r.Kept[label] = true
+	}
+	delete(r.Dropped, label)
+	return r
+}
+
+// Drop returns r without the given labels, naming reason as the clause
+// dropping them.
+func (r ResultLabels) Drop(reason string, labels ...string) ResultLabels {
+	r = r.clone()
+	for _, l := range labels {
+		delete(r.Kept, l)
+		r.Dropped[l] = reason
+	}
+	return r
+}
+
+func (r ResultLabels) clone() ResultLabels {
+	c := r
+	c.Kept, c.Dropped = map[string]bool{}, map[string]string{}
+	for k := range r.Kept {
+		c.Kept[k] = true
+	}
+	for k, v := range r.Dropped {
+		c.Dropped[k] = v
+	}
+	return c
+}
+
+// OutputLabels returns the labels of the series n evaluates to.
+func OutputLabels(n Node) ResultLabels {
+	switch n := n.(type) {
+	case *VectorSelector, *MatrixSelector:
+		return OpenLabels()
+	case *SubqueryExpr:
+		return OutputLabels(n.Expr)
+	case *ParenExpr:
+		return OutputLabels(n.Expr)
+	case *UnaryExpr:
+		return OutputLabels(n.Expr)
+	case *Call:
+		return callLabels(n)
+	case *AggregateExpr:
+		switch {
+		case n.Without:
+			return OutputLabels(n.Expr).Drop("without ("+strings.Join(n.Grouping, ", ")+")", n.Grouping...)
+		case n.Op == "topk" || n.Op == "bottomk" || n.Op == "limitk" || n.Op == "limit_ratio":
+			// These return the input series unchanged.
+			return OutputLabels(n.Expr)
+		}
+		reason := n.Op
+		if len(n.Grouping) > 0 || n.HasBy {
+			reason = "by (" + strings.Join(n.Grouping, ", ") + ")"
+		}
+		r := ClosedLabels(reason, n.Grouping...)
+		if s, ok := n.Param.(*StringLiteral); ok && n.Op == "count_values" {
+			r = r.Add(s.Val)
+		}
+		return r
+	case *BinaryExpr:
+		return binaryLabels(n)
+	}
+	return ClosedLabels("")
+}
+
+func callLabels(n *Call) ResultLabels {
+	switch n.Func.Name {
+	case "label_replace", "label_join":
+		r := OutputLabels(n.Args[0])
+		if s, ok := n.Args[1].(*StringLiteral); ok {
+			r = r.Add(s.Val)
+		}
+		return r
+	case "histogram_quantile":
+		return OutputLabels(n.Args[1]).Drop("histogram_quantile", "le")
+	case "vector", "scalar":
+		return ClosedLabels(n.Func.Name + "()")
+	case "absent", "absent_over_time":
+		var labels []string
+		Inspect(n.Args[0], func(c Node) bool {
+			if vs, ok := c.(*VectorSelector); ok {
+				for _, m := range vs.Matchers {
+					if m.Op == "=" && m.Name != "__name__" {
+						labels = append(labels, m.Name)
+					}
+				}
+			}
+			return true
+		})
+		return ClosedLabels(n.Func.Name+"()", labels...)
+	}
+	for _, a := range n.Args {
+		if t := a.Type(); t == ValueTypeVector || t == ValueTypeMatrix {
+			return OutputLabels(a)
+		}
+	}
+	return ClosedLabels(n.Func.Name + "()")
+}
+
+func binaryLabels(n *BinaryExpr) ResultLabels {
+	lt, rt := n.LHS.Type(), n.RHS.Type()
+	if lt != ValueTypeVector {
+		return OutputLabels(n.RHS)
+	}
+	if rt != ValueTypeVector {
+		return OutputLabels(n.LHS)
+	}
+	lhs, rhs := OutputLabels(n.LHS), OutputLabels(n.RHS)
+	vm := n.VectorMatching
+	switch {
+	case n.Op == "or":
+		if lhs.Closed && rhs.Closed {
+			r := lhs.clone()
+			for l := range rhs.Kept {
+				r.Kept[l] = true
+			}
+			return r
+		}
+		return OpenLabels()
+	case isSetOp(n.Op) || vm == nil || !vm.HasMatching:
+		return lhs
+	case vm.Card == "group_left" || vm.Card == "group_right":
+		r := lhs
+		if vm.Card == "group_right" {
+			r = rhs
+		}
+		for _, l := range vm.Include {
+			r = r.Add(l)
+		}
+		return r
+	case vm.On:
+		clause := "on (" + strings.Join(vm.MatchingLabels, ", ") + ")"
+		var kept []string
+		for _, l := range vm.MatchingLabels {
+			if ok, _ := lhs.Has(l); ok {
+				kept = append(kept, l)
+			}
+		}
+		return ClosedLabels(clause, kept...)
+	}
+	return lhs.Drop("ignoring ("+strings.Join(vm.MatchingLabels, ", ")+")", vm.MatchingLabels...)
+}
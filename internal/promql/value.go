@@ -0,0 +1,239 @@
+package promql
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label is a label name and value.
+type Label struct {
+	Name, Value string
+}
+
+// Labels is a label set sorted by name.
+type Labels []Label
+
+// MetricName is the label holding a series' metric name.
+const MetricName = "__name__"
+
+// LabelsFromMap returns the sorted label set of m, dropping empty values.
+func LabelsFromMap(m map[string]string) Labels {
+	ls := make(Labels, 0, len(m))
+	for k, v := range m {
+		if v != "" {
+			ls = append(ls, Label{k, v})
+		}
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+	return ls
+}
+
+// Map returns the labels as a map.
+func (ls Labels) Map() map[string]string {
+	m := make(map[string]string, len(ls))
+	for _, l := range ls {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+// Get returns the value of the label name, or "".
+func (ls Labels) Get(name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// With returns a copy of ls with name set to value; an empty value removes
+// the label.
+func (ls Labels) With(name, value string) Labels {
+	m := ls.Map()
+	m[name] = value
+	return LabelsFromMap(m)
+}
+
+// Without returns a copy of ls without the given labels.
+func (ls Labels) Without(names ...string) Labels {
+	out := make(Labels, 0, len(ls))
+	for _, l := range ls {
+		if !contains(names, l.Name) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// Only returns a copy of ls with only the given labels.
+func (ls Labels) Only(names ...string) Labels {
+	out := make(Labels, 0, len(names))
+	for _, l := range ls {
+		if contains(names, l.Name) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// String formats the labels the way Prometheus does: name{a="b", c="d"}.
+func (ls Labels) String() string {
+	var b strings.Builder
+	name := ls.Get(MetricName)
+	b.WriteString(name)
+	rest := ls.Without(MetricName)
+	if len(rest) == 0 && name != "" {
+		return b.String()
+	}
+	b.WriteByte('{')
+	for i, l := range rest {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Point is a sample value at a timestamp in milliseconds.
+type Point struct {
+	T int64
+	V float64
+}
+
+// Sample is a point of an instant vector.
+type Sample struct {
+	Metric Labels
+	Point
+}
+
+// Series is a labelled list of points.
+type Series struct {
+	Metric Labels
+	Points []Point
+}
+
+// Value is the result of evaluating an expression: Vector, Matrix, Scalar
+// or String.
+type Value interface {
+	Type() ValueType
+}
+
+// Vector is an instant vector.
+type Vector []Sample
+
+// Matrix is a range vector.
+type Matrix []Series
+
+// Scalar is a scalar value.
+type Scalar Point
+
+// String is a string value.
+type String struct {
+	T int64
+	V string
+}
+
+func (Vector) Type() ValueType { return ValueTypeVector }
+func (Matrix) Type() ValueType { return ValueTypeMatrix }
+func (Scalar) Type() ValueType { return ValueTypeScalar }
+func (String) Type() ValueType { return ValueTypeString }
+
+// staleNaN marks the end of a series, like Prometheus' staleness markers.
+const staleNaN uint64 = 0x7ff0000000000002
+
+// StaleMarker returns the value that marks a series as stale.
+func StaleMarker() float64 { return math.Float64frombits(staleNaN) }
+
+// IsStaleMarker reports whether v is a staleness marker.
+func IsStaleMarker(v float64) bool { return math.Float64bits(v) == staleNaN }
+
+// Storage is an in-memory series store for evaluating expressions without
+// a Prometheus or Mimir server.
+type Storage struct {
+	series map[string]*Series
+	order  []string
+}
+
+// NewStorage returns an empty storage.
+func NewStorage() *Storage {
+	return &Storage{series: map[string]*Series{}}
+}
+
+// Add appends a point to the series with the given labels. Points must be
+// added in time order per series.
+func (s *Storage) Add(metric Labels, t int64, v float64) {
+	key := metric.String()
+	ser, ok := s.series[key]
+	if !ok {
+		ser = &Series{Metric: metric}
+		s.series[key] = ser
+		s.order = append(s.order, key)
+	}
+	if n := len(ser.Points); n > 0 && ser.Points[n-1].T == t {
+		ser.Points[n-1].V = v
+		return
+	}
+	ser.Points = append(ser.Points, Point{T: t, V: v})
+}
+
+// Select returns the series matching all matchers.
+func (s *Storage) Select(matchers []*LabelMatcher) ([]*Series, error) {
+	type compiled struct {
+		m  *LabelMatcher
+		re *regexp.Regexp
+	}
+	var cms []compiled
+	for _, m := range matchers {
+		c := compiled{m: m}
+		if m.Op == "=~" || m.Op == "!~" {
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			c.re = re
+		}
+		cms = append(cms, c)
+	}
+	var out []*Series
+	for _, key := range s.order {
+		ser := s.series[key]
+		ok := true
+		for _, c := range cms {
+			v := ser.Metric.Get(c.m.Name)
+			switch c.m.Op {
+			case "=":
+				ok = v == c.m.Value
+			case "!=":
+				ok = v != c.m.Value
+			case "=~":
+				ok = c.re.MatchString(v)
+			case "!~":
+				ok = !c.re.MatchString(v)
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			out = append(out, ser)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,174 @@
+package rules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+const (
+	// PrometheusRuleAPIVersion is the apiVersion of generated PrometheusRule
+	// manifests.
+	PrometheusRuleAPIVersion = "monitoring.coreos.com/v1"
+
+	// NamespaceAnnotation on a PrometheusRule names the ruler namespace of
+	// its groups, overriding the namespace format.
+	NamespaceAnnotation = "mal-sync/namespace"
+
+	// DefaultNamespaceFormat derives the ruler namespace of a
+	// PrometheusRule from its Kubernetes namespace and name.
+	DefaultNamespaceFormat = "{namespace}-{name}"
+)
+
+// Manifest identifies the PrometheusRule object a File was read from.
+type Manifest struct {
+	Namespace  string // metadata.namespace; "default" when unset
+	Name       string // metadata.name
+	Annotation string // value of NamespaceAnnotation, if set
+}
+
+// IsPrometheusRule reports whether doc is a Prometheus Operator
+// PrometheusRule manifest.
+func IsPrometheusRule(doc *yamlnode.Node) bool {
+	return doc.Get("kind").Text() == "PrometheusRule" &&
+		strings.HasPrefix(doc.Get("apiVersion").Text(), "monitoring.coreos.com/")
+}
+
+// IsManifest reports whether doc is a Kubernetes object, which rule files
+// never are.
+func IsManifest(doc *yamlnode.Node) bool {
+	return doc.Get("apiVersion") != nil && doc.Get("kind") != nil
+}
+
+// fromManifest returns the plain rule file document of a PrometheusRule:
+// its spec.groups under the namespace the default format derives. The
+// groups are shared with the manifest, so positions stay those of the
+// manifest file.
+func fromManifest(path string, doc *yamlnode.Node) (*yamlnode.Node, *Manifest, error) {
+	meta := doc.Get("metadata")
+	m := &Manifest{
+		Namespace:  meta.Get("namespace").Text(),
+		Name:       meta.Get("name").Text(),
+		Annotation: meta.Get("annotations").Get(NamespaceAnnotation).Text(),
+	}
+	if m.Name == "" {
+		return nil, nil, fmt.Errorf("%s:%d: PrometheusRule has no metadata.name", path, doc.Line)
+	}
+	if m.Namespace == "" {
+		m.Namespace = "default"
+	}
+	spec := doc.Get("spec")
+	if spec != nil && !spec.IsNull() && spec.Resolve().Kind != yamlnode.MappingNode {
+		return nil, nil, fmt.Errorf("%s:%d: spec of PrometheusRule %s must be a mapping", path, spec.Line, m.Name)
+	}
+	groups := spec.Get("groups")
+	if groups == nil {
+		groups = yamlnode.NewSequence()
+	}
+	rf := yamlnode.NewMapping()
+	rf.Line, rf.Column = doc.Line, doc.Column
+	rf.Set("namespace", yamlnode.NewString(m.ruleNamespace(DefaultNamespaceFormat)))
+	rf.Set("groups", groups)
+	return rf, m, nil
+}
+
+// ruleNamespace returns the ruler namespace of the manifest: the value of
+// NamespaceAnnotation, or format with {namespace} and {name} replaced.
+func (m *Manifest) ruleNamespace(format string) string {
+	if m.Annotation != "" {
+		return m.Annotation
+	}
+	return FormatNamespace(format, m.Namespace, m.Name)
+}
+
+// FormatNamespace returns format with {namespace} and {name} replaced by
+// the namespace and name of a Kubernetes object.
+func FormatNamespace(format, namespace, name string) string {
+	return strings.NewReplacer("{namespace}", namespace, "{name}", name).Replace(format)
+}
+
+// ApplyNamespaceFormat derives the namespace of every file read from a
+// PrometheusRule with format, in which {namespace} and {name} stand for
+// the object's metadata. Objects annotated with NamespaceAnnotation keep
+// that namespace.
+func ApplyNamespaceFormat(files []*File, format string) error {
+	if !strings.Contains(format, "{namespace}") && !strings.Contains(format, "{name}") {
+		return fmt.Errorf("namespace format %q must contain {namespace} or {name}", format)
+	}
+	for _, f := range files {
+		if f.Manifest == nil {
+			continue
+		}
+		f.Namespace = f.Manifest.ruleNamespace(format)
+		f.Doc.Set("namespace", yamlnode.NewString(f.Namespace))
+	}
+	return nil
+}
+
+// StagedName returns the file name the staged copy of f gets: the base name
+// of its path, with the object's namespace and name added for files read
+// from a PrometheusRule so objects of one manifest do not collide, and
+// .yaml added for JSON files so a.json and a.yaml do not.
+func StagedName(f *File) string {
+	base := filepath.Base(f.Path)
+	if f.Manifest == nil {
+		if IsJSONFile(base) {
+			return base + ".yaml"
+		}
+		return base
+	}
+	return TrimRuleExt(base) + "_" + f.Manifest.Namespace + "_" + f.Manifest.Name + ".yaml"
+}
+
+var dnsLabelInvalidRe = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// ObjectName turns s, such as a rule file name or namespace, into a valid
+// Kubernetes object name.
+func ObjectName(s string) string {
+	s = dnsLabelInvalidRe.ReplaceAllString(strings.ToLower(s), "-")
+	s = strings.Trim(s, "-")
+	if len(s) > 253 {
+		s = strings.TrimRight(s[:253], "-")
+	}
+	if s == "" {
+		return "rules"
+	}
+	return s
+}
+
+// ToPrometheusRule returns a PrometheusRule manifest holding the groups of
+// a plain rule file. The file's namespace, if any, is kept in
+// NamespaceAnnotation so converting back restores it. k8sNamespace may be
+// empty to leave metadata.namespace unset.
+func ToPrometheusRule(f *File, name, k8sNamespace string) *yamlnode.Node {
+	doc := yamlnode.NewMapping()
+	doc.HeadComment = f.Doc.HeadComment
+	if doc.HeadComment == "" && len(f.Doc.Content) > 0 {
+		// The comment at the top of a file belongs to its first key
+		doc.HeadComment = f.Doc.Content[0].HeadComment
+	}
+	doc.Set("apiVersion", yamlnode.NewString(PrometheusRuleAPIVersion))
+	doc.Set("kind", yamlnode.NewString("PrometheusRule"))
+	meta := yamlnode.NewMapping()
+	meta.Set("name", yamlnode.NewString(name))
+	if k8sNamespace != "" {
+		meta.Set("namespace", yamlnode.NewString(k8sNamespace))
+	}
+	if f.Namespace != "" {
+		annotations := yamlnode.NewMapping()
+		annotations.Set(NamespaceAnnotation, yamlnode.NewString(f.Namespace))
+		meta.Set("annotations", annotations)
+	}
+	doc.Set("metadata", meta)
+	spec := yamlnode.NewMapping()
+	groups := f.Doc.Get("groups")
+	if groups == nil {
+		groups = yamlnode.NewSequence()
+	}
+	spec.Set("groups", groups)
+	doc.Set("spec", spec)
+	return doc
+}
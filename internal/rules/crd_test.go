@@ -0,0 +1,159 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+const manifests = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+---
+apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: api
+  namespace: prod
+spec:
+  groups:
+    - name: api
+      rules:
+        - alert: ApiDown
+          expr: up == 0
+---
+apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: nodes
+spec:
+  groups:
+    - name: nodes
+      rules:
+        - record: job:up:sum
+          expr: sum(up)
+---
+apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: pinned
+  namespace: prod
+  annotations:
+    mal-sync/namespace: team-a
+spec: {}
+`
+
+// describe returns "namespace path groups" for each file.
+func describe(files []*File) []string {
+	var out []string
+	for _, f := range files {
+		var groups []string
+		for _, g := range f.Groups {
+			groups = append(groups, g.Name)
+		}
+		out = append(out, f.Namespace+" "+StagedName(f)+" ["+strings.Join(groups, ",")+"]")
+	}
+	return out
+}
+
+func TestParseManifest(t *testing.T) {
+	files, err := Parse("k8s/rules.yaml", []byte(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"prod-api rules_prod_api.yaml [api]",
+		"default-nodes rules_default_nodes.yaml [nodes]",
+		"team-a rules_prod_pinned.yaml []",
+	}
+	if got := describe(files); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("files:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// Positions are those of the manifest
+	if pos := files[0].Groups[0].Rules[0].Pos(); pos != "k8s/rules.yaml:15" {
+		t.Errorf("rule position = %s, want k8s/rules.yaml:15", pos)
+	}
+
+	if err := ApplyNamespaceFormat(files, "k8s-{namespace}/{name}"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"k8s-prod/api rules_prod_api.yaml [api]",
+		"k8s-default/nodes rules_default_nodes.yaml [nodes]",
+		"team-a rules_prod_pinned.yaml []",
+	}
+	if got := describe(files); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("files with a namespace format:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if ns := files[0].Doc.Get("namespace").Text(); ns != "k8s-prod/api" {
+		t.Errorf("staged namespace = %q", ns)
+	}
+	if err := ApplyNamespaceFormat(files, "static"); err == nil || err.Error() != `namespace format "static" must contain {namespace} or {name}` {
+		t.Errorf("ApplyNamespaceFormat without placeholders error = %v", err)
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     string
+	}{
+		{"apiVersion: monitoring.coreos.com/v1\nkind: PrometheusRule\nmetadata: {}\n", "m.yaml:1: PrometheusRule has no metadata.name"},
+		{"apiVersion: monitoring.coreos.com/v1\nkind: PrometheusRule\nmetadata:\n  name: x\nspec: [a]\n", "m.yaml:5: spec of PrometheusRule x must be a mapping"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse("m.yaml", []byte(tt.manifest)); err == nil || err.Error() != tt.want {
+			t.Errorf("Parse error = %v, want %s", err, tt.want)
+		}
+	}
+
+	// Kubernetes objects other than PrometheusRules hold no rules
+	files, err := Parse("m.yaml", []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: x\n"))
+	if err != nil || len(files) != 0 {
+		t.Errorf("Parse of a ConfigMap = %v, %v", describe(files), err)
+	}
+}
+
+func TestToPrometheusRule(t *testing.T) {
+	files, err := Parse("team rules.yaml", []byte("# Team rules\nnamespace: team\ngroups:\n  - name: g\n    rules:\n      - alert: A\n        expr: up == 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := ObjectName("Team Rules_v2")
+	want := `# Team rules
+apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: team-rules-v2
+  namespace: monitoring
+  annotations:
+    mal-sync/namespace: team
+spec:
+  groups:
+    - name: g
+      rules:
+        - alert: A
+          expr: up == 0
+`
+	out := ToPrometheusRule(files[0], name, "monitoring")
+	if got := string(yamlnode.Encode(out)); got != want {
+		t.Errorf("ToPrometheusRule =\n%s\nwant\n%s", got, want)
+	}
+
+	// Converting back restores the namespace
+	back, err := Parse("crd.yaml", yamlnode.Encode(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describe(back); len(got) != 1 || got[0] != "team crd_monitoring_team-rules-v2.yaml [g]" {
+		t.Errorf("converted back = %v", got)
+	}
+
+	for in, want := range map[string]string{"a.b": "a-b", "--": "rules", strings.Repeat("a", 300): strings.Repeat("a", 253)} {
+		if got := ObjectName(in); got != want {
+			t.Errorf("ObjectName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
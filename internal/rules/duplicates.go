@@ -0,0 +1,124 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// CheckDuplicates finds definitions that clash once all files are uploaded
+// to one tenant. A group name used twice in a namespace makes the ruler
+// keep only one of the groups. Two recording rules writing the same series
+// (name and static labels) produce conflicting samples, and two alerts with
+// the same name and static labels send duplicate notifications, in
+// whichever groups or namespaces of the tenant they are. These are errors.
+// An alert repeating the name and expression of another with different
+// labels is usually a copy that drifted and is reported as a warning. Each
+// violation is reported at the later definition and names the earlier one.
+func CheckDuplicates(files []*File) []Violation {
+	var violations []Violation
+	groups := map[string]*Group{}
+	identities := map[string]*Rule{}
+	alertExprs := map[string]*Rule{}
+	for _, f := range files {
+		for _, g := range f.Groups {
+			key := f.Namespace + "\x00" + g.Name
+			if first, ok := groups[key]; ok {
+				violations = append(violations, Violation{
+					Severity: SeverityError,
+					Pos:      g.Pos(),
+					Group:    g.Name,
+					Message:  fmt.Sprintf("duplicate group %q in namespace %q, first defined at %s", g.Name, f.Namespace, first.Pos()),
+				})
+			} else {
+				groups[key] = g
+			}
+			for _, r := range g.Rules {
+				if r.Name() == "" {
+					continue
+				}
+				kind := "recording rule output"
+				if r.IsAlert() {
+					kind = "alert"
+				}
+				id := ruleIdentity(r)
+				if first, ok := identities[kind+"\x00"+id]; ok {
+					violations = append(violations, Violation{
+						Severity: SeverityError,
+						Pos:      r.Pos(),
+						Group:    g.Name,
+						Rule:     r.Name(),
+						Message:  fmt.Sprintf("duplicate %s %s, first defined at %s (%s)", kind, id, first.Pos(), where(first, r)),
+					})
+					continue
+				}
+				identities[kind+"\x00"+id] = r
+				if !r.IsAlert() {
+					continue
+				}
+				expr := r.Alert + "\x00" + r.Expr
+				if first, ok := alertExprs[expr]; ok {
+					violations = append(violations, Violation{
+						Severity: SeverityWarning,
+						Pos:      r.Pos(),
+						Group:    g.Name,
+						Rule:     r.Name(),
+						Message:  fmt.Sprintf("alert %s repeats the expression of %s at %s with different labels (%s)", id, ruleIdentity(first), first.Pos(), where(first, r)),
+					})
+				} else {
+					alertExprs[expr] = r
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// where describes where the earlier rule e is relative to r.
+func where(e, r *Rule) string {
+	switch {
+	case e.Group.File.Namespace != r.Group.File.Namespace:
+		return fmt.Sprintf("group %s in namespace %q", e.Group.Name, e.Group.File.Namespace)
+	case e.Group.Name != r.Group.Name:
+		return "group " + e.Group.Name
+	}
+	return "same group"
+}
+
+// ruleIdentity is the rule name with its static labels, e.g.
+// ApiDown{severity="critical"}.
+func ruleIdentity(r *Rule) string {
+	if len(r.Labels) == 0 {
+		return r.Name()
+	}
+	keys := make([]string, 0, len(r.Labels))
+	for k := range r.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", k, r.Labels[k])
+	}
+	return r.Name() + "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// ValidateDuplicates logs every duplicate definition in files and fails if
+// any of them is an error.
+func ValidateDuplicates(files []*File) error {
+	log.Printf("Checking %d rule file(s) for duplicate groups and rules", len(files))
+	errs, warnings := 0, 0
+	for _, v := range CheckDuplicates(files) {
+		log.Print(v)
+		if v.Severity == SeverityError {
+			errs++
+		} else {
+			warnings++
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("found %d duplicate group(s) or rule(s) and %d warning(s)", errs, warnings)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func parseFiles(t *testing.T, docs map[string]string) []*File {
+	t.Helper()
+	var files []*File
+	for _, name := range []string{"a.yaml", "b.yaml"} {
+		if docs[name] == "" {
+			continue
+		}
+		parsed, err := Parse(name, []byte(docs[name]))
+		if err != nil {
+			t.Fatalf("parse %s: %v", name, err)
+		}
+		files = append(files, parsed...)
+	}
+	return files
+}
+
+func TestCheckDuplicates(t *testing.T) {
+	const api = `groups:
+  - name: api
+    rules:
+      - alert: ApiDown
+        expr: up{job="api"} == 0
+        labels:
+          severity: critical
+      - record: job:requests:rate5m
+        expr: sum by (job) (rate(requests_total[5m]))
+`
+	tests := []struct {
+		name string
+		a, b string
+		want []string // "severity: message fragment", in order
+	}{
+		{
+			name: "no duplicates",
+			a:    api,
+			b:    "groups:\n  - name: other\n    rules:\n      - alert: ApiSlow\n        expr: vector(1)\n",
+		},
+		{
+			name: "group in the same namespace",
+			a:    api,
+			b:    "groups:\n  - name: api\n    rules: []\n",
+			want: []string{`error: duplicate group "api" in namespace "", first defined at a.yaml:2`},
+		},
+		{
+			name: "group in another namespace",
+			a:    api,
+			b:    "namespace: other\ngroups:\n  - name: api\n    rules:\n      - alert: ApiSlow\n        expr: vector(1)\n",
+		},
+		{
+			name: "alert repeated within a group",
+			a: `groups:
+  - name: api
+    rules:
+      - alert: ApiDown
+        expr: up == 0
+      - alert: ApiDown
+        expr: up == 0
+`,
+			want: []string{"error: duplicate alert ApiDown, first defined at a.yaml:4 (same group)"},
+		},
+		{
+			name: "alert with another expression in the same group",
+			a: `groups:
+  - name: api
+    rules:
+      - alert: ApiDown
+        expr: up == 0
+      - alert: ApiDown
+        expr: absent(up)
+`,
+			want: []string{"error: duplicate alert ApiDown, first defined at a.yaml:4 (same group)"},
+		},
+		{
+			name: "recording rule repeated within a group",
+			a: `groups:
+  - name: api
+    rules:
+      - record: job:up
+        expr: sum by (job) (up)
+      - record: job:up
+        expr: count by (job) (up)
+`,
+			want: []string{"error: duplicate recording rule output job:up, first defined at a.yaml:4 (same group)"},
+		},
+		{
+			name: "rules in another group",
+			a:    api,
+			b: `groups:
+  - name: copy
+    rules:
+      - alert: ApiDown
+        expr: up{job="api"} == 0
+        labels:
+          severity: critical
+      - record: job:requests:rate5m
+        expr: sum by (job) (rate(requests_total[5m]))
+`,
+			want: []string{
+				`error: duplicate alert ApiDown{severity="critical"}, first defined at a.yaml:4 (group api)`,
+				"error: duplicate recording rule output job:requests:rate5m, first defined at a.yaml:8 (group api)",
+			},
+		},
+		{
+			name: "recording rule in another namespace",
+			a:    api,
+			b:    "namespace: other\ngroups:\n  - name: api\n    rules:\n      - record: job:requests:rate5m\n        expr: vector(1)\n",
+			want: []string{`error: duplicate recording rule output job:requests:rate5m, first defined at a.yaml:8 (group api in namespace "")`},
+		},
+		{
+			name: "alert in another namespace with another expression",
+			a:    api,
+			b:    "namespace: other\ngroups:\n  - name: api\n    rules:\n      - alert: ApiDown\n        expr: absent(up{job=\"api\"})\n        labels:\n          severity: critical\n",
+			want: []string{`error: duplicate alert ApiDown{severity="critical"}, first defined at a.yaml:4 (group api in namespace "")`},
+		},
+		{
+			name: "recording rules with different labels",
+			a:    api,
+			b:    "groups:\n  - name: copy\n    rules:\n      - record: job:requests:rate5m\n        expr: vector(1)\n        labels:\n          source: copy\n",
+		},
+		{
+			name: "alerts with different labels and expressions",
+			a:    api,
+			b:    "groups:\n  - name: copy\n    rules:\n      - alert: ApiDown\n        expr: up == 0\n        labels:\n          severity: warning\n",
+		},
+		{
+			name: "alerts with different labels and the same expression",
+			a:    api,
+			b:    "namespace: other\ngroups:\n  - name: copy\n    rules:\n      - alert: ApiDown\n        expr: up{job=\"api\"} == 0\n        labels:\n          severity: warning\n",
+			want: []string{`warning: alert ApiDown{severity="warning"} repeats the expression of ApiDown{severity="critical"} at a.yaml:4 with different labels (group api in namespace "")`},
+		},
+		{
+			name: "repeated in several groups",
+			a:    "groups:\n  - name: one\n    rules:\n      - alert: A\n        expr: vector(1)\n  - name: two\n    rules:\n      - alert: A\n        expr: vector(1)\n      - alert: A\n        expr: vector(1)\n",
+			want: []string{
+				"error: duplicate alert A, first defined at a.yaml:4 (group one)",
+				"error: duplicate alert A, first defined at a.yaml:4 (group one)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := CheckDuplicates(parseFiles(t, map[string]string{"a.yaml": tt.a, "b.yaml": tt.b}))
+			var got []string
+			for _, v := range violations {
+				got = append(got, string(v.Severity)+": "+v.Message)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("violations:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateDuplicates(t *testing.T) {
+	drifted := parseFiles(t, map[string]string{
+		"a.yaml": "groups:\n  - name: one\n    rules:\n      - alert: A\n        expr: vector(1)\n        labels: {severity: critical}\n",
+		"b.yaml": "groups:\n  - name: two\n    rules:\n      - alert: A\n        expr: vector(1)\n        labels: {severity: warning}\n",
+	})
+	if err := ValidateDuplicates(drifted); err != nil {
+		t.Errorf("alert copied with other labels: %v", err)
+	}
+	copied := parseFiles(t, map[string]string{
+		"a.yaml": "groups:\n  - name: one\n    rules:\n      - alert: A\n        expr: vector(1)\n",
+		"b.yaml": "namespace: other\ngroups:\n  - name: two\n    rules:\n      - record: a:b:c\n        expr: vector(1)\n      - alert: A\n        expr: vector(2)\n",
+	})
+	if err := ValidateDuplicates(copied); err == nil || !strings.Contains(err.Error(), "found 1 duplicate group(s) or rule(s) and 0 warning(s)") {
+		t.Errorf("alert copied to another namespace: error = %v", err)
+	}
+	overwritten := parseFiles(t, map[string]string{
+		"a.yaml": "groups:\n  - name: one\n    rules:\n      - alert: A\n        expr: vector(1)\n",
+		"b.yaml": "groups:\n  - name: one\n    rules:\n      - alert: B\n        expr: vector(1)\n",
+	})
+	if err := ValidateDuplicates(overwritten); err == nil || !strings.Contains(err.Error(), "found 1 duplicate group(s) or rule(s) and 0 warning(s)") {
+		t.Errorf("group defined twice: error = %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+package rules
+
+import (
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+)
+
+// ParseDuration parses a Prometheus duration such as "5m", "1h30m" or "2d".
+// Unlike time.ParseDuration it accepts the d, w and y units and rejects
+// fractional values, matching what rule files accept.
+func ParseDuration(s string) (time.Duration, error) {
+	return promql.ParseDuration(s)
+}
@@ -0,0 +1,181 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// ParseFunc parses a rule expression. Errors of type *promql.Error are
+// reported at the offending column; other errors at the start of the
+// expression.
+type ParseFunc func(expr string) error
+
+// CheckExprs parses the expression of every rule in files and returns a
+// violation for each rule that is malformed or whose expression does not
+// parse. Positions are "file:line:col" in the original files.
+func CheckExprs(files []*File, parse ParseFunc) []Violation {
+	var violations []Violation
+	for _, f := range files {
+		for _, g := range f.Groups {
+			for _, r := range g.Rules {
+				add := func(pos, msg string) {
+					violations = append(violations, Violation{Severity: SeverityError, Pos: pos, Group: g.Name, Rule: r.Name(), Message: msg})
+				}
+				switch {
+				case r.Alert != "" && r.Record != "":
+					add(r.Pos(), "rule must set either alert or record, not both")
+				case r.Alert == "" && r.Record == "":
+					add(r.Pos(), "rule must set alert or record")
+				}
+				if strings.TrimSpace(r.Expr) == "" {
+					add(r.Pos(), "rule has no expr")
+					continue
+				}
+				err := parse(r.Expr)
+				if err == nil {
+					continue
+				}
+				offset, msg := 0, err.Error()
+				var perr *promql.Error
+				if errors.As(err, &perr) {
+					offset, msg = perr.Pos, perr.Msg
+				}
+				line, col := ExprPosition(r, offset)
+				add(fmt.Sprintf("%s:%d:%d", f.Path, line, col), msg)
+			}
+		}
+	}
+	return violations
+}
+
+// ValidateExprs logs every expression error in files and fails if there
+// are any, so all broken rules are reported in one run. lang names the
+// query language in log messages.
+func ValidateExprs(lang string, files []*File, parse ParseFunc) error {
+	count := 0
+	for _, f := range files {
+		for _, g := range f.Groups {
+			count += len(g.Rules)
+		}
+	}
+	log.Printf("Validating %s expressions of %d rule(s)", lang, count)
+	violations := CheckExprs(files, parse)
+	for _, v := range violations {
+		log.Print(v)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("found %d invalid rule(s)", len(violations))
+	}
+	log.Printf("All %s expressions are valid", lang)
+	return nil
+}
+
+// ExprPosition maps a byte offset in r.Expr to the line and column of the
+// rule file it was read from. The value and the source are walked side by
+// side: escapes and doubled quotes take several source bytes per value
+// byte, and runs of whitespace (folded lines, block indentation) are
+// matched as a whole.
+func ExprPosition(r *Rule, offset int) (int, int) {
+	n := r.ExprNode().Resolve()
+	lines := r.Group.File.Lines
+	if n == nil || n.Line == 0 || n.Line > len(lines) {
+		return r.Node.Line, r.Node.Column
+	}
+	line, col := n.Line, n.Column
+	switch n.Style {
+	case yamlnode.SingleQuotedStyle, yamlnode.DoubleQuotedStyle:
+		col++
+	case yamlnode.LiteralStyle, yamlnode.FoldedStyle:
+		line, col = line+1, 1
+	}
+	if line > len(lines) {
+		return n.Line, n.Column
+	}
+
+	// src is the rest of the file from the start of the value.
+	var b strings.Builder
+	b.WriteString(lines[line-1][min(col-1, len(lines[line-1])):])
+	for _, l := range lines[line:] {
+		b.WriteByte('\n')
+		b.WriteString(l)
+	}
+	src := b.String()
+	value := r.Expr
+
+	si, vi := 0, 0
+	// skipIndent skips indentation and double-quoted line continuations,
+	// which have no counterpart in the value.
+	skipIndent := func() {
+		for si < len(src) {
+			if isSpace(src[si]) {
+				si++
+			} else if n.Style == yamlnode.DoubleQuotedStyle && src[si] == '\\' && si+1 < len(src) && src[si+1] == '\n' {
+				si += 2
+			} else {
+				break
+			}
+		}
+	}
+	for vi < offset && vi < len(value) && si < len(src) {
+		if isSpace(value[vi]) {
+			for vi < len(value) && isSpace(value[vi]) && vi < offset {
+				vi++
+			}
+			if vi < len(value) && isSpace(value[vi]) {
+				break // offset is inside the run; report its start
+			}
+			for si < len(src) && isSpace(src[si]) {
+				si++
+			}
+			continue
+		}
+		skipIndent()
+		_, size := utf8.DecodeRuneInString(value[vi:])
+		vi += size
+		switch {
+		case n.Style == yamlnode.DoubleQuotedStyle && si < len(src) && src[si] == '\\':
+			si += escapeLen(src[si:])
+		case n.Style == yamlnode.SingleQuotedStyle && strings.HasPrefix(src[si:], "''"):
+			si += 2
+		default:
+			_, size := utf8.DecodeRuneInString(src[si:])
+			si += size
+		}
+	}
+	if vi < len(value) && !isSpace(value[vi]) {
+		skipIndent()
+	}
+	if si > len(src) {
+		si = len(src)
+	}
+	consumed := src[:si]
+	if nl := strings.Count(consumed, "\n"); nl > 0 {
+		return line + nl, si - strings.LastIndexByte(consumed, '\n')
+	}
+	return line, col + si
+}
+
+// escapeLen returns the length of the escape sequence at the start of s.
+func escapeLen(s string) int {
+	if len(s) < 2 {
+		return len(s)
+	}
+	n := 2
+	switch s[1] {
+	case 'x':
+		n = 4
+	case 'u':
+		n = 6
+	case 'U':
+		n = 10
+	}
+	return min(n, len(s))
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
@@ -0,0 +1,350 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the name of the files listing files that are not rule
+// files, with gitignore semantics. The one in a rules directory applies, and
+// so do those of its parents up to the root of the git work tree.
+const IgnoreFile = ".malsyncignore"
+
+// Filter narrows down the files of a rules directory that are rule files.
+// Patterns use gitignore syntax and are relative to the rules directory: a
+// pattern without a slash matches the file name, e.g. "values*.yaml".
+type Filter struct {
+	Include []string // A file must match one of these, unless empty
+	Exclude []string // A file matching one of these is skipped
+}
+
+// Selector decides which files of a rules directory are rule files.
+type Selector struct {
+	dir      string // absolute, with symlinks resolved
+	only     string // the single file of a rules path naming a file
+	include  []*pattern
+	exclude  []*pattern
+	ignores  []*pattern // of every ignore file, outermost first
+	outerDir string     // directory of the outermost ignore file
+}
+
+// pattern is a compiled gitignore pattern.
+type pattern struct {
+	source  string // "file:line", "include" or "exclude", for skip reasons
+	text    string
+	base    string // directory the pattern is relative to
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// Selector returns the selector of the rules directory dir, reading the
+// ignore files that apply to it. When dir is a single file, only that file
+// is selected and neither the filter nor ignore files are applied.
+func (f Filter) Selector(dir string) (*Selector, error) {
+	abs, err := absPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(abs); err == nil && !info.IsDir() {
+		return &Selector{only: abs}, nil
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	s := &Selector{dir: abs}
+	for _, p := range f.Include {
+		if s.include, err = appendPattern(s.include, p, "include", abs); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range f.Exclude {
+		if s.exclude, err = appendPattern(s.exclude, p, "exclude", abs); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range ignoreDirs(abs) {
+		patterns, err := loadIgnoreFile(filepath.Join(d, IgnoreFile), d)
+		if err != nil {
+			return nil, err
+		}
+		if len(patterns) > 0 && s.outerDir == "" {
+			s.outerDir = d
+		}
+		s.ignores = append(s.ignores, patterns...)
+	}
+	return s, nil
+}
+
+// Skip returns why the file at path is not a rule file of the directory,
+// or "" when it is one.
+func (s *Selector) Skip(path string, isDir bool) string {
+	abs, err := absPath(path)
+	if err != nil {
+		abs = path
+	}
+	if s.only != "" {
+		if abs != s.only {
+			return "not the rules path"
+		}
+		return ""
+	}
+	if isDir {
+		return "subdirectories of the rules path are not read"
+	}
+	if filepath.Dir(abs) != s.dir {
+		return "not directly in the rules path"
+	}
+	name := filepath.Base(abs)
+	switch {
+	case name == MarkerFile:
+		return "marker file of mal-sync apply"
+	case !IsRuleFile(name):
+		return "not a .yaml, .yml or .json file"
+	}
+	// Files in an ignored directory cannot be re-included, as in git
+	if s.outerDir != "" {
+		rel, _ := filepath.Rel(s.outerDir, s.dir)
+		dir := s.outerDir
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if part == "." {
+				continue
+			}
+			dir = filepath.Join(dir, part)
+			if p := lastMatch(s.ignores, dir, true); p != nil && !p.negate {
+				return fmt.Sprintf("directory %s is ignored by %q in %s", dir, p.text, p.source)
+			}
+		}
+	}
+	if p := lastMatch(s.ignores, abs, false); p != nil && !p.negate {
+		return fmt.Sprintf("ignored by %q in %s", p.text, p.source)
+	}
+	for _, p := range s.exclude {
+		if p.matches(abs, false) {
+			return fmt.Sprintf("matches %s pattern %q", p.source, p.text)
+		}
+	}
+	if len(s.include) > 0 {
+		for _, p := range s.include {
+			if p.matches(abs, false) {
+				return ""
+			}
+		}
+		return "matches no include pattern"
+	}
+	return ""
+}
+
+// lastMatch returns the last of patterns matching path, which decides
+// whether it is ignored.
+func lastMatch(patterns []*pattern, path string, isDir bool) *pattern {
+	var last *pattern
+	for _, p := range patterns {
+		if p.matches(path, isDir) {
+			last = p
+		}
+	}
+	return last
+}
+
+// matches reports whether p matches the absolute path.
+func (p *pattern) matches(path string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	rel, err := filepath.Rel(p.base, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return p.re.MatchString(filepath.ToSlash(rel))
+}
+
+// ignoreDirs returns the directories whose ignore files apply to dir,
+// outermost first: dir and its parents up to the root of the git work
+// tree, or only dir outside of one.
+func ignoreDirs(dir string) []string {
+	dirs := []string{dir}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return []string{dir}
+		}
+		d = parent
+		dirs = append([]string{d}, dirs...)
+	}
+	return dirs
+}
+
+// loadIgnoreFile reads the patterns of an ignore file, if it exists.
+func loadIgnoreFile(path, base string) ([]*pattern, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+	var patterns []*pattern
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if patterns, err = appendPattern(patterns, scanner.Text(), fmt.Sprintf("%s:%d", path, line), base); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return patterns, nil
+}
+
+// appendPattern compiles a gitignore pattern relative to base and appends
+// it to patterns. Blank lines and comments are skipped.
+func appendPattern(patterns []*pattern, text, source, base string) ([]*pattern, error) {
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(text, " ") && !strings.HasSuffix(text, `\ `) {
+		text = text[:len(text)-1]
+	}
+	if text == "" || text[0] == '#' {
+		return patterns, nil
+	}
+	p := &pattern{source: source, text: text, base: base}
+	glob := text
+	if glob[0] == '!' {
+		p.negate = true
+		glob = glob[1:]
+	} else if strings.HasPrefix(glob, `\!`) || strings.HasPrefix(glob, `\#`) {
+		glob = glob[1:]
+	}
+	if strings.HasSuffix(glob, "/") {
+		p.dirOnly = true
+		glob = strings.TrimSuffix(glob, "/")
+	}
+	// A pattern with a slash before its end is relative to base; one
+	// without matches at any depth
+	anchored := strings.Contains(glob, "/")
+	glob = strings.TrimPrefix(glob, "/")
+	if glob == "" {
+		return nil, fmt.Errorf("%s: invalid pattern %q", source, text)
+	}
+	expr, err := globRegexp(glob)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid pattern %q: %w", source, text, err)
+	}
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	if p.re, err = regexp.Compile("^" + expr + "$"); err != nil {
+		return nil, fmt.Errorf("%s: invalid pattern %q: %w", source, text, err)
+	}
+	return append(patterns, p), nil
+}
+
+// globRegexp translates a gitignore glob into a regular expression.
+func globRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated character class")
+			}
+			b.WriteString(classRegexp(glob[i+1 : i+1+end]))
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// classRegexp translates the contents of a glob character class into a
+// regular expression class. As in git, a class never matches a slash: one
+// is added to negated classes and removed from the others, splitting ranges
+// that span it.
+func classRegexp(class string) string {
+	negate := strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	quote := func(r rune) string {
+		if strings.ContainsRune(`\]^-[`, r) {
+			return `\` + string(r)
+		}
+		return string(r)
+	}
+	var b strings.Builder
+	chars := []rune(class)
+	for i := 0; i < len(chars); i++ {
+		lo := chars[i]
+		if lo == '\\' && i+1 < len(chars) {
+			i++
+			lo = chars[i]
+		}
+		hi := lo
+		if i+2 < len(chars) && chars[i+1] == '-' {
+			i += 2
+			hi = chars[i]
+			if hi == '\\' && i+1 < len(chars) {
+				i++
+				hi = chars[i]
+			}
+		}
+		switch {
+		case negate || hi < '/' || lo > '/':
+			b.WriteString(quote(lo))
+			if hi != lo {
+				b.WriteString("-" + quote(hi))
+			}
+		default:
+			if lo < '/' {
+				b.WriteString(quote(lo) + "-" + quote('/'-1))
+			}
+			if hi > '/' {
+				b.WriteString(quote('/'+1) + "-" + quote(hi))
+			}
+		}
+	}
+	switch {
+	case negate:
+		return "[^/" + b.String() + "]"
+	case b.Len() == 0:
+		return `[^\x00-\x{10FFFF}]` // matches nothing
+	}
+	return "[" + b.String() + "]"
+}
+
+// absPath returns path made absolute, with symlinks of its directory
+// resolved so paths reported by git compare equal.
+func absPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs)), nil
+	}
+	return abs, nil
+}
@@ -0,0 +1,184 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// workTree creates a git work tree with an ignore file at its root and
+// returns its path.
+func workTree(t *testing.T, ignore string) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, IgnoreFile), []byte(ignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// skip returns why the file at the slash-separated path below root is not
+// a rule file of its directory.
+func skip(t *testing.T, root, path string, filter Filter) string {
+	t.Helper()
+	abs := filepath.Join(root, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := filter.Selector(filepath.Dir(abs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Skip(abs, false)
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		ignore  string
+		path    string
+		ignored bool
+	}{
+		{"unanchored name", "old.yaml", "a/b/old.yaml", true},
+		{"unanchored glob", "values*.yaml", "a/values-prod.yaml", true},
+		{"unanchored glob not matching", "values*.yaml", "a/rules.yaml", false},
+		{"anchored at the root", "/old.yaml", "old.yaml", true},
+		{"anchored at the root in a subdirectory", "/old.yaml", "a/old.yaml", false},
+		{"anchored by a middle slash", "a/old.yaml", "a/old.yaml", true},
+		{"anchored by a middle slash elsewhere", "a/old.yaml", "b/a/old.yaml", false},
+		{"star within a directory", "a/*.yaml", "a/x.yaml", true},
+		{"star does not cross directories", "a/*.yaml", "a/b/x.yaml", false},
+		{"leading ** at the root", "**/old.yaml", "old.yaml", true},
+		{"leading ** at any depth", "**/b/old.yaml", "a/b/old.yaml", true},
+		{"middle ** without directories", "a/**/x.yaml", "a/x.yaml", true},
+		{"middle ** with directories", "a/**/x.yaml", "a/b/c/x.yaml", true},
+		{"middle ** is anchored", "a/**/x.yaml", "b/a/x.yaml", false},
+		{"trailing **", "a/**", "a/b/x.yaml", true},
+		{"trailing ** outside the directory", "a/**", "x.yaml", false},
+		{"directory only", "b/", "a/b/x.yaml", true},
+		{"directory only does not match files", "x.yaml/", "a/x.yaml", false},
+		{"negation", "*.yaml\n!keep.yaml", "a/keep.yaml", false},
+		{"negation of other files", "*.yaml\n!keep.yaml", "a/x.yaml", true},
+		{"negation is overridden by a later pattern", "!keep.yaml\n*.yaml", "keep.yaml", true},
+		{"negation inside an ignored directory", "a/\n!a/keep.yaml", "a/keep.yaml", true},
+		{"escaped exclamation mark", `\!important.yaml`, "!important.yaml", true},
+		{"escaped hash", `\#x.yaml`, "#x.yaml", true},
+		{"comment", "#x.yaml", "#x.yaml", false},
+		{"escaped star", `x\*.yaml`, "x*.yaml", true},
+		{"escaped star is literal", `x\*.yaml`, "xy.yaml", false},
+		{"escaped question mark", `a\?.yaml`, "ab.yaml", false},
+		{"trailing spaces", "old.yaml  ", "old.yaml", true},
+		{"character class", "[ab].yaml", "b.yaml", true},
+		{"character class not matching", "[ab].yaml", "c.yaml", false},
+		{"character range", "[a-c].yaml", "b.yaml", true},
+		{"negated character class", "[!ab].yaml", "c.yaml", true},
+		{"negated character class not matching", "[!ab].yaml", "a.yaml", false},
+		{"caret negated character class", "[^ab].yaml", "a.yaml", false},
+		{"negated character class does not match a slash", "a[!x]b.yaml", "a/b.yaml", false},
+		{"range does not match a slash", "a[+-0]b.yaml", "a/b.yaml", false},
+		{"range around a slash", "a[+-0]b.yaml", "a.b.yaml", true},
+		{"class of only a slash", "a[/]b.yaml", "a/b.yaml", false},
+		{"question mark does not match a slash", "a?b.yaml", "a/b.yaml", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := workTree(t, tt.ignore)
+			reason := skip(t, root, tt.path, Filter{})
+			if ignored := reason != ""; ignored != tt.ignored {
+				t.Errorf("%q ignoring %s = %v (%s), want %v", tt.ignore, tt.path, ignored, reason, tt.ignored)
+			}
+		})
+	}
+}
+
+func TestIgnorePatternErrors(t *testing.T) {
+	for _, ignore := range []string{"[ab.yaml", "/", "[c-a].yaml"} {
+		root := workTree(t, ignore)
+		if _, err := (Filter{}).Selector(root); err == nil {
+			t.Errorf("Selector with ignore file %q succeeded", ignore)
+		}
+	}
+}
+
+func TestIgnoreFilesOfParents(t *testing.T) {
+	outside := t.TempDir()
+	root := filepath.Join(outside, "repo")
+	if err := os.MkdirAll(filepath.Join(root, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "team", "rules")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		filepath.Join(outside, IgnoreFile):      "*.yaml\n",              // above the work tree, not read
+		filepath.Join(root, IgnoreFile):         "old*.yaml\ntmp.yaml\n", // outermost
+		filepath.Join(root, "team", IgnoreFile): "!old-kept.yaml\n",
+		filepath.Join(dir, IgnoreFile):          "/local.yaml\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := Filter{}.Selector(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"rules.yaml":    "",
+		"old.yaml":      `ignored by "old*.yaml" in ` + filepath.Join(root, IgnoreFile) + ":1",
+		"old-kept.yaml": "",
+		"tmp.yaml":      `ignored by "tmp.yaml" in ` + filepath.Join(root, IgnoreFile) + ":2",
+		"local.yaml":    `ignored by "/local.yaml" in ` + filepath.Join(dir, IgnoreFile) + ":1",
+	} {
+		if got := s.Skip(filepath.Join(dir, name), false); got != want {
+			t.Errorf("Skip(%s) = %q, want %q", name, got, want)
+		}
+	}
+
+	// Outside of a git work tree only the rules directory's file applies
+	plain := filepath.Join(outside, "plain")
+	if err := os.MkdirAll(plain, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Filter{}.Selector(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Skip(filepath.Join(plain, "rules.yaml"), false); got != "" {
+		t.Errorf("Skip outside a work tree = %q", got)
+	}
+}
+
+func TestFilterWithIgnoreFile(t *testing.T) {
+	root := workTree(t, "old.yaml\n!values-keep.yaml\n")
+	filter := Filter{Include: []string{"*.yaml", "extra.yml"}, Exclude: []string{"values*.yaml"}}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"rules.yaml", ""},
+		{"extra.yml", ""},
+		{"other.yml", "matches no include pattern"},
+		{"values-prod.yaml", `matches exclude pattern "values*.yaml"`},
+		// An exclude pattern applies even to files an ignore file re-includes
+		{"values-keep.yaml", `matches exclude pattern "values*.yaml"`},
+		{"old.yaml", `ignored by "old.yaml" in ` + filepath.Join(root, IgnoreFile) + ":1"},
+		{"README.md", "not a .yaml, .yml or .json file"},
+		{"sub/rules.yaml", ""},
+	}
+	for _, tt := range tests {
+		if got := skip(t, root, tt.path, filter); got != tt.want {
+			t.Errorf("Skip(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	// Include and exclude patterns are relative to the rules directory
+	filter = Filter{Exclude: []string{"/rules.yaml"}}
+	if got := skip(t, root, "sub/rules.yaml", filter); got != `matches exclude pattern "/rules.yaml"` {
+		t.Errorf("Skip of an anchored exclude pattern = %q", got)
+	}
+}
@@ -0,0 +1,73 @@
+package rules
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// Namespace strategies of NamespaceStrategy.
+const (
+	NamespaceFromFile      = "file"      // The namespace key of each file
+	NamespaceFromFileName  = "filename"  // The name of each file without its extension
+	NamespaceFromDirectory = "directory" // The name of the directory of each file
+	NamespaceFixed         = "fixed"     // NamespaceStrategy.Name for every file
+)
+
+// NamespaceStrategy assigns the namespaces of rule files in place of the
+// namespace they declare.
+type NamespaceStrategy struct {
+	Strategy string // NamespaceFromFile when empty
+	Name     string // Namespace of NamespaceFixed
+	Prefix   string // Prepended to every namespace
+}
+
+// IsZero reports whether s keeps the namespaces of files as they are.
+func (s NamespaceStrategy) IsZero() bool {
+	return (s.Strategy == "" || s.Strategy == NamespaceFromFile) && s.Prefix == ""
+}
+
+// Validate checks that s names a known strategy.
+func (s NamespaceStrategy) Validate() error {
+	switch s.Strategy {
+	case "", NamespaceFromFile, NamespaceFromFileName, NamespaceFromDirectory:
+		return nil
+	case NamespaceFixed:
+		if s.Name == "" {
+			return fmt.Errorf("namespace strategy %q requires a name", s.Strategy)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown namespace strategy %q, expected %s, %s, %s or %s",
+		s.Strategy, NamespaceFromFile, NamespaceFromFileName, NamespaceFromDirectory, NamespaceFixed)
+}
+
+// ApplyNamespaceStrategy sets the namespace of every file as s assigns it.
+// With NamespaceFromFile, files without a namespace keep none.
+func ApplyNamespaceStrategy(files []*File, s NamespaceStrategy) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	for _, f := range files {
+		namespace := f.Namespace
+		switch s.Strategy {
+		case NamespaceFromFileName:
+			namespace = TrimRuleExt(filepath.Base(f.Path))
+		case NamespaceFromDirectory:
+			abs, err := filepath.Abs(f.Path)
+			if err != nil {
+				return err
+			}
+			namespace = filepath.Base(filepath.Dir(abs))
+		case NamespaceFixed:
+			namespace = s.Name
+		}
+		if namespace == "" {
+			continue
+		}
+		f.Namespace = s.Prefix + namespace
+		f.Doc.Set("namespace", yamlnode.NewString(f.Namespace))
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// Severity is the severity of a policy violation.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Violation is a rule or group that does not follow a policy.
+type Violation struct {
+	Severity Severity
+	Pos      string // file:line
+	Group    string
+	Rule     string // empty for group-level violations
+	Message  string
+}
+
+func (v Violation) String() string {
+	where := v.Group
+	if v.Rule != "" {
+		where += "/" + v.Rule
+	}
+	return fmt.Sprintf("%s: [%s] %s: %s", v.Pos, v.Severity, where, v.Message)
+}
+
+// Policy describes an organisation's rule conventions. Every check is
+// optional; a zero Policy accepts everything.
+type Policy struct {
+	RequiredLabels      []Requirement // Labels every alerting rule must have
+	RequiredAnnotations []Requirement // Annotations every alerting rule must have
+	MinFor              *MinFor
+	RecordingRuleName   *NamePattern
+	MaxGroupSize        *MaxGroupSize
+}
+
+// Requirement is a required label or annotation.
+type Requirement struct {
+	Name     string
+	Values   []string       // Allowed values; any value when empty
+	Pattern  *regexp.Regexp // Optional pattern the value must match
+	Severity Severity
+}
+
+// MinFor is the minimum "for" duration of alerting rules.
+type MinFor struct {
+	Duration time.Duration
+	Raw      string
+	Severity Severity
+}
+
+// NamePattern is the pattern recording rule names must match.
+type NamePattern struct {
+	Pattern  *regexp.Regexp
+	Severity Severity
+}
+
+// MaxGroupSize is the maximum number of rules per group.
+type MaxGroupSize struct {
+	Rules    int
+	Severity Severity
+}
+
+// LoadPolicy reads a policy file:
+//
+//	required_labels:
+//	  - name: severity
+//	    values: [critical, warning, info]
+//	  - name: team
+//	required_annotations:
+//	  - name: summary
+//	  - name: runbook_url
+//	    pattern: '^https://'
+//	    severity: warning
+//	min_for: {duration: 1m, severity: warning}
+//	recording_rule_name: {pattern: '^[a-z_]+:[a-z0-9_]+:[a-z0-9_]+$'}
+//	max_group_size: {rules: 20, severity: warning}
+//
+// Severity defaults to error.
+func LoadPolicy(path string) (*Policy, error) {
+	docs, err := yamlnode.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if len(docs) == 0 || docs[0].IsNull() {
+		return p, nil
+	}
+	doc := docs[0]
+	if len(docs) > 1 || doc.Kind != yamlnode.MappingNode {
+		return nil, fmt.Errorf("%s: policy must be a single YAML mapping", path)
+	}
+	for _, key := range doc.Keys() {
+		n := doc.Get(key)
+		if _, ok := policyKeys[key]; !ok {
+			return nil, fmt.Errorf("%s:%d: unknown policy key %q", path, doc.GetKey(key).Line, key)
+		}
+		if err := checkPolicyKeys(path, key, n); err != nil {
+			return nil, err
+		}
+		var err error
+		switch key {
+		case "required_labels":
+			p.RequiredLabels, err = parseRequirements(n)
+		case "required_annotations":
+			p.RequiredAnnotations, err = parseRequirements(n)
+		case "min_for":
+			p.MinFor = &MinFor{Raw: n.Get("duration").Text()}
+			if p.MinFor.Duration, err = ParseDuration(p.MinFor.Raw); err == nil {
+				p.MinFor.Severity, err = parseSeverity(n)
+			}
+		case "recording_rule_name":
+			p.RecordingRuleName = &NamePattern{}
+			if p.RecordingRuleName.Pattern, err = regexp.Compile(n.Get("pattern").Text()); err == nil {
+				p.RecordingRuleName.Severity, err = parseSeverity(n)
+			}
+		case "max_group_size":
+			p.MaxGroupSize = &MaxGroupSize{}
+			if p.MaxGroupSize.Rules, err = strconv.Atoi(n.Get("rules").Text()); err == nil && p.MaxGroupSize.Rules <= 0 {
+				err = fmt.Errorf("rules must be positive")
+			}
+			if err == nil {
+				p.MaxGroupSize.Severity, err = parseSeverity(n)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n.Line, key, err)
+		}
+	}
+	return p, nil
+}
+
+// policyKeys are the policy keys and the keys allowed in the value of
+// each, or in each item of it for lists.
+var policyKeys = map[string][]string{
+	"required_labels":      {"name", "values", "pattern", "severity"},
+	"required_annotations": {"name", "values", "pattern", "severity"},
+	"min_for":              {"duration", "severity"},
+	"recording_rule_name":  {"pattern", "severity"},
+	"max_group_size":       {"rules", "severity"},
+}
+
+// checkPolicyKeys rejects keys a policy check does not know, so a typo
+// does not silently disable the check.
+func checkPolicyKeys(path, key string, n *yamlnode.Node) error {
+	allowed := policyKeys[key]
+	n = n.Resolve()
+	mappings := []*yamlnode.Node{n}
+	if key == "required_labels" || key == "required_annotations" {
+		if n.Kind != yamlnode.SequenceNode {
+			return fmt.Errorf("%s:%d: %s must be a list", path, n.Line, key)
+		}
+		mappings = n.Items()
+	}
+	for _, m := range mappings {
+		m = m.Resolve()
+		if m.Kind != yamlnode.MappingNode {
+			return fmt.Errorf("%s:%d: %s must be a mapping", path, m.Line, key)
+		}
+		for _, k := range m.Keys() {
+			if !contains(allowed, k) {
+				return fmt.Errorf("%s:%d: unknown %s key %q", path, m.GetKey(k).Line, key, k)
+			}
+		}
+	}
+	return nil
+}
+
+func parseRequirements(n *yamlnode.Node) ([]Requirement, error) {
+	var out []Requirement
+	for _, item := range n.Items() {
+		r := Requirement{Name: item.Get("name").Text()}
+		if r.Name == "" {
+			return nil, fmt.Errorf("line %d: entry without a name", item.Line)
+		}
+		for _, v := range item.Get("values").Items() {
+			r.Values = append(r.Values, v.Text())
+		}
+		if pattern := item.Get("pattern").Text(); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", item.Line, err)
+			}
+			r.Pattern = re
+		}
+		var err error
+		if r.Severity, err = parseSeverity(item); err != nil {
+			return nil, fmt.Errorf("line %d: %w", item.Line, err)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func parseSeverity(n *yamlnode.Node) (Severity, error) {
+	switch s := Severity(n.Get("severity").Text()); s {
+	case "":
+		return SeverityError, nil
+	case SeverityError, SeverityWarning:
+		return s, nil
+	default:
+		return "", fmt.Errorf("severity must be %q or %q, got %q", SeverityError, SeverityWarning, s)
+	}
+}
+
+// Check returns the policy violations of files in file and document order.
+func (p *Policy) Check(files []*File) []Violation {
+	var out []Violation
+	for _, f := range files {
+		for _, g := range f.Groups {
+			if p.MaxGroupSize != nil && len(g.Rules) > p.MaxGroupSize.Rules {
+				out = append(out, Violation{
+					Severity: p.MaxGroupSize.Severity,
+					Pos:      g.Pos(),
+					Group:    g.Name,
+					Message:  fmt.Sprintf("group has %d rules, more than the maximum of %d", len(g.Rules), p.MaxGroupSize.Rules),
+				})
+			}
+			for _, r := range g.Rules {
+				out = append(out, p.checkRule(r)...)
+			}
+		}
+	}
+	return out
+}
+
+func (p *Policy) checkRule(r *Rule) []Violation {
+	var out []Violation
+	add := func(sev Severity, format string, args ...any) {
+		out = append(out, Violation{Severity: sev, Pos: r.Pos(), Group: r.Group.Name, Rule: r.Name(), Message: fmt.Sprintf(format, args...)})
+	}
+	if !r.IsAlert() {
+		if p.RecordingRuleName != nil && !p.RecordingRuleName.Pattern.MatchString(r.Record) {
+			add(p.RecordingRuleName.Severity, "recording rule name does not match %q", p.RecordingRuleName.Pattern)
+		}
+		return out
+	}
+	checkRequired := func(what string, reqs []Requirement, values map[string]string) {
+		for _, req := range reqs {
+			v, ok := values[req.Name]
+			switch {
+			case !ok || v == "":
+				add(req.Severity, "missing required %s %q", what, req.Name)
+			case len(req.Values) > 0 && !contains(req.Values, v):
+				add(req.Severity, "%s %s=%q is not one of %v", what, req.Name, v, req.Values)
+			case req.Pattern != nil && !req.Pattern.MatchString(v):
+				add(req.Severity, "%s %s=%q does not match %q", what, req.Name, v, req.Pattern)
+			}
+		}
+	}
+	checkRequired("label", p.RequiredLabels, r.Labels)
+	checkRequired("annotation", p.RequiredAnnotations, r.Annotations)
+	if p.MinFor != nil {
+		d, err := ParseDuration(r.For)
+		switch {
+		case r.For == "":
+			add(p.MinFor.Severity, "alert has no \"for\"; the minimum is %s", p.MinFor.Raw)
+		case err != nil:
+			add(SeverityError, "%v", err)
+		case d < p.MinFor.Duration:
+			add(p.MinFor.Severity, "\"for: %s\" is shorter than the minimum of %s", r.For, p.MinFor.Raw)
+		}
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Enforce checks files against the policy file at path, logs every
+// violation and returns an error when any of them is an error.
+func Enforce(policyPath string, files []*File) error {
+	policy, err := LoadPolicy(policyPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("Checking %d rule file(s) against policy %s", len(files), policyPath)
+	errors, warnings := 0, 0
+	for _, v := range policy.Check(files) {
+		log.Print(v)
+		if v.Severity == SeverityError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("rule policy check found %d error(s) and %d warning(s)", errors, warnings)
+	}
+	log.Printf("Rule policy check passed with %d warning(s)", warnings)
+	return nil
+}
@@ -0,0 +1,188 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePolicy(t *testing.T, policy string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{"unknown policy key", "min_fro: {duration: 1m}\n", `policy.yaml:1: unknown policy key "min_fro"`},
+		{"unknown min_for key", "min_for:\n  duration: 1m\n  severty: warning\n", `policy.yaml:3: unknown min_for key "severty"`},
+		{"unknown requirement key", "required_labels:\n  - name: team\n  - name: severity\n    value: [critical]\n", `policy.yaml:4: unknown required_labels key "value"`},
+		{"unknown recording_rule_name key", "recording_rule_name: {patern: '^a'}\n", `unknown recording_rule_name key "patern"`},
+		{"unknown max_group_size key", "max_group_size: {rule: 10}\n", `unknown max_group_size key "rule"`},
+		{"requirements not a list", "required_annotations:\n  name: summary\n", "policy.yaml:2: required_annotations must be a list"},
+		{"check not a mapping", "min_for: 1m\n", "policy.yaml:1: min_for must be a mapping"},
+		{"requirement without name", "required_labels:\n  - values: [a]\n", "entry without a name"},
+		{"invalid severity", "min_for: {duration: 1m, severity: fatal}\n", `severity must be "error" or "warning", got "fatal"`},
+		{"invalid duration", "min_for: {duration: soon}\n", "policy.yaml:1: min_for:"},
+		{"invalid pattern", "recording_rule_name: {pattern: '('}\n", "policy.yaml:1: recording_rule_name:"},
+		{"group size not positive", "max_group_size: {rules: 0}\n", "rules must be positive"},
+		{"not a mapping", "- min_for\n", "policy must be a single YAML mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadPolicy(writePolicy(t, tt.policy))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("LoadPolicy error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := `required_labels:
+  - name: severity
+    values: [critical, warning]
+  - name: team
+required_annotations:
+  - name: summary
+  - name: runbook_url
+    pattern: '^https://'
+    severity: warning
+min_for: {duration: 5m, severity: warning}
+recording_rule_name: {pattern: '^[a-z_]+:[a-z0-9_]+:[a-z0-9_]+$'}
+max_group_size: {rules: 3}
+`
+	tests := []struct {
+		name  string
+		rules string
+		want  []string // "severity: message", in order
+	}{
+		{
+			name: "compliant",
+			rules: `      - alert: ApiDown
+        expr: up == 0
+        for: 5m
+        labels: {severity: critical, team: api}
+        annotations: {summary: API down, runbook_url: 'https://runbooks/api'}
+      - record: job:requests:rate5m
+        expr: sum by (job) (rate(requests_total[5m]))
+`,
+		},
+		{
+			name: "missing labels and annotations",
+			rules: `      - alert: ApiDown
+        expr: up == 0
+        for: 10m
+        labels: {team: ""}
+`,
+			want: []string{
+				`error: missing required label "severity"`,
+				`error: missing required label "team"`,
+				`error: missing required annotation "summary"`,
+				`warning: missing required annotation "runbook_url"`,
+			},
+		},
+		{
+			name: "values and patterns",
+			rules: `      - alert: ApiDown
+        expr: up == 0
+        for: 5m
+        labels: {severity: page, team: api}
+        annotations: {summary: API down, runbook_url: 'http://runbooks/api'}
+`,
+			want: []string{
+				`error: label severity="page" is not one of [critical warning]`,
+				`warning: annotation runbook_url="http://runbooks/api" does not match "^https://"`,
+			},
+		},
+		{
+			name: "min for",
+			rules: `      - alert: NoFor
+        expr: up == 0
+        labels: {severity: critical, team: api}
+        annotations: {summary: s, runbook_url: 'https://r'}
+      - alert: ShortFor
+        expr: up == 0
+        for: 1m
+        labels: {severity: critical, team: api}
+        annotations: {summary: s, runbook_url: 'https://r'}
+      - alert: BadFor
+        expr: up == 0
+        for: soon
+        labels: {severity: critical, team: api}
+        annotations: {summary: s, runbook_url: 'https://r'}
+`,
+			want: []string{
+				`warning: alert has no "for"; the minimum is 5m`,
+				`warning: "for: 1m" is shorter than the minimum of 5m`,
+				`error: `,
+			},
+		},
+		{
+			name: "recording rule name",
+			rules: `      - record: requests_rate
+        expr: sum(rate(requests_total[5m]))
+`,
+			want: []string{`error: recording rule name does not match "^[a-z_]+:[a-z0-9_]+:[a-z0-9_]+$"`},
+		},
+		{
+			name: "group size",
+			rules: `      - record: a:b:c
+        expr: vector(1)
+      - record: a:b:d
+        expr: vector(1)
+      - record: a:b:e
+        expr: vector(1)
+      - record: a:b:f
+        expr: vector(1)
+`,
+			want: []string{"error: group has 4 rules, more than the maximum of 3"},
+		},
+	}
+	p, err := LoadPolicy(writePolicy(t, policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := Parse("rules.yaml", []byte("groups:\n  - name: g\n    rules:\n"+tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			violations := p.Check(files)
+			if len(violations) != len(tt.want) {
+				t.Fatalf("Check = %v, want %d violation(s)", violations, len(tt.want))
+			}
+			for i, v := range violations {
+				if got := string(v.Severity) + ": " + v.Message; !strings.HasPrefix(got, tt.want[i]) {
+					t.Errorf("violation %d = %q, want %q", i, got, tt.want[i])
+				}
+				if !strings.HasPrefix(v.Pos, "rules.yaml:") {
+					t.Errorf("violation %d position = %q", i, v.Pos)
+				}
+			}
+		})
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	files, err := Parse("rules.yaml", []byte("groups:\n  - name: g\n    rules:\n      - alert: A\n        expr: up == 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Enforce(writePolicy(t, "min_for: {duration: 1m, severity: warning}\n"), files); err != nil {
+		t.Errorf("Enforce with warnings only: %v", err)
+	}
+	err = Enforce(writePolicy(t, "required_labels:\n  - name: team\nmin_for: {duration: 1m, severity: warning}\n"), files)
+	if err == nil || err.Error() != "rule policy check found 1 error(s) and 1 warning(s)" {
+		t.Errorf("Enforce error = %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+// Package rules loads Prometheus-style rule files (as used by Mimir and Loki)
+// with the positions of every group and rule, so checks can point at the
+// exact line that needs fixing.
+package rules
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/common"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// File is a parsed rule file.
+type File struct {
+	Path      string
+	Namespace string // optional top-level "namespace" used by mimirtool/lokitool
+	Groups    []*Group
+	Doc       *yamlnode.Node
+	Lines     []string  // source lines, used to map expression errors to columns
+	Manifest  *Manifest // PrometheusRule the file was read from; nil for rule files
+
+	declared string // Namespace as read, so staging knows when it was reassigned
+}
+
+// Group is a rule group.
+type Group struct {
+	Name          string
+	Interval      string
+	SourceTenants []string
+	Rules         []*Rule
+	File          *File
+	Node          *yamlnode.Node
+}
+
+// Rule is an alerting or recording rule.
+type Rule struct {
+	Alert       string
+	Record      string
+	Expr        string
+	For         string
+	Labels      map[string]string
+	Annotations map[string]string
+	Group       *Group
+	Node        *yamlnode.Node
+}
+
+// Name returns the alert name or the recorded series name.
+func (r *Rule) Name() string {
+	if r.Alert != "" {
+		return r.Alert
+	}
+	return r.Record
+}
+
+// IsAlert reports whether r is an alerting rule.
+func (r *Rule) IsAlert() bool { return r.Alert != "" }
+
+// Pos returns the "file:line" of the rule.
+func (r *Rule) Pos() string {
+	return fmt.Sprintf("%s:%d", r.Group.File.Path, r.Node.Line)
+}
+
+// Pos returns the "file:line" of the group.
+func (g *Group) Pos() string {
+	return fmt.Sprintf("%s:%d", g.File.Path, g.Node.Line)
+}
+
+// ExprNode returns the node holding the rule's expression.
+func (r *Rule) ExprNode() *yamlnode.Node {
+	return r.Node.Get("expr")
+}
+
+// MarkerFile is the name of the files declaring subtrees for "mal-sync
+// apply". It is never a rule file.
+const MarkerFile = ".mal-sync.yaml"
+
+// ResolveFiles lists the rule files under path: the *.yaml, *.yml and
+// *.json files of a directory, or path itself when it is a single rule file.
+func ResolveFiles(path string) ([]string, error) {
+	return Filter{}.ResolveFiles(path)
+}
+
+// ResolveFiles is ResolveFiles for the files f and the ignore files of
+// path select. Every other file of the directory is logged with the reason
+// it is skipped.
+func (f Filter) ResolveFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat rules path %s: %w", path, err)
+	}
+	if !info.IsDir() {
+		if !IsRuleFile(path) {
+			return nil, fmt.Errorf("rules.path points to a file but it is not a .yaml, .yml or .json file: %s", path)
+		}
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules directory %s: %w", path, err)
+	}
+	selector, err := f.Selector(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		file := filepath.Join(path, entry.Name())
+		if reason := selector.Skip(file, entry.IsDir()); reason != "" {
+			log.Printf("Skipping %s: %s", file, reason)
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// IsRuleFile reports whether name has a rule file extension. JSON is a
+// subset of YAML, so .json files are parsed like the others.
+func IsRuleFile(name string) bool {
+	return IsYAMLFile(name) || IsJSONFile(name)
+}
+
+// IsYAMLFile reports whether name has a YAML extension.
+func IsYAMLFile(name string) bool {
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml")
+}
+
+// IsJSONFile reports whether name has a JSON extension.
+func IsJSONFile(name string) bool {
+	return strings.HasSuffix(name, ".json")
+}
+
+// TrimRuleExt returns name without its rule file extension.
+func TrimRuleExt(name string) string {
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// LoadFiles parses every file in paths.
+func LoadFiles(paths []string) ([]*File, error) {
+	var files []*File
+	for _, p := range paths {
+		loaded, err := Load(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, loaded...)
+	}
+	return files, nil
+}
+
+// Load parses a rule file, or a Kubernetes manifest of one or more
+// PrometheusRule objects. Every PrometheusRule becomes a File of its own,
+// whose namespace is derived with DefaultNamespaceFormat; other objects in
+// the manifest are ignored.
+func Load(path string) ([]*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return Parse(path, data)
+}
+
+// Parse is Load for the contents of a file, such as an older version of
+// it; path is only used in errors and positions.
+func Parse(path string, data []byte) ([]*File, error) {
+	docs, err := yamlnode.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, doc := range docs {
+		if doc.Kind == yamlnode.MappingNode && IsManifest(doc) {
+			return loadManifest(path, lines, docs)
+		}
+	}
+	f := &File{Path: path, Lines: lines}
+	if len(docs) == 0 || docs[0].IsNull() {
+		f.Doc = yamlnode.NewMapping()
+		return []*File{f}, nil
+	}
+	if len(docs) > 1 {
+		return nil, fmt.Errorf("%s must contain exactly one YAML document, found %d", path, len(docs))
+	}
+	doc := docs[0]
+	if doc.Kind != yamlnode.MappingNode {
+		return nil, fmt.Errorf("%s:%d: top level of a rule file must be a mapping", path, doc.Line)
+	}
+	if err := f.parse(doc); err != nil {
+		return nil, err
+	}
+	return []*File{f}, nil
+}
+
+// StageFiles writes a copy of every file to dir and returns the paths of
+// the copies, in the order of files. YAML rule files are copied as they
+// are; files read from a PrometheusRule or JSON, and files whose namespace
+// was reassigned, are written as plain YAML rule files, the only files
+// mimirtool and lokitool read from a directory.
+func StageFiles(files []*File, dir string) ([]string, error) {
+	var staged []string
+	for _, f := range files {
+		dst := filepath.Join(dir, StagedName(f))
+		switch {
+		case f.Manifest != nil:
+			log.Printf("Converting PrometheusRule %s/%s in %s to %s", f.Manifest.Namespace, f.Manifest.Name, f.Path, dst)
+		case IsJSONFile(f.Path):
+			log.Printf("Converting JSON rule file %s to %s", f.Path, dst)
+		case f.Namespace != f.declared:
+			log.Printf("Writing rule file %s with namespace %s to %s", f.Path, f.Namespace, dst)
+		default:
+			log.Printf("Copying rule file %s to %s", f.Path, dst)
+			if err := common.CopyFile(f.Path, dst); err != nil {
+				return nil, fmt.Errorf("failed to copy rule file %s to %s: %w", f.Path, dst, err)
+			}
+			staged = append(staged, dst)
+			continue
+		}
+		if err := os.WriteFile(dst, yamlnode.Encode(f.Doc), 0640); err != nil {
+			return nil, fmt.Errorf("failed to write rule file %s: %w", dst, err)
+		}
+		staged = append(staged, dst)
+	}
+	return staged, nil
+}
+
+// loadManifest returns a File for every PrometheusRule in docs.
+func loadManifest(path string, lines []string, docs []*yamlnode.Node) ([]*File, error) {
+	var files []*File
+	for _, doc := range docs {
+		if doc.IsNull() {
+			continue
+		}
+		if doc.Kind != yamlnode.MappingNode || !IsManifest(doc) {
+			return nil, fmt.Errorf("%s:%d: expected a Kubernetes object, as the file contains PrometheusRule manifests", path, doc.Line)
+		}
+		if !IsPrometheusRule(doc) {
+			continue
+		}
+		rf, m, err := fromManifest(path, doc)
+		if err != nil {
+			return nil, err
+		}
+		f := &File{Path: path, Lines: lines, Manifest: m}
+		if err := f.parse(rf); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// parse reads the namespace and groups of a rule file document.
+func (f *File) parse(doc *yamlnode.Node) error {
+	path := f.Path
+	f.Doc = doc
+	f.Namespace = doc.Get("namespace").Text()
+	f.declared = f.Namespace
+	groups := doc.Get("groups")
+	if !groups.IsNull() && groups.Resolve().Kind != yamlnode.SequenceNode {
+		return fmt.Errorf("%s:%d: groups must be a list", path, groups.Line)
+	}
+	for _, gn := range groups.Items() {
+		gn = gn.Resolve()
+		if gn.Kind != yamlnode.MappingNode {
+			return fmt.Errorf("%s:%d: rule group must be a mapping", path, gn.Line)
+		}
+		g := &Group{
+			Name:     gn.Get("name").Text(),
+			Interval: gn.Get("interval").Text(),
+			File:     f,
+			Node:     gn,
+		}
+		for _, t := range gn.Get("source_tenants").Items() {
+			g.SourceTenants = append(g.SourceTenants, t.Text())
+		}
+		for _, rn := range gn.Get("rules").Items() {
+			rn = rn.Resolve()
+			if rn.Kind != yamlnode.MappingNode {
+				return fmt.Errorf("%s:%d: rule must be a mapping", path, rn.Line)
+			}
+			g.Rules = append(g.Rules, &Rule{
+				Alert:       rn.Get("alert").Text(),
+				Record:      rn.Get("record").Text(),
+				Expr:        rn.Get("expr").Text(),
+				For:         rn.Get("for").Text(),
+				Labels:      stringMap(rn.Get("labels")),
+				Annotations: stringMap(rn.Get("annotations")),
+				Group:       g,
+				Node:        rn,
+			})
+		}
+		f.Groups = append(f.Groups, g)
+	}
+	return nil
+}
+
+func stringMap(n *yamlnode.Node) map[string]string {
+	m := map[string]string{}
+	for _, k := range n.Keys() {
+		m[k] = n.Get(k).Text()
+	}
+	return m
+}
@@ -0,0 +1,163 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// NamesFunc returns the series names a rule expression reads.
+type NamesFunc func(expr string) []string
+
+// SplitGroups splits every group of f with more than maxRules rules into
+// groups named name-1, name-2 and so on, rewriting f.Doc and f.Groups.
+// Every other group setting, such as interval and source_tenants, is
+// copied to each part. Rules keep their order, and a rule reading a series
+// recorded in the same group stays in the same part as that recording rule,
+// so chains of recording rules are still evaluated together. names may be
+// nil when expressions cannot read recorded series. It returns the names of
+// the groups that were split.
+func SplitGroups(f *File, maxRules int, names NamesFunc) ([]string, error) {
+	if maxRules <= 0 {
+		return nil, nil
+	}
+	var split []string
+	var groups []*Group
+	var items []*yamlnode.Node
+	for _, g := range f.Groups {
+		if len(g.Rules) <= maxRules {
+			groups = append(groups, g)
+			items = append(items, g.Node)
+			continue
+		}
+		parts, err := splitRules(g, maxRules, names)
+		if err != nil {
+			return nil, err
+		}
+		split = append(split, g.Name)
+		for i, part := range parts {
+			pg := *g
+			pg.Name = g.Name + "-" + strconv.Itoa(i+1)
+			pg.Rules = part
+			pg.Node = g.Node.Clone()
+			pg.Node.Line, pg.Node.Column = g.Node.Line, g.Node.Column
+			if i > 0 {
+				pg.Node.HeadComment = ""
+			}
+			pg.Node.Set("name", yamlnode.NewString(pg.Name))
+			ruleItems := yamlnode.NewSequence()
+			for _, r := range part {
+				r.Group = &pg
+				ruleItems.Content = append(ruleItems.Content, r.Node)
+			}
+			pg.Node.Set("rules", ruleItems)
+			groups = append(groups, &pg)
+			items = append(items, pg.Node)
+		}
+	}
+	if len(split) > 0 {
+		f.Groups = groups
+		f.Doc.Get("groups").Resolve().Content = items
+	}
+	return split, nil
+}
+
+// splitRules partitions the rules of g into parts of at most maxRules
+// rules. Rules connected through recorded series form one unit that is
+// never divided; units are packed in order of their first rule.
+func splitRules(g *Group, maxRules int, names NamesFunc) ([][]*Rule, error) {
+	parent := make([]int, len(g.Rules))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	if names != nil {
+		recorders := map[string][]int{}
+		for i, r := range g.Rules {
+			if r.Record != "" {
+				recorders[r.Record] = append(recorders[r.Record], i)
+			}
+		}
+		for i, r := range g.Rules {
+			for _, name := range names(r.Expr) {
+				for _, j := range recorders[name] {
+					if a, b := find(i), find(j); a != b {
+						parent[a] = b
+					}
+				}
+			}
+		}
+	}
+
+	units := map[int][]int{}
+	var order []int
+	for i := range g.Rules {
+		root := find(i)
+		if _, ok := units[root]; !ok {
+			order = append(order, root)
+		}
+		units[root] = append(units[root], i)
+	}
+
+	var parts [][]int
+	var current []int
+	for _, root := range order {
+		unit := units[root]
+		if len(unit) > maxRules {
+			chain := make([]string, len(unit))
+			for i, idx := range unit {
+				chain[i] = g.Rules[idx].Name()
+			}
+			return nil, fmt.Errorf("%s: group %q cannot be split into groups of at most %d rules: its %d rules %s read each other's recorded series and must stay in one group; raise the limit or move part of the chain to another group",
+				g.Pos(), g.Name, maxRules, len(unit), strings.Join(chain, ", "))
+		}
+		if len(current)+len(unit) > maxRules {
+			parts = append(parts, current)
+			current = nil
+		}
+		current = append(current, unit...)
+	}
+	parts = append(parts, current)
+
+	out := make([][]*Rule, len(parts))
+	for i, part := range parts {
+		sort.Ints(part)
+		for _, idx := range part {
+			out[i] = append(out[i], g.Rules[idx])
+		}
+	}
+	return out, nil
+}
+
+// SplitFiles splits the oversized groups of every file and writes the files
+// that changed to their staged copies; staged[i] is the copy of files[i].
+// maxRules returns the rules-per-group limit of a namespace, 0 meaning
+// unlimited.
+func SplitFiles(files []*File, staged []string, maxRules func(namespace string) int, names NamesFunc) error {
+	for i, f := range files {
+		before := len(f.Groups)
+		split, err := SplitGroups(f, maxRules(f.Namespace), names)
+		if err != nil {
+			return err
+		}
+		if len(split) == 0 {
+			continue
+		}
+		log.Printf("Split %d group(s) of %s (%v) into %d groups of at most %d rules", len(split), f.Path, split, len(f.Groups)-before+len(split), maxRules(f.Namespace))
+		if err := os.WriteFile(staged[i], yamlnode.Encode(f.Doc), 0640); err != nil {
+			return fmt.Errorf("failed to write split rule file %s: %w", staged[i], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+func metricNames(expr string) []string {
+	e, err := promql.Parse(expr)
+	if err != nil {
+		return nil
+	}
+	return promql.MetricNames(e)
+}
+
+func TestSplitGroups(t *testing.T) {
+	files, err := Parse("rules.yaml", []byte(`groups:
+  # API rules
+  - name: api
+    interval: 1m
+    source_tenants: [a, b]
+    rules:
+      - record: job:a:sum
+        expr: sum by (job) (up)
+      - alert: Down
+        expr: up == 0
+      - record: job:b:sum
+        expr: sum by (job) (x)
+      - alert: NoneUp
+        expr: job:a:sum == 0
+      - alert: Up
+        expr: up == 1
+  - name: small
+    rules:
+      - alert: Small
+        expr: up == 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := files[0]
+	split, err := SplitGroups(f, 2, metricNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(split, ",") != "api" {
+		t.Errorf("split = %v, want [api]", split)
+	}
+
+	// NoneUp reads job:a:sum, so it stays with its recording rule and the
+	// other rules keep their order
+	var got []string
+	for _, g := range f.Groups {
+		var names []string
+		for _, r := range g.Rules {
+			names = append(names, r.Name())
+			if r.Group != g {
+				t.Errorf("rule %s points at group %s, want %s", r.Name(), r.Group.Name, g.Name)
+			}
+		}
+		got = append(got, g.Name+": "+strings.Join(names, ", "))
+	}
+	want := []string{
+		"api-1: job:a:sum, NoneUp",
+		"api-2: Down, job:b:sum",
+		"api-3: Up",
+		"small: Small",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("groups:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	docs, err := yamlnode.Parse(yamlnode.Encode(f.Doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := docs[0].Get("groups").Items()
+	if len(items) != 4 {
+		t.Fatalf("encoded %d groups, want 4", len(items))
+	}
+	for _, g := range items[:3] {
+		if g.Get("interval").Text() != "1m" || len(g.Get("source_tenants").Items()) != 2 {
+			t.Errorf("group %s lost interval or source_tenants:\n%s", g.Get("name").Text(), yamlnode.Encode(g))
+		}
+	}
+	if out := string(yamlnode.Encode(f.Doc)); strings.Count(out, "# API rules") != 1 {
+		t.Errorf("group comment is not kept once:\n%s", out)
+	}
+}
+
+func TestSplitGroupsWithoutNames(t *testing.T) {
+	files, err := Parse("rules.yaml", []byte(`groups:
+  - name: api
+    rules:
+      - record: job:a:sum
+        expr: sum by (job) (up)
+      - alert: NoneUp
+        expr: job:a:sum == 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SplitGroups(files[0], 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(files[0].Groups); n != 2 || files[0].Groups[1].Name != "api-2" {
+		t.Errorf("split into %d groups, want api-1 and api-2", n)
+	}
+
+	split, err := SplitGroups(files[0], 0, metricNames)
+	if err != nil || split != nil {
+		t.Errorf("SplitGroups without a limit = %v, %v", split, err)
+	}
+}
+
+func TestSplitGroupsChainTooLong(t *testing.T) {
+	files, err := Parse("rules.yaml", []byte(`groups:
+  - name: api
+    rules:
+      - record: job:a:sum
+        expr: sum by (job) (up)
+      - record: job:b:sum
+        expr: job:a:sum * 2
+      - alert: Other
+        expr: up == 0
+      - alert: NoneUp
+        expr: job:b:sum == 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SplitGroups(files[0], 2, metricNames)
+	want := `rules.yaml:2: group "api" cannot be split into groups of at most 2 rules: its 3 rules job:a:sum, job:b:sum, NoneUp read each other's recorded series and must stay in one group; raise the limit or move part of the chain to another group`
+	if err == nil || err.Error() != want {
+		t.Errorf("SplitGroups error = %v, want %s", err, want)
+	}
+	if len(files[0].Groups) != 1 || files[0].Groups[0].Name != "api" {
+		t.Errorf("groups changed after a failed split")
+	}
+}
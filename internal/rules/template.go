@@ -0,0 +1,338 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// TemplateData is what alert label and annotation templates are executed
+// with, exposed to them as $labels, $externalLabels, $externalURL and
+// $value.
+type TemplateData struct {
+	Labels         map[string]string
+	ExternalLabels map[string]string
+	ExternalURL    string
+	Value          float64
+}
+
+// QuerySample is an element of the result of the template query function.
+type QuerySample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// QueryFunc evaluates a PromQL expression for the template query function.
+type QueryFunc func(expr string) ([]*QuerySample, error)
+
+// templateDefs are prepended to every template, as Prometheus does.
+const templateDefs = "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$externalURL := .ExternalURL}}{{$value := .Value}}"
+
+// ExpandTemplate executes a label or annotation template. query may be nil,
+// in which case the query function fails.
+func ExpandTemplate(name, text string, data TemplateData, query QueryFunc) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(TemplateFuncs(query, data.ExternalURL)).Parse(templateDefs + text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template %s: %w", name, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error executing template %s: %w", name, err)
+	}
+	return b.String(), nil
+}
+
+// TemplateFuncs returns the functions Prometheus provides to alert
+// templates.
+func TemplateFuncs(query QueryFunc, externalURL string) template.FuncMap {
+	return template.FuncMap{
+		"query": func(q string) ([]*QuerySample, error) {
+			if query == nil {
+				return nil, errors.New("query is not available here")
+			}
+			return query(q)
+		},
+		"first": func(v []*QuerySample) (*QuerySample, error) {
+			if len(v) > 0 {
+				return v[0], nil
+			}
+			return nil, errors.New("first() called on vector with no elements")
+		},
+		"label": func(label string, s *QuerySample) string {
+			if s == nil {
+				return ""
+			}
+			return s.Labels[label]
+		},
+		"value": func(s *QuerySample) float64 {
+			if s == nil {
+				return 0
+			}
+			return s.Value
+		},
+		"strvalue": func(s *QuerySample) string {
+			if s == nil {
+				return ""
+			}
+			return s.Labels["__value__"]
+		},
+		"args": func(args ...any) map[string]any {
+			m := map[string]any{}
+			for i, a := range args {
+				m["arg"+strconv.Itoa(i)] = a
+			}
+			return m
+		},
+		"reReplaceAll": func(pattern, repl, text string) string {
+			return regexp.MustCompile(pattern).ReplaceAllString(text, repl)
+		},
+		"safeHtml": func(text string) string { return text },
+		"match":    regexp.MatchString,
+		"title":    titleCase,
+		"toUpper":  strings.ToUpper,
+		"toLower":  strings.ToLower,
+		"graphLink": func(expr string) string {
+			return "/graph?g0.expr=" + url.QueryEscape(expr) + "&g0.tab=0"
+		},
+		"tableLink": func(expr string) string {
+			return "/graph?g0.expr=" + url.QueryEscape(expr) + "&g0.tab=1"
+		},
+		"sortByLabel": func(label string, v []*QuerySample) []*QuerySample {
+			sorted := append([]*QuerySample{}, v...)
+			sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Labels[label] < sorted[j].Labels[label] })
+			return sorted
+		},
+		"humanize":           withFloat(humanize),
+		"humanize1024":       withFloat(humanize1024),
+		"humanizeDuration":   withFloat(humanizeDuration),
+		"humanizePercentage": withFloat(func(v float64) string { return fmt.Sprintf("%.4g%%", v*100) }),
+		"humanizeTimestamp": func(i any) (string, error) {
+			v, err := toFloat(i)
+			if err != nil {
+				return "", err
+			}
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Sprintf("%.4g", v), nil
+			}
+			t, err := floatToTime(v)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprint(t), nil
+		},
+		"toTime": func(i any) (time.Time, error) {
+			v, err := toFloat(i)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return floatToTime(v)
+		},
+		"toDuration": func(i any) (time.Duration, error) {
+			v, err := toFloat(i)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(v * float64(time.Second)), nil
+		},
+		"parseDuration": func(s string) (float64, error) {
+			d, err := ParseDuration(s)
+			if err != nil {
+				return 0, err
+			}
+			return d.Seconds(), nil
+		},
+		"now":            func() float64 { return float64(time.Now().UnixNano()) / 1e9 },
+		"pathPrefix":     func() string { return pathPrefix(externalURL) },
+		"externalURL":    func() string { return externalURL },
+		"urlQueryEscape": url.QueryEscape,
+		"stripPort": func(hostPort string) string {
+			host, _, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				return hostPort
+			}
+			return host
+		},
+		"stripDomain": func(hostPort string) string {
+			host, port, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				host = hostPort
+			}
+			if ip := net.ParseIP(host); ip != nil {
+				return hostPort
+			}
+			host, _, _ = strings.Cut(host, ".")
+			if port != "" {
+				return net.JoinHostPort(host, port)
+			}
+			return host
+		},
+	}
+}
+
+func pathPrefix(externalURL string) string {
+	u, err := url.Parse(externalURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// floatToTime converts Unix seconds to a time with the millisecond
+// precision of Prometheus timestamps.
+func floatToTime(v float64) (time.Time, error) {
+	ns := v * 1e9
+	if ns > math.MaxInt64 || ns < math.MinInt64 {
+		return time.Time{}, fmt.Errorf("%v cannot be represented as a nanoseconds timestamp since it overflows int64", v)
+	}
+	return time.UnixMilli(int64(ns) / 1e6).UTC(), nil
+}
+
+// titleCase upper-cases the first letter of every word, leaving the rest
+// alone. Words are separated by spaces and punctuation other than
+// underscores and apostrophes, so "don't" stays one word.
+func titleCase(s string) string {
+	prev := ' '
+	var b strings.Builder
+	for _, r := range s {
+		if isWordSeparator(prev) {
+			b.WriteRune(unicode.ToTitle(r))
+		} else {
+			b.WriteRune(r)
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func isWordSeparator(r rune) bool {
+	switch {
+	case r == '_' || r == '\'' || r == '’':
+		return false
+	case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+		return false
+	}
+	return true
+}
+
+// withFloat adapts a formatting function to accept numbers or numeric
+// strings, like Prometheus' humanize functions.
+func withFloat(f func(float64) string) func(any) (string, error) {
+	return func(i any) (string, error) {
+		v, err := toFloat(i)
+		if err != nil {
+			return "", err
+		}
+		return f(v), nil
+	}
+}
+
+func toFloat(i any) (float64, error) {
+	switch v := i.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case time.Duration:
+		return v.Seconds(), nil
+	}
+	return 0, fmt.Errorf("can't convert %T to float", i)
+}
+
+func humanize(v float64) string {
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v)
+	}
+	if math.Abs(v) >= 1 {
+		prefix := ""
+		for _, p := range []string{"k", "M", "G", "T", "P", "E", "Z", "Y"} {
+			if math.Abs(v) < 1000 {
+				break
+			}
+			prefix = p
+			v /= 1000
+		}
+		return fmt.Sprintf("%.4g%s", v, prefix)
+	}
+	prefix := ""
+	for _, p := range []string{"m", "u", "n", "p", "f", "a", "z", "y"} {
+		if math.Abs(v) >= 1 {
+			break
+		}
+		prefix = p
+		v *= 1000
+	}
+	return fmt.Sprintf("%.4g%s", v, prefix)
+}
+
+func humanize1024(v float64) string {
+	if math.Abs(v) <= 1 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v)
+	}
+	prefix := ""
+	for _, p := range []string{"ki", "Mi", "Gi", "Ti", "Pi", "Ei", "Zi", "Yi"} {
+		if math.Abs(v) < 1024 {
+			break
+		}
+		prefix = p
+		v /= 1024
+	}
+	return fmt.Sprintf("%.4g%s", v, prefix)
+}
+
+func humanizeDuration(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v)
+	}
+	if v == 0 {
+		return fmt.Sprintf("%.4gs", v)
+	}
+	if math.Abs(v) >= 1 {
+		sign := ""
+		if v < 0 {
+			sign = "-"
+			v = -v
+		}
+		duration := int64(v)
+		seconds := duration % 60
+		minutes := (duration / 60) % 60
+		hours := (duration / 60 / 60) % 24
+		days := duration / 60 / 60 / 24
+		switch {
+		case days != 0:
+			return fmt.Sprintf("%s%dd %dh %dm %ds", sign, days, hours, minutes, seconds)
+		case hours != 0:
+			return fmt.Sprintf("%s%dh %dm %ds", sign, hours, minutes, seconds)
+		case minutes != 0:
+			return fmt.Sprintf("%s%dm %ds", sign, minutes, seconds)
+		}
+		return fmt.Sprintf("%s%.4gs", sign, v)
+	}
+	prefix := ""
+	for _, p := range []string{"m", "u", "n", "p", "f", "a", "z", "y"} {
+		if math.Abs(v) >= 1 {
+			break
+		}
+		prefix = p
+		v *= 1000
+	}
+	return fmt.Sprintf("%.4g%ss", v, prefix)
+}
@@ -0,0 +1,118 @@
+package rules
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// prometheusTemplateFuncs are the functions Prometheus provides to alert
+// templates, from template.NewTemplateExpander.
+var prometheusTemplateFuncs = []string{
+	"args", "externalURL", "first", "graphLink", "humanize", "humanize1024",
+	"humanizeDuration", "humanizePercentage", "humanizeTimestamp", "label",
+	"match", "now", "parseDuration", "pathPrefix", "query", "reReplaceAll",
+	"safeHtml", "sortByLabel", "stripDomain", "stripPort", "strvalue",
+	"tableLink", "title", "toDuration", "toLower", "toTime", "toUpper",
+	"urlQueryEscape", "value",
+}
+
+func TestTemplateFuncsMatchPrometheus(t *testing.T) {
+	var got []string
+	for name := range TemplateFuncs(nil, "") {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != strings.Join(prometheusTemplateFuncs, " ") {
+		t.Errorf("template functions:\n%v\nwant:\n%v", got, prometheusTemplateFuncs)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	query := func(expr string) ([]*QuerySample, error) {
+		switch expr {
+		case "up":
+			return []*QuerySample{
+				{Labels: map[string]string{"instance": "b:9090", "__value__": "1"}, Value: 1},
+				{Labels: map[string]string{"instance": "a:9090", "__value__": "0"}, Value: 0},
+			}, nil
+		case "none":
+			return nil, nil
+		}
+		return nil, errors.New("bad query")
+	}
+	data := TemplateData{
+		Labels:         map[string]string{"instance": "web-1.example.com:9100", "job": "node"},
+		ExternalLabels: map[string]string{"cluster": "prod"},
+		ExternalURL:    "https://prometheus.example.com/prom",
+		Value:          1234.5678,
+	}
+	tests := []struct {
+		fn, text, want, err string
+	}{
+		{"variables", `{{$labels.job}} {{$externalLabels.cluster}} {{$externalURL}} {{$value}}`, "node prod https://prometheus.example.com/prom 1234.5678", ""},
+		{"query", `{{range query "up"}}{{.Labels.instance}} {{end}}`, "b:9090 a:9090 ", ""},
+		{"query", `{{query "bad"}}`, "", "bad query"},
+		{"first", `{{with query "up"}}{{(first .).Value}}{{end}}`, "1", ""},
+		{"first", `{{first (query "none")}}`, "", "first() called on vector with no elements"},
+		{"label", `{{query "up" | first | label "instance"}}`, "b:9090", ""},
+		{"value", `{{query "up" | first | value}}`, "1", ""},
+		{"strvalue", `{{query "up" | first | strvalue}}`, "1", ""},
+		{"args", `{{define "t"}}{{.arg0}}-{{.arg1}}{{end}}{{template "t" args 1 "b"}}`, "1-b", ""},
+		{"reReplaceAll", `{{reReplaceAll "(a)b" "x$1" "abcab"}}`, "xacxa", ""},
+		{"reReplaceAll", `{{reReplaceAll "(" "" "a"}}`, "", "missing closing )"},
+		{"safeHtml", `{{safeHtml "<b>"}}`, "<b>", ""},
+		{"match", `{{match "^web" $labels.instance}} {{match "^db" $labels.instance}}`, "true false", ""},
+		{"title", `{{title "disk full, don't panic on web-1"}}`, "Disk Full, Don't Panic On Web-1", ""},
+		{"title", `{{title "aBC node_exporter"}}`, "ABC Node_exporter", ""},
+		{"toUpper", `{{toUpper "aBc"}}`, "ABC", ""},
+		{"toLower", `{{toLower "aBc"}}`, "abc", ""},
+		{"graphLink", `{{graphLink "up == 0"}}`, "/graph?g0.expr=up+%3D%3D+0&g0.tab=0", ""},
+		{"tableLink", `{{tableLink "up"}}`, "/graph?g0.expr=up&g0.tab=1", ""},
+		{"sortByLabel", `{{range sortByLabel "instance" (query "up")}}{{.Labels.instance}} {{end}}`, "a:9090 b:9090 ", ""},
+		{"humanize", `{{humanize 0}} {{humanize 1234.5678}} {{humanize 0.0012}} {{humanize "2e9"}}`, "0 1.235k 1.2m 2G", ""},
+		{"humanize", `{{humanize "x"}}`, "", `parsing "x"`},
+		{"humanize", `{{humanize true}}`, "", "can't convert bool to float"},
+		{"humanize1024", `{{humanize1024 1}} {{humanize1024 1048576}} {{humanize1024 1536}}`, "1 1Mi 1.5ki", ""},
+		{"humanizeDuration", `{{humanizeDuration 0}} {{humanizeDuration 0.25}} {{humanizeDuration 45}} {{humanizeDuration 3725}} {{humanizeDuration 90061}}`, "0s 250ms 45s 1h 2m 5s 1d 1h 1m 1s", ""},
+		{"humanizeDuration", `{{humanizeDuration -65}}`, "-1m 5s", ""},
+		{"humanizePercentage", `{{humanizePercentage 0.1234567}}`, "12.35%", ""},
+		{"humanizeTimestamp", `{{humanizeTimestamp 1435065584.128}}`, "2015-06-23 13:19:44.128 +0000 UTC", ""},
+		{"humanizeTimestamp", `{{humanizeTimestamp 1e12}}`, "", "overflows int64"},
+		{"toTime", `{{(toTime 1435065584.1289).Format "2006-01-02T15:04:05.000000Z"}}`, "2015-06-23T13:19:44.128000Z", ""},
+		{"toDuration", `{{toDuration 90.5}}`, "1m30.5s", ""},
+		{"parseDuration", `{{parseDuration "1h30m"}}`, "5400", ""},
+		{"parseDuration", `{{parseDuration "1x"}}`, "", "1x"},
+		{"now", `{{if gt now 1e9}}ok{{end}}`, "ok", ""},
+		{"pathPrefix", `{{pathPrefix}}`, "/prom", ""},
+		{"externalURL", `{{externalURL}}`, "https://prometheus.example.com/prom", ""},
+		{"urlQueryEscape", `{{urlQueryEscape "a b&c=d/é"}}`, "a+b%26c%3Dd%2F%C3%A9", ""},
+		{"stripPort", `{{stripPort $labels.instance}} {{stripPort "web-1"}} {{stripPort "[::1]:9100"}}`, "web-1.example.com web-1 ::1", ""},
+		{"stripDomain", `{{stripDomain $labels.instance}} {{stripDomain "web-1.example.com"}} {{stripDomain "10.0.0.1:9100"}}`, "web-1:9100 web-1 10.0.0.1:9100", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fn, func(t *testing.T) {
+			got, err := ExpandTemplate("test", tt.text, data, query)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("%s: error = %v, want it to contain %q", tt.text, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.text, err)
+			}
+			if got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTemplateWithoutQuery(t *testing.T) {
+	_, err := ExpandTemplate("test", `{{query "up"}}`, TemplateData{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "query is not available here") {
+		t.Errorf("error = %v, want query to be unavailable", err)
+	}
+}
@@ -0,0 +1,207 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+)
+
+// LabelsFunc returns the labels of the series a rule expression evaluates
+// to. ok is false when the expression cannot be analysed.
+type LabelsFunc func(expr string) (labels promql.ResultLabels, ok bool)
+
+// templatePrefixRe matches the "template: name:line:col: " prefix of
+// text/template errors, which only repeats the position reported anyway.
+var templatePrefixRe = regexp.MustCompile(`^template: [^:]*:\d+:(\d+:)? `)
+
+// CheckTemplates parses and test-executes the label and annotation
+// templates of every alerting rule in files, with the Prometheus template
+// functions and a synthetic series carrying every label the template
+// reads. Templates that do not parse or fail to execute are errors.
+// References to labels that the expression drops, through by, without or
+// another clause, are warnings: they always expand to an empty string.
+// labels may be nil to skip that check.
+func CheckTemplates(files []*File, labels LabelsFunc) []Violation {
+	var violations []Violation
+	for _, f := range files {
+		for _, g := range f.Groups {
+			for _, r := range g.Rules {
+				if !r.IsAlert() {
+					continue
+				}
+				var result promql.ResultLabels
+				analysed := false
+				if labels != nil {
+					result, analysed = labels(r.Expr)
+				}
+				for _, field := range []string{"labels", "annotations"} {
+					values := r.Labels
+					if field == "annotations" {
+						values = r.Annotations
+					}
+					keys := make([]string, 0, len(values))
+					for k := range values {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						text := values[key]
+						if !strings.Contains(text, "{{") {
+							continue
+						}
+						pos := r.Pos()
+						if n := r.Node.Get(field).Get(key); n != nil {
+							pos = fmt.Sprintf("%s:%d", f.Path, n.Line)
+						}
+						add := func(severity Severity, format string, args ...any) {
+							violations = append(violations, Violation{
+								Severity: severity,
+								Pos:      pos,
+								Group:    g.Name,
+								Rule:     r.Name(),
+								Message:  fmt.Sprintf("%s %q: ", strings.TrimSuffix(field, "s"), key) + fmt.Sprintf(format, args...),
+							})
+						}
+						refs, err := templateLabelRefs(key, text)
+						if err != nil {
+							add(SeverityError, "invalid template: %s", cleanTemplateError(err))
+							continue
+						}
+						data := TemplateData{
+							Labels:         map[string]string{},
+							ExternalLabels: map[string]string{},
+							ExternalURL:    "http://localhost",
+							Value:          1,
+						}
+						for _, l := range refs {
+							data.Labels[l] = "1"
+						}
+						query := func(string) ([]*QuerySample, error) {
+							return []*QuerySample{{Labels: data.Labels, Value: 1}}, nil
+						}
+						if _, err := ExpandTemplate(key, text, data, query); err != nil {
+							add(SeverityError, "template fails to execute: %s", cleanTemplateError(err))
+							continue
+						}
+						if !analysed {
+							continue
+						}
+						for _, l := range refs {
+							if ok, reason := result.Has(l); !ok {
+								add(SeverityWarning, "references label %q, which the expression drops with %s", l, reason)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// ValidateTemplates logs every template finding in files and fails if
+// there are errors.
+func ValidateTemplates(files []*File, labels LabelsFunc) error {
+	errs := 0
+	for _, v := range CheckTemplates(files, labels) {
+		log.Print(v)
+		if v.Severity == SeverityError {
+			errs++
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("found %d invalid alert template(s)", errs)
+	}
+	return nil
+}
+
+// templateLabelRefs parses a template and returns the series labels it
+// reads through $labels.name, index $labels "name" or, outside range and
+// with blocks, .Labels.name.
+func templateLabelRefs(name, text string) ([]string, error) {
+	tmpl, err := template.New(name).Funcs(TemplateFuncs(nil, "")).Parse(templateDefs + text)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var refs []string
+	add := func(l string) {
+		if !seen[l] {
+			seen[l] = true
+			refs = append(refs, l)
+		}
+	}
+	var walk func(n parse.Node, topLevel bool)
+	walk = func(n parse.Node, topLevel bool) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c, topLevel)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, topLevel)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c, topLevel)
+			}
+		case *parse.CommandNode:
+			if len(n.Args) == 3 {
+				fn, isIdent := n.Args[0].(*parse.IdentifierNode)
+				v, isVar := n.Args[1].(*parse.VariableNode)
+				s, isString := n.Args[2].(*parse.StringNode)
+				if isIdent && fn.Ident == "index" && isVar && len(v.Ident) == 1 && v.Ident[0] == "$labels" && isString {
+					add(s.Text)
+				}
+			}
+			for _, c := range n.Args {
+				walk(c, topLevel)
+			}
+		case *parse.VariableNode:
+			if len(n.Ident) >= 2 && n.Ident[0] == "$labels" {
+				add(n.Ident[1])
+			}
+		case *parse.FieldNode:
+			if topLevel && len(n.Ident) >= 2 && n.Ident[0] == "Labels" {
+				add(n.Ident[1])
+			}
+		case *parse.IfNode:
+			walk(n.Pipe, topLevel)
+			walk(n.List, topLevel)
+			walk(n.ElseList, topLevel)
+		case *parse.RangeNode:
+			walk(n.Pipe, topLevel)
+			walk(n.List, false)
+			walk(n.ElseList, topLevel)
+		case *parse.WithNode:
+			walk(n.Pipe, topLevel)
+			walk(n.List, false)
+			walk(n.ElseList, topLevel)
+		case *parse.TemplateNode:
+			walk(n.Pipe, topLevel)
+		}
+	}
+	walk(tmpl.Tree.Root, true)
+	return refs, nil
+}
+
+// cleanTemplateError strips the wrapping and position prefixes of a
+// template error, leaving the cause.
+func cleanTemplateError(err error) string {
+	msg := err.Error()
+	if _, rest, ok := strings.Cut(msg, ": template: "); ok {
+		msg = "template: " + rest
+	}
+	return templatePrefixRe.ReplaceAllString(msg, "")
+}
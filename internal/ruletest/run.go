@@ -0,0 +1,504 @@
+package ruletest
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/rules"
+)
+
+// Options configures a rule test run.
+type Options struct {
+	TestPaths []string // Test files, or directories of them
+	RuleFiles []string // Rule files for test files that list no rule_files
+}
+
+// Run runs every test file and logs each failure. It returns an error when
+// a test fails or a test file cannot be loaded.
+func Run(opts Options) error {
+	files, err := ResolveTestFiles(opts.TestPaths)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no rule test files found in %s", strings.Join(opts.TestPaths, ", "))
+	}
+	failed, total := 0, 0
+	for _, path := range files {
+		log.Printf("Unit testing %s", path)
+		tf, err := loadTestFile(path)
+		if err != nil {
+			return err
+		}
+		ruleFiles := tf.RuleFiles
+		if len(ruleFiles) == 0 {
+			ruleFiles = opts.RuleFiles
+		}
+		if len(ruleFiles) == 0 {
+			return fmt.Errorf("%s: no rule_files listed and no rules path given", path)
+		}
+		parsed, err := rules.LoadFiles(ruleFiles)
+		if err != nil {
+			return err
+		}
+		groups, err := orderGroups(parsed, tf.GroupEvalOrder)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, tg := range tf.Tests {
+			total++
+			errs := runTestGroup(tg, groups, tf.EvaluationInterval)
+			if len(errs) == 0 {
+				continue
+			}
+			failed++
+			log.Printf("  FAILED test %s (%s:%d):", tg.Name, path, tg.Line)
+			for _, e := range errs {
+				log.Printf("    %s", strings.ReplaceAll(e, "\n", "\n    "))
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d rule test(s) failed", failed, total)
+	}
+	log.Printf("SUCCESS: %d rule test(s) passed", total)
+	return nil
+}
+
+// orderGroups returns the groups of files in evaluation order: the order of
+// group_eval_order when given, which must then name every group, and file
+// order otherwise.
+func orderGroups(files []*rules.File, order []string) ([]*rules.Group, error) {
+	var groups []*rules.Group
+	for _, f := range files {
+		groups = append(groups, f.Groups...)
+	}
+	if len(order) == 0 {
+		return groups, nil
+	}
+	byName := map[string]*rules.Group{}
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+	var ordered []*rules.Group
+	for _, name := range order {
+		g, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("group_eval_order names unknown group %q", name)
+		}
+		ordered = append(ordered, g)
+		delete(byName, name)
+	}
+	if len(byName) > 0 {
+		var missing []string
+		for name := range byName {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("group_eval_order does not list group(s) %s", strings.Join(missing, ", "))
+	}
+	return ordered, nil
+}
+
+// alert is an active alert of an alerting rule.
+type alert struct {
+	labels      promql.Labels
+	annotations map[string]string
+	activeAt    int64
+	firing      bool
+
+	// keepFiringSince is when a firing alert first left the result; 0
+	// while it is in the result
+	keepFiringSince int64
+}
+
+// ruleState is what a rule remembers between evaluations.
+type ruleState struct {
+	rule    *rules.Rule
+	expr    promql.Expr
+	holdFor int64
+	keepFor int64
+	alerts  map[string]*alert
+	written map[string]promql.Labels // series written at the last evaluation
+}
+
+// runTestGroup evaluates the rule groups over the test's input series and
+// returns a description of every failed expectation.
+func runTestGroup(tg *testGroup, groups []*rules.Group, evalInterval time.Duration) []string {
+	var errs []string
+	storage := promql.NewStorage()
+	interval := tg.Interval.Milliseconds()
+	for _, s := range tg.InputSeries {
+		for i, v := range s.Values {
+			if !v.missing {
+				storage.Add(s.Labels, int64(i)*interval, v.v)
+			}
+		}
+	}
+	engine := &promql.Engine{Storage: storage, DefaultStep: evalInterval}
+
+	// Parse every rule once; a rule that does not parse fails the test.
+	states := map[*rules.Rule]*ruleState{}
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			st := &ruleState{rule: r, alerts: map[string]*alert{}, written: map[string]promql.Labels{}}
+			expr, err := promql.Parse(r.Expr)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s: %v", r.Pos(), r.Name(), err))
+				continue
+			}
+			st.expr = expr
+			if r.For != "" {
+				d, err := promql.ParseDuration(r.For)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %s: invalid for %q", r.Pos(), r.Name(), r.For))
+					continue
+				}
+				st.holdFor = d.Milliseconds()
+			}
+			if kf := r.Node.Get("keep_firing_for").Text(); kf != "" {
+				d, err := promql.ParseDuration(kf)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %s: invalid keep_firing_for %q", r.Pos(), r.Name(), kf))
+					continue
+				}
+				st.keepFor = d.Milliseconds()
+			}
+			states[r] = st
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	var maxEval time.Duration
+	for _, at := range tg.AlertTests {
+		maxEval = max(maxEval, at.EvalTime)
+	}
+	for _, et := range tg.ExprTests {
+		maxEval = max(maxEval, et.EvalTime)
+	}
+
+	step := evalInterval.Milliseconds()
+	pending := append([]alertTest{}, tg.AlertTests...)
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].EvalTime < pending[j].EvalTime })
+	for ts := int64(0); ts <= maxEval.Milliseconds(); ts += step {
+		for _, g := range groups {
+			groupInterval := step
+			if g.Interval != "" {
+				if d, err := promql.ParseDuration(g.Interval); err == nil && d > 0 {
+					groupInterval = d.Milliseconds()
+				}
+			}
+			if ts%groupInterval != 0 {
+				continue
+			}
+			for _, r := range g.Rules {
+				if err := evalRule(engine, states[r], tg, ts); err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %s: error evaluating at %s: %v", r.Pos(), r.Name(), formatTime(ts), err))
+				}
+			}
+		}
+		// Check the alert tests whose eval_time falls in this step.
+		for len(pending) > 0 && pending[0].EvalTime.Milliseconds() < ts+step {
+			at := pending[0]
+			pending = pending[1:]
+			if msg := checkAlerts(at, groups, states); msg != "" {
+				errs = append(errs, msg)
+			}
+		}
+	}
+
+	for _, et := range tg.ExprTests {
+		if msg := checkExpr(engine, et); msg != "" {
+			errs = append(errs, msg)
+		}
+	}
+	return errs
+}
+
+// evalRule evaluates a recording or alerting rule at ts and writes its
+// output series, with staleness markers for series that disappeared.
+func evalRule(engine *promql.Engine, st *ruleState, tg *testGroup, ts int64) error {
+	r := st.rule
+	v, err := engine.Instant(st.expr, ts)
+	if err != nil {
+		return err
+	}
+	var vec promql.Vector
+	switch v := v.(type) {
+	case promql.Vector:
+		vec = v
+	case promql.Scalar:
+		vec = promql.Vector{{Metric: promql.Labels{}, Point: promql.Point{T: ts, V: v.V}}}
+	default:
+		return fmt.Errorf("rule result is a %s, not an instant vector", v.Type())
+	}
+
+	written := map[string]promql.Labels{}
+	write := func(metric promql.Labels, value float64) error {
+		key := metric.String()
+		if _, dup := written[key]; dup {
+			return fmt.Errorf("vector contains metrics with the same labelset after applying rule labels")
+		}
+		written[key] = metric
+		engine.Storage.Add(metric, ts, value)
+		return nil
+	}
+
+	if !r.IsAlert() {
+		for _, s := range vec {
+			metric := s.Metric.With(promql.MetricName, r.Record)
+			for k, val := range r.Labels {
+				metric = metric.With(k, val)
+			}
+			if err := write(metric, s.V); err != nil {
+				return err
+			}
+		}
+	} else {
+		query := func(q string) ([]*rules.QuerySample, error) {
+			expr, err := promql.Parse(q)
+			if err != nil {
+				return nil, err
+			}
+			res, err := engine.Instant(expr, ts)
+			if err != nil {
+				return nil, err
+			}
+			return querySamples(res), nil
+		}
+		seen := map[string]bool{}
+		for _, s := range vec {
+			data := rules.TemplateData{Labels: s.Metric.Map(), ExternalLabels: tg.ExternalLabels, ExternalURL: tg.ExternalURL, Value: s.V}
+			metric := s.Metric.Without(promql.MetricName)
+			for _, k := range sortedKeys(r.Labels) {
+				metric = metric.With(k, expand("__alert_"+r.Alert, r.Labels[k], data, query))
+			}
+			metric = metric.With("alertname", r.Alert)
+			annotations := map[string]string{}
+			for k, text := range r.Annotations {
+				annotations[k] = expand("__alert_"+r.Alert, text, data, query)
+			}
+			key := metric.String()
+			if seen[key] {
+				return fmt.Errorf("vector contains metrics with the same labelset after applying alert labels")
+			}
+			seen[key] = true
+			a, ok := st.alerts[key]
+			if !ok {
+				a = &alert{labels: metric, activeAt: ts}
+				st.alerts[key] = a
+			}
+			a.annotations = annotations
+			a.keepFiringSince = 0
+		}
+		for key, a := range st.alerts {
+			if !seen[key] {
+				// Gone from the result: pending alerts are dropped, firing
+				// ones resolve once keep_firing_for has passed since they
+				// first went missing.
+				if a.firing && a.keepFiringSince == 0 {
+					a.keepFiringSince = ts
+				}
+				if !a.firing || ts-a.keepFiringSince >= st.keepFor {
+					delete(st.alerts, key)
+					continue
+				}
+			}
+			if !a.firing && ts-a.activeAt >= st.holdFor {
+				a.firing = true
+			}
+		}
+		for _, key := range sortedKeys(st.alerts) {
+			a := st.alerts[key]
+			state := "pending"
+			if a.firing {
+				state = "firing"
+			}
+			metric := a.labels.With(promql.MetricName, "ALERTS").With("alertstate", state)
+			if err := write(metric, 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, metric := range st.written {
+		if _, ok := written[key]; !ok {
+			engine.Storage.Add(metric, ts, promql.StaleMarker())
+		}
+	}
+	st.written = written
+	return nil
+}
+
+// expand executes a label or annotation template; failures are reported in
+// the result the way Prometheus does.
+func expand(name, text string, data rules.TemplateData, query rules.QueryFunc) string {
+	out, err := rules.ExpandTemplate(name, text, data, query)
+	if err != nil {
+		return fmt.Sprintf("<error expanding template: %v>", err)
+	}
+	return out
+}
+
+func querySamples(v promql.Value) []*rules.QuerySample {
+	switch v := v.(type) {
+	case promql.Vector:
+		out := make([]*rules.QuerySample, len(v))
+		for i, s := range v {
+			out[i] = &rules.QuerySample{Labels: s.Metric.Map(), Value: s.V}
+		}
+		return out
+	case promql.Scalar:
+		return []*rules.QuerySample{{Labels: map[string]string{}, Value: v.V}}
+	}
+	return nil
+}
+
+// checkAlerts compares the firing alerts named at.Alertname with the
+// expected ones.
+func checkAlerts(at alertTest, groups []*rules.Group, states map[*rules.Rule]*ruleState) string {
+	var got []string
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			if r.Alert != at.Alertname {
+				continue
+			}
+			for _, a := range states[r].alerts {
+				if a.firing {
+					got = append(got, formatAlert(a.labels, a.annotations))
+				}
+			}
+		}
+	}
+	var exp []string
+	for _, e := range at.ExpAlerts {
+		labels := map[string]string{"alertname": at.Alertname}
+		for k, v := range e.Labels {
+			labels[k] = v
+		}
+		exp = append(exp, formatAlert(promql.LabelsFromMap(labels), e.Annotations))
+	}
+	sort.Strings(got)
+	sort.Strings(exp)
+	if strings.Join(got, "\n") == strings.Join(exp, "\n") {
+		return ""
+	}
+	return fmt.Sprintf("alertname: %s, time: %s (line %d),\n    exp: %s,\n    got: %s",
+		at.Alertname, formatDuration(at.EvalTime), at.Line, formatList(exp), formatList(got))
+}
+
+func formatAlert(labels promql.Labels, annotations map[string]string) string {
+	return fmt.Sprintf("Labels:%s Annotations:%s", labels.String(), promql.LabelsFromMap(annotations).String())
+}
+
+// checkExpr evaluates a promql_expr_test and compares its samples.
+func checkExpr(engine *promql.Engine, et exprTest) string {
+	fail := func(format string, args ...any) string {
+		return fmt.Sprintf("expr: %q, time: %s (line %d),%s", et.Expr, formatDuration(et.EvalTime), et.Line, fmt.Sprintf(format, args...))
+	}
+	expr, err := promql.Parse(et.Expr)
+	if err != nil {
+		return fail(" error: %v", err)
+	}
+	res, err := engine.Instant(expr, et.EvalTime.Milliseconds())
+	if err != nil {
+		return fail(" error: %v", err)
+	}
+	var got []expSample
+	switch v := res.(type) {
+	case promql.Vector:
+		for _, s := range v {
+			got = append(got, expSample{Labels: s.Metric, Value: s.V})
+		}
+	case promql.Scalar:
+		got = append(got, expSample{Labels: promql.Labels{}, Value: v.V})
+	default:
+		return fail(" expected an instant vector or scalar result, got %s", res.Type())
+	}
+	exp := append([]expSample{}, et.ExpSamples...)
+	sortSamples(got)
+	sortSamples(exp)
+	match := len(got) == len(exp)
+	for i := 0; match && i < len(got); i++ {
+		match = got[i].Labels.String() == exp[i].Labels.String() && almostEqual(got[i].Value, exp[i].Value)
+	}
+	if match {
+		return ""
+	}
+	return fail("\n    exp: %s,\n    got: %s", formatSamples(exp), formatSamples(got))
+}
+
+func sortSamples(s []expSample) {
+	sort.SliceStable(s, func(i, j int) bool { return s[i].Labels.String() < s[j].Labels.String() })
+}
+
+func formatSamples(s []expSample) string {
+	items := make([]string, len(s))
+	for i, x := range s {
+		items[i] = fmt.Sprintf("%s %g", x.Labels.String(), x.Value)
+	}
+	return formatList(items)
+}
+
+func formatList(items []string) string {
+	if len(items) == 0 {
+		return "[]"
+	}
+	return "[\n      " + strings.Join(items, "\n      ") + "\n    ]"
+}
+
+// almostEqual compares with the same relative tolerance as promtool.
+func almostEqual(a, b float64) bool {
+	const epsilon = 1e-6
+	const minNormal = 0x1p-1022 // smallest normal float64
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	absSum := math.Abs(a) + math.Abs(b)
+	diff := math.Abs(a - b)
+	if a == 0 || b == 0 || absSum < minNormal {
+		return diff < epsilon*minNormal
+	}
+	return diff/math.Min(absSum, math.MaxFloat64) < epsilon
+}
+
+func formatTime(ts int64) string {
+	return formatDuration(time.Duration(ts) * time.Millisecond)
+}
+
+// formatDuration formats d the way durations are written in test files.
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, u := range []struct {
+		unit string
+		d    time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}, {"ms", time.Millisecond}} {
+		if n := d / u.d; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.unit)
+			d -= n * u.d
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
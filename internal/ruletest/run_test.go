@@ -0,0 +1,242 @@
+package ruletest
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/rules"
+)
+
+const testRules = `groups:
+  - name: g
+    rules:
+      - alert: Down
+        expr: up == 0
+        for: 2m
+        labels:
+          severity: page
+        annotations:
+          summary: '{{ $labels.job }} is down ({{ $value }})'
+      - alert: Flapping
+        expr: up == 0
+        keep_firing_for: 3m
+      - alert: Held
+        expr: up == 0
+        for: 1m
+        keep_firing_for: 2m
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`
+
+// testHeader is the start of every test file below: the api job is down
+// from 1m to 4m and at 10m.
+const testHeader = `rule_files: [rules.yaml]
+evaluation_interval: 1m
+tests:
+  - interval: 1m
+    input_series:
+      - series: 'up{job="api"}'
+        values: '1 0 0 0 0 1 1 1 1 1 0 1 1 1'
+`
+
+// writeTest writes testRules and a test file made of testHeader and tests,
+// and returns the path of the test file.
+func writeTest(t *testing.T, tests string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(testRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.yaml")
+	if err := os.WriteFile(path, []byte(testHeader+tests), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// promtool 3.9 passes this test file as well.
+func TestRunAlertStates(t *testing.T) {
+	path := writeTest(t, `    alert_rule_test:
+      # Down is pending for 2m before it fires, and resolves at once
+      - {eval_time: 0m, alertname: Down}
+      - {eval_time: 1m, alertname: Down}
+      - eval_time: 3m
+        alertname: Down
+        exp_alerts:
+          - exp_labels: {job: api, severity: page}
+            exp_annotations: {summary: api is down (0)}
+      - {eval_time: 5m, alertname: Down}
+      - {eval_time: 10m, alertname: Down}
+      # Flapping fires at once and keeps firing for 3m from 5m, when it
+      # first went missing
+      - eval_time: 1m
+        alertname: Flapping
+        exp_alerts: [{exp_labels: {job: api}}]
+      - eval_time: 7m
+        alertname: Flapping
+        exp_alerts: [{exp_labels: {job: api}}]
+      - {eval_time: 8m, alertname: Flapping}
+      - eval_time: 12m
+        alertname: Flapping
+        exp_alerts: [{exp_labels: {job: api}}]
+      # Held is pending for 1m and keeps firing for 2m
+      - {eval_time: 1m, alertname: Held}
+      - eval_time: 2m
+        alertname: Held
+        exp_alerts: [{exp_labels: {job: api}}]
+      - eval_time: 6m
+        alertname: Held
+        exp_alerts: [{exp_labels: {job: api}}]
+      - {eval_time: 7m, alertname: Held}
+    promql_expr_test:
+      - expr: job:up:sum
+        eval_time: 2m
+        exp_samples:
+          - labels: 'job:up:sum{job="api"}'
+            value: 0
+      - expr: ALERTS{alertname="Down"}
+        eval_time: 2m
+        exp_samples:
+          - labels: 'ALERTS{alertname="Down", alertstate="pending", job="api", severity="page"}'
+            value: 1
+`)
+	if err := Run(Options{TestPaths: []string{path}}); err != nil {
+		t.Error(err)
+	}
+}
+
+// promtool 3.9 fails each of these tests too.
+func TestRunFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		tests string
+		want  []string
+	}{
+		{
+			name: "pending alert expected to fire",
+			tests: `    alert_rule_test:
+      - eval_time: 2m
+        alertname: Down
+        exp_alerts: [{exp_labels: {job: api, severity: page}, exp_annotations: {summary: api is down (0)}}]
+`,
+			want: []string{"alertname: Down, time: 2m (line 9),\n    exp: [\n      Labels:{alertname=\"Down\", job=\"api\", severity=\"page\"} Annotations:{summary=\"api is down (0)\"}\n    ],\n    got: []"},
+		},
+		{
+			name: "resolved alert expected to keep firing",
+			tests: `    alert_rule_test:
+      - eval_time: 8m
+        alertname: Flapping
+        exp_alerts: [{exp_labels: {job: api}}]
+`,
+			want: []string{"alertname: Flapping, time: 8m (line 9),\n    exp: [\n      Labels:{alertname=\"Flapping\", job=\"api\"} Annotations:{}\n    ],\n    got: []"},
+		},
+		{
+			name: "missing label",
+			tests: `    alert_rule_test:
+      - eval_time: 3m
+        alertname: Down
+        exp_alerts: [{exp_labels: {job: api}, exp_annotations: {summary: api is down (0)}}]
+`,
+			want: []string{"alertname: Down, time: 3m (line 9),\n    exp: [\n      Labels:{alertname=\"Down\", job=\"api\"} Annotations:{summary=\"api is down (0)\"}\n    ],\n    got: [\n      Labels:{alertname=\"Down\", job=\"api\", severity=\"page\"} Annotations:{summary=\"api is down (0)\"}\n    ]"},
+		},
+		{
+			name: "other annotation",
+			tests: `    alert_rule_test:
+      - eval_time: 3m
+        alertname: Down
+        exp_alerts: [{exp_labels: {job: api, severity: page}, exp_annotations: {summary: api is down}}]
+`,
+			want: []string{`alertname: Down, time: 3m (line 9)`},
+		},
+		{
+			name: "alert expected once too often",
+			tests: `    alert_rule_test:
+      - eval_time: 1m
+        alertname: Flapping
+        exp_alerts: [{exp_labels: {job: api}}, {exp_labels: {job: api}}]
+`,
+			want: []string{`alertname: Flapping, time: 1m (line 9)`},
+		},
+		{
+			name: "sample value",
+			tests: `    promql_expr_test:
+      - expr: job:up:sum
+        eval_time: 5m
+        exp_samples: [{labels: 'job:up:sum{job="api"}', value: 0}]
+`,
+			want: []string{"expr: \"job:up:sum\", time: 5m (line 9),\n    exp: [\n      job:up:sum{job=\"api\"} 0\n    ],\n    got: [\n      job:up:sum{job=\"api\"} 1\n    ]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTest(t, tt.tests)
+			tf, err := loadTestFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := rules.LoadFiles(tf.RuleFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, err := orderGroups(parsed, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs := runTestGroup(tf.Tests[0], groups, tf.EvaluationInterval)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("failures = %q, want %d", errs, len(tt.want))
+			}
+			for i, e := range errs {
+				if !strings.HasPrefix(e, tt.want[i]) {
+					t.Errorf("failure %d =\n%s\nwant\n%s", i, e, tt.want[i])
+				}
+			}
+			if err := Run(Options{TestPaths: []string{path}}); err == nil || err.Error() != "1 of 1 rule test(s) failed" {
+				t.Errorf("Run error = %v", err)
+			}
+		})
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"1 2 3", "1 2 3"},
+		{"1+2x3", "1 3 5 7"},
+		{"10-1x2 _ 4", "10 9 8 _ 4"},
+		{"_x3 2x2", "_ _ _ 2 2 2"},
+		{"1e3 -Inf stale", "1000 -Inf stale"},
+	}
+	for _, tt := range tests {
+		values, err := parseValues(tt.in)
+		if err != nil {
+			t.Errorf("parseValues(%q): %v", tt.in, err)
+			continue
+		}
+		var got []string
+		for _, v := range values {
+			switch {
+			case v.missing:
+				got = append(got, "_")
+			case promql.IsStaleMarker(v.v):
+				got = append(got, "stale")
+			default:
+				got = append(got, strconv.FormatFloat(v.v, 'g', -1, 64))
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("parseValues(%q) = %s, want %s", tt.in, strings.Join(got, " "), tt.want)
+		}
+	}
+	for _, in := range []string{"a", "1x", "1+x2", "stalex2", "1x-1"} {
+		if _, err := parseValues(in); err == nil {
+			t.Errorf("parseValues(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package ruletest
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+)
+
+// parseLabels parses a series description such as up{job="api"} or
+// {job="api"}. Only equality matchers are allowed.
+func parseLabels(s string) (promql.Labels, error) {
+	if t := strings.TrimSpace(s); t == "" || t == "{}" {
+		return promql.Labels{}, nil
+	}
+	expr, err := promql.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid series %q: %w", s, err)
+	}
+	vs, ok := expr.(*promql.VectorSelector)
+	if !ok || vs.Offset != "" || vs.At != "" {
+		return nil, fmt.Errorf("invalid series %q: expected a metric name with labels", s)
+	}
+	m := map[string]string{}
+	if vs.Name != "" {
+		m[promql.MetricName] = vs.Name
+	}
+	for _, lm := range vs.Matchers {
+		if lm.Op != "=" {
+			return nil, fmt.Errorf("invalid series %q: only = may be used for labels", s)
+		}
+		m[lm.Name] = lm.Value
+	}
+	return promql.LabelsFromMap(m), nil
+}
+
+// sampleValue is one step of an input series; missing steps have no
+// sample.
+type sampleValue struct {
+	v       float64
+	missing bool
+}
+
+// parseValues expands the promtool series notation: numbers, "_" for a
+// missing sample, "stale", "a+bxn" and "a-bxn" for n+1 samples starting at
+// a and growing by b, "axn" for n+1 samples of a and "_xn" for n missing
+// samples.
+func parseValues(s string) ([]sampleValue, error) {
+	var out []sampleValue
+	for _, item := range strings.Fields(s) {
+		switch {
+		case item == "_":
+			out = append(out, sampleValue{missing: true})
+			continue
+		case item == "stale":
+			out = append(out, sampleValue{v: promql.StaleMarker()})
+			continue
+		}
+		x := strings.LastIndexByte(item, 'x')
+		if x < 0 {
+			v, err := parseFloat(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q in series values", item)
+			}
+			out = append(out, sampleValue{v: v})
+			continue
+		}
+		n, err := strconv.Atoi(item[x+1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid repetition %q in series values", item)
+		}
+		head := item[:x]
+		if head == "_" {
+			for i := 0; i < n; i++ {
+				out = append(out, sampleValue{missing: true})
+			}
+			continue
+		}
+		if head == "stale" {
+			return nil, fmt.Errorf("invalid value %q in series values: stale cannot be repeated", item)
+		}
+		start, step, err := splitExpansion(head)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q in series values: %w", item, err)
+		}
+		for i := 0; i <= n; i++ {
+			out = append(out, sampleValue{v: start + float64(i)*step})
+		}
+	}
+	return out, nil
+}
+
+// splitExpansion splits "a+b" or "a-b" into a and the signed step; a plain
+// "a" has step 0.
+func splitExpansion(s string) (float64, float64, error) {
+	if v, err := parseFloat(s); err == nil {
+		return v, 0, nil
+	}
+	for i := len(s) - 1; i > 0; i-- {
+		if (s[i] == '+' || s[i] == '-') && s[i-1] != 'e' && s[i-1] != 'E' {
+			start, err := parseFloat(s[:i])
+			if err != nil {
+				return 0, 0, err
+			}
+			step, err := parseFloat(s[i+1:])
+			if err != nil {
+				return 0, 0, err
+			}
+			if s[i] == '-' {
+				step = -step
+			}
+			return start, step, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("expected a, a+b or a-b")
+}
+
+func parseFloat(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,266 @@
+// Package ruletest runs rule unit tests written in the promtool
+// "test rules" format against an embedded PromQL engine, so alerting and
+// recording rules can be tested without a running Mimir.
+package ruletest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/promql"
+	"github.com/antnsn/mal-sync/internal/rules"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// testFile is a parsed test file:
+//
+//	rule_files: [rules.yaml]
+//	evaluation_interval: 1m
+//	group_eval_order: [group-a, group-b]
+//	tests:
+//	  - interval: 1m
+//	    input_series:
+//	      - series: 'up{job="api"}'
+//	        values: '1 1 0x10'
+//	    alert_rule_test:
+//	      - eval_time: 10m
+//	        alertname: ApiDown
+//	        exp_alerts:
+//	          - exp_labels: {job: api, severity: critical}
+//	            exp_annotations: {summary: API is down}
+//	    promql_expr_test:
+//	      - expr: up
+//	        eval_time: 1m
+//	        exp_samples:
+//	          - labels: 'up{job="api"}'
+//	            value: 1
+type testFile struct {
+	Path               string
+	RuleFiles          []string
+	EvaluationInterval time.Duration
+	GroupEvalOrder     []string
+	Tests              []*testGroup
+}
+
+type testGroup struct {
+	Name           string
+	Line           int
+	Interval       time.Duration
+	InputSeries    []inputSeries
+	AlertTests     []alertTest
+	ExprTests      []exprTest
+	ExternalLabels map[string]string
+	ExternalURL    string
+}
+
+type inputSeries struct {
+	Labels promql.Labels
+	Values []sampleValue
+}
+
+type alertTest struct {
+	Line      int
+	EvalTime  time.Duration
+	Alertname string
+	ExpAlerts []expAlert
+}
+
+type expAlert struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+type exprTest struct {
+	Line       int
+	Expr       string
+	EvalTime   time.Duration
+	ExpSamples []expSample
+}
+
+type expSample struct {
+	Labels promql.Labels
+	Value  float64
+}
+
+// ResolveTestFiles lists the test files under the given paths: the *.yaml
+// and *.yml files of directories, and files as given.
+func ResolveTestFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat rule tests path %s: %w", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rule tests directory %s: %w", path, err)
+		}
+		var dirFiles []string
+		for _, entry := range entries {
+			if !entry.IsDir() && rules.IsYAMLFile(entry.Name()) {
+				dirFiles = append(dirFiles, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+func loadTestFile(path string) (*testFile, error) {
+	docs, err := yamlnode.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) != 1 || docs[0].Kind != yamlnode.MappingNode {
+		return nil, fmt.Errorf("%s: test file must be a single YAML mapping", path)
+	}
+	doc := docs[0]
+	tf := &testFile{Path: path, EvaluationInterval: time.Minute}
+	fail := func(n *yamlnode.Node, format string, args ...any) error {
+		return fmt.Errorf("%s:%d: %s", path, n.Line, fmt.Sprintf(format, args...))
+	}
+	for _, key := range doc.Keys() {
+		n := doc.Get(key)
+		switch key {
+		case "rule_files":
+			for _, item := range n.Items() {
+				pattern := item.Text()
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil || len(matches) == 0 {
+					return nil, fail(item, "rule file %s not found", item.Text())
+				}
+				tf.RuleFiles = append(tf.RuleFiles, matches...)
+			}
+		case "evaluation_interval":
+			d, err := promql.ParseDuration(n.Text())
+			if err != nil || d <= 0 {
+				return nil, fail(n, "invalid evaluation_interval %q", n.Text())
+			}
+			tf.EvaluationInterval = d
+		case "group_eval_order":
+			for _, item := range n.Items() {
+				tf.GroupEvalOrder = append(tf.GroupEvalOrder, item.Text())
+			}
+		case "tests":
+		default:
+			return nil, fail(n, "unknown key %q", key)
+		}
+	}
+	for i, tn := range doc.Get("tests").Items() {
+		tg, err := parseTestGroup(tn, tf.EvaluationInterval)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", path, err)
+		}
+		if tg.Name == "" {
+			tg.Name = "#" + strconv.Itoa(i+1)
+		}
+		tf.Tests = append(tf.Tests, tg)
+	}
+	return tf, nil
+}
+
+// parseTestGroup parses one entry of tests. Errors start with the line
+// number, to be prefixed with the file name.
+func parseTestGroup(tn *yamlnode.Node, defaultInterval time.Duration) (*testGroup, error) {
+	fail := func(n *yamlnode.Node, format string, args ...any) error {
+		return fmt.Errorf("%d: %s", n.Line, fmt.Sprintf(format, args...))
+	}
+	duration := func(n *yamlnode.Node, what string) (time.Duration, error) {
+		d, err := promql.ParseDuration(n.Text())
+		if err != nil {
+			return 0, fail(n, "invalid %s %q", what, n.Text())
+		}
+		return d, nil
+	}
+	tg := &testGroup{Name: tn.Get("name").Text(), Line: tn.Line, Interval: defaultInterval, ExternalURL: tn.Get("external_url").Text()}
+	for _, key := range tn.Keys() {
+		switch key {
+		case "name", "interval", "input_series", "alert_rule_test", "promql_expr_test", "external_labels", "external_url":
+		default:
+			return nil, fail(tn.Get(key), "unknown key %q in test", key)
+		}
+	}
+	if n := tn.Get("interval"); !n.IsNull() {
+		d, err := duration(n, "interval")
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fail(n, "interval must be positive")
+		}
+		tg.Interval = d
+	}
+	tg.ExternalLabels = map[string]string{}
+	for _, k := range tn.Get("external_labels").Keys() {
+		tg.ExternalLabels[k] = tn.Get("external_labels").Get(k).Text()
+	}
+	for _, sn := range tn.Get("input_series").Items() {
+		labels, err := parseLabels(sn.Get("series").Text())
+		if err != nil {
+			return nil, fail(sn, "%v", err)
+		}
+		values, err := parseValues(sn.Get("values").Text())
+		if err != nil {
+			return nil, fail(sn, "%v", err)
+		}
+		tg.InputSeries = append(tg.InputSeries, inputSeries{Labels: labels, Values: values})
+	}
+	for _, an := range tn.Get("alert_rule_test").Items() {
+		at := alertTest{Line: an.Line, Alertname: an.Get("alertname").Text()}
+		var err error
+		if at.EvalTime, err = duration(an.Get("eval_time"), "eval_time"); err != nil {
+			return nil, err
+		}
+		if at.Alertname == "" {
+			return nil, fail(an, "alert_rule_test needs an alertname")
+		}
+		for _, en := range an.Get("exp_alerts").Items() {
+			at.ExpAlerts = append(at.ExpAlerts, expAlert{
+				Labels:      textMap(en.Get("exp_labels")),
+				Annotations: textMap(en.Get("exp_annotations")),
+			})
+		}
+		tg.AlertTests = append(tg.AlertTests, at)
+	}
+	for _, en := range tn.Get("promql_expr_test").Items() {
+		et := exprTest{Line: en.Line, Expr: en.Get("expr").Text()}
+		var err error
+		if et.EvalTime, err = duration(en.Get("eval_time"), "eval_time"); err != nil {
+			return nil, err
+		}
+		for _, sn := range en.Get("exp_samples").Items() {
+			labels, err := parseLabels(sn.Get("labels").Text())
+			if err != nil {
+				return nil, fail(sn, "%v", err)
+			}
+			v, err := parseFloat(strings.TrimSpace(sn.Get("value").Text()))
+			if err != nil {
+				return nil, fail(sn, "invalid value %q", sn.Get("value").Text())
+			}
+			et.ExpSamples = append(et.ExpSamples, expSample{Labels: labels, Value: v})
+		}
+		tg.ExprTests = append(tg.ExprTests, et)
+	}
+	return tg, nil
+}
+
+func textMap(n *yamlnode.Node) map[string]string {
+	m := map[string]string{}
+	for _, k := range n.Keys() {
+		m[k] = n.Get(k).Text()
+	}
+	return m
+}
@@ -0,0 +1,112 @@
+package silences
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the path of the Alertmanager v2 API under Mimir's default
+// Alertmanager HTTP prefix.
+const apiPrefix = "/alertmanager/api/v2"
+
+// apiMatcher is a matcher as represented by the Alertmanager v2 API.
+type apiMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// apiSilence is a silence as represented by the Alertmanager v2 API.
+type apiSilence struct {
+	ID        string       `json:"id,omitempty"`
+	Matchers  []apiMatcher `json:"matchers"`
+	StartsAt  time.Time    `json:"startsAt"`
+	EndsAt    time.Time    `json:"endsAt"`
+	CreatedBy string       `json:"createdBy"`
+	Comment   string       `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+func (s apiSilence) state() string {
+	if s.Status == nil {
+		return ""
+	}
+	return s.Status.State
+}
+
+// client talks to the Alertmanager silences API of a single Mimir tenant.
+type client struct {
+	address  string
+	tenantID string
+	http     *http.Client
+}
+
+func (c *client) do(method, path string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body for %s %s: %w", method, path, err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	url := strings.TrimSuffix(c.address, "/") + apiPrefix + path
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to build request %s %s: %w", method, url, err)
+	}
+	req.Header.Set("X-Scope-OrgID", c.tenantID)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("request %s %s failed: %w", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response of %s %s: %w", method, url, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("request %s %s returned %s: %s", method, url, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to decode response of %s %s: %w", method, url, err)
+		}
+	}
+	return nil
+}
+
+func (c *client) list() ([]apiSilence, error) {
+	var out []apiSilence
+	if err := c.do(http.MethodGet, "/silences", nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// put creates a silence, or replaces the silence with the same ID.
+func (c *client) put(s apiSilence) (string, error) {
+	var out struct {
+		SilenceID string `json:"silenceID"`
+	}
+	s.Status = nil
+	if err := c.do(http.MethodPost, "/silences", s, &out); err != nil {
+		return "", err
+	}
+	return out.SilenceID, nil
+}
+
+func (c *client) expire(id string) error {
+	return c.do(http.MethodDelete, "/silence/"+id, nil, nil)
+}
@@ -0,0 +1,336 @@
+package silences
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/alertmanager"
+	"github.com/antnsn/mal-sync/internal/state"
+	"github.com/antnsn/mal-sync/internal/yamlnode"
+)
+
+// markerRe matches the ownership marker mal-sync appends to the comment of
+// every silence it manages. Silences without it are never touched.
+var markerRe = regexp.MustCompile(`\s*\[mal-sync:([^\]]+)\]$`)
+
+const defaultCreatedBy = "mal-sync"
+
+// Options configures a silences sync.
+type Options struct {
+	Path         string // Directory of silence files (*.yaml, *.yml) or a single file
+	MimirAddress string
+	MimirID      string
+	HTTPClient   *http.Client // Optional; defaults to a client with a 30s timeout
+	State        state.Store  // Optional; records when silences declared with only a duration first started
+	Now          func() time.Time
+}
+
+// Silence is a silence declared in a silences file.
+type Silence struct {
+	Name      string
+	Matchers  []alertmanager.Matcher
+	StartsAt  time.Time // zero means "when created"
+	EndsAt    time.Time // zero when Duration is used
+	Duration  time.Duration
+	CreatedBy string
+	Comment   string
+	Source    string // file:line of the declaration
+}
+
+// Sync reconciles the silences declared under opts.Path with the silences of
+// the tenant: missing silences are created, changed ones are updated and
+// managed silences that are no longer declared are expired. A silence
+// declared with only a duration keeps the start it was first created with,
+// so it is not created again once it has ended.
+func Sync(opts Options) error {
+	log.Printf("Starting silences sync for Mimir instance: %s (ID: %s)", opts.MimirAddress, opts.MimirID)
+	log.Printf("Silences path: %s", opts.Path)
+
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	c := &client{address: opts.MimirAddress, tenantID: opts.MimirID, http: httpClient}
+
+	// 1. Load the declared silences
+	declared, err := Load(opts.Path)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d declared silence(s)", len(declared))
+
+	// 2. Fetch the current silences and index the ones we manage. Expired
+	// silences still tell when each silence first started
+	existing, err := c.list()
+	if err != nil {
+		return fmt.Errorf("failed to list silences: %w", err)
+	}
+	managed := map[string][]apiSilence{}
+	starts := map[string]time.Time{}
+	for _, s := range existing {
+		m := markerRe.FindStringSubmatch(s.Comment)
+		if m == nil {
+			continue
+		}
+		if start, ok := starts[m[1]]; !ok || s.StartsAt.Before(start) {
+			starts[m[1]] = s.StartsAt
+		}
+		if s.state() == "expired" {
+			continue
+		}
+		managed[m[1]] = append(managed[m[1]], s)
+	}
+	// Alertmanager forgets expired silences after its retention period;
+	// the state file remembers their starts for as long as they are declared
+	target := "silences " + opts.MimirAddress + " " + opts.MimirID
+	if opts.State.Enabled() {
+		last, err := opts.State.Load(target)
+		if err != nil {
+			return err
+		}
+		for name, start := range last.Starts {
+			if cur, ok := starts[name]; !ok || start.Before(cur) {
+				starts[name] = start
+			}
+		}
+	}
+
+	// 3. Create or update declared silences
+	current := now()
+	wanted := map[string]bool{}
+	nextStarts := map[string]time.Time{}
+	for _, d := range declared {
+		wanted[d.Name] = true
+		owned := managed[d.Name]
+		desired := d.toAPI(current)
+		if d.StartsAt.IsZero() && d.Duration > 0 {
+			// Keep the first start, so updates do not reset the window and
+			// an ended silence is not created again
+			if start, ok := starts[d.Name]; ok {
+				desired.StartsAt = start
+				desired.EndsAt = start.Add(d.Duration)
+			}
+			nextStarts[d.Name] = desired.StartsAt
+		}
+		if !desired.EndsAt.After(current) {
+			log.Printf("Silence %s (%s) has already ended at %s; skipping", d.Name, d.Source, desired.EndsAt.Format(time.RFC3339))
+			wanted[d.Name] = false
+			continue
+		}
+		if len(owned) > 0 && d.matches(owned[0]) {
+			log.Printf("Silence %s is up to date (ID: %s)", d.Name, owned[0].ID)
+		} else {
+			if len(owned) > 0 {
+				desired.ID = owned[0].ID
+				log.Printf("Updating silence %s (ID: %s)", d.Name, desired.ID)
+			} else {
+				log.Printf("Creating silence %s", d.Name)
+			}
+			id, err := c.put(desired)
+			if err != nil {
+				return fmt.Errorf("failed to apply silence %s (%s): %w", d.Name, d.Source, err)
+			}
+			log.Printf("Silence %s applied (ID: %s)", d.Name, id)
+		}
+		// Only one silence per name should exist; expire any extras.
+		for _, extra := range owned[min(1, len(owned)):] {
+			log.Printf("Expiring duplicate silence %s (ID: %s)", d.Name, extra.ID)
+			if err := c.expire(extra.ID); err != nil {
+				return fmt.Errorf("failed to expire duplicate silence %s (ID: %s): %w", d.Name, extra.ID, err)
+			}
+		}
+	}
+
+	// 4. Expire managed silences that are no longer declared
+	var names []string
+	for name := range managed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if wanted[name] {
+			continue
+		}
+		for _, s := range managed[name] {
+			log.Printf("Expiring silence %s (ID: %s), no longer declared", name, s.ID)
+			if err := c.expire(s.ID); err != nil {
+				return fmt.Errorf("failed to expire silence %s (ID: %s): %w", name, s.ID, err)
+			}
+		}
+	}
+
+	if err := opts.State.Save(target, &state.Target{Starts: nextStarts}); err != nil {
+		return err
+	}
+
+	log.Println("Silences reconciled successfully.")
+	return nil
+}
+
+// toAPI converts a declared silence into its API representation, resolving
+// relative start and end times against now.
+func (d Silence) toAPI(now time.Time) apiSilence {
+	s := apiSilence{
+		StartsAt:  d.StartsAt,
+		EndsAt:    d.EndsAt,
+		CreatedBy: d.CreatedBy,
+		Comment:   fmt.Sprintf("%s [mal-sync:%s]", d.Comment, d.Name),
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if d.Duration > 0 {
+		s.EndsAt = s.StartsAt.Add(d.Duration)
+	}
+	for _, m := range d.Matchers {
+		s.Matchers = append(s.Matchers, apiMatcher{Name: m.Name, Value: m.Value, IsRegex: m.IsRegex(), IsEqual: m.IsEqual()})
+	}
+	return s
+}
+
+// matches reports whether an existing silence already implements d. A
+// silence declared with a duration and no start is compared on everything
+// but its time window, which was fixed when it was created.
+func (d Silence) matches(s apiSilence) bool {
+	if s.CreatedBy != d.CreatedBy || s.Comment != fmt.Sprintf("%s [mal-sync:%s]", d.Comment, d.Name) {
+		return false
+	}
+	if !d.StartsAt.IsZero() && !s.StartsAt.Equal(d.StartsAt) {
+		return false
+	}
+	switch {
+	case !d.EndsAt.IsZero():
+		if !s.EndsAt.Equal(d.EndsAt) {
+			return false
+		}
+	case !d.StartsAt.IsZero():
+		if !s.EndsAt.Equal(d.StartsAt.Add(d.Duration)) {
+			return false
+		}
+	}
+	if len(s.Matchers) != len(d.Matchers) {
+		return false
+	}
+	want := map[apiMatcher]bool{}
+	for _, m := range d.Matchers {
+		want[apiMatcher{Name: m.Name, Value: m.Value, IsRegex: m.IsRegex(), IsEqual: m.IsEqual()}] = true
+	}
+	for _, m := range s.Matchers {
+		if !want[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// Load reads the silences declared in a file or in the *.yaml and *.yml
+// files of a directory. Each file holds a top-level "silences" list.
+func Load(path string) ([]Silence, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat silences path %s: %w", path, err)
+	}
+	var files []string
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read silences directory %s: %w", path, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".yaml") || strings.HasSuffix(entry.Name(), ".yml")) {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	} else {
+		files = []string{path}
+	}
+
+	var out []Silence
+	seen := map[string]string{}
+	for _, file := range files {
+		docs, err := yamlnode.ParseFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			for _, item := range doc.Get("silences").Items() {
+				s, err := parseSilence(item, file)
+				if err != nil {
+					return nil, err
+				}
+				if prev, dup := seen[s.Name]; dup {
+					return nil, fmt.Errorf("silence %q is declared at both %s and %s", s.Name, prev, s.Source)
+				}
+				seen[s.Name] = s.Source
+				out = append(out, s)
+			}
+		}
+	}
+	return out, nil
+}
+
+func parseSilence(n *yamlnode.Node, file string) (Silence, error) {
+	s := Silence{
+		Name:      n.Get("name").Text(),
+		CreatedBy: n.Get("created_by").Text(),
+		Comment:   n.Get("comment").Text(),
+		Source:    fmt.Sprintf("%s:%d", file, n.Line),
+	}
+	if s.Name == "" {
+		return s, fmt.Errorf("%s: silence without a name", s.Source)
+	}
+	if strings.ContainsAny(s.Name, "[]") {
+		return s, fmt.Errorf("%s: silence name %q must not contain brackets", s.Source, s.Name)
+	}
+	if s.CreatedBy == "" {
+		s.CreatedBy = defaultCreatedBy
+	}
+	if s.Comment == "" {
+		return s, fmt.Errorf("%s: silence %s needs a comment", s.Source, s.Name)
+	}
+	for _, m := range n.Get("matchers").Items() {
+		parsed, err := alertmanager.ParseMatchers(m.Text())
+		if err != nil {
+			return s, fmt.Errorf("%s: silence %s: %w", s.Source, s.Name, err)
+		}
+		s.Matchers = append(s.Matchers, parsed...)
+	}
+	if len(s.Matchers) == 0 {
+		return s, fmt.Errorf("%s: silence %s needs at least one matcher", s.Source, s.Name)
+	}
+
+	var err error
+	if v := n.Get("starts_at").Text(); v != "" {
+		if s.StartsAt, err = time.Parse(time.RFC3339, v); err != nil {
+			return s, fmt.Errorf("%s: silence %s: invalid starts_at: %w", s.Source, s.Name, err)
+		}
+	}
+	if v := n.Get("ends_at").Text(); v != "" {
+		if s.EndsAt, err = time.Parse(time.RFC3339, v); err != nil {
+			return s, fmt.Errorf("%s: silence %s: invalid ends_at: %w", s.Source, s.Name, err)
+		}
+	}
+	if v := n.Get("duration").Text(); v != "" {
+		if s.Duration, err = time.ParseDuration(v); err != nil || s.Duration <= 0 {
+			return s, fmt.Errorf("%s: silence %s: invalid duration %q", s.Source, s.Name, v)
+		}
+	}
+	switch {
+	case s.EndsAt.IsZero() == (s.Duration == 0):
+		return s, fmt.Errorf("%s: silence %s needs exactly one of ends_at or duration", s.Source, s.Name)
+	case !s.EndsAt.IsZero() && !s.StartsAt.IsZero() && !s.EndsAt.After(s.StartsAt):
+		return s, fmt.Errorf("%s: silence %s ends before it starts", s.Source, s.Name)
+	}
+	return s, nil
+}
@@ -0,0 +1,287 @@
+package silences
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/state"
+)
+
+// fakeAlertmanager serves the silences API of one tenant. Silences whose
+// end has passed are listed as expired until forget is called.
+type fakeAlertmanager struct {
+	t        *testing.T
+	mu       sync.Mutex
+	now      time.Time
+	silences map[string]apiSilence
+	nextID   int
+	requests []string // Method and path of every change
+}
+
+func newFakeAlertmanager(t *testing.T, now time.Time) (*fakeAlertmanager, *httptest.Server) {
+	am := &fakeAlertmanager{t: t, now: now, silences: map[string]apiSilence{}}
+	srv := httptest.NewServer(am)
+	t.Cleanup(srv.Close)
+	return am, srv
+}
+
+func (am *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if got := r.Header.Get("X-Scope-OrgID"); got != "team-a" {
+		http.Error(w, "wrong tenant "+got, http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == apiPrefix+"/silences":
+		out := []apiSilence{}
+		for _, s := range am.silences {
+			s.Status = &struct {
+				State string `json:"state"`
+			}{State: "active"}
+			if !s.EndsAt.After(am.now) {
+				s.Status.State = "expired"
+			}
+			out = append(out, s)
+		}
+		json.NewEncoder(w).Encode(out)
+	case r.Method == http.MethodPost && r.URL.Path == apiPrefix+"/silences":
+		var s apiSilence
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.ID != "" {
+			if _, ok := am.silences[s.ID]; !ok {
+				http.Error(w, "silence not found", http.StatusNotFound)
+				return
+			}
+		} else {
+			am.nextID++
+			s.ID = fmt.Sprintf("s%d", am.nextID)
+		}
+		// Like Alertmanager, a silence starting in the past starts now
+		if s.StartsAt.Before(am.now) {
+			s.StartsAt = am.now
+		}
+		am.silences[s.ID] = s
+		am.requests = append(am.requests, "POST "+s.ID)
+		json.NewEncoder(w).Encode(map[string]string{"silenceID": s.ID})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiPrefix+"/silence/"):
+		id := strings.TrimPrefix(r.URL.Path, apiPrefix+"/silence/")
+		s, ok := am.silences[id]
+		if !ok {
+			http.Error(w, "silence not found", http.StatusNotFound)
+			return
+		}
+		s.EndsAt = am.now
+		am.silences[id] = s
+		am.requests = append(am.requests, "DELETE "+id)
+	default:
+		http.Error(w, "unexpected request", http.StatusNotFound)
+	}
+}
+
+// changes returns the changes made since the last call.
+func (am *fakeAlertmanager) changes() string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	out := strings.Join(am.requests, ", ")
+	am.requests = nil
+	return out
+}
+
+// forget drops expired silences, as Alertmanager does after its retention.
+func (am *fakeAlertmanager) forget() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for id, s := range am.silences {
+		if !s.EndsAt.After(am.now) {
+			delete(am.silences, id)
+		}
+	}
+}
+
+func writeSilences(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "silences.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSync(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	am, srv := newFakeAlertmanager(t, now)
+	am.silences["manual"] = apiSilence{ID: "manual", Matchers: []apiMatcher{{Name: "a", Value: "b", IsEqual: true}}, StartsAt: now, EndsAt: now.Add(time.Hour), CreatedBy: "ops", Comment: "by hand"}
+	opts := Options{MimirAddress: srv.URL, MimirID: "team-a", Now: func() time.Time { return now }}
+
+	opts.Path = writeSilences(t, `silences:
+  - name: maintenance
+    matchers: ['alertname="DiskFull"', 'instance=~"db-.*"']
+    ends_at: 2026-01-02T00:00:00Z
+    comment: Database maintenance
+  - name: past
+    matchers: ['alertname="Old"']
+    ends_at: 2025-01-01T00:00:00Z
+    comment: Already over
+`)
+	if err := Sync(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := am.changes(); got != "POST s1" {
+		t.Fatalf("first sync made changes %q, want POST s1", got)
+	}
+	s := am.silences["s1"]
+	if s.Comment != "Database maintenance [mal-sync:maintenance]" || s.CreatedBy != "mal-sync" || len(s.Matchers) != 2 {
+		t.Errorf("created silence %+v", s)
+	}
+
+	if err := Sync(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := am.changes(); got != "" {
+		t.Errorf("sync without changes made changes %q", got)
+	}
+
+	opts.Path = writeSilences(t, `silences:
+  - name: maintenance
+    matchers: ['alertname="DiskFull"']
+    ends_at: 2026-01-02T00:00:00Z
+    comment: Database maintenance
+`)
+	if err := Sync(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := am.changes(); got != "POST s1" {
+		t.Errorf("sync of a changed silence made changes %q, want POST s1", got)
+	}
+
+	opts.Path = writeSilences(t, "silences: []\n")
+	if err := Sync(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := am.changes(); got != "DELETE s1" {
+		t.Errorf("sync without declarations made changes %q, want DELETE s1", got)
+	}
+	if !am.silences["manual"].EndsAt.Equal(now.Add(time.Hour)) {
+		t.Error("silence created by hand was expired")
+	}
+}
+
+func TestSyncDurationOnly(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	path := writeSilences(t, `silences:
+  - name: deploy
+    matchers: ['job="api"']
+    duration: 2h
+    comment: Deployment
+`)
+	tests := []struct {
+		name   string
+		state  bool
+		forget bool
+	}{
+		{name: "expired silence still listed"},
+		{name: "expired silence forgotten, state file", state: true, forget: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am, srv := newFakeAlertmanager(t, start)
+			now := start
+			opts := Options{Path: path, MimirAddress: srv.URL, MimirID: "team-a", Now: func() time.Time { return now }}
+			if tt.state {
+				opts.State = state.Store{Path: filepath.Join(t.TempDir(), "state.json")}
+			}
+			if err := Sync(opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := am.changes(); got != "POST s1" {
+				t.Fatalf("first sync made changes %q, want POST s1", got)
+			}
+
+			// Later syncs within the window neither extend nor recreate it
+			now = start.Add(time.Hour)
+			am.now = now
+			if err := Sync(opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := am.changes(); got != "" {
+				t.Errorf("sync within the window made changes %q", got)
+			}
+			if end := am.silences["s1"].EndsAt; !end.Equal(start.Add(2 * time.Hour)) {
+				t.Errorf("silence ends at %s, want %s", end, start.Add(2*time.Hour))
+			}
+
+			now = start.Add(3 * time.Hour)
+			am.now = now
+			if tt.forget {
+				am.forget()
+			}
+			for i := 0; i < 2; i++ {
+				if err := Sync(opts); err != nil {
+					t.Fatal(err)
+				}
+				if got := am.changes(); got != "" {
+					t.Errorf("sync %d after the silence ended made changes %q", i+1, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncDurationOnlyKeepsStartOnUpdate(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	am, srv := newFakeAlertmanager(t, start)
+	now := start
+	opts := Options{MimirAddress: srv.URL, MimirID: "team-a", Now: func() time.Time { return now }}
+	opts.Path = writeSilences(t, "silences:\n  - name: deploy\n    matchers: ['job=\"api\"']\n    duration: 2h\n    comment: Deployment\n")
+	if err := Sync(opts); err != nil {
+		t.Fatal(err)
+	}
+	now = start.Add(time.Hour)
+	am.now = now
+	opts.Path = writeSilences(t, "silences:\n  - name: deploy\n    matchers: ['job=\"api\"']\n    duration: 3h\n    comment: Longer deployment\n")
+	if err := Sync(opts); err != nil {
+		t.Fatal(err)
+	}
+	am.changes()
+	if end := am.silences["s1"].EndsAt; !end.Equal(start.Add(3 * time.Hour)) {
+		t.Errorf("updated silence ends at %s, want %s", end, start.Add(3*time.Hour))
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"no name", "silences:\n  - matchers: ['a=\"b\"']\n    duration: 1h\n    comment: c\n", "silence without a name"},
+		{"brackets in name", "silences:\n  - name: a[b]\n    matchers: ['a=\"b\"']\n    duration: 1h\n    comment: c\n", "must not contain brackets"},
+		{"no comment", "silences:\n  - name: a\n    matchers: ['a=\"b\"']\n    duration: 1h\n", "needs a comment"},
+		{"no matchers", "silences:\n  - name: a\n    duration: 1h\n    comment: c\n", "needs at least one matcher"},
+		{"invalid matcher", "silences:\n  - name: a\n    matchers: ['a']\n    duration: 1h\n    comment: c\n", "silence a:"},
+		{"invalid duration", "silences:\n  - name: a\n    matchers: ['a=\"b\"']\n    duration: -1h\n    comment: c\n", `invalid duration "-1h"`},
+		{"ends_at and duration", "silences:\n  - name: a\n    matchers: ['a=\"b\"']\n    duration: 1h\n    ends_at: 2026-01-01T00:00:00Z\n    comment: c\n", "exactly one of ends_at or duration"},
+		{"ends before start", "silences:\n  - name: a\n    matchers: ['a=\"b\"']\n    starts_at: 2026-01-02T00:00:00Z\n    ends_at: 2026-01-01T00:00:00Z\n    comment: c\n", "ends before it starts"},
+		{"duplicate name", "silences:\n  - name: a\n    matchers: ['a=\"b\"']\n    duration: 1h\n    comment: c\n  - name: a\n    matchers: ['a=\"c\"']\n    duration: 1h\n    comment: c\n", `silence "a" is declared at both`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeSilences(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package source
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/common"
+)
+
+// DefaultMaxSize limits downloads and extracted archives when
+// Artifacts.MaxSize is 0.
+const DefaultMaxSize = 100 << 20
+
+// Artifacts fetches paths given as https:// or s3:// URLs and extracts
+// .tar.gz, .tgz and .zip bundles, local or remote. A path may end in
+// "#sha256=<hex>" to pin the checksum of the file or bundle, and a bundle
+// path may be followed by "//sub/path" to select a file or directory
+// inside it:
+//
+//	https://example.com/rules-1.2.0.tar.gz//mimir#sha256=3b0c…
+type Artifacts struct {
+	CacheDir string // Keeps downloads between runs for conditional requests; none when empty
+	MaxSize  int64  // Maximum size of a download and of an extracted bundle; DefaultMaxSize when 0
+	S3       S3     // Endpoint and credentials of s3:// paths
+	Client   *http.Client
+}
+
+var checksumRe = regexp.MustCompile(`#sha256=([0-9a-fA-F]{64})$`)
+
+// artifact is a parsed path.
+type artifact struct {
+	location string // URL or local path of the file or bundle
+	remote   bool
+	archive  string // ".tar.gz" or ".zip" for bundles
+	subpath  string // path inside the bundle
+	sha256   string // pinned checksum, lower case
+}
+
+// IsArtifact reports whether path needs fetching or extracting, as opposed
+// to a plain local file or directory.
+func IsArtifact(path string) bool {
+	a := parseArtifact(path)
+	return a.remote || a.archive != "" || a.sha256 != ""
+}
+
+func parseArtifact(path string) artifact {
+	var a artifact
+	if m := checksumRe.FindStringSubmatch(path); m != nil {
+		a.sha256 = strings.ToLower(m[1])
+		path = strings.TrimSuffix(path, m[0])
+	}
+	prefix := ""
+	if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "s3://") {
+		a.remote = true
+		i := strings.Index(path, "://") + 3
+		prefix, path = path[:i], path[i:]
+	}
+	// Only split at "//" when what precedes it is a bundle, so doubled
+	// slashes in plain paths keep working.
+	if i := strings.Index(path, "//"); i >= 0 && archiveType(prefix+path[:i]) != "" {
+		path, a.subpath = path[:i], strings.Trim(path[i+2:], "/")
+	}
+	a.location = prefix + path
+	a.archive = archiveType(a.location)
+	return a
+}
+
+// archiveType returns the bundle type of a path or URL from its extension.
+func archiveType(location string) string {
+	name := location
+	if u, err := url.Parse(location); err == nil && u.Scheme != "" {
+		name = u.Path
+	}
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ".tar.gz"
+	case strings.HasSuffix(name, ".zip"):
+		return ".zip"
+	}
+	return ""
+}
+
+// Resolve returns a local path for path: plain paths as they are, URLs
+// downloaded and bundles extracted below dir, which should be the staging
+// directory of the sync.
+func (s Artifacts) Resolve(path, dir string) (string, error) {
+	if path == "" || !IsArtifact(path) {
+		return path, nil
+	}
+	a := parseArtifact(path)
+	key := hashString(path)[:12]
+	file := a.location
+	if a.remote {
+		// Downloads keep their own name, which the syncs log and stage
+		// them as.
+		file = filepath.Join(dir, key, baseName(a.location))
+		var err error
+		if strings.HasPrefix(a.location, "s3://") {
+			err = s.fetchS3(a, file)
+		} else {
+			err = s.download(a, file)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if a.sha256 != "" {
+		if err := verifyChecksum(file, a.sha256); err != nil {
+			return "", fmt.Errorf("%s: %w", a.location, err)
+		}
+	}
+	if a.archive == "" {
+		return file, nil
+	}
+	extracted := filepath.Join(dir, key, "contents")
+	if err := s.extract(file, a.archive, extracted); err != nil {
+		return "", fmt.Errorf("failed to extract %s: %w", a.location, err)
+	}
+	target := filepath.Join(extracted, filepath.Clean("/"+a.subpath))
+	if _, err := os.Stat(target); err != nil {
+		return "", fmt.Errorf("%q not found in %s", a.subpath, a.location)
+	}
+	log.Printf("Extracted %s into %s", a.location, extracted)
+	return target, nil
+}
+
+// Version identifies the current state of the s3:// paths among paths by
+// the keys and ETags of their objects, so daemon mode can skip syncs while
+// nothing changed. It returns "" when no path is on S3.
+func (s Artifacts) Version(paths ...string) (string, error) {
+	var b strings.Builder
+	for _, path := range paths {
+		if path == "" || !strings.HasPrefix(path, "s3://") {
+			continue
+		}
+		v, err := s.s3Version(parseArtifact(path).location)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(path + "\n" + v)
+	}
+	if b.Len() == 0 {
+		return "", nil
+	}
+	return hashString(b.String()), nil
+}
+
+func (s Artifacts) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return &http.Client{Timeout: 5 * time.Minute}
+}
+
+func (s Artifacts) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+// cacheMeta is stored next to a cached download to make the next request
+// for it conditional.
+type cacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// download fetches a.location, an https:// URL or the URL of an S3
+// object, to dest. With a cache directory the download is kept there and
+// revalidated on the next call with If-None-Match and If-Modified-Since;
+// the cached copy is reused when the server answers 304 Not Modified.
+func (s Artifacts) download(a artifact, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", a.location, err)
+	}
+	file := dest
+	var meta cacheMeta
+	var metaFile string
+	if s.CacheDir != "" {
+		if err := os.MkdirAll(s.CacheDir, 0750); err != nil {
+			return fmt.Errorf("failed to create cache directory %s: %w", s.CacheDir, err)
+		}
+		file = filepath.Join(s.CacheDir, hashString(a.location)[:16]+"-"+baseName(a.location))
+		metaFile = file + ".json"
+		if data, err := os.ReadFile(metaFile); err == nil {
+			json.Unmarshal(data, &meta)
+		}
+		if _, err := os.Stat(file); err != nil || meta.URL != a.location {
+			meta = cacheMeta{}
+		}
+	}
+	// stage copies a cached download to dest.
+	stage := func() error {
+		if file == dest {
+			return nil
+		}
+		if err := common.CopyFile(file, dest); err != nil {
+			return fmt.Errorf("failed to stage %s: %w", a.location, err)
+		}
+		return nil
+	}
+
+	var req *http.Request
+	var err error
+	if strings.HasPrefix(a.location, "s3://") {
+		var bucket, key string
+		if bucket, key, err = parseS3(a.location); err == nil {
+			req, err = s.S3.newRequest(http.MethodGet, bucket, key, nil, nil)
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodGet, a.location, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid URL %s: %w", a.location, err)
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", a.location, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && meta.URL != "":
+		log.Printf("%s not modified, using cached copy %s", a.location, file)
+		return stage()
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("failed to fetch %s: server returned %s", a.location, resp.Status)
+	}
+	if resp.ContentLength > s.maxSize() {
+		return fmt.Errorf("%s is %d bytes, more than the limit of %d bytes", a.location, resp.ContentLength, s.maxSize())
+	}
+
+	// Download next to the file and rename, so a failed or oversized
+	// download never replaces a good cached copy.
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".download-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file for %s: %w", a.location, err)
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, s.maxSize()+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", a.location, err)
+	}
+	if n > s.maxSize() {
+		return fmt.Errorf("%s is larger than the limit of %d bytes", a.location, s.maxSize())
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("failed to store download of %s: %w", a.location, err)
+	}
+	log.Printf("Downloaded %s (%d bytes)", a.location, n)
+	if metaFile != "" {
+		meta = cacheMeta{URL: a.location, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+		data, _ := json.Marshal(meta)
+		if err := os.WriteFile(metaFile, data, 0640); err != nil {
+			log.Printf("Warning: failed to record cache metadata for %s: %v", a.location, err)
+		}
+	}
+	return stage()
+}
+
+// verifyChecksum checks the SHA-256 of file against want.
+func verifyChecksum(file, want string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch: got sha256 %s, want %s", got, want)
+	}
+	return nil
+}
+
+// extract unpacks a bundle into dir. Entries escaping dir, links and
+// special files are rejected, and the total size is limited to MaxSize.
+func (s Artifacts) extract(file, archive, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	budget := s.maxSize()
+	write := func(name string, isDir bool, r io.Reader) error {
+		target, err := entryPath(dir, name)
+		if err != nil || target == dir {
+			return err
+		}
+		if isDir {
+			return os.MkdirAll(target, 0750)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(out, io.LimitReader(r, budget+1))
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if budget -= n; budget < 0 {
+			return fmt.Errorf("extracted contents exceed the limit of %d bytes", s.maxSize())
+		}
+		return nil
+	}
+
+	if archive == ".zip" {
+		zr, err := zip.OpenReader(file)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			mode := zf.Mode()
+			if !mode.IsRegular() && !mode.IsDir() {
+				return fmt.Errorf("%s: only regular files and directories are supported", zf.Name)
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %w", zf.Name, err)
+			}
+			err = write(zf.Name, mode.IsDir(), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+			if err := write(hdr.Name, hdr.Typeflag == tar.TypeDir, tr); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+		default:
+			return fmt.Errorf("%s: only regular files and directories are supported", hdr.Name)
+		}
+	}
+}
+
+// entryPath returns where a bundle entry is extracted to, rejecting
+// absolute names and names that climb out of dir.
+func entryPath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: entry escapes the extraction directory", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// baseName returns the file name of a URL, for naming its download.
+func baseName(location string) string {
+	if u, err := url.Parse(location); err == nil {
+		location = u.Path
+	}
+	if name := filepath.Base(location); name != "." && name != "/" {
+		return name
+	}
+	return "download"
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseSize parses a size such as 1048576, 512KiB, 100MiB or 1GB.
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1}}
+	num, factor := strings.TrimSpace(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, factor = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected bytes or a number with KiB, MiB or GiB", s)
+	}
+	return n * factor, nil
+}
@@ -0,0 +1,354 @@
+package source
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// entry is a file of a generated bundle; a link names its target.
+type entry struct {
+	name, body string
+	typeflag   byte   // tar.TypeReg when zero
+	link       string // target of symlinks and hardlinks
+}
+
+func tarGz(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.link, Mode: 0644, Size: int64(len(e.body))}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipFile builds a zip; entries with a link are stored as symlinks.
+func zipFile(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		hdr.SetMode(0644)
+		if e.link != "" {
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			body = e.link
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// listFiles returns "path: contents" of every file under dir.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel)+": "+readFile(t, path))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// serveFiles serves files by path, with an ETag of their contents, and
+// counts the requests that transferred a body.
+type serveFiles struct {
+	mu        sync.Mutex
+	files     map[string][]byte
+	downloads int
+}
+
+func (s *serveFiles) set(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = data
+}
+
+func (s *serveFiles) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloads
+}
+
+func (s *serveFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, ok := s.files[r.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	tag := `"` + checksum(data)[:16] + `"`
+	if r.Header.Get("If-None-Match") == tag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.mu.Lock()
+	s.downloads++
+	s.mu.Unlock()
+	w.Header().Set("ETag", tag)
+	if r.URL.Query().Get("chunked") != "" {
+		// Without a Content-Length the size is only known while reading
+		w.Write(data[:1])
+		w.(http.Flusher).Flush()
+		w.Write(data[1:])
+		return
+	}
+	w.Write(data)
+}
+
+func newFileServer(t *testing.T, files map[string][]byte) (*serveFiles, *httptest.Server) {
+	t.Helper()
+	s := &serveFiles{files: files}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func TestResolveBundles(t *testing.T) {
+	bundle := []entry{
+		{name: "rules/", typeflag: tar.TypeDir},
+		{name: "rules/mimir/api.yaml", body: "groups: []\n"},
+		{name: "rules/loki/app.yaml", body: "groups: [] # loki\n"},
+	}
+	tgz, zipped := tarGz(t, bundle...), zipFile(t, bundle[1:]...)
+	_, srv := newFileServer(t, map[string][]byte{
+		"/v1/rules.tar.gz": tgz,
+		"/v1/rules.zip":    zipped,
+		"/v1/api.yaml":     []byte("groups: []\n"),
+	})
+	local := filepath.Join(t.TempDir(), "local.tgz")
+	if err := os.WriteFile(local, tgz, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{srv.URL + "/v1/rules.tar.gz//rules/mimir#sha256=" + checksum(tgz), []string{"api.yaml: groups: []\n"}},
+		{srv.URL + "/v1/rules.zip//rules", []string{"loki/app.yaml: groups: [] # loki\n", "mimir/api.yaml: groups: []\n"}},
+		{srv.URL + "/v1/rules.zip?token=x//rules/loki/", []string{"app.yaml: groups: [] # loki\n"}},
+		{local + "//rules/mimir/api.yaml", []string{"api.yaml: groups: []\n"}},
+		{srv.URL + "/v1/api.yaml#sha256=" + strings.ToUpper(checksum([]byte("groups: []\n"))), []string{"api.yaml: groups: []\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := Artifacts{}.Resolve(tt.path, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			if info, err := os.Stat(got); err == nil && info.IsDir() {
+				files = listFiles(t, got)
+			} else {
+				files = []string{filepath.Base(got) + ": " + readFile(t, got)}
+			}
+			if strings.Join(files, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Resolve(%s) holds:\n%s\nwant:\n%s", tt.path, strings.Join(files, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+
+	if _, err := (Artifacts{}).Resolve(srv.URL+"/v1/rules.tar.gz//nope", t.TempDir()); err == nil || !strings.Contains(err.Error(), `"nope" not found in`) {
+		t.Errorf("Resolve of a missing subpath error = %v", err)
+	}
+	if _, err := (Artifacts{}).Resolve(srv.URL+"/v1/missing.yaml", t.TempDir()); err == nil || !strings.Contains(err.Error(), "server returned 404 Not Found") {
+		t.Errorf("Resolve of a missing URL error = %v", err)
+	}
+}
+
+func TestResolveChecksumMismatch(t *testing.T) {
+	tgz := tarGz(t, entry{name: "a.yaml", body: "groups: []\n"})
+	_, srv := newFileServer(t, map[string][]byte{"/rules.tar.gz": tgz})
+	wrong := strings.Repeat("0", 64)
+	dir := t.TempDir()
+	_, err := Artifacts{}.Resolve(srv.URL+"/rules.tar.gz#sha256="+wrong, dir)
+	if err == nil || err.Error() != srv.URL+"/rules.tar.gz: checksum mismatch: got sha256 "+checksum(tgz)+", want "+wrong {
+		t.Errorf("Resolve error = %v", err)
+	}
+	// Nothing is extracted from a bundle that fails its checksum
+	for _, f := range listFiles(t, dir) {
+		if strings.Contains(f, "contents") {
+			t.Errorf("extracted %s", f)
+		}
+	}
+}
+
+func TestExtractRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		data    []byte
+		want    string
+	}{
+		{"parent entry", "rules.tar.gz", tarGz(t, entry{name: "../evil.yaml", body: "x"}), "../evil.yaml: entry escapes the extraction directory"},
+		{"nested parent entry", "rules.tar.gz", tarGz(t, entry{name: "a/../../evil.yaml", body: "x"}), "a/../../evil.yaml: entry escapes the extraction directory"},
+		{"absolute entry", "rules.tar.gz", tarGz(t, entry{name: "/tmp/evil.yaml", body: "x"}), "/tmp/evil.yaml: entry escapes the extraction directory"},
+		{"symlink", "rules.tar.gz", tarGz(t, entry{name: "link", typeflag: tar.TypeSymlink, link: "/etc/passwd"}), "link: only regular files and directories are supported"},
+		{"hardlink", "rules.tar.gz", tarGz(t, entry{name: "a.yaml", body: "x"}, entry{name: "link", typeflag: tar.TypeLink, link: "a.yaml"}), "link: only regular files and directories are supported"},
+		{"zip parent entry", "rules.zip", zipFile(t, entry{name: "../evil.yaml", body: "x"}), "../evil.yaml: entry escapes the extraction directory"},
+		{"zip symlink", "rules.zip", zipFile(t, entry{name: "link", link: "../../etc/passwd"}), "link: only regular files and directories are supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			bundle := filepath.Join(root, tt.archive)
+			if err := os.WriteFile(bundle, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			staging := filepath.Join(root, "a", "b", "staging")
+			_, err := Artifacts{}.Resolve(bundle, staging)
+			if err == nil || !strings.HasSuffix(err.Error(), tt.want) {
+				t.Fatalf("Resolve error = %v, want %s", err, tt.want)
+			}
+			for _, f := range listFiles(t, root) {
+				if name, _, _ := strings.Cut(f, ":"); path.Base(name) == "evil.yaml" || path.Base(name) == "link" {
+					t.Errorf("wrote %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	big := []byte(strings.Repeat("x", 2000))
+	// Compresses to far less than it extracts to
+	bomb := tarGz(t, entry{name: "a.yaml", body: string(big)}, entry{name: "b.yaml", body: string(big)})
+	_, srv := newFileServer(t, map[string][]byte{"/big.yaml": big, "/bomb.tar.gz": bomb})
+	a := Artifacts{MaxSize: 1000}
+
+	if _, err := a.Resolve(srv.URL+"/big.yaml", t.TempDir()); err == nil || !strings.HasSuffix(err.Error(), "big.yaml is 2000 bytes, more than the limit of 1000 bytes") {
+		t.Errorf("Resolve of a large download error = %v", err)
+	}
+	if _, err := a.Resolve(srv.URL+"/big.yaml?chunked=1", t.TempDir()); err == nil || !strings.HasSuffix(err.Error(), "is larger than the limit of 1000 bytes") {
+		t.Errorf("Resolve of a large download without a length error = %v", err)
+	}
+	if len(bomb) >= 1000 {
+		t.Fatalf("bundle is %d bytes, want it under the limit", len(bomb))
+	}
+	if _, err := a.Resolve(srv.URL+"/bomb.tar.gz", t.TempDir()); err == nil || !strings.HasSuffix(err.Error(), "extracted contents exceed the limit of 1000 bytes") {
+		t.Errorf("Resolve of a large bundle error = %v", err)
+	}
+	// The limit covers all entries together
+	if _, err := (Artifacts{MaxSize: 3000}).Resolve(srv.URL+"/bomb.tar.gz", t.TempDir()); err == nil || !strings.HasSuffix(err.Error(), "extracted contents exceed the limit of 3000 bytes") {
+		t.Errorf("Resolve of a bundle over the total limit error = %v", err)
+	}
+	if _, err := (Artifacts{MaxSize: 4000}).Resolve(srv.URL+"/bomb.tar.gz", t.TempDir()); err != nil {
+		t.Errorf("Resolve of a bundle at the limit: %v", err)
+	}
+}
+
+func TestDownloadCache(t *testing.T) {
+	files, srv := newFileServer(t, map[string][]byte{"/rules.tar.gz": tarGz(t, entry{name: "a.yaml", body: "v1"})})
+	a := Artifacts{CacheDir: filepath.Join(t.TempDir(), "cache")}
+	resolve := func() string {
+		t.Helper()
+		dir, err := a.Resolve(srv.URL+"/rules.tar.gz", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readFile(t, filepath.Join(dir, "a.yaml"))
+	}
+
+	if got := resolve(); got != "v1" || files.count() != 1 {
+		t.Errorf("first fetch = %q after %d download(s)", got, files.count())
+	}
+	// 304 Not Modified reuses the cached bundle
+	if got := resolve(); got != "v1" || files.count() != 1 {
+		t.Errorf("cached fetch = %q after %d download(s), want v1 after 1", got, files.count())
+	}
+	// A new ETag downloads it again
+	files.set("/rules.tar.gz", tarGz(t, entry{name: "a.yaml", body: "v2"}))
+	if got := resolve(); got != "v2" || files.count() != 2 {
+		t.Errorf("fetch after a change = %q after %d download(s), want v2 after 2", got, files.count())
+	}
+	if got := resolve(); got != "v2" || files.count() != 2 {
+		t.Errorf("cached fetch after a change = %q after %d download(s), want v2 after 2", got, files.count())
+	}
+
+	// A lost cache file is downloaded again even when the server would
+	// answer 304
+	matches, _ := filepath.Glob(filepath.Join(a.CacheDir, "*-rules.tar.gz"))
+	if len(matches) != 1 {
+		t.Fatalf("cache holds %v", matches)
+	}
+	if err := os.Remove(matches[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolve(); got != "v2" || files.count() != 3 {
+		t.Errorf("fetch after losing the cache = %q after %d download(s), want v2 after 3", got, files.count())
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{"1048576": 1 << 20, "512KiB": 512 << 10, "100 MiB": 100 << 20, "1GB": 1e9, "10B": 10} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "-1", "1TB", "MiB"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded", in)
+		}
+	}
+}
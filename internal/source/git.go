@@ -0,0 +1,199 @@
+package source
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Git is a git repository to sync from. Any URL git understands works,
+// including file:// URLs and paths of local (bare) repositories.
+type Git struct {
+	URL     string // Repository URL; empty to read local paths instead
+	Ref     string // Branch, tag or commit; the remote's default branch when empty
+	Subpath string // Directory of the repository that paths are relative to
+	Dir     string // Checkout directory, reused between fetches
+}
+
+// appliedFile records the commit of the last successful sync. It lives in
+// the .git directory so checkouts and git clean leave it alone.
+const appliedFile = "mal-sync-applied"
+
+// Fetch clones the repository into Dir, or fetches into the existing clone,
+// and checks out Ref. It returns the directory of Subpath in the checkout
+// and the commit SHA checked out.
+func (g Git) Fetch() (string, string, error) {
+	if _, err := os.Stat(filepath.Join(g.Dir, ".git")); err != nil {
+		log.Printf("Cloning %s into %s", g.URL, g.Dir)
+		if err := os.MkdirAll(g.Dir, 0750); err != nil {
+			return "", "", fmt.Errorf("failed to create git checkout directory %s: %w", g.Dir, err)
+		}
+		if _, err := g.git("init", "-q"); err != nil {
+			return "", "", err
+		}
+		if _, err := g.git("remote", "add", "origin", g.URL); err != nil {
+			return "", "", err
+		}
+	} else if _, err := g.git("remote", "set-url", "origin", g.URL); err != nil {
+		return "", "", err
+	}
+
+	args := []string{"fetch", "-q", "--prune", "--force", "origin", "+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"}
+	if g.Ref == "" {
+		args = append(args, "+HEAD:refs/mal-sync/HEAD")
+	}
+	if _, err := g.git(args...); err != nil {
+		return "", "", fmt.Errorf("failed to fetch %s: %w", g.URL, err)
+	}
+	sha, err := g.resolve()
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := g.git("checkout", "-q", "--force", "--detach", sha); err != nil {
+		return "", "", err
+	}
+	if _, err := g.git("clean", "-q", "-d", "-f", "-x"); err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Join(g.Dir, filepath.Clean("/"+g.Subpath))
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", "", fmt.Errorf("subpath %q not found in %s at %s", g.Subpath, g.URL, sha)
+	}
+	if !info.IsDir() {
+		return "", "", fmt.Errorf("subpath %q of %s is not a directory", g.Subpath, g.URL)
+	}
+	log.Printf("Checked out %s of %s at commit %s", g.refName(), g.URL, sha)
+	return dir, sha, nil
+}
+
+// resolve returns the commit Ref names, trying it as a branch, a tag and
+// finally as a commit SHA or full ref.
+func (g Git) resolve() (string, error) {
+	candidates := []string{"refs/mal-sync/HEAD"}
+	if g.Ref != "" {
+		candidates = []string{"refs/remotes/origin/" + g.Ref, "refs/tags/" + g.Ref, g.Ref}
+	}
+	for _, c := range candidates {
+		if sha, err := g.git("rev-parse", "--verify", "--quiet", c+"^{commit}"); err == nil {
+			return sha, nil
+		}
+	}
+	return "", fmt.Errorf("ref %q not found in %s", g.refName(), g.URL)
+}
+
+func (g Git) refName() string {
+	if g.Ref == "" {
+		return "HEAD"
+	}
+	return g.Ref
+}
+
+// Applied returns the commit of the last successful sync from Dir, or ""
+// when there was none.
+func (g Git) Applied() string {
+	data, err := os.ReadFile(filepath.Join(g.Dir, ".git", appliedFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// RecordApplied records sha as the commit of the last successful sync.
+func (g Git) RecordApplied(sha string) error {
+	path := filepath.Join(g.Dir, ".git", appliedFile)
+	if err := os.WriteFile(path, []byte(sha+"\n"), 0640); err != nil {
+		return fmt.Errorf("failed to record applied commit in %s: %w", path, err)
+	}
+	return nil
+}
+
+// git runs a git command in Dir and returns its standard output without
+// surrounding whitespace, for commands that print a single value such as a
+// commit SHA.
+func (g Git) git(args ...string) (string, error) {
+	out, err := g.output(args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// output runs a git command in Dir and returns its standard output as it
+// is. Prompts for credentials are disabled so a daemon never hangs on one.
+func (g Git) output(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.Dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, fmt.Errorf("git %s failed: %w", strings.Join(args, " "), err)
+		}
+		return nil, fmt.Errorf("git %s failed: %w: %s", strings.Join(args, " "), err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// Change is a file under a path that differs between a commit and the work
+// tree, including files not yet committed.
+type Change struct {
+	Path string // Absolute path in the work tree
+	Old  []byte // Contents at the commit; nil when the file was added
+}
+
+// Diff returns the files under path, which must be in a git work tree,
+// that were added, modified or deleted since the commit since names.
+// Renames are reported as a deletion and an addition.
+func Diff(path, since string) ([]Change, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := abs
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+		dir = filepath.Dir(abs)
+	}
+	top, err := Git{Dir: dir}.git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("%s is not in a git work tree: %w", path, err)
+	}
+	repo := Git{Dir: top}
+	sha, err := repo.git("rev-parse", "--verify", "--quiet", since+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("commit %q not found in %s", since, top)
+	}
+
+	diff, err := repo.output("diff", "--name-status", "-z", "--no-renames", sha, "--", abs)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	fields := strings.Split(strings.TrimSuffix(string(diff), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, rel := fields[i], fields[i+1]
+		c := Change{Path: filepath.Join(top, rel)}
+		if status != "A" {
+			old, err := repo.output("show", sha+":"+rel)
+			if err != nil {
+				return nil, err
+			}
+			c.Old = append([]byte{}, old...) // not nil for an empty file
+		}
+		changes = append(changes, c)
+	}
+	untracked, err := repo.output("ls-files", "-z", "--others", "--exclude-standard", "--", abs)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range strings.Split(string(untracked), "\x00") {
+		if rel != "" {
+			changes = append(changes, Change{Path: filepath.Join(top, rel)})
+		}
+	}
+	return changes, nil
+}
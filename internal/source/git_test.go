@@ -0,0 +1,295 @@
+package source
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testRepo is a git work tree used as the remote of the tests.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	r := &testRepo{t: t, dir: t.TempDir()}
+	r.run("init", "-q", "-b", "main")
+	return r
+}
+
+func (r *testRepo) url() string { return "file://" + r.dir }
+
+// run runs git in the repository and returns its trimmed output.
+func (r *testRepo) run(args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+r.dir)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		r.t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out.String())
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// write writes files into the work tree; an empty content deletes the file.
+func (r *testRepo) write(files map[string]string) {
+	r.t.Helper()
+	for name, content := range files {
+		path := filepath.Join(r.dir, name)
+		if content == "" {
+			if err := os.Remove(path); err != nil {
+				r.t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+}
+
+// commit writes files and commits all changes, returning the commit SHA.
+func (r *testRepo) commit(files map[string]string) string {
+	r.t.Helper()
+	r.write(files)
+	r.run("add", "-A")
+	r.run("commit", "-q", "--allow-empty", "-m", "change")
+	return r.run("rev-parse", "HEAD")
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGitFetch(t *testing.T) {
+	remote := newTestRepo(t)
+	first := remote.commit(map[string]string{"rules/a.yaml": "v1\n", "README.md": "readme\n"})
+	remote.run("tag", "v1")
+	remote.run("branch", "release")
+	second := remote.commit(map[string]string{"rules/a.yaml": "v2\n"})
+
+	g := Git{URL: remote.url(), Subpath: "rules", Dir: filepath.Join(t.TempDir(), "checkout")}
+	dir, sha, err := g.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != second || dir != filepath.Join(g.Dir, "rules") {
+		t.Errorf("Fetch = %s, %s, want %s at %s", dir, sha, filepath.Join(g.Dir, "rules"), second)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.yaml")); got != "v2\n" {
+		t.Errorf("a.yaml = %q, want v2", got)
+	}
+
+	// Files left in the checkout are removed by the next fetch
+	if err := os.WriteFile(filepath.Join(dir, "stray.yaml"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	third := remote.commit(map[string]string{"rules/b.yaml": "b\n"})
+	if _, sha, err = g.Fetch(); err != nil || sha != third {
+		t.Fatalf("Fetch of a new commit = %s, %v, want %s", sha, err, third)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stray.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("untracked file survived the fetch: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.yaml")); got != "v2\n" {
+		t.Errorf("a.yaml = %q after the fetch, want v2", got)
+	}
+
+	for _, ref := range []string{"release", "v1", first, "refs/tags/v1"} {
+		g := g
+		g.Ref = ref
+		if _, sha, err := g.Fetch(); err != nil || sha != first {
+			t.Errorf("Fetch of ref %s = %s, %v, want %s", ref, sha, err, first)
+		}
+	}
+
+	// Force-pushed branches are followed
+	remote.run("checkout", "-q", "release")
+	rewritten := remote.commit(map[string]string{"rules/a.yaml": "rewritten\n"})
+	remote.run("checkout", "-q", "main")
+	g.Ref = "release"
+	if _, sha, err := g.Fetch(); err != nil || sha != rewritten {
+		t.Fatalf("Fetch of an updated branch = %s, %v, want %s", sha, err, rewritten)
+	}
+	remote.run("branch", "-f", "release", second)
+	if _, sha, err := g.Fetch(); err != nil || sha != second {
+		t.Errorf("Fetch of a force-pushed branch = %s, %v, want %s", sha, err, second)
+	}
+	remote.run("reset", "-q", "--hard", first)
+	g.Ref = ""
+	if _, sha, err := g.Fetch(); err != nil || sha != first {
+		t.Errorf("Fetch of the reset default branch = %s, %v, want %s", sha, err, first)
+	}
+}
+
+func TestGitFetchErrors(t *testing.T) {
+	remote := newTestRepo(t)
+	remote.commit(map[string]string{"rules/a.yaml": "a\n"})
+	tests := []struct {
+		name string
+		git  Git
+		err  string
+	}{
+		{"missing ref", Git{URL: remote.url(), Ref: "nope"}, `ref "nope" not found`},
+		{"missing subpath", Git{URL: remote.url(), Subpath: "other"}, `subpath "other" not found`},
+		{"subpath is a file", Git{URL: remote.url(), Subpath: "rules/a.yaml"}, "is not a directory"},
+		{"missing repository", Git{URL: "file://" + filepath.Join(t.TempDir(), "missing")}, "failed to fetch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.git.Dir = filepath.Join(t.TempDir(), "checkout")
+			_, _, err := tt.git.Fetch()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Fetch error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestGitApplied(t *testing.T) {
+	remote := newTestRepo(t)
+	sha := remote.commit(map[string]string{"a.yaml": "a\n"})
+	g := Git{URL: remote.url(), Dir: filepath.Join(t.TempDir(), "checkout")}
+	if _, _, err := g.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.Applied(); got != "" {
+		t.Errorf("Applied before any sync = %q", got)
+	}
+	if err := g.RecordApplied(sha); err != nil {
+		t.Fatal(err)
+	}
+	remote.commit(map[string]string{"b.yaml": "b\n"})
+	if _, _, err := g.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.Applied(); got != sha {
+		t.Errorf("Applied after a fetch = %q, want %s", got, sha)
+	}
+}
+
+func TestRun(t *testing.T) {
+	remote := newTestRepo(t)
+	sha := remote.commit(map[string]string{"rules/a.yaml": "a\n"})
+	g := Git{URL: remote.url(), Subpath: "rules", Dir: filepath.Join(t.TempDir(), "checkout")}
+
+	err := Run(g, nil, 0, func(dir string) error { return errors.New("boom") })
+	if err == nil || !strings.Contains(err.Error(), "sync of commit "+sha+" failed: boom") {
+		t.Errorf("Run with a failing sync = %v", err)
+	}
+	if got := g.Applied(); got != "" {
+		t.Errorf("failed sync was recorded as applied: %q", got)
+	}
+
+	var synced string
+	if err := Run(g, nil, 0, func(dir string) error { synced = dir; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if synced != filepath.Join(g.Dir, "rules") || g.Applied() != sha {
+		t.Errorf("Run synced %q and applied %q, want %q and %s", synced, g.Applied(), filepath.Join(g.Dir, "rules"), sha)
+	}
+
+	if err := Run(Git{}, nil, 0, func(dir string) error { synced = dir; return nil }); err != nil || synced != "" {
+		t.Errorf("Run without a URL synced %q, %v, want local paths", synced, err)
+	}
+	if err := Run(Git{}, nil, 0, func(string) error { return errors.New("boom") }); err == nil || err.Error() != "boom" {
+		t.Errorf("Run without a URL and a failing sync = %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.write(map[string]string{"rules/keep.yaml": "keep\n"})
+	if err := os.WriteFile(filepath.Join(repo.dir, "rules", "empty.yaml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := repo.commit(map[string]string{
+		"rules/keep.yaml":   "keep\n",
+		"rules/edit.yaml":   "old\n",
+		"rules/delete.yaml": "gone\n",
+		"rules/rename.yaml": "moved\n",
+		"rules/spaced.yaml": "\n  # indented\ngroups: []\n\n\n",
+		"other/x.yaml":      "x\n",
+	})
+	repo.commit(map[string]string{
+		"rules/edit.yaml":    "new\n",
+		"rules/delete.yaml":  "",
+		"rules/added.yaml":   "added\n",
+		"rules/rename.yaml":  "",
+		"rules/renamed.yaml": "moved\n",
+		"rules/spaced.yaml":  "groups: []\n",
+		"rules/empty.yaml":   "groups: []\n",
+		"other/x.yaml":       "changed\n",
+	})
+	repo.write(map[string]string{"rules/untracked.yaml": "u\n", "rules/keep.yaml": "dirty\n"})
+
+	changes, err := Diff(filepath.Join(repo.dir, "rules"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		rel, _ := filepath.Rel(repo.dir, c.Path)
+		old := "<added>"
+		if c.Old != nil {
+			old = string(c.Old)
+		}
+		got = append(got, fmt.Sprintf("%s: %q", rel, old))
+	}
+	sort.Strings(got)
+	// The old contents are exact, leading and trailing blank lines included
+	want := []string{
+		`rules/added.yaml: "<added>"`,
+		`rules/delete.yaml: "gone\n"`,
+		`rules/edit.yaml: "old\n"`,
+		`rules/empty.yaml: ""`,
+		`rules/keep.yaml: "keep\n"`,
+		`rules/rename.yaml: "moved\n"`,
+		`rules/renamed.yaml: "<added>"`,
+		`rules/spaced.yaml: "\n  # indented\ngroups: []\n\n\n"`,
+		`rules/untracked.yaml: "<added>"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Diff:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A single file can be diffed as well
+	changes, err = Diff(filepath.Join(repo.dir, "rules", "edit.yaml"), "HEAD")
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Diff of a committed file = %v, %v, want no changes", changes, err)
+	}
+
+	if _, err := Diff(filepath.Join(repo.dir, "rules"), "nope"); err == nil || !strings.Contains(err.Error(), `commit "nope" not found`) {
+		t.Errorf("Diff since a missing commit error = %v", err)
+	}
+	if _, err := Diff(t.TempDir(), "HEAD"); err == nil || !strings.Contains(err.Error(), "is not in a git work tree") {
+		t.Errorf("Diff outside a work tree error = %v", err)
+	}
+}
@@ -0,0 +1,434 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 reads s3://bucket/key and s3://bucket/prefix paths from S3 or an
+// S3-compatible store such as MinIO.
+//
+// Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, or else from the AWS_PROFILE (default "default")
+// section of CredentialsFile. Without credentials requests are unsigned,
+// which works for public buckets.
+type S3 struct {
+	Endpoint        string // e.g. http://minio:9000, addressed path-style; AWS when empty
+	Region          string // AWS_REGION, AWS_DEFAULT_REGION or us-east-1 when empty
+	CredentialsFile string // Shared credentials file; AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials when empty
+}
+
+// s3Object is an object of a listing.
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+// s3Credentials are the keys requests are signed with.
+type s3Credentials struct {
+	accessKey, secretKey, token string
+}
+
+func parseS3(location string) (bucket, key string, err error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 location %q, expected s3://bucket/prefix", location)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+func (s S3) region() string {
+	for _, region := range []string{s.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// objectURL returns the URL of key in bucket, with the key escaped the way
+// it is signed.
+func (s S3) objectURL(bucket, key string) (*url.URL, error) {
+	escaped := s3Escape(key, false)
+	if s.Endpoint == "" {
+		return url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, s.region(), escaped))
+	}
+	return url.Parse(strings.TrimSuffix(s.Endpoint, "/") + "/" + s3Escape(bucket, true) + "/" + escaped)
+}
+
+// newRequest returns a signed request for key in bucket, with body as
+// the payload.
+func (s S3) newRequest(method, bucket, key string, query url.Values, body []byte) (*http.Request, error) {
+	u, err := s.objectURL(bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", s.Endpoint, err)
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	creds, err := s.credentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.accessKey != "" {
+		s.sign(req, creds, sha256Hex(string(body)), time.Now().UTC())
+	}
+	return req, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, whose
+// payload has the hex SHA-256 hash payloadHash.
+func (s S3) sign(req *http.Request, creds s3Credentials, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region() + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	for _, part := range []string{s.region(), "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
+
+// credentials returns the credentials from the environment or the shared
+// credentials file, or none.
+func (s S3) credentials() (s3Credentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return s3Credentials{key, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	file := s.CredentialsFile
+	if file == "" {
+		file = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return s3Credentials{}, nil
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) && s.CredentialsFile == "" {
+			return s3Credentials{}, nil
+		}
+		return s3Credentials{}, fmt.Errorf("failed to read S3 credentials: %w", err)
+	}
+	defer f.Close()
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	var creds s3Credentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			creds.accessKey = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.secretKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.token = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to read S3 credentials from %s: %w", file, err)
+	}
+	if creds.accessKey == "" && s.CredentialsFile != "" {
+		return s3Credentials{}, fmt.Errorf("no credentials for profile %q in %s", profile, file)
+	}
+	return creds, nil
+}
+
+// list returns the objects of bucket whose keys start with prefix.
+func (s S3) list(client *http.Client, bucket, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(http.MethodGet, bucket, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, err)
+		}
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = s3Response(resp, &result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Get returns the object at an s3://bucket/key location, or nil when it
+// does not exist.
+func (s S3) Get(location string) ([]byte, error) {
+	bucket, key, err := parseS3(location)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(http.MethodGet, bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", location, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %w", location, s3Response(resp, nil))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", location, err)
+	}
+	return data, nil
+}
+
+// Put stores data as the object at an s3://bucket/key location.
+func (s S3) Put(location string, data []byte) error {
+	bucket, key, err := parseS3(location)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodPut, bucket, key, nil, data)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %w", location, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to store %s: %w", location, s3Response(resp, nil))
+	}
+	return nil
+}
+
+// s3Response decodes a successful XML response into v, or returns the
+// error the response describes.
+func s3Response(resp *http.Response, v any) error {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return fmt.Errorf("%s: %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// objects returns the objects an s3:// location names: the object with
+// exactly its key, or else every object below it as a directory. Keys
+// ending in "/" are always directories.
+func (s S3) objects(client *http.Client, location string) (bucket, prefix string, objects []s3Object, err error) {
+	bucket, key, err := parseS3(location)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if key != "" && !strings.HasSuffix(key, "/") {
+		all, err := s.list(client, bucket, key)
+		if err != nil {
+			return "", "", nil, err
+		}
+		for _, o := range all {
+			if o.Key == key {
+				return bucket, key, []s3Object{o}, nil
+			}
+		}
+		key += "/"
+	}
+	all, err := s.list(client, bucket, key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, o := range all {
+		if !strings.HasSuffix(o.Key, "/") { // skip directory markers
+			objects = append(objects, o)
+		}
+	}
+	if len(objects) == 0 {
+		return "", "", nil, fmt.Errorf("no objects found at %s", location)
+	}
+	return bucket, key, objects, nil
+}
+
+// fetchS3 downloads what an s3:// location names to dest: the object with
+// its key as a file, or the objects below its prefix as a directory.
+func (s Artifacts) fetchS3(a artifact, dest string) error {
+	bucket, prefix, objects, err := s.S3.objects(s.client(), a.location)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 1 && objects[0].Key == prefix {
+		return s.download(a, dest)
+	}
+	if a.sha256 != "" || a.archive != "" {
+		return fmt.Errorf("%s is a prefix, not an object", a.location)
+	}
+	var total int64
+	for _, o := range objects {
+		if total += o.Size; total > s.maxSize() {
+			return fmt.Errorf("objects at %s exceed the limit of %d bytes", a.location, s.maxSize())
+		}
+		file, err := entryPath(dest, strings.TrimPrefix(o.Key, prefix))
+		if err != nil {
+			return err
+		}
+		if err := s.download(artifact{location: "s3://" + bucket + "/" + o.Key, remote: true}, file); err != nil {
+			return err
+		}
+	}
+	log.Printf("Fetched %d object(s) from %s", len(objects), a.location)
+	return nil
+}
+
+// s3Version returns the keys and ETags of the objects at an s3:// location.
+func (s Artifacts) s3Version(location string) (string, error) {
+	_, _, objects, err := s.S3.objects(s.client(), location)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, o := range objects {
+		b.WriteString(o.Key + " " + o.ETag + "\n")
+	}
+	return b.String(), nil
+}
+
+// s3Escape escapes s as AWS signing expects: everything but unreserved
+// characters, and slashes too when escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by key, escaped as AWS signing
+// expects.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
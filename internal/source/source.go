@@ -0,0 +1,77 @@
+// Package source fetches rule files and configs from where they are
+// published into a local directory the syncs read from, and keeps syncing
+// as new versions appear.
+package source
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Run calls sync with the directory paths are relative to: the checkout of
+// src, or "" when src has no URL and local paths are used as they are.
+// After a successful sync from git the commit is recorded as applied.
+//
+// With interval 0 Run syncs once and returns the error of the sync. With a
+// positive interval it runs as a daemon and never returns: it polls every
+// interval and syncs each new commit, or syncs again every interval when
+// reading local paths. Failures are logged and retried at the next poll.
+//
+// version, if not nil, identifies the state of remote paths outside git,
+// such as the ETags of S3 objects (see Artifacts.Version). The daemon then
+// skips syncs while it returns the version last synced, rather than
+// syncing every interval.
+func Run(src Git, version func() (string, error), interval time.Duration, sync func(dir string) error) error {
+	applied := ""
+	once := func(daemon bool) error {
+		if src.URL == "" {
+			current := ""
+			if daemon && version != nil {
+				var err error
+				if current, err = version(); err != nil {
+					return err
+				}
+				if current != "" && current == applied {
+					log.Printf("Remote objects are unchanged, nothing to sync")
+					return nil
+				}
+			}
+			if err := sync(""); err != nil {
+				return err
+			}
+			applied = current
+			return nil
+		}
+		dir, sha, err := src.Fetch()
+		if err != nil {
+			return err
+		}
+		if daemon && sha == src.Applied() {
+			log.Printf("Commit %s is already applied, nothing to sync", sha)
+			return nil
+		}
+		if err := sync(dir); err != nil {
+			return fmt.Errorf("sync of commit %s failed: %w", sha, err)
+		}
+		if err := src.RecordApplied(sha); err != nil {
+			return err
+		}
+		log.Printf("Applied commit %s", sha)
+		return nil
+	}
+	if interval <= 0 {
+		return once(false)
+	}
+	if interval < time.Second {
+		return errors.New("daemon interval must be at least 1s")
+	}
+	log.Printf("Running as a daemon, syncing every %s", interval)
+	for {
+		if err := once(true); err != nil {
+			log.Printf("Sync failed, retrying in %s: %v", interval, err)
+		}
+		time.Sleep(interval)
+	}
+}
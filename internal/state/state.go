@@ -0,0 +1,170 @@
+// Package state keeps the content hashes of what the last successful sync
+// pushed, so later syncs can skip rule namespaces and Alertmanager configs
+// that have not changed.
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antnsn/mal-sync/internal/source"
+)
+
+// Store reads and writes a state file, shared by every target synced with
+// it. A target is one tenant of one subcommand and address.
+type Store struct {
+	Path           string        // Local file or s3://bucket/key; the store is disabled when empty
+	S3             source.S3     // Reads and writes s3:// paths
+	VerifyInterval time.Duration // Sync everything again after this long to catch out-of-band edits; never when 0
+}
+
+// Target is the state of one target.
+type Target struct {
+	Verified time.Time         `json:"verified"` // Time everything was last synced
+	Hashes   map[string]string `json:"hashes"`   // Content hash of each rule namespace or tenant config
+
+	// Starts records when each silence declared with only a duration
+	// first started, so it is not created again once it has ended
+	Starts map[string]time.Time `json:"starts,omitempty"`
+}
+
+// file is the content of a state file.
+type file struct {
+	Targets map[string]*Target `json:"targets"`
+}
+
+// Enabled reports whether s has a state file.
+func (s Store) Enabled() bool {
+	return s.Path != ""
+}
+
+// Due reports whether everything must be synced: when t was never synced
+// in full, or not in the last VerifyInterval.
+func (s Store) Due(t *Target) bool {
+	if t.Verified.IsZero() {
+		return true
+	}
+	return s.VerifyInterval > 0 && time.Since(t.Verified) >= s.VerifyInterval
+}
+
+// Load returns the state of target, empty when s is disabled or target
+// was never synced.
+func (s Store) Load(target string) (*Target, error) {
+	f, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if t := f.Targets[target]; t != nil {
+		if t.Hashes == nil {
+			t.Hashes = map[string]string{}
+		}
+		return t, nil
+	}
+	return &Target{Hashes: map[string]string{}}, nil
+}
+
+// Save replaces the state of target. The state file is read again first,
+// so the state of other targets synced in the meantime is kept.
+func (s Store) Save(target string, t *Target) error {
+	if !s.Enabled() {
+		return nil
+	}
+	f, err := s.read()
+	if err != nil {
+		return err
+	}
+	f.Targets[target] = t
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if strings.HasPrefix(s.Path, "s3://") {
+		return s.S3.Put(s.Path, data)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for state file %s: %w", s.Path, err)
+	}
+	// Write next to the file and rename, so an interrupted write never
+	// leaves a truncated state file
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", s.Path, err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", s.Path, err)
+	}
+	return nil
+}
+
+// read returns the content of the state file, empty when there is none.
+func (s Store) read() (*file, error) {
+	f := &file{Targets: map[string]*Target{}}
+	if !s.Enabled() {
+		return f, nil
+	}
+	var data []byte
+	var err error
+	if strings.HasPrefix(s.Path, "s3://") {
+		data, err = s.S3.Get(s.Path)
+	} else if data, err = os.ReadFile(s.Path); os.IsNotExist(err) {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", s.Path, err)
+	}
+	if data == nil {
+		return f, nil
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		// A corrupt state file only costs a full sync
+		log.Printf("Warning: ignoring invalid state file %s: %v", s.Path, err)
+		return &file{Targets: map[string]*Target{}}, nil
+	}
+	if f.Targets == nil {
+		f.Targets = map[string]*Target{}
+	}
+	return f, nil
+}
+
+// HashFiles returns the hash of the contents of files, in order, named by
+// names so renames change the hash too.
+func HashFiles(names, files []string) (string, error) {
+	h := sha256.New()
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", file, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", names[i], len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Changed returns the keys whose hash in current differs from t, and of
+// them the keys missing from current, both sorted.
+func (t *Target) Changed(current map[string]string) (changed, deleted []string) {
+	for key, hash := range current {
+		if t.Hashes[key] != hash {
+			changed = append(changed, key)
+		}
+	}
+	for key := range t.Hashes {
+		if _, ok := current[key]; !ok {
+			changed = append(changed, key)
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(deleted)
+	return changed, deleted
+}
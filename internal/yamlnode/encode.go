@@ -0,0 +1,280 @@
+package yamlnode
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encode renders documents in a canonical block style: two-space
+// indentation, sequences indented below their key, flow collections
+// expanded, and the plainest scalar style that reads back as the same value.
+// Comments are preserved. Multiple documents are separated by "---".
+func Encode(docs ...*Node) []byte {
+	e := &encoder{}
+	for i, doc := range docs {
+		if i > 0 {
+			e.b.WriteString("---\n")
+		}
+		e.document(doc)
+	}
+	return []byte(e.b.String())
+}
+
+type encoder struct {
+	b strings.Builder
+}
+
+func spaces(n int) string { return strings.Repeat(" ", n) }
+
+func (e *encoder) comment(text string, indent int) {
+	if text == "" {
+		return
+	}
+	for _, l := range strings.Split(text, "\n") {
+		e.b.WriteString(spaces(indent) + l + "\n")
+	}
+}
+
+func lineComment(texts ...string) string {
+	var parts []string
+	for _, t := range texts {
+		if t != "" {
+			parts = append(parts, strings.ReplaceAll(t, "\n", " "))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " " + strings.Join(parts, " ")
+}
+
+func properties(n *Node) string {
+	var parts []string
+	if n.Anchor != "" {
+		parts = append(parts, "&"+n.Anchor)
+	}
+	if n.Tag != "" && n.Tag != "!!str" && n.Tag != "!!map" && n.Tag != "!!seq" {
+		parts = append(parts, n.Tag)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (e *encoder) document(n *Node) {
+	if n == nil {
+		e.b.WriteString("null\n")
+		return
+	}
+	switch {
+	case n.Kind == MappingNode && len(n.Content) > 0 && properties(n) == "":
+		e.comment(n.HeadComment, 0)
+		e.mapping(n, 0, false)
+	case n.Kind == SequenceNode && len(n.Content) > 0 && properties(n) == "":
+		e.comment(n.HeadComment, 0)
+		e.sequence(n, 0, false)
+	default:
+		e.comment(n.HeadComment, 0)
+		e.b.WriteString("---")
+		e.value(n, 0, "")
+	}
+}
+
+func (e *encoder) mapping(n *Node, indent int, inline bool) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if !(inline && i == 0) {
+			e.comment(key.HeadComment, indent)
+			e.b.WriteString(spaces(indent))
+		}
+		e.b.WriteString(keyText(key) + ":")
+		e.value(value, indent, key.LineComment)
+	}
+	e.comment(n.FootComment, indent)
+}
+
+// value writes a mapping value or sequence item after its "key:" or "-"
+// indicator, including the terminating newline. keyComment is a comment
+// that was attached to the key line in the source.
+func (e *encoder) value(v *Node, indent int, keyComment string) {
+	props := properties(v)
+	if props != "" {
+		props = " " + props
+	}
+	switch v.Kind {
+	case AliasNode:
+		e.b.WriteString(" *" + v.Value + lineComment(keyComment, v.LineComment) + "\n")
+	case MappingNode:
+		if len(v.Content) == 0 {
+			e.b.WriteString(props + " {}" + lineComment(keyComment, v.LineComment) + "\n")
+			return
+		}
+		e.b.WriteString(props + lineComment(keyComment, v.LineComment) + "\n")
+		e.mapping(v, indent+2, false)
+	case SequenceNode:
+		if len(v.Content) == 0 {
+			e.b.WriteString(props + " []" + lineComment(keyComment, v.LineComment) + "\n")
+			return
+		}
+		e.b.WriteString(props + lineComment(keyComment, v.LineComment) + "\n")
+		e.sequence(v, indent+2, false)
+	default:
+		text, block := scalarText(v, false)
+		if block {
+			e.b.WriteString(props + " " + blockHeader(v.Value) + lineComment(keyComment, v.LineComment) + "\n")
+			e.blockBody(v.Value, indent+2)
+			return
+		}
+		if text != "" {
+			text = " " + text
+		}
+		e.b.WriteString(props + text + lineComment(keyComment, v.LineComment) + "\n")
+	}
+}
+
+func (e *encoder) sequence(n *Node, indent int, inline bool) {
+	for idx, item := range n.Content {
+		inlineMapping := item.Kind == MappingNode && len(item.Content) > 0 && properties(item) == ""
+		inlineSequence := item.Kind == SequenceNode && len(item.Content) > 0 && properties(item) == ""
+		if !(inline && idx == 0) {
+			e.comment(item.HeadComment, indent)
+			if inlineMapping {
+				e.comment(item.Content[0].HeadComment, indent)
+			}
+			e.b.WriteString(spaces(indent))
+		}
+		e.b.WriteString("-")
+		switch {
+		case inlineMapping:
+			e.b.WriteString(" ")
+			if item.LineComment != "" {
+				// There is no place for a comment on the "- key:" line of a
+				// mapping item; keep it with the first key instead.
+				item.Content[0].LineComment = joinComments(item.LineComment, item.Content[0].LineComment)
+			}
+			e.mapping(item, indent+2, true)
+		case inlineSequence:
+			e.b.WriteString(" ")
+			e.sequence(item, indent+2, true)
+		default:
+			e.value(item, indent, "")
+		}
+	}
+	e.comment(n.FootComment, indent)
+}
+
+func keyText(key *Node) string {
+	key = key.Resolve()
+	if key.Kind != ScalarNode {
+		return "null"
+	}
+	text, _ := scalarText(key, true)
+	if text == "" {
+		return `""`
+	}
+	return text
+}
+
+// scalarText returns the inline representation of a scalar, or block=true
+// when the value should be written as a literal block scalar.
+func scalarText(n *Node, isKey bool) (string, bool) {
+	str := n.Tag == "!!str" || n.Style != PlainStyle || (n.Tag != "" && !strings.HasPrefix(n.Tag, "!!"))
+	if !str && !strings.Contains(n.Value, "\n") {
+		// Plain scalars are written as-is so numbers, booleans and nulls
+		// keep the spelling they were given.
+		return n.Value, false
+	}
+	s := n.Value
+	if !needsQuotes(s) {
+		return s, false
+	}
+	if !isKey && strings.Contains(s, "\n") && blockSafe(s) {
+		return "", true
+	}
+	if printable(s) {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'", false
+	}
+	return doubleQuote(s), false
+}
+
+// blockSafe reports whether s survives a round trip through a literal block
+// scalar.
+func blockSafe(s string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if l != "" && strings.TrimSpace(l) == "" {
+			return false
+		}
+		if strings.HasPrefix(l, "\t") {
+			return false
+		}
+	}
+	for _, r := range s {
+		if (r < 0x20 && r != '\n' && r != '\t') || r == 0x7f || r == '\ufeff' {
+			return false
+		}
+	}
+	return utf8.ValidString(s)
+}
+
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if (r < 0x20 && r != '\t') || r == 0x7f || r == '\ufeff' || r == '\u0085' || r == '\u2028' || r == '\u2029' {
+			return false
+		}
+	}
+	return !strings.Contains(s, "\t")
+}
+
+func doubleQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f || r == '\ufeff' || r == '\u0085' || r == '\u2028' || r == '\u2029' || r == utf8.RuneError {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func blockHeader(s string) string {
+	header := "|"
+	if strings.HasPrefix(s, " ") {
+		header += "2"
+	}
+	switch {
+	case !strings.HasSuffix(s, "\n"):
+		header += "-"
+	case strings.HasSuffix(s, "\n\n") || s == "\n":
+		header += "+"
+	}
+	return header
+}
+
+func (e *encoder) blockBody(s string, indent int) {
+	s = strings.TrimSuffix(s, "\n")
+	for _, l := range strings.Split(s, "\n") {
+		if l == "" {
+			e.b.WriteString("\n")
+			continue
+		}
+		e.b.WriteString(spaces(indent) + l + "\n")
+	}
+}
@@ -0,0 +1,482 @@
+// Package yamlnode implements the subset of YAML used by Alertmanager
+// configurations, Prometheus-style rule files and Kubernetes manifests.
+//
+// Documents are parsed into a tree of Nodes that keeps key order, scalar
+// styles, comments and source positions, so callers can report errors with
+// file:line context and re-encode documents without losing information.
+// The package is intentionally stdlib-only.
+package yamlnode
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kind identifies the type of a Node.
+type Kind int
+
+const (
+	ScalarNode Kind = iota + 1
+	MappingNode
+	SequenceNode
+	AliasNode
+)
+
+// Style records how a node was written in the source document.
+type Style int
+
+const (
+	PlainStyle Style = iota
+	SingleQuotedStyle
+	DoubleQuotedStyle
+	LiteralStyle
+	FoldedStyle
+	FlowStyle
+)
+
+// Node is a single YAML node. Mappings store keys and values alternately in
+// Content; sequences store their items in Content.
+type Node struct {
+	Kind    Kind
+	Style   Style
+	Tag     string // explicit tag such as "!!str"; empty when implicit
+	Value   string // scalar value, or alias name for AliasNode
+	Anchor  string
+	Alias   *Node // target of an AliasNode
+	Content []*Node
+
+	Line   int // 1-based line in the source document; 0 for built nodes
+	Column int // 1-based column in the source document; 0 for built nodes
+
+	HeadComment string // comment lines preceding the node, including '#'
+	LineComment string // comment on the same line as the node, including '#'
+	FootComment string // comment lines after the last entry of a collection
+}
+
+// Error is a parse error with the position it occurred at.
+type Error struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("yaml: line %d, column %d: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("yaml: line %d: %s", e.Line, e.Msg)
+}
+
+// ParseFile reads and parses all documents in the file at path.
+func ParseFile(path string) ([]*Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	docs, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return docs, nil
+}
+
+// NewMapping returns an empty block mapping.
+func NewMapping() *Node { return &Node{Kind: MappingNode} }
+
+// NewSequence returns an empty block sequence.
+func NewSequence() *Node { return &Node{Kind: SequenceNode} }
+
+// NewString returns a scalar that always decodes as a string, regardless of
+// whether its text looks like a number, boolean or null.
+func NewString(s string) *Node { return &Node{Kind: ScalarNode, Tag: "!!str", Value: s} }
+
+// NewScalar returns a plain scalar whose type is resolved from its text, as
+// if it had been written unquoted in a document.
+func NewScalar(s string) *Node { return &Node{Kind: ScalarNode, Value: s} }
+
+// Resolve follows aliases and returns the node they refer to.
+func (n *Node) Resolve() *Node {
+	for n != nil && n.Kind == AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// Get returns the value stored under key in a mapping, or nil.
+func (n *Node) Get(key string) *Node {
+	n = n.Resolve()
+	if n == nil || n.Kind != MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Resolve().Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// GetKey returns the key node for key in a mapping, or nil.
+func (n *Node) GetKey(key string) *Node {
+	n = n.Resolve()
+	if n == nil || n.Kind != MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Resolve().Value == key {
+			return n.Content[i]
+		}
+	}
+	return nil
+}
+
+// Set stores value under key in a mapping, replacing an existing entry in
+// place or appending a new one.
+func (n *Node) Set(key string, value *Node) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content[i+1] = value
+			return
+		}
+	}
+	n.Content = append(n.Content, NewString(key), value)
+}
+
+// Delete removes key from a mapping. It reports whether the key was present.
+func (n *Node) Delete(key string) bool {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content = append(n.Content[:i], n.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Keys returns the keys of a mapping in document order.
+func (n *Node) Keys() []string {
+	n = n.Resolve()
+	if n == nil || n.Kind != MappingNode {
+		return nil
+	}
+	keys := make([]string, 0, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		keys = append(keys, n.Content[i].Resolve().Value)
+	}
+	return keys
+}
+
+// Items returns the items of a sequence, or nil for any other node.
+func (n *Node) Items() []*Node {
+	n = n.Resolve()
+	if n == nil || n.Kind != SequenceNode {
+		return nil
+	}
+	return n.Content
+}
+
+// Text returns the value of a scalar node, or "" for any other node.
+func (n *Node) Text() string {
+	n = n.Resolve()
+	if n == nil || n.Kind != ScalarNode {
+		return ""
+	}
+	return n.Value
+}
+
+// IsNull reports whether n is missing or an explicit null scalar.
+func (n *Node) IsNull() bool {
+	n = n.Resolve()
+	if n == nil {
+		return true
+	}
+	if n.Kind != ScalarNode {
+		return false
+	}
+	tag, _ := resolveScalar(n)
+	return tag == "!!null"
+}
+
+// IsString reports whether n is a scalar that decodes as a string.
+func (n *Node) IsString() bool {
+	n = n.Resolve()
+	if n == nil || n.Kind != ScalarNode {
+		return false
+	}
+	tag, _ := resolveScalar(n)
+	return tag == "!!str"
+}
+
+// Pos formats the node position as "line:column".
+func (n *Node) Pos() string {
+	return fmt.Sprintf("%d:%d", n.Line, n.Column)
+}
+
+// Clone returns a deep copy of n. Aliases in the copy point at the original
+// anchored nodes.
+func (n *Node) Clone() *Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	if n.Content != nil {
+		c.Content = make([]*Node, len(n.Content))
+		for i, child := range n.Content {
+			c.Content[i] = child.Clone()
+		}
+	}
+	return &c
+}
+
+// Interface decodes n into plain Go values: map[string]any, []any, string,
+// int64, float64, bool or nil. Merge keys ("<<") are expanded.
+func (n *Node) Interface() any {
+	n = n.Resolve()
+	if n == nil {
+		return nil
+	}
+	switch n.Kind {
+	case MappingNode:
+		m := make(map[string]any, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Resolve()
+			if key.Value == "<<" && key.Style == PlainStyle {
+				mergeInto(m, n.Content[i+1])
+				continue
+			}
+			m[key.Value] = n.Content[i+1].Interface()
+		}
+		return m
+	case SequenceNode:
+		s := make([]any, 0, len(n.Content))
+		for _, item := range n.Content {
+			s = append(s, item.Interface())
+		}
+		return s
+	default:
+		_, v := resolveScalar(n)
+		return v
+	}
+}
+
+func mergeInto(m map[string]any, src *Node) {
+	src = src.Resolve()
+	var sources []*Node
+	if src.Kind == SequenceNode {
+		sources = src.Content
+	} else {
+		sources = []*Node{src}
+	}
+	for _, s := range sources {
+		if mm, ok := s.Interface().(map[string]any); ok {
+			for k, v := range mm {
+				if _, exists := m[k]; !exists {
+					m[k] = v
+				}
+			}
+		}
+	}
+}
+
+// FromInterface builds a node tree from plain Go values as produced by
+// Interface or encoding/json. Map keys are sorted for a stable output.
+func FromInterface(v any) *Node {
+	switch t := v.(type) {
+	case nil:
+		return NewScalar("null")
+	case *Node:
+		return t
+	case map[string]any:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m := NewMapping()
+		for _, k := range keys {
+			m.Content = append(m.Content, NewString(k), FromInterface(t[k]))
+		}
+		return m
+	case map[string]string:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m := NewMapping()
+		for _, k := range keys {
+			m.Content = append(m.Content, NewString(k), NewString(t[k]))
+		}
+		return m
+	case []any:
+		s := NewSequence()
+		for _, item := range t {
+			s.Content = append(s.Content, FromInterface(item))
+		}
+		return s
+	case []string:
+		s := NewSequence()
+		for _, item := range t {
+			s.Content = append(s.Content, NewString(item))
+		}
+		return s
+	case string:
+		return NewString(t)
+	case bool:
+		return NewScalar(strconv.FormatBool(t))
+	case int:
+		return NewScalar(strconv.Itoa(t))
+	case int64:
+		return NewScalar(strconv.FormatInt(t, 10))
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1e15 {
+			return NewScalar(strconv.FormatInt(int64(t), 10))
+		}
+		return NewScalar(strconv.FormatFloat(t, 'g', -1, 64))
+	case fmt.Stringer:
+		return NewString(t.String())
+	default:
+		return NewString(fmt.Sprint(t))
+	}
+}
+
+var (
+	intRe   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	hexRe   = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+	octRe   = regexp.MustCompile(`^0o[0-7]+$`)
+	floatRe = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+// resolveScalar returns the resolved tag and decoded value of a scalar.
+func resolveScalar(n *Node) (string, any) {
+	if n.Tag != "" && n.Tag != "!" {
+		switch n.Tag {
+		case "!!str", "!!binary", "!!timestamp":
+			return "!!str", n.Value
+		case "!!null":
+			return "!!null", nil
+		case "!!bool", "!!int", "!!float":
+			tag, v := resolvePlain(n.Value)
+			if tag == n.Tag || (n.Tag == "!!float" && tag == "!!int") {
+				if n.Tag == "!!float" {
+					if i, ok := v.(int64); ok {
+						return "!!float", float64(i)
+					}
+				}
+				return tag, v
+			}
+			return "!!str", n.Value
+		default:
+			// Application-specific tags are carried through as strings.
+			return "!!str", n.Value
+		}
+	}
+	if n.Style != PlainStyle || n.Tag == "!" {
+		return "!!str", n.Value
+	}
+	return resolvePlain(n.Value)
+}
+
+func resolvePlain(s string) (string, any) {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return "!!null", nil
+	case "true", "True", "TRUE":
+		return "!!bool", true
+	case "false", "False", "FALSE":
+		return "!!bool", false
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF":
+		return "!!float", math.Inf(1)
+	case "-.inf", "-.Inf", "-.INF":
+		return "!!float", math.Inf(-1)
+	case ".nan", ".NaN", ".NAN":
+		return "!!float", math.NaN()
+	}
+	if intRe.MatchString(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return "!!int", i
+		}
+	}
+	if hexRe.MatchString(s) {
+		if i, err := strconv.ParseInt(s[2:], 16, 64); err == nil {
+			return "!!int", i
+		}
+	}
+	if octRe.MatchString(s) {
+		if i, err := strconv.ParseInt(s[2:], 8, 64); err == nil {
+			return "!!int", i
+		}
+	}
+	if floatRe.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return "!!float", f
+		}
+	}
+	return "!!str", s
+}
+
+// needsQuotes reports whether s must be quoted to be read back as the same
+// string. It is conservative: YAML 1.1 booleans such as "yes" and "on" are
+// quoted too, since older parsers still read them as booleans.
+func needsQuotes(s string) bool {
+	if s == "" {
+		return true
+	}
+	if tag, _ := resolvePlain(s); tag != "!!str" {
+		return true
+	}
+	switch strings.ToLower(s) {
+	case "y", "n", "yes", "no", "on", "off":
+		return true
+	}
+	if s[0] == ' ' || s[len(s)-1] == ' ' || s[0] == '\t' || s[len(s)-1] == '\t' {
+		return true
+	}
+	switch s[0] {
+	case '&', '*', '!', '|', '>', '\'', '"', '%', '@', '`', '#', ',', '[', ']', '{', '}':
+		return true
+	case '-', '?', ':':
+		if len(s) == 1 || s[1] == ' ' || s[1] == '\t' {
+			return true
+		}
+		if strings.HasPrefix(s, "---") {
+			return true
+		}
+	}
+	if strings.HasSuffix(s, ":") {
+		return true
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, ":\t") || strings.Contains(s, " #") || strings.Contains(s, "\t#") {
+		return true
+	}
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f || r == '\ufeff' {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns a deep copy of n with every alias replaced by a copy of the
+// node it refers to and all anchors removed. Expanded trees can be moved
+// between documents without dangling references.
+func (n *Node) Expand() *Node {
+	n = n.Resolve()
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.Anchor = ""
+	if n.Content != nil {
+		c.Content = make([]*Node, len(n.Content))
+		for i, child := range n.Content {
+			c.Content[i] = child.Expand()
+		}
+	}
+	return &c
+}
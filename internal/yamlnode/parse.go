@@ -0,0 +1,980 @@
+package yamlnode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type commentLine struct {
+	indent int
+	text   string
+}
+
+type parser struct {
+	lines   []string
+	offset  int // line number offset of this document within the source
+	anchors map[string]*Node
+	pending []commentLine
+	scanned int // comment lines before this index have been collected
+	// inline is set while parsing a mapping value that starts on the line
+	// of its key, where block collections are not allowed
+	inline bool
+}
+
+// Parse parses every document in data. Documents containing only comments
+// or whitespace are skipped.
+func Parse(data []byte) ([]*Node, error) {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+
+	var docs []*Node
+	start := 0
+	seenMarker := false
+	flush := func(end int) error {
+		doc, err := parseDocument(lines[start:end], start)
+		if err != nil {
+			return err
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+		return nil
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !seenMarker && strings.HasPrefix(line, "%") {
+			// Directives are only meaningful before the first document marker.
+			lines[i] = ""
+			continue
+		}
+		if isMarker(line, "---") {
+			if err := flush(i); err != nil {
+				return nil, err
+			}
+			seenMarker = true
+			// Content on the marker line starts the next document; blank the
+			// marker so columns stay intact.
+			lines[i] = "   " + line[3:]
+			start = i
+			continue
+		}
+		if isMarker(line, "...") {
+			if err := flush(i); err != nil {
+				return nil, err
+			}
+			lines[i] = ""
+			start = i
+		}
+	}
+	if err := flush(len(lines)); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func isMarker(line, marker string) bool {
+	if !strings.HasPrefix(line, marker) {
+		return false
+	}
+	rest := line[len(marker):]
+	return rest == "" || rest[0] == ' ' || rest[0] == '\t'
+}
+
+func parseDocument(lines []string, offset int) (*Node, error) {
+	p := &parser{lines: lines, offset: offset, anchors: map[string]*Node{}}
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(trimmed, "\t") && strings.TrimSpace(trimmed) != "" && !strings.HasPrefix(strings.TrimSpace(trimmed), "#") {
+			return nil, &Error{Line: offset + i + 1, Column: len(line) - len(trimmed) + 1, Msg: "found a tab character used as indentation"}
+		}
+	}
+	i := p.nextContent(0)
+	if i >= len(lines) {
+		return nil, nil
+	}
+	root, next, err := p.parseNode(i, 0, -1, false)
+	if err != nil {
+		return nil, err
+	}
+	next = p.nextContent(next)
+	if next < len(lines) {
+		return nil, p.errorf(next, p.indent(next), "unexpected content after the document root")
+	}
+	if foot := p.takePending(); foot != "" {
+		root.FootComment = joinComments(root.FootComment, foot)
+	}
+	return root, nil
+}
+
+func (p *parser) errorf(line, col int, format string, args ...any) error {
+	return &Error{Line: p.offset + line + 1, Column: col + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) indent(i int) int {
+	line := p.lines[i]
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isBlankLine(line string) bool { return strings.TrimSpace(line) == "" }
+
+// nextContent returns the index of the first line at or after i that holds
+// content, collecting comment lines on the way.
+func (p *parser) nextContent(i int) int {
+	for ; i < len(p.lines); i++ {
+		line := p.lines[i]
+		if isBlankLine(line) {
+			continue
+		}
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(trimmed, "#") {
+			if i >= p.scanned {
+				p.pending = append(p.pending, commentLine{indent: len(line) - len(trimmed), text: strings.TrimRight(trimmed, " \t")})
+			}
+			continue
+		}
+		break
+	}
+	p.scanned = max(p.scanned, i)
+	return i
+}
+
+func (p *parser) takePending() string {
+	if len(p.pending) == 0 {
+		return ""
+	}
+	texts := make([]string, len(p.pending))
+	for i, c := range p.pending {
+		texts[i] = c.text
+	}
+	p.pending = nil
+	return strings.Join(texts, "\n")
+}
+
+// takeFoot removes the pending comments indented at least as far as a
+// collection that just ended, so they stay with that collection.
+func (p *parser) takeFoot(indent int) string {
+	n := 0
+	for n < len(p.pending) && p.pending[n].indent >= indent {
+		n++
+	}
+	if n == 0 {
+		return ""
+	}
+	texts := make([]string, n)
+	for i := 0; i < n; i++ {
+		texts[i] = p.pending[i].text
+	}
+	p.pending = p.pending[n:]
+	return strings.Join(texts, "\n")
+}
+
+func joinComments(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	default:
+		return a + "\n" + b
+	}
+}
+
+func skipSpaces(line string, c int) int {
+	for c < len(line) && (line[c] == ' ' || line[c] == '\t') {
+		c++
+	}
+	return c
+}
+
+// trailingComment returns the comment starting at or after column c, if the
+// rest of the line holds nothing else.
+func trailingComment(line string, c int) (string, bool) {
+	c = skipSpaces(line, c)
+	if c >= len(line) {
+		return "", true
+	}
+	if line[c] == '#' {
+		return strings.TrimRight(line[c:], " \t"), true
+	}
+	return "", false
+}
+
+func isDash(line string, c int) bool {
+	return c < len(line) && line[c] == '-' && (c+1 == len(line) || line[c+1] == ' ' || line[c+1] == '\t')
+}
+
+// parseNode parses the node whose text starts at line i, column c. Lines
+// that continue the node must be indented further than parent. When
+// compact is set, a block sequence indented exactly as parent is accepted
+// as the value (the "key:\n- item" form).
+func (p *parser) parseNode(i, c, parent int, compact bool) (*Node, int, error) {
+	line := p.lines[i]
+	c = skipSpaces(line, c)
+	inline := p.inline
+	p.inline = false
+
+	var anchor, tag string
+	for c < len(line) && (line[c] == '&' || line[c] == '!') {
+		end := c
+		for end < len(line) && line[end] != ' ' && line[end] != '\t' {
+			end++
+		}
+		if line[c] == '&' {
+			anchor = line[c+1 : end]
+			if anchor == "" {
+				return nil, 0, p.errorf(i, c, "anchor name is empty")
+			}
+		} else {
+			tag = expandTag(line[c:end])
+		}
+		c = skipSpaces(line, end)
+	}
+
+	finish := func(n *Node, next int, err error) (*Node, int, error) {
+		if err != nil {
+			return nil, 0, err
+		}
+		if tag != "" {
+			n.Tag = tag
+		}
+		if anchor != "" {
+			n.Anchor = anchor
+			p.anchors[anchor] = n
+		}
+		return n, next, nil
+	}
+
+	if comment, ok := trailingComment(line, c); ok {
+		// The node starts on a following line, or is an empty scalar.
+		j := p.nextContent(i + 1)
+		if j < len(p.lines) {
+			ind := p.indent(j)
+			if ind > parent || (compact && ind == parent && isDash(p.lines[j], ind)) {
+				n, next, err := p.parseNode(j, ind, parent, compact)
+				if err == nil && comment != "" {
+					n.LineComment = joinComments(comment, n.LineComment)
+				}
+				return finish(n, next, err)
+			}
+		}
+		n := &Node{Kind: ScalarNode, Line: p.offset + i + 1, Column: c + 1, LineComment: comment}
+		return finish(n, i+1, nil)
+	}
+
+	switch ch := line[c]; {
+	case ch == '*':
+		end := c + 1
+		for end < len(line) && line[end] != ' ' && line[end] != '\t' && line[end] != ',' && line[end] != ']' && line[end] != '}' {
+			end++
+		}
+		name := line[c+1 : end]
+		target, ok := p.anchors[name]
+		if !ok {
+			return nil, 0, p.errorf(i, c, "unknown anchor %q referenced", name)
+		}
+		n := &Node{Kind: AliasNode, Value: name, Alias: target, Line: p.offset + i + 1, Column: c + 1}
+		comment, ok := trailingComment(line, end)
+		if !ok {
+			return nil, 0, p.errorf(i, end, "unexpected content after alias")
+		}
+		n.LineComment = comment
+		return n, i + 1, nil
+	case isDash(line, c):
+		if inline {
+			return nil, 0, p.errorf(i, c, "block sequence entries are not allowed in this context")
+		}
+		return finish(p.parseSequence(i, c))
+	case ch == '|' || ch == '>':
+		return finish(p.parseBlockScalar(i, c, parent))
+	case ch == '[' || ch == '{':
+		cur := cursor{i: i, c: c}
+		n, err := p.parseFlow(&cur)
+		if err != nil {
+			return nil, 0, err
+		}
+		rest := p.lines[cur.i]
+		comment, ok := trailingComment(rest, cur.c)
+		if !ok {
+			return nil, 0, p.errorf(cur.i, skipSpaces(rest, cur.c), "unexpected content after flow collection")
+		}
+		n.LineComment = comment
+		return finish(n, cur.i+1, nil)
+	case ch == '"' || ch == '\'':
+		cur := cursor{i: i, c: c}
+		n, err := p.parseQuoted(&cur)
+		if err != nil {
+			return nil, 0, err
+		}
+		rest := p.lines[cur.i]
+		after := skipSpaces(rest, cur.c)
+		if cur.i == i && after < len(rest) && rest[after] == ':' && (after+1 == len(rest) || rest[after+1] == ' ' || rest[after+1] == '\t') {
+			if inline {
+				return nil, 0, p.errorf(i, after, "mapping values are not allowed in this context")
+			}
+			return finish(p.parseMapping(i, c))
+		}
+		comment, ok := trailingComment(rest, cur.c)
+		if !ok {
+			return nil, 0, p.errorf(cur.i, after, "unexpected content after quoted scalar")
+		}
+		n.LineComment = comment
+		return finish(n, cur.i+1, nil)
+	case ch == '?':
+		if c+1 == len(line) || line[c+1] == ' ' {
+			return nil, 0, p.errorf(i, c, "complex mapping keys are not supported")
+		}
+	}
+
+	if colon := mappingColon(line, c); colon >= 0 {
+		if inline {
+			return nil, 0, p.errorf(i, colon, "mapping values are not allowed in this context")
+		}
+		return finish(p.parseMapping(i, c))
+	}
+	return finish(p.parsePlain(i, c, parent))
+}
+
+func expandTag(t string) string {
+	if strings.HasPrefix(t, "!!") {
+		return "!!" + t[2:]
+	}
+	if strings.HasPrefix(t, "!<tag:yaml.org,2002:") && strings.HasSuffix(t, ">") {
+		return "!!" + strings.TrimSuffix(strings.TrimPrefix(t, "!<tag:yaml.org,2002:"), ">")
+	}
+	return t
+}
+
+// mappingColon returns the column of the ':' that ends a plain implicit key
+// starting at column c, or -1 when the line does not start a mapping entry.
+func mappingColon(line string, c int) int {
+	for k := c; k < len(line); k++ {
+		switch line[k] {
+		case '#':
+			if k > c && (line[k-1] == ' ' || line[k-1] == '\t') {
+				return -1
+			}
+		case ':':
+			if k+1 == len(line) || line[k+1] == ' ' || line[k+1] == '\t' {
+				if k == c {
+					return -1
+				}
+				return k
+			}
+		}
+	}
+	return -1
+}
+
+func (p *parser) parseMapping(i, c int) (*Node, int, error) {
+	m := &Node{Kind: MappingNode, Line: p.offset + i + 1, Column: c + 1}
+	seen := map[string]*Node{}
+	first := true
+	for {
+		if !first {
+			j := p.nextContent(i)
+			if j >= len(p.lines) || p.indent(j) < c {
+				break
+			}
+			if p.indent(j) > c {
+				return nil, 0, p.errorf(j, p.indent(j), "unexpected indentation in mapping")
+			}
+			if isDash(p.lines[j], c) {
+				return nil, 0, p.errorf(j, c, "expected a mapping key, found a sequence item")
+			}
+			i = j
+		}
+		head := p.takePending()
+		key, after, err := p.parseKey(i, c)
+		if err != nil {
+			return nil, 0, err
+		}
+		if prev, dup := seen[key.Value]; dup {
+			return nil, 0, p.errorf(i, c, "mapping key %q already defined at line %d", key.Value, prev.Line)
+		}
+		seen[key.Value] = key
+		key.HeadComment = head
+		p.inline = true
+		value, next, err := p.parseNode(i, after, c, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		if value.Kind != ScalarNode && value.Kind != AliasNode && value.Style != FlowStyle && value.LineComment != "" && value.Line > key.Line {
+			// "key: # comment" followed by a nested block: keep the comment
+			// with the key so it is re-emitted on the same line.
+			key.LineComment, value.LineComment = value.LineComment, ""
+		}
+		m.Content = append(m.Content, key, value)
+		i = next
+		first = false
+	}
+	m.FootComment = p.takeFoot(c)
+	return m, i, nil
+}
+
+func (p *parser) parseKey(i, c int) (*Node, int, error) {
+	line := p.lines[i]
+	if line[c] == '"' || line[c] == '\'' {
+		cur := cursor{i: i, c: c}
+		key, err := p.parseQuoted(&cur)
+		if err != nil {
+			return nil, 0, err
+		}
+		if cur.i != i {
+			return nil, 0, p.errorf(i, c, "mapping keys must fit on a single line")
+		}
+		after := skipSpaces(line, cur.c)
+		if after >= len(line) || line[after] != ':' {
+			return nil, 0, p.errorf(i, after, "expected ':' after mapping key")
+		}
+		return key, after + 1, nil
+	}
+	colon := mappingColon(line, c)
+	if colon < 0 {
+		return nil, 0, p.errorf(i, c, "expected a mapping key")
+	}
+	text := strings.TrimRight(line[c:colon], " \t")
+	key := &Node{Kind: ScalarNode, Value: text, Line: p.offset + i + 1, Column: c + 1}
+	if strings.HasPrefix(text, "&") || strings.HasPrefix(text, "!") || strings.HasPrefix(text, "*") {
+		return nil, 0, p.errorf(i, c, "anchors, tags and aliases on mapping keys are not supported")
+	}
+	return key, colon + 1, nil
+}
+
+func (p *parser) parseSequence(i, c int) (*Node, int, error) {
+	s := &Node{Kind: SequenceNode, Line: p.offset + i + 1, Column: c + 1}
+	first := true
+	for {
+		if !first {
+			j := p.nextContent(i)
+			if j >= len(p.lines) || p.indent(j) < c {
+				break
+			}
+			if p.indent(j) > c {
+				return nil, 0, p.errorf(j, p.indent(j), "unexpected indentation in sequence")
+			}
+			if !isDash(p.lines[j], c) {
+				// A compact sequence ends at the next key of its mapping.
+				break
+			}
+			i = j
+		}
+		head := p.takePending()
+		item, next, err := p.parseNode(i, c+1, c, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		item.HeadComment = joinComments(head, item.HeadComment)
+		if item.Kind == MappingNode && len(item.Content) > 0 && item.Content[0].HeadComment != "" && item.Line == p.offset+i+1 {
+			item.HeadComment = joinComments(item.HeadComment, item.Content[0].HeadComment)
+			item.Content[0].HeadComment = ""
+		}
+		s.Content = append(s.Content, item)
+		i = next
+		first = false
+	}
+	s.FootComment = p.takeFoot(c)
+	return s, i, nil
+}
+
+func (p *parser) parseBlockScalar(i, c, parent int) (*Node, int, error) {
+	line := p.lines[i]
+	n := &Node{Kind: ScalarNode, Style: LiteralStyle, Line: p.offset + i + 1, Column: c + 1}
+	if line[c] == '>' {
+		n.Style = FoldedStyle
+	}
+	chomp := byte(0)
+	explicit := 0
+	k := c + 1
+	for ; k < len(line) && line[k] != ' ' && line[k] != '\t'; k++ {
+		switch ch := line[k]; {
+		case (ch == '-' || ch == '+') && chomp == 0:
+			chomp = ch
+		case ch >= '1' && ch <= '9' && explicit == 0:
+			explicit = int(ch - '0')
+		default:
+			return nil, 0, p.errorf(i, k, "invalid block scalar header")
+		}
+	}
+	comment, ok := trailingComment(line, k)
+	if !ok {
+		return nil, 0, p.errorf(i, k, "unexpected content after block scalar header")
+	}
+	n.LineComment = comment
+
+	contentIndent := -1
+	if explicit > 0 {
+		contentIndent = max(parent, 0) + explicit
+	}
+	var content []string
+	j := i + 1
+	for ; j < len(p.lines); j++ {
+		l := p.lines[j]
+		if isBlankLine(l) {
+			if contentIndent >= 0 && len(l) > contentIndent {
+				content = append(content, l[contentIndent:])
+			} else {
+				content = append(content, "")
+			}
+			continue
+		}
+		ind := p.indent(j)
+		if contentIndent < 0 {
+			if ind <= parent {
+				break
+			}
+			contentIndent = ind
+		}
+		if ind < contentIndent {
+			break
+		}
+		content = append(content, l[contentIndent:])
+	}
+	// Trailing blank lines belong to the scalar only for chomping purposes.
+	trailing := 0
+	for len(content) > 0 && strings.TrimSpace(content[len(content)-1]) == "" {
+		content = content[:len(content)-1]
+		trailing++
+	}
+	next := j - trailing
+
+	var body string
+	if n.Style == LiteralStyle {
+		body = strings.Join(content, "\n")
+	} else {
+		body = foldLines(content)
+	}
+	switch {
+	case len(content) == 0:
+		if chomp == '+' {
+			body = strings.Repeat("\n", trailing)
+		}
+	case chomp == '-':
+	case chomp == '+':
+		body += "\n" + strings.Repeat("\n", trailing)
+	default:
+		body += "\n"
+	}
+	n.Value = body
+	return n, next, nil
+}
+
+func foldLines(lines []string) string {
+	var b strings.Builder
+	first := true
+	lastNormal := false
+	empty := 0
+	for _, l := range lines {
+		if l == "" {
+			empty++
+			continue
+		}
+		more := l[0] == ' ' || l[0] == '\t'
+		switch {
+		case first:
+			b.WriteString(strings.Repeat("\n", empty))
+		case lastNormal && !more && empty == 0:
+			b.WriteByte(' ')
+		case lastNormal && !more:
+			b.WriteString(strings.Repeat("\n", empty))
+		default:
+			b.WriteString("\n" + strings.Repeat("\n", empty))
+		}
+		b.WriteString(l)
+		first = false
+		lastNormal = !more
+		empty = 0
+	}
+	return b.String()
+}
+
+func (p *parser) parsePlain(i, c, parent int) (*Node, int, error) {
+	line := p.lines[i]
+	n := &Node{Kind: ScalarNode, Line: p.offset + i + 1, Column: c + 1}
+	text, comment := splitPlainComment(line[c:])
+	n.LineComment = comment
+	var b strings.Builder
+	b.WriteString(text)
+	next := i + 1
+	if comment == "" {
+		empty := 0
+		for j := i + 1; j < len(p.lines); j++ {
+			l := p.lines[j]
+			if isBlankLine(l) {
+				empty++
+				continue
+			}
+			trimmed := strings.TrimLeft(l, " \t")
+			if p.indent(j) <= parent || strings.HasPrefix(trimmed, "#") {
+				break
+			}
+			if mappingColon(l, p.indent(j)) >= 0 {
+				return nil, 0, p.errorf(j, p.indent(j), "mapping values are not allowed in this context")
+			}
+			part, partComment := splitPlainComment(trimmed)
+			if empty > 0 {
+				b.WriteString(strings.Repeat("\n", empty))
+			} else {
+				b.WriteByte(' ')
+			}
+			b.WriteString(part)
+			empty = 0
+			next = j + 1
+			if partComment != "" {
+				n.LineComment = partComment
+				break
+			}
+		}
+	}
+	n.Value = b.String()
+	return n, next, nil
+}
+
+// splitPlainComment splits a plain scalar line into its text and an optional
+// trailing comment.
+func splitPlainComment(s string) (string, string) {
+	for k := 0; k < len(s); k++ {
+		if s[k] == '#' && k > 0 && (s[k-1] == ' ' || s[k-1] == '\t') {
+			return strings.TrimRight(s[:k], " \t"), strings.TrimRight(s[k:], " \t")
+		}
+	}
+	return strings.TrimRight(s, " \t"), ""
+}
+
+// cursor is a position within the document used by the flow and quoted
+// scalar parsers, which may span several lines.
+type cursor struct {
+	i, c int
+}
+
+// peek returns the byte at the cursor, '\n' at the end of a line and 0 at
+// the end of the document.
+func (p *parser) peek(cur *cursor) byte {
+	if cur.i >= len(p.lines) {
+		return 0
+	}
+	if cur.c >= len(p.lines[cur.i]) {
+		return '\n'
+	}
+	return p.lines[cur.i][cur.c]
+}
+
+func (p *parser) advance(cur *cursor) {
+	if cur.i >= len(p.lines) {
+		return
+	}
+	if cur.c >= len(p.lines[cur.i]) {
+		cur.i++
+		cur.c = 0
+		return
+	}
+	cur.c++
+}
+
+// skipFlowSpace skips whitespace, line breaks and comments inside a flow
+// collection.
+func (p *parser) skipFlowSpace(cur *cursor) {
+	for {
+		switch ch := p.peek(cur); ch {
+		case ' ', '\t', '\n':
+			p.advance(cur)
+		case '#':
+			if cur.c == 0 || p.lines[cur.i][cur.c-1] == ' ' || p.lines[cur.i][cur.c-1] == '\t' {
+				cur.c = len(p.lines[cur.i])
+				continue
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) parseFlow(cur *cursor) (*Node, error) {
+	open := p.peek(cur)
+	n := &Node{Style: FlowStyle, Line: p.offset + cur.i + 1, Column: cur.c + 1}
+	closer := byte(']')
+	if open == '{' {
+		n.Kind = MappingNode
+		closer = '}'
+	} else {
+		n.Kind = SequenceNode
+	}
+	p.advance(cur)
+	for {
+		p.skipFlowSpace(cur)
+		ch := p.peek(cur)
+		if ch == 0 {
+			return nil, p.errorf(n.Line-1-p.offset, n.Column-1, "unterminated flow collection")
+		}
+		if ch == closer {
+			p.advance(cur)
+			return n, nil
+		}
+		entry, err := p.parseFlowValue(cur, closer)
+		if err != nil {
+			return nil, err
+		}
+		p.skipFlowSpace(cur)
+		var value *Node
+		if p.peek(cur) == ':' {
+			p.advance(cur)
+			p.skipFlowSpace(cur)
+			if next := p.peek(cur); next == ',' || next == closer {
+				value = &Node{Kind: ScalarNode, Line: p.offset + cur.i + 1, Column: cur.c + 1}
+			} else {
+				value, err = p.parseFlowValue(cur, closer)
+				if err != nil {
+					return nil, err
+				}
+			}
+			p.skipFlowSpace(cur)
+		}
+		if value != nil || n.Kind == MappingNode {
+			if entry.Kind == MappingNode || entry.Kind == SequenceNode {
+				// Mostly an unquoted Go template such as {{ $labels.x }}
+				return nil, p.errorf(entry.Line-1-p.offset, entry.Column-1, "flow collections cannot be mapping keys; quote values that start with '{' or '['")
+			}
+		}
+		if n.Kind == MappingNode {
+			if value == nil {
+				value = &Node{Kind: ScalarNode, Line: entry.Line, Column: entry.Column}
+			}
+			n.Content = append(n.Content, entry, value)
+		} else if value != nil {
+			pair := &Node{Kind: MappingNode, Style: FlowStyle, Line: entry.Line, Column: entry.Column, Content: []*Node{entry, value}}
+			n.Content = append(n.Content, pair)
+		} else {
+			n.Content = append(n.Content, entry)
+		}
+		switch p.peek(cur) {
+		case ',':
+			p.advance(cur)
+		case closer:
+		case 0:
+			return nil, p.errorf(n.Line-1-p.offset, n.Column-1, "unterminated flow collection")
+		default:
+			return nil, p.errorf(cur.i, cur.c, "expected ',' or '%c' in flow collection", closer)
+		}
+	}
+}
+
+func (p *parser) parseFlowValue(cur *cursor, closer byte) (*Node, error) {
+	var anchor, tag string
+	for {
+		ch := p.peek(cur)
+		if ch != '&' && ch != '!' {
+			break
+		}
+		line := p.lines[cur.i]
+		end := cur.c
+		for end < len(line) && !strings.ContainsRune(" \t,[]{}", rune(line[end])) {
+			end++
+		}
+		if ch == '&' {
+			anchor = line[cur.c+1 : end]
+		} else {
+			tag = expandTag(line[cur.c:end])
+		}
+		cur.c = end
+		p.skipFlowSpace(cur)
+	}
+	var n *Node
+	var err error
+	switch ch := p.peek(cur); ch {
+	case '[', '{':
+		n, err = p.parseFlow(cur)
+	case '"', '\'':
+		n, err = p.parseQuoted(cur)
+	case '*':
+		line := p.lines[cur.i]
+		end := cur.c + 1
+		for end < len(line) && !strings.ContainsRune(" \t,[]{}", rune(line[end])) {
+			end++
+		}
+		name := line[cur.c+1 : end]
+		target, ok := p.anchors[name]
+		if !ok {
+			return nil, p.errorf(cur.i, cur.c, "unknown anchor %q referenced", name)
+		}
+		n = &Node{Kind: AliasNode, Value: name, Alias: target, Line: p.offset + cur.i + 1, Column: cur.c + 1}
+		cur.c = end
+		return n, nil
+	default:
+		n = p.parseFlowPlain(cur)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tag != "" {
+		n.Tag = tag
+	}
+	if anchor != "" {
+		n.Anchor = anchor
+		p.anchors[anchor] = n
+	}
+	return n, nil
+}
+
+func (p *parser) parseFlowPlain(cur *cursor) *Node {
+	n := &Node{Kind: ScalarNode, Line: p.offset + cur.i + 1, Column: cur.c + 1}
+	var parts []string
+	var b strings.Builder
+	for {
+		ch := p.peek(cur)
+		if ch == 0 || ch == ',' || ch == ']' || ch == '}' || ch == '[' || ch == '{' {
+			break
+		}
+		if ch == '\n' {
+			parts = append(parts, strings.TrimSpace(b.String()))
+			b.Reset()
+			p.advance(cur)
+			continue
+		}
+		if ch == ':' {
+			line := p.lines[cur.i]
+			if cur.c+1 >= len(line) || strings.ContainsRune(" \t,[]{}", rune(line[cur.c+1])) {
+				break
+			}
+		}
+		if ch == '#' && cur.c > 0 && (p.lines[cur.i][cur.c-1] == ' ' || p.lines[cur.i][cur.c-1] == '\t') {
+			cur.c = len(p.lines[cur.i])
+			continue
+		}
+		b.WriteByte(ch)
+		p.advance(cur)
+	}
+	parts = append(parts, strings.TrimSpace(b.String()))
+	var words []string
+	for _, part := range parts {
+		if part != "" {
+			words = append(words, part)
+		}
+	}
+	n.Value = strings.Join(words, " ")
+	return n
+}
+
+// parseQuoted parses a single- or double-quoted scalar starting at the
+// cursor and leaves the cursor just after the closing quote.
+func (p *parser) parseQuoted(cur *cursor) (*Node, error) {
+	quote := p.peek(cur)
+	n := &Node{Kind: ScalarNode, Style: SingleQuotedStyle, Line: p.offset + cur.i + 1, Column: cur.c + 1}
+	if quote == '"' {
+		n.Style = DoubleQuotedStyle
+	}
+	p.advance(cur)
+	var b strings.Builder
+	for {
+		if cur.i >= len(p.lines) {
+			return nil, p.errorf(n.Line-1-p.offset, n.Column-1, "unterminated quoted scalar")
+		}
+		line := p.lines[cur.i]
+		if cur.c >= len(line) {
+			// Line folding: trailing whitespace is dropped, a single break
+			// becomes a space and each empty line becomes a newline.
+			s := strings.TrimRight(b.String(), " \t")
+			b.Reset()
+			b.WriteString(s)
+			empty := 0
+			cur.i++
+			cur.c = 0
+			for cur.i < len(p.lines) && isBlankLine(p.lines[cur.i]) {
+				empty++
+				cur.i++
+			}
+			if cur.i >= len(p.lines) {
+				continue
+			}
+			if empty == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteString(strings.Repeat("\n", empty))
+			}
+			cur.c = skipSpaces(p.lines[cur.i], 0)
+			continue
+		}
+		ch := line[cur.c]
+		if quote == '\'' {
+			if ch == '\'' {
+				if cur.c+1 < len(line) && line[cur.c+1] == '\'' {
+					b.WriteByte('\'')
+					cur.c += 2
+					continue
+				}
+				cur.c++
+				break
+			}
+			b.WriteByte(ch)
+			cur.c++
+			continue
+		}
+		if ch == '"' {
+			cur.c++
+			break
+		}
+		if ch != '\\' {
+			b.WriteByte(ch)
+			cur.c++
+			continue
+		}
+		if cur.c+1 >= len(line) {
+			// Escaped line break: join the lines without a space.
+			cur.i++
+			cur.c = 0
+			if cur.i < len(p.lines) {
+				cur.c = skipSpaces(p.lines[cur.i], 0)
+			}
+			continue
+		}
+		esc := line[cur.c+1]
+		cur.c += 2
+		switch esc {
+		case '0':
+			b.WriteByte(0)
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 't', '\t':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'v':
+			b.WriteByte('\v')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case 'e':
+			b.WriteByte(0x1b)
+		case ' ', '"', '/', '\\':
+			b.WriteByte(esc)
+		case 'N':
+			b.WriteString("\u0085")
+		case '_':
+			b.WriteString("\u00a0")
+		case 'L':
+			b.WriteString("\u2028")
+		case 'P':
+			b.WriteString("\u2029")
+		case 'x', 'u', 'U':
+			width := map[byte]int{'x': 2, 'u': 4, 'U': 8}[esc]
+			if cur.c+width > len(line) {
+				return nil, p.errorf(cur.i, cur.c-2, "invalid escape sequence")
+			}
+			code, err := strconv.ParseUint(line[cur.c:cur.c+width], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return nil, p.errorf(cur.i, cur.c-2, "invalid escape sequence")
+			}
+			b.WriteRune(rune(code))
+			cur.c += width
+		default:
+			return nil, p.errorf(cur.i, cur.c-2, "unknown escape character %q", esc)
+		}
+	}
+	n.Value = b.String()
+	return n, nil
+}
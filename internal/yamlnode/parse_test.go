@@ -0,0 +1,167 @@
+package yamlnode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRejectsInvalidYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"nested mapping on key line", "a: b: c\n", "line 1, column 5: mapping values are not allowed in this context"},
+		{"nested quoted mapping on key line", "a: \"b\": c\n", "line 1, column 7: mapping values are not allowed in this context"},
+		{"sequence on key line", "a: - b\n", "line 1, column 4: block sequence entries are not allowed in this context"},
+		{"unquoted template", "summary: {{ $labels.instance }} is down\n", "flow collections cannot be mapping keys"},
+		{"unquoted template alone", "summary: {{ $labels.instance }}\n", "flow collections cannot be mapping keys"},
+		{"template in flow sequence", "items: [{{ x }}: y]\n", "flow collections cannot be mapping keys"},
+		{"duplicate key", "a: 1\na: 2\n", "line 2, column 1: mapping key \"a\" already defined at line 1"},
+		{"tab indentation", "a:\n\tb: c\n", "found a tab character used as indentation"},
+		{"unterminated flow", "a: [b, c\n", "line 1, column 4: unterminated flow collection"},
+		{"unknown alias", "a: *x\n", "unknown anchor \"x\" referenced"},
+		{"bad indentation", "a:\n  b: 1\n   c: 2\n", "line 3, column 4: mapping values are not allowed in this context"},
+		{"plain continuation with colon", "a: b\n  c: d\n", "mapping values are not allowed in this context"},
+		{"content after root", "a: b\n- c\n", "expected a mapping key, found a sequence item"},
+		{"content after flow root", "[a]\nb\n", "unexpected content after the document root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.in))
+			if err == nil {
+				t.Fatalf("Parse(%q) succeeded, want error containing %q", tt.in, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Parse(%q) error = %q, want it to contain %q", tt.in, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want any
+	}{
+		{"plain scalars", "a: b\nn: 3\nf: 1.5\nt: true\nz: null\ne:\n", map[string]any{"a": "b", "n": 3, "f": 1.5, "t": true, "z": nil, "e": nil}},
+		{"colon without space", "url: http://host:80/path\nb: a:b\n", map[string]any{"url": "http://host:80/path", "b": "a:b"}},
+		{"quoted template", "summary: '{{ $labels.instance }} is down'\n", map[string]any{"summary": "{{ $labels.instance }} is down"}},
+		{"double quoted escapes", `s: "a\tb\n\"c\" \u00e9"` + "\n", map[string]any{"s": "a\tb\n\"c\" é"}},
+		{"single quoted escape", "s: 'it''s'\n", map[string]any{"s": "it's"}},
+		{"string tag", "s: !!str 123\n", map[string]any{"s": "123"}},
+		{"nested mapping", "a:\n  b:\n    c: d\n", map[string]any{"a": map[string]any{"b": map[string]any{"c": "d"}}}},
+		{"sequence of mappings", "- a: 1\n  b: 2\n- c\n", []any{map[string]any{"a": 1, "b": 2}, "c"}},
+		{"compact sequence", "a:\n- b\n- c\nd: e\n", map[string]any{"a": []any{"b", "c"}, "d": "e"}},
+		{"sequence after comment", "a: # note\n  - b\n", map[string]any{"a": []any{"b"}}},
+		{"flow collections", "a: {b: [1, 2], c: {d: e}}\n", map[string]any{"a": map[string]any{"b": []any{1, 2}, "c": map[string]any{"d": "e"}}}},
+		{"json", `{"a": [1, {"b": "c"}], "d": null}`, map[string]any{"a": []any{1, map[string]any{"b": "c"}}, "d": nil}},
+		{"literal block", "a: |\n  x\n  y\nb: c\n", map[string]any{"a": "x\ny\n", "b": "c"}},
+		{"literal block strip", "a: |-\n  x\n\n", map[string]any{"a": "x"}},
+		{"folded block", "a: >\n  x\n  y\n\n  z\n", map[string]any{"a": "x y\nz\n"}},
+		{"multi-line plain", "a: x\n  y\n", map[string]any{"a": "x y"}},
+		{"comments", "# head\na: b # line\n# foot\n", map[string]any{"a": "b"}},
+		{"anchors and merge keys", "base: &b\n  x: 1\nderived:\n  <<: *b\n  y: 2\n", map[string]any{"base": map[string]any{"x": 1}, "derived": map[string]any{"x": 1, "y": 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := Parse([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.in, err)
+			}
+			if len(docs) != 1 {
+				t.Fatalf("Parse(%q) returned %d documents, want 1", tt.in, len(docs))
+			}
+			if got := docs[0].Interface(); !equal(got, tt.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDocuments(t *testing.T) {
+	docs, err := Parse([]byte("a: 1\n---\n# only a comment\n---\nb: 2\n...\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("got %d documents, want 2", len(docs))
+	}
+	if docs[1].Get("b").Line != 5 {
+		t.Errorf("line of b = %d, want 5", docs[1].Get("b").Line)
+	}
+}
+
+func TestParsePositions(t *testing.T) {
+	docs, err := Parse([]byte("groups:\n  - name: g\n    rules:\n      - alert: A\n        expr: up == 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr := docs[0].Get("groups").Items()[0].Get("rules").Items()[0].Get("expr")
+	if expr.Line != 5 || expr.Column != 15 {
+		t.Errorf("expr at %d:%d, want 5:15", expr.Line, expr.Column)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []string{
+		"a: b\n",
+		"# head\na: b # line\nc:\n  - d\n  - e: f\n    g: h\n",
+		"groups:\n  - name: g\n    rules:\n      - alert: A\n        expr: up == 0\n        annotations:\n          summary: '{{ $labels.instance }} is down'\n",
+		"a: |\n  x\n  y\n",
+		"s: \"a\\tb\"\nn: '123'\nt: 'true'\ne: ''\n",
+	}
+	for _, in := range tests {
+		docs, err := Parse([]byte(in))
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", in, err)
+		}
+		if out := string(Encode(docs...)); out != in {
+			t.Errorf("Encode(Parse(%q)) = %q", in, out)
+		}
+	}
+}
+
+// equal compares values of Interface, whose numbers may be of any integer
+// or float type.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return number(a) == number(b)
+}
+
+// number converts integers to float64 so 3 and int64(3) compare equal.
+func number(v any) any {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return v
+}